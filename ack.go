@@ -0,0 +1,120 @@
+package gomq
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// defaultAckTimeout and defaultMaxRedeliveries are how long
+// RecvAck waits for a message to be acked, and how many times
+// it redelivers it, unless WithAck says otherwise.
+const (
+	defaultAckTimeout      = 30 * time.Second
+	defaultMaxRedeliveries = 5
+)
+
+// unacked is a message RecvAck returned that is waiting to be
+// acked or nacked. settled is set, atomically, by whichever
+// of the ack, the nack and the expiry of the ack timeout
+// comes first; the others do nothing.
+type unacked struct {
+	socket  *Socket
+	d       delivery
+	settled int32
+	done    chan struct{}
+}
+
+// RecvAck is like RecvMessage, but keeps the message in the
+// socket until it is acked: ack says the message was handled,
+// while nack gives it back, to be received again ahead of
+// the other messages waiting if requeue is true, or to be
+// dropped and counted by Rejected if it is false. A message
+// that is neither acked nor nacked within the ack timeout,
+// say because the goroutine handling it crashed, is given
+// back as by nack(true), to be received again by this or
+// another goroutine. A message given back more often than
+// the maximum number of redeliveries is rejected instead;
+// see WithAck for both. Only the first of ack and nack, or
+// the timeout, counts.
+//
+// Acks are local to the socket: nothing is sent to the peer,
+// so a message is only redelivered while the socket is open
+// and one received when the socket closes is lost.
+func (s *Socket) RecvAck() (msg *zmtp.Message, ack func(), nack func(requeue bool), err error) {
+	d, err := s.recv()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	u := &unacked{socket: s, d: d, done: make(chan struct{})}
+	go u.expire(s.clock.NewTimer(s.ackTimeout))
+	return d.msg, u.ack, u.nack, nil
+}
+
+// ack settles the message as handled.
+func (u *unacked) ack() {
+	u.settle()
+}
+
+// nack settles the message as not handled, giving it back if
+// requeue is true and rejecting it otherwise.
+func (u *unacked) nack(requeue bool) {
+	if !u.settle() {
+		return
+	}
+	if requeue {
+		u.socket.redeliver(u.d)
+	} else {
+		u.socket.reject()
+	}
+}
+
+// expire gives the message back once timer fires, unless it
+// was settled first or the socket closed.
+func (u *unacked) expire(timer zmtp.Timer) {
+	select {
+	case <-timer.C():
+		if u.settle() {
+			u.socket.redeliver(u.d)
+		}
+	case <-u.done:
+		timer.Stop()
+	case <-u.socket.done:
+		timer.Stop()
+	}
+}
+
+// settle reports whether it was the first to settle the
+// message.
+func (u *unacked) settle() bool {
+	if !atomic.CompareAndSwapInt32(&u.settled, 0, 1) {
+		return false
+	}
+	close(u.done)
+	return true
+}
+
+// redeliver puts d back to be received again, or rejects it
+// if it was redelivered too often already.
+func (s *Socket) redeliver(d delivery) {
+	d.redeliveries++
+	if s.maxRedeliveries >= 0 && d.redeliveries > s.maxRedeliveries {
+		s.reject()
+		return
+	}
+	s.hold(d)
+}
+
+// reject counts a message RecvAck returned that was dropped.
+func (s *Socket) reject() {
+	atomic.AddUint64(&s.rejected, 1)
+}
+
+// Rejected returns the number of messages received with
+// RecvAck that were dropped, for being nacked without
+// requeueing or redelivered too often.
+func (s *Socket) Rejected() uint64 {
+	return atomic.LoadUint64(&s.rejected)
+}
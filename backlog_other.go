@@ -0,0 +1,12 @@
+//go:build !unix
+
+package gomq
+
+import "net"
+
+// setBacklog would change the length of ln's queue of
+// connections waiting to be accepted; elsewhere than on Unix
+// the system default is kept.
+func setBacklog(ln net.Listener, n int) error {
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package gomq
+
+import (
+	"net"
+	"syscall"
+)
+
+// setBacklog changes the length of ln's queue of connections
+// waiting to be accepted, by calling listen(2) again on its
+// socket. Listeners without a socket are left alone.
+func setBacklog(ln net.Listener, n int) error {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var listenErr error
+	if err := raw.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), n)
+	}); err != nil {
+		return err
+	}
+	return listenErr
+}
@@ -0,0 +1,48 @@
+package gomq
+
+import (
+	"testing"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+func benchmarkClientServer(b *testing.B, size int) {
+	server := NewServer(zmtp.NewSecurityNull())
+	defer server.Close()
+
+	addr, err := server.Bind("tcp://127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+
+	if err := client.Connect("tcp://" + addr.String()); err != nil {
+		b.Fatal(err)
+	}
+
+	msg := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if err := client.Send(msg); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := server.Recv(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkClientServer16(b *testing.B)   { benchmarkClientServer(b, 16) }
+func BenchmarkClientServer256(b *testing.B)  { benchmarkClientServer(b, 256) }
+func BenchmarkClientServer4096(b *testing.B) { benchmarkClientServer(b, 4096) }
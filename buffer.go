@@ -0,0 +1,134 @@
+package gomq
+
+import "sync/atomic"
+
+// messageOverhead is what a queued message counts for
+// towards WithSendBufferBytes and WithRecvBufferBytes on top
+// of its body, for the bookkeeping that goes with it.
+const messageOverhead = 32
+
+// queuedSize is what b counts for in a byte-limited queue.
+func queuedSize(b []byte) int64 {
+	return int64(len(b)) + messageOverhead
+}
+
+// reserve accounts for b about to be put on the send queue,
+// reporting false if that would take the queue over its byte
+// limit (see WithSendBufferBytes). An empty queue takes a
+// message of any size, so that no message is too large to
+// be sent at all. queuedBytes is accessed atomically.
+func (c *Connection) reserve(b []byte) bool {
+	n := queuedSize(b)
+	for {
+		queued := atomic.LoadInt64(&c.queuedBytes)
+		if c.sendLimit > 0 && queued > 0 && queued+n > c.sendLimit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&c.queuedBytes, queued, queued+n) {
+			return true
+		}
+	}
+}
+
+// unreserve gives back what reserve took for b, when b did
+// not make it onto the queue after all. It wakes up no one:
+// senders waiting for room are woken when the writer takes
+// messages off the queue.
+func (c *Connection) unreserve(b []byte) {
+	atomic.AddInt64(&c.queuedBytes, -queuedSize(b))
+}
+
+// dequeued accounts for the writer taking batch off the send
+// queue.
+func (c *Connection) dequeued(batch []outbound) {
+	var n int64
+	for _, m := range batch {
+		n += queuedSize(m.msg)
+	}
+	atomic.AddInt64(&c.queuedBytes, -n)
+	c.signalRoom()
+}
+
+// signalRoom wakes up a sender waiting for room in the send
+// queue.
+func (c *Connection) signalRoom() {
+	select {
+	case c.sendRoom <- struct{}{}:
+	default:
+	}
+}
+
+// aboveLowWater reports whether the send queue is still at
+// least half full, by count or by bytes.
+func (c *Connection) aboveLowWater() bool {
+	if len(c.sendQueue) >= cap(c.sendQueue)/2 {
+		return true
+	}
+	return c.sendLimit > 0 && atomic.LoadInt64(&c.queuedBytes) >= c.sendLimit/2
+}
+
+// reserveRecv accounts for b about to be put on the receive
+// queue, waiting while that would take the queue over its
+// byte limit (see WithRecvBufferBytes). Like reserve, it lets
+// any message into an empty queue. It returns false if conn
+// or the socket is closed while waiting.
+func (s *Socket) reserveRecv(conn *Connection, b []byte) bool {
+	atomic.AddInt64(&s.inbound, 1)
+	if s.recvBufferBytes <= 0 {
+		return true
+	}
+
+	n := queuedSize(b)
+	for {
+		s.lock.RLock()
+		freed := s.recvFreed
+		s.lock.RUnlock()
+
+		queued := atomic.LoadInt64(&s.inboundBytes)
+		if queued == 0 || queued+n <= s.recvBufferBytes {
+			if atomic.CompareAndSwapInt64(&s.inboundBytes, queued, queued+n) {
+				return true
+			}
+			continue
+		}
+
+		select {
+		case <-freed:
+		case <-conn.closing:
+			atomic.AddInt64(&s.inbound, -1)
+			return false
+		case <-s.done:
+			atomic.AddInt64(&s.inbound, -1)
+			return false
+		}
+	}
+}
+
+// took accounts for d being taken off the receive queue, or
+// out of the held messages, by a receive.
+func (s *Socket) took(d delivery) {
+	s.dequeuedRecv(d)
+	s.unreserveRecv(d.msg.Body)
+}
+
+// unreserveRecv gives back what reserveRecv counted for b,
+// once the message is received or was never queued after all.
+func (s *Socket) unreserveRecv(b []byte) {
+	atomic.AddInt64(&s.inbound, -1)
+	if s.recvBufferBytes <= 0 {
+		return
+	}
+
+	atomic.AddInt64(&s.inboundBytes, -queuedSize(b))
+	s.lock.Lock()
+	close(s.recvFreed)
+	s.recvFreed = make(chan struct{})
+	s.lock.Unlock()
+}
+
+// InboundBytes returns how many bytes the messages waiting to
+// be received take up, as counted by WithRecvBufferBytes. It
+// is zero unless that limit is set.
+func (s *Socket) InboundBytes() int64 {
+	return atomic.LoadInt64(&s.inboundBytes)
+}
@@ -0,0 +1,205 @@
+package gomq
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// z85Alphabet holds the characters of the Z85 encoding that
+// CURVE keys are written in.
+const z85Alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#"
+
+// Cert is a CURVE certificate as stored by czmq's zcert: a
+// key pair written in Z85 and free-form metadata.
+type Cert struct {
+	PublicKey string
+
+	// SecretKey is empty for a public certificate.
+	SecretKey string
+
+	Metadata map[string]string
+}
+
+// LoadCert reads a certificate in the ZPL format written by
+// czmq's zcert_save. Like zcert_load, it reads the secret
+// certificate at path+"_secret" if there is one, and the
+// public certificate at path otherwise.
+func LoadCert(path string) (*Cert, error) {
+	f, err := os.Open(path + "_secret")
+	if os.IsNotExist(err) {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := parseZPL(f)
+	if err != nil {
+		return nil, fmt.Errorf("gomq: certificate %s: %v", f.Name(), err)
+	}
+
+	cert := &Cert{
+		PublicKey: entries["curve/public-key"],
+		SecretKey: entries["curve/secret-key"],
+		Metadata:  make(map[string]string),
+	}
+	for name, value := range entries {
+		if key, ok := strings.CutPrefix(name, "metadata/"); ok {
+			cert.Metadata[key] = value
+		}
+	}
+
+	if !isZ85Key(cert.PublicKey) {
+		return nil, fmt.Errorf("gomq: certificate %s: invalid public key %q", f.Name(), cert.PublicKey)
+	}
+	if cert.SecretKey != "" && !isZ85Key(cert.SecretKey) {
+		return nil, fmt.Errorf("gomq: certificate %s: invalid secret key", f.Name())
+	}
+
+	return cert, nil
+}
+
+// Save writes the public certificate to basePath and, if the
+// certificate has a secret key, the secret certificate to
+// basePath+"_secret", readable by its owner only.
+func (c *Cert) Save(basePath string) error {
+	if err := c.save(basePath, false, 0644); err != nil {
+		return err
+	}
+	if c.SecretKey == "" {
+		return nil
+	}
+	return c.save(basePath+"_secret", true, 0600)
+}
+
+func (c *Cert) save(path string, secret bool, mode os.FileMode) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "#   ****  Generated on %s by gomq  ****\n", time.Now().Format("2006-01-02 15:04:05"))
+	if secret {
+		buf.WriteString("#   ZeroMQ CURVE **Secret** Certificate\n")
+		buf.WriteString("#   DO NOT PROVIDE THIS FILE TO OTHER USERS nor change its permissions.\n")
+	} else {
+		buf.WriteString("#   ZeroMQ CURVE Public Certificate\n")
+		buf.WriteString("#   Exchange securely, or use a secure mechanism to verify the contents\n")
+		buf.WriteString("#   of this file after exchange. Store public certificates in your home\n")
+		buf.WriteString("#   directory, in the .curve subdirectory.\n")
+	}
+
+	buf.WriteString("\nmetadata\n")
+	names := make([]string, 0, len(c.Metadata))
+	for name := range c.Metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writeZPL(&buf, name, c.Metadata[name]); err != nil {
+			return err
+		}
+	}
+
+	buf.WriteString("curve\n")
+	writeZPL(&buf, "public-key", c.PublicKey)
+	if secret {
+		writeZPL(&buf, "secret-key", c.SecretKey)
+	}
+
+	// Rewriting an existing file keeps its old mode, so set it
+	// explicitly.
+	if err := os.WriteFile(path, buf.Bytes(), mode); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+// writeZPL writes a name = value line one level deep.
+func writeZPL(w io.Writer, name, value string) error {
+	quote := `"`
+	if strings.Contains(value, `"`) {
+		if strings.Contains(value, "'") {
+			return fmt.Errorf("gomq: metadata %q cannot hold both kinds of quote", name)
+		}
+		quote = "'"
+	}
+	_, err := fmt.Fprintf(w, "    %s = %s%s%s\n", name, quote, value, quote)
+	return err
+}
+
+// parseZPL reads a ZPL document (https://rfc.zeromq.org/spec:4)
+// and returns its values keyed by their slash-separated path,
+// e.g. "curve/public-key".
+func parseZPL(r io.Reader) (map[string]string, error) {
+	entries := make(map[string]string)
+	var path []string
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), " \t\r")
+		content := strings.TrimLeft(text, " ")
+		if content == "" || content[0] == '#' {
+			continue
+		}
+
+		indent := len(text) - len(content)
+		if indent%4 != 0 || indent/4 > len(path) {
+			return nil, fmt.Errorf("line %d: bad indentation", line)
+		}
+		path = path[:indent/4]
+
+		name, value, hasValue := strings.Cut(content, "=")
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("line %d: bad name %q", line, name)
+		}
+		path = append(path, name)
+
+		if hasValue {
+			v, err := parseZPLValue(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			entries[strings.Join(path, "/")] = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// parseZPLValue parses a quoted or bare ZPL value, dropping
+// any trailing comment.
+func parseZPLValue(s string) (string, error) {
+	if s != "" && (s[0] == '"' || s[0] == '\'') {
+		end := strings.IndexByte(s[1:], s[0])
+		if end < 0 {
+			return "", fmt.Errorf("unterminated value %s", s)
+		}
+		return s[1 : 1+end], nil
+	}
+
+	if i := strings.IndexAny(s, " \t#"); i >= 0 {
+		s = s[:i]
+	}
+	return s, nil
+}
+
+// isZ85Key reports whether s is a Z85 encoded 32 byte key.
+func isZ85Key(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, r := range s {
+		if !strings.ContainsRune(z85Alphabet, r) {
+			return false
+		}
+	}
+	return true
+}
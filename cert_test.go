@@ -0,0 +1,142 @@
+package gomq
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Written by czmq's zcert_save.
+const (
+	czmqPublicCert = `#   ****  Generated on 2017-03-29 16:32:21 by CZMQ  ****
+#   ZeroMQ CURVE Public Certificate
+#   Exchange securely, or use a secure mechanism to verify the contents
+#   of this file after exchange. Store public certificates in your home
+#   directory, in the .curve subdirectory.
+
+metadata
+    name = "ops"
+    email = "ops@example.com"
+curve
+    public-key = "Yne@$w-vo<fVvi]a<NY6T1ed:M$fCG*[IaLV{hID"
+`
+	czmqSecretCert = `#   ****  Generated on 2017-03-29 16:32:21 by CZMQ  ****
+#   ZeroMQ CURVE **Secret** Certificate
+#   DO NOT PROVIDE THIS FILE TO OTHER USERS nor change its permissions.
+
+metadata
+    name = "ops"
+    email = "ops@example.com"
+curve
+    public-key = "Yne@$w-vo<fVvi]a<NY6T1ed:M$fCG*[IaLV{hID"
+    secret-key = "D:)Q[IlAW!ahhC2ac:9*A}h:p?([4%wOTJ%JR%cs"
+`
+)
+
+func TestLoadCert(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.key")
+	if err := os.WriteFile(path, []byte(czmqPublicCert), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := LoadCert(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "Yne@$w-vo<fVvi]a<NY6T1ed:M$fCG*[IaLV{hID", cert.PublicKey; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if want, got := "", cert.SecretKey; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if want, got := "ops@example.com", cert.Metadata["email"]; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if err := os.WriteFile(path+"_secret", []byte(czmqSecretCert), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err = LoadCert(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "D:)Q[IlAW!ahhC2ac:9*A}h:p?([4%wOTJ%JR%cs", cert.SecretKey; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestLoadCertInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.key")
+	if err := os.WriteFile(path, []byte("curve\n    public-key = \"short\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadCert(path); err == nil {
+		t.Errorf("want an error for an invalid key")
+	}
+
+	if err := os.WriteFile(path, []byte("curve\n  public-key = \"x\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadCert(path); err == nil {
+		t.Errorf("want an error for bad indentation")
+	}
+}
+
+func TestCertSave(t *testing.T) {
+	want := &Cert{
+		PublicKey: "Yne@$w-vo<fVvi]a<NY6T1ed:M$fCG*[IaLV{hID",
+		SecretKey: "D:)Q[IlAW!ahhC2ac:9*A}h:p?([4%wOTJ%JR%cs",
+		Metadata:  map[string]string{"name": "ops", "quote": `say "hi"`},
+	}
+
+	path := filepath.Join(t.TempDir(), "client.key")
+	if err := want.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, mode := range map[string]os.FileMode{path: 0644, path + "_secret": 0600} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := info.Mode().Perm(); mode != got {
+			t.Errorf("%s: want %v, got %v", file, mode, got)
+		}
+	}
+
+	got, err := LoadCert(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.PublicKey != want.PublicKey || got.SecretKey != want.SecretKey {
+		t.Errorf("want keys %q/%q, got %q/%q", want.PublicKey, want.SecretKey, got.PublicKey, got.SecretKey)
+	}
+
+	for name, value := range want.Metadata {
+		if got.Metadata[name] != value {
+			t.Errorf("metadata %q: want %q, got %q", name, value, got.Metadata[name])
+		}
+	}
+
+	if err := os.Remove(path + "_secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	public, err := LoadCert(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if public.SecretKey != "" {
+		t.Errorf("public certificate holds the secret key")
+	}
+}
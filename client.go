@@ -1,25 +1,239 @@
 package gomq
 
-import "github.com/zeromq/gomq/zmtp"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
 
 // ClientSocket is a ZMQ_CLIENT socket type.
 // See: http://rfc.zeromq.org/spec:41
 type ClientSocket struct {
 	*Socket
+
+	// turn is held by the Request in progress, which may
+	// then use owed, the number of replies owed by each
+	// connection to earlier Requests that no longer want
+	// them.
+	turn chan struct{}
+	owed map[*Connection]int
 }
 
-// NewClient accepts a zmtp.SecurityMechanism and returns
-// a ClientSocket as a gomq.Client interface.
-func NewClient(mechanism zmtp.SecurityMechanism) Client {
-	return &ClientSocket{
-		Socket: NewSocket(false, zmtp.ClientSocketType, mechanism),
-	}
+// NewClient accepts a zmtp.SecurityMechanism and optional
+// SocketOptions and returns a ClientSocket as a
+// gomq.Client interface.
+func NewClient(mechanism zmtp.SecurityMechanism, opts ...SocketOption) Client {
+	return mustNew(zmtp.ClientSocketType, mechanism, opts).(*ClientSocket)
 }
 
 // Connect accepts a zeromq endpoint and connects the
-// client socket to it. Currently the only transport
-// supported is TCP. The endpoint string should be
-// in the format "tcp://<address>:<port>".
+// client socket to it. The supported transports are TCP
+// and unix domain sockets, plus the in-process mem
+// transport, with endpoints in the format
+// "tcp://<address>:<port>", "ipc://<path>" or
+// "mem://<name>"; see ParseEndpoint.
 func (c *ClientSocket) Connect(endpoint string) error {
 	return ConnectClient(c, endpoint)
 }
+
+// Request sends msg and waits for the reply. It returns
+// what Send returns if msg cannot be sent, ErrSocketClosed if
+// the socket is closed while waiting, and ctx.Err() if ctx is
+// done first; if that was its deadline, the error also wraps
+// ErrTimeout.
+//
+// CLIENT messages carry nothing to match a reply to its
+// request, so Requests on a socket take turns, and a reply is
+// told apart by the connection it arrives on, which holds as
+// long as each peer replies once to each request, in the
+// order the requests came. The reply to a Request that gave
+// up is discarded when it arrives, by a later Request, rather
+// than taken for that one's reply. Do not mix Request with
+// Send and Recv on the same socket.
+func (c *ClientSocket) Request(ctx context.Context, msg []byte) ([]byte, error) {
+	if err := c.takeTurn(ctx); err != nil {
+		return nil, err
+	}
+	defer func() { <-c.turn }()
+
+	conn, err := c.sendVia(msg, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// A request the HWM policy dropped has no reply coming,
+	// so the first one to arrive is taken.
+	var from map[*Connection]bool
+	if conn != nil {
+		from = map[*Connection]bool{conn: true}
+	}
+	d, err := c.awaitReply(ctx, from)
+	if err != nil {
+		if conn != nil {
+			c.owed[conn]++
+		}
+		if ctx.Err() != nil {
+			return nil, requestErr(ctx)
+		}
+		return nil, err
+	}
+	return d.msg.Body, nil
+}
+
+// RequestHedged is like Request, but sends msg to a second
+// peer too if the first has not replied within hedgeAfter,
+// and returns whichever reply comes first. It is for cutting
+// the tail latency of requests that any of the socket's peers
+// can answer and that are safe to handle twice. The first
+// peer is picked in turn, as Send picks them, and the second
+// is the next one that is connected; with a single peer
+// RequestHedged is Request.
+//
+// Replies are told apart by the connection they arrive on,
+// which holds as long as each peer replies once to each
+// request, in the order the requests came. The reply of the
+// peer that lost, like those of both peers if ctx is done
+// first, is discarded when it arrives, by this or a later
+// Request. Messages already sent cannot be called back:
+// cancelling ctx only stops waiting for them.
+func (c *ClientSocket) RequestHedged(ctx context.Context, msg []byte, hedgeAfter time.Duration) ([]byte, error) {
+	if err := c.takeTurn(ctx); err != nil {
+		return nil, err
+	}
+	defer func() { <-c.turn }()
+
+	conns := c.inTurn()
+	if len(conns) == 0 {
+		return nil, ErrNotConnected
+	}
+	// Only the peers the request was queued for, rather than
+	// dropped by the HWM policy, have a reply coming.
+	pending := make(map[*Connection]bool)
+	queued, err := c.sendToPeer(ConnID(conns[0].id), msg, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	if queued {
+		pending[conns[0]] = true
+	}
+
+	// Wait for the first peer's reply until it is time to
+	// hedge, then for either's.
+	wait, hedge := context.WithCancel(ctx)
+	defer hedge()
+	timer := c.clock.NewTimer(hedgeAfter)
+	defer timer.Stop()
+	go func() {
+		select {
+		case <-timer.C():
+			hedge()
+		case <-wait.Done():
+		}
+	}()
+
+	d, err := c.awaitReply(wait, pending)
+	if err != nil && ctx.Err() == nil && wait.Err() != nil {
+		for _, conn := range conns[1:] {
+			if conn.isStopping() {
+				continue
+			}
+			// If the second peer cannot take the request, the
+			// first is waited for alone.
+			if queued, err := c.sendToPeer(ConnID(conn.id), msg, 0, false); queued && err == nil {
+				pending[conn] = true
+			}
+			break
+		}
+		d, err = c.awaitReply(ctx, pending)
+	}
+	if err != nil {
+		for conn := range pending {
+			c.owed[conn]++
+		}
+		if ctx.Err() != nil {
+			return nil, requestErr(ctx)
+		}
+		return nil, err
+	}
+
+	for conn := range pending {
+		if conn != d.conn {
+			c.owed[conn]++
+		}
+	}
+	return d.msg.Body, nil
+}
+
+// takeTurn waits for the Requests before to be done, and then
+// discards the replies owed to those that gave up that have
+// arrived meanwhile.
+func (c *ClientSocket) takeTurn(ctx context.Context) error {
+	select {
+	case c.turn <- struct{}{}:
+	case <-ctx.Done():
+		return requestErr(ctx)
+	}
+
+	c.lock.RLock()
+	for conn := range c.owed {
+		// Replies owed by connections torn down since will
+		// never come.
+		if c.conns[conn.id] != conn {
+			delete(c.owed, conn)
+		}
+	}
+	c.lock.RUnlock()
+
+	for len(c.owed) > 0 {
+		d, ok := c.tryRecv()
+		if !ok {
+			break
+		}
+		c.late(d)
+	}
+	return nil
+}
+
+// awaitReply waits for the reply to a Request, discarding late
+// replies to earlier ones. If from is not empty, the reply
+// must come from one of its connections: messages from
+// others, which no Request is waiting for, are discarded too.
+func (c *ClientSocket) awaitReply(ctx context.Context, from map[*Connection]bool) (delivery, error) {
+	for {
+		d, err := c.recvContext(ctx)
+		if err != nil {
+			return delivery{}, err
+		}
+		if c.late(d) {
+			continue
+		}
+		if len(from) > 0 && !from[d.conn] {
+			continue
+		}
+		return d, nil
+	}
+}
+
+// late reports whether d is the reply to a Request that gave
+// up, or of a peer that lost a RequestHedged, accounting for
+// it if so.
+func (c *ClientSocket) late(d delivery) bool {
+	if c.owed[d.conn] == 0 {
+		return false
+	}
+	if c.owed[d.conn]--; c.owed[d.conn] == 0 {
+		delete(c.owed, d.conn)
+	}
+	return true
+}
+
+// requestErr is the error a Request returns when ctx is done.
+func requestErr(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, ctx.Err())
+	}
+	return ctx.Err()
+}
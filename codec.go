@@ -0,0 +1,116 @@
+package gomq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrNoCodec is returned by SendVal and RecvVal on a socket
+// without a codec (see WithCodec).
+var ErrNoCodec = errors.New("gomq: socket has no codec")
+
+// Codec turns values into message bodies and back for
+// SendVal and RecvVal. A protobuf codec only needs to assert
+// that v is a proto.Message and call proto.Marshal and
+// proto.Unmarshal.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+// CodecError is returned by SendVal and RecvVal when the
+// socket's codec fails, telling it apart from errors sending
+// or receiving the message.
+type CodecError struct {
+	// Op is "marshal" or "unmarshal".
+	Op  string
+	Err error
+}
+
+func (e *CodecError) Error() string {
+	return fmt.Sprintf("gomq: codec %s: %v", e.Op, e.Err)
+}
+
+// Unwrap returns the codec's error.
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
+
+// JSONCodec encodes values as JSON.
+type JSONCodec struct{}
+
+// Marshal returns the JSON encoding of v.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes the JSON in b into v.
+func (JSONCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+// RawCodec passes message bodies through unchanged. It
+// marshals []byte and string values and unmarshals into
+// *[]byte and *string.
+type RawCodec struct{}
+
+// Marshal returns v, which must be a []byte or a string.
+func (RawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return nil, fmt.Errorf("cannot marshal %T, want []byte or string", v)
+	}
+}
+
+// Unmarshal stores a copy of b in v, which must be a *[]byte
+// or a *string.
+func (RawCodec) Unmarshal(b []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = append([]byte(nil), b...)
+	case *string:
+		*v = string(b)
+	default:
+		return fmt.Errorf("cannot unmarshal into %T, want *[]byte or *string", v)
+	}
+	return nil
+}
+
+// SendVal marshals v with the socket's codec and sends the
+// result like Send. Codec failures are returned as a
+// *CodecError.
+func (s *Socket) SendVal(v interface{}) error {
+	if s.codec == nil {
+		return ErrNoCodec
+	}
+
+	b, err := s.codec.Marshal(v)
+	if err != nil {
+		return &CodecError{Op: "marshal", Err: err}
+	}
+	return s.Send(b)
+}
+
+// RecvVal receives a message like Recv and unmarshals it into
+// v with the socket's codec. Codec failures are returned as a
+// *CodecError; the message is consumed either way.
+func (s *Socket) RecvVal(v interface{}) error {
+	if s.codec == nil {
+		return ErrNoCodec
+	}
+
+	b, err := s.Recv()
+	if err != nil {
+		return err
+	}
+
+	if err := s.codec.Unmarshal(b, v); err != nil {
+		return &CodecError{Op: "unmarshal", Err: err}
+	}
+	return nil
+}
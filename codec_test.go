@@ -0,0 +1,101 @@
+package gomq
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+type codecTestMessage struct {
+	Name  string
+	Count int
+}
+
+func newCodecPair(t *testing.T, codec Codec) (*ServerSocket, *ClientSocket) {
+	server := NewServer(zmtp.NewSecurityNull(), WithCodec(codec)).(*ServerSocket)
+	addr, err := server.Bind("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull(), WithCodec(codec)).(*ClientSocket)
+	if err := client.Connect("tcp://" + addr.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	return server, client
+}
+
+func TestJSONCodec(t *testing.T) {
+	server, client := newCodecPair(t, JSONCodec{})
+	defer server.Close()
+	defer client.Close()
+
+	want := codecTestMessage{Name: "HELLO", Count: 3}
+	if err := client.SendVal(want); err != nil {
+		t.Fatal(err)
+	}
+
+	var got codecTestMessage
+	if err := server.RecvVal(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	if want != got {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+
+	var codecErr *CodecError
+	if err := client.SendVal(make(chan int)); !errors.As(err, &codecErr) {
+		t.Errorf("want a *CodecError, got %v", err)
+	}
+
+	if err := client.Send([]byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.RecvVal(&got); !errors.As(err, &codecErr) || codecErr.Op != "unmarshal" {
+		t.Errorf("want an unmarshal *CodecError, got %v", err)
+	}
+}
+
+func TestRawCodec(t *testing.T) {
+	server, client := newCodecPair(t, RawCodec{})
+	defer server.Close()
+	defer client.Close()
+
+	if err := client.SendVal("HELLO"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	if err := server.RecvVal(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "HELLO"; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	var codecErr *CodecError
+	if err := client.SendVal(42); !errors.As(err, &codecErr) {
+		t.Errorf("want a *CodecError, got %v", err)
+	}
+}
+
+func TestSendValErrors(t *testing.T) {
+	client := NewClient(zmtp.NewSecurityNull()).(*ClientSocket)
+	defer client.Close()
+
+	if want, got := ErrNoCodec, client.SendVal("HELLO"); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	client = NewClient(zmtp.NewSecurityNull(), WithCodec(JSONCodec{})).(*ClientSocket)
+	defer client.Close()
+
+	if want, got := ErrNotConnected, client.SendVal("HELLO"); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
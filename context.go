@@ -0,0 +1,158 @@
+package gomq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// defaultContext is the Context of sockets created with the
+// package-level constructors. It does not keep track of its
+// sockets, so it cannot be terminated.
+var defaultContext = &Context{mem: newMemRegistry()}
+
+// Context owns a set of sockets and the state they share,
+// such as the names bound on the mem transport: sockets of
+// different contexts cannot reach each other over mem://,
+// so independent parts of a program do not collide.
+// Sockets created with the package-level constructors
+// belong to a default context.
+type Context struct {
+	opts []SocketOption
+	mem  *memRegistry
+
+	lock       sync.Mutex
+	sockets    map[*Socket]struct{}
+	terminated bool
+}
+
+// NewContext returns a new Context. The options are applied
+// to every socket created from it, before the socket's own.
+func NewContext(opts ...SocketOption) *Context {
+	return &Context{
+		opts:    opts,
+		mem:     newMemRegistry(),
+		sockets: make(map[*Socket]struct{}),
+	}
+}
+
+// New is like the package-level New, for a socket owned by
+// the context.
+func (c *Context) New(sockType zmtp.SocketType, mechanism zmtp.SecurityMechanism, opts ...SocketOption) (ZeroMQSocket, error) {
+	s, err := New(sockType, mechanism, c.options(opts)...)
+	if err != nil {
+		return nil, err
+	}
+	c.add(s.(baser).base())
+	return s, nil
+}
+
+// NewClient is like the package-level NewClient, for a
+// socket owned by the context.
+func (c *Context) NewClient(mechanism zmtp.SecurityMechanism, opts ...SocketOption) Client {
+	client := NewClient(mechanism, c.options(opts)...)
+	c.add(client.(baser).base())
+	return client
+}
+
+// NewServer is like the package-level NewServer, for a
+// socket owned by the context.
+func (c *Context) NewServer(mechanism zmtp.SecurityMechanism, opts ...SocketOption) Server {
+	server := NewServer(mechanism, c.options(opts)...)
+	c.add(server.(baser).base())
+	return server
+}
+
+// NewPush is like the package-level NewPush, for a socket
+// owned by the context.
+func (c *Context) NewPush(mechanism zmtp.SecurityMechanism, opts ...SocketOption) *PushSocket {
+	push := NewPush(mechanism, c.options(opts)...)
+	c.add(push.base())
+	return push
+}
+
+// NewPull is like the package-level NewPull, for a socket
+// owned by the context.
+func (c *Context) NewPull(mechanism zmtp.SecurityMechanism, opts ...SocketOption) *PullSocket {
+	pull := NewPull(mechanism, c.options(opts)...)
+	c.add(pull.base())
+	return pull
+}
+
+// options returns the context's options followed by opts.
+func (c *Context) options(opts []SocketOption) []SocketOption {
+	return append(append([]SocketOption(nil), c.opts...), opts...)
+}
+
+// add makes the context own s. A socket created from a
+// terminated context is closed straight away.
+func (c *Context) add(s *Socket) {
+	s.ctx = c
+
+	c.lock.Lock()
+	if c.terminated {
+		c.lock.Unlock()
+		s.Close()
+		return
+	}
+	c.sockets[s] = struct{}{}
+	c.lock.Unlock()
+}
+
+// remove forgets a socket that was closed.
+func (c *Context) remove(s *Socket) {
+	if c.sockets == nil {
+		return
+	}
+
+	c.lock.Lock()
+	delete(c.sockets, s)
+	c.lock.Unlock()
+}
+
+// Term closes every socket of the context, each with its own
+// linger (see WithLinger), and waits for them to be closed.
+// Sockets created from the context afterwards are closed
+// straight away. If the sockets are not closed within
+// timeout Term returns ErrTimeout, leaving them to finish
+// closing in the background; a negative timeout waits for as
+// long as it takes.
+func (c *Context) Term(timeout time.Duration) error {
+	c.lock.Lock()
+	c.terminated = true
+	sockets := make([]*Socket, 0, len(c.sockets))
+	for s := range c.sockets {
+		sockets = append(sockets, s)
+	}
+	c.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, s := range sockets {
+			wg.Add(1)
+			go func(s *Socket) {
+				s.Close()
+				wg.Done()
+			}(s)
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	if timeout < 0 {
+		<-done
+		return nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
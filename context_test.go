@@ -0,0 +1,82 @@
+package gomq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+func TestContextMem(t *testing.T) {
+	endpoint := "mem://gomq-test-context"
+
+	ctx1, ctx2 := NewContext(), NewContext()
+	defer ctx1.Term(-1)
+	defer ctx2.Term(-1)
+
+	for i, c := range []*Context{ctx1, ctx2} {
+		server := c.NewServer(zmtp.NewSecurityNull())
+		if _, err := server.Bind(endpoint); err != nil {
+			t.Fatalf("context %d: %v", i+1, err)
+		}
+	}
+
+	client := ctx1.NewClient(zmtp.NewSecurityNull())
+	if err := client.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	// The default context does not see the endpoints bound in
+	// ctx1 and ctx2.
+	if _, err := defaultContext.mem.dial("gomq-test-context"); err == nil {
+		t.Error("want the default context not to find the endpoint")
+	}
+}
+
+func TestContextTerm(t *testing.T) {
+	c := NewContext()
+
+	server := c.NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	if _, err := server.Bind("mem://gomq-test-context-term"); err != nil {
+		t.Fatal(err)
+	}
+	client := c.NewClient(zmtp.NewSecurityNull())
+	if err := client.Connect("mem://gomq-test-context-term"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitForPeers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := server.Recv()
+		errs <- err
+	}()
+
+	if err := c.Term(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		if want, got := ErrSocketClosed, err; want != got {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Recv did not return after Term")
+	}
+
+	if want, got := 0, len(c.sockets); want != got {
+		t.Errorf("want %d sockets left, got %d", want, got)
+	}
+
+	late := c.NewPull(zmtp.NewSecurityNull())
+	if _, err := late.Recv(); err != ErrSocketClosed {
+		t.Errorf("want %v from a socket created after Term, got %v", ErrSocketClosed, err)
+	}
+}
@@ -0,0 +1,67 @@
+package gomq
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// deadlineConn is the transport of a connection as its ZMTP
+// connection sees it when the socket has a write timeout or a
+// read idle timeout. It sets the deadline for each read and
+// write as it starts, so reads time out once nothing has come
+// in for the idle timeout, and writes once one has taken
+// longer than the write timeout. Transports that do not
+// support deadlines, such as mem, are not bounded.
+type deadlineConn struct {
+	net.Conn
+	write, idle time.Duration
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if c.idle > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.idle))
+	}
+	n, err := c.Conn.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = fmt.Errorf("%w: %w", ErrReadIdle, err)
+	}
+	return n, err
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if c.write > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.write))
+	}
+	n, err := c.Conn.Write(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = fmt.Errorf("%w: %w", ErrWriteTimeout, err)
+	}
+	return n, err
+}
+
+// newZMTPConn returns the ZMTP connection for a connection the
+// socket dialed or accepted, set up with the socket's allowed
+// mechanisms and their checking, command size limit, timestamps
+// and clock, and bounding its reads and writes if the socket
+// has a read idle or write timeout.
+func (s *Socket) newZMTPConn(netConn net.Conn) *zmtp.Connection {
+	var rw net.Conn = netConn
+	if s.writeTimeout > 0 || s.readIdleTimeout > 0 {
+		rw = &deadlineConn{Conn: netConn, write: s.writeTimeout, idle: s.readIdleTimeout}
+	}
+
+	zmtpConn := zmtp.NewConnection(rw)
+	zmtpConn.AllowMechanisms(s.mechanisms...)
+	zmtpConn.SetMaxCommandSize(s.maxCommandSize)
+	zmtpConn.SetTimestamps(s.timestamps)
+	zmtpConn.SetClock(s.clock)
+	if s.strictMechanism != nil {
+		zmtpConn.SetStrictMechanism(*s.strictMechanism)
+	}
+	return zmtpConn
+}
@@ -0,0 +1,190 @@
+package gomq
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// DebugInfo is a snapshot of a socket's state, for bug
+// reports. It holds no credentials: of the security
+// mechanism only the type is kept. It marshals to JSON, so
+// it can be published with expvar.Func.
+type DebugInfo struct {
+	Type      zmtp.SocketType
+	Mechanism zmtp.SecurityMechanismType
+	Closed    bool
+
+	// EffectiveOptions are the settings the socket was
+	// created with, as Options returns them.
+	EffectiveOptions
+
+	// Bound and Connected list the socket's endpoints; the
+	// status of a connect-side endpoint includes its latest
+	// error.
+	Bound     []string
+	Connected []EndpointStatus
+
+	Peers []PeerInfo
+
+	// Inbound is the number of received messages waiting
+	// for Recv.
+	Inbound            int64
+	InboundBytes       int64
+	Dropped            uint64
+	Expired            uint64
+	Discarded          uint64
+	Duplicates         uint64
+	Rejected           uint64
+	Filtered           uint64
+	Accepted           int
+	EvictedHandshakes  uint64
+	HandshakesInFlight int
+}
+
+// EffectiveOptions holds the settings a socket was created
+// with, whether set by its options or left to the defaults.
+type EffectiveOptions struct {
+	SendHWM              int
+	RecvHWM              int
+	HWMPolicy            HWMPolicy
+	SendTimeout          time.Duration
+	SendBufferBytes      int64
+	SendTTL              time.Duration
+	RecvBufferBytes      int64
+	Linger               time.Duration
+	RetryInterval        time.Duration
+	HeartbeatInterval    time.Duration
+	HeartbeatTimeout     time.Duration
+	WriteTimeout         time.Duration
+	ReadIdleTimeout      time.Duration
+	MaxCommandSize       int64
+	ParallelConnections  int
+	MinPeers             int
+	MaxConnections       int
+	ConnLimitPolicy      ConnLimitPolicy
+	MaxHandshakes        int
+	HandshakeConcurrency int
+	InboundRateLimit     RateLimit
+	PeerRateLimit        bool
+	StrictSendOnly       bool
+	UnorderedRecv        bool
+	Dedup                DedupWindow
+	AckTimeout           time.Duration
+	MaxRedeliveries      int
+	IPFamily             IPFamily
+	ManualRead           bool
+}
+
+// Options returns the settings the socket was created with:
+// those of its options, and the defaults it started from for
+// the others (see SetDefaults).
+func (s *Socket) Options() EffectiveOptions {
+	return EffectiveOptions{
+		SendHWM:              s.sendHWM,
+		RecvHWM:              cap(s.recvQueue),
+		HWMPolicy:            s.hwmPolicy,
+		SendTimeout:          s.sendTimeout,
+		SendBufferBytes:      s.sendBufferBytes,
+		SendTTL:              s.sendTTL,
+		RecvBufferBytes:      s.recvBufferBytes,
+		Linger:               s.linger,
+		RetryInterval:        s.retryInterval,
+		HeartbeatInterval:    s.heartbeatInterval,
+		HeartbeatTimeout:     s.heartbeatTimeout,
+		WriteTimeout:         s.writeTimeout,
+		ReadIdleTimeout:      s.readIdleTimeout,
+		MaxCommandSize:       s.maxCommandSize,
+		ParallelConnections:  max(s.parallelConns, 1),
+		MinPeers:             s.minPeers,
+		MaxConnections:       s.maxConns,
+		ConnLimitPolicy:      s.connLimitPolicy,
+		MaxHandshakes:        s.maxHandshakes,
+		HandshakeConcurrency: cap(s.handshakeSlots),
+		InboundRateLimit:     s.rateLimit,
+		PeerRateLimit:        s.peerRateLimit != nil,
+		StrictSendOnly:       s.strictSendOnly,
+		UnorderedRecv:        s.unorderedRecv,
+		Dedup:                s.dedupWindow(),
+		AckTimeout:           s.ackTimeout,
+		MaxRedeliveries:      s.maxRedeliveries,
+		IPFamily:             s.ipFamily,
+		ManualRead:           s.manualRead != nil,
+	}
+}
+
+// DebugInfo returns a snapshot of the socket's state. It is
+// safe to call at any time, from any goroutine, including
+// while the socket is busy or closing.
+func (s *Socket) DebugInfo() DebugInfo {
+	info := DebugInfo{
+		Type:               s.sockType,
+		EffectiveOptions:   s.Options(),
+		Inbound:            atomic.LoadInt64(&s.inbound),
+		InboundBytes:       s.InboundBytes(),
+		Dropped:            s.Dropped(),
+		Expired:            s.Expired(),
+		Discarded:          s.Discarded(),
+		Duplicates:         s.Duplicates(),
+		Rejected:           s.Rejected(),
+		Filtered:           s.Filtered(),
+		EvictedHandshakes:  s.EvictedHandshakes(),
+		HandshakesInFlight: s.HandshakesInFlight(),
+	}
+	if mechanism := s.SecurityMechanism(); mechanism != nil {
+		info.Mechanism = mechanism.Type()
+	}
+
+	var connected []string
+	s.lock.RLock()
+	info.Closed = s.closed
+	info.Accepted = s.acceptedConns
+	for _, l := range s.listeners {
+		info.Bound = append(info.Bound, l.endpoint)
+	}
+	seen := make(map[string]bool)
+	for _, d := range s.dialers {
+		for _, ep := range d.endpoints {
+			// Parallel connections share their endpoints.
+			if endpoint := ep.String(); !seen[endpoint] {
+				seen[endpoint] = true
+				connected = append(connected, endpoint)
+			}
+		}
+	}
+	s.lock.RUnlock()
+
+	for _, endpoint := range connected {
+		info.Connected = append(info.Connected, s.EndpointStatus(endpoint))
+	}
+	info.Peers = s.Peers()
+	return info
+}
+
+// DebugString formats DebugInfo as text, one item a line.
+func (s *Socket) DebugString() string {
+	info := s.DebugInfo()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "socket %s mechanism=%s closed=%t\n", info.Type, info.Mechanism, info.Closed)
+	fmt.Fprintf(&b, "options %+v\n", info.EffectiveOptions)
+	fmt.Fprintf(&b, "counters inbound=%d inbound_bytes=%d dropped=%d expired=%d discarded=%d duplicates=%d rejected=%d filtered=%d accepted=%d evicted_handshakes=%d handshakes_in_flight=%d\n",
+		info.Inbound, info.InboundBytes, info.Dropped, info.Expired, info.Discarded, info.Duplicates, info.Rejected, info.Filtered, info.Accepted, info.EvictedHandshakes, info.HandshakesInFlight)
+	for _, endpoint := range info.Bound {
+		fmt.Fprintf(&b, "bound %s\n", endpoint)
+	}
+	for _, status := range info.Connected {
+		fmt.Fprintf(&b, "connect %s connected=%t attempts=%d last_error=%v\n",
+			status.Endpoint, status.Connected, len(status.Attempts), status.LastErr)
+	}
+	for _, peer := range info.Peers {
+		fmt.Fprintf(&b, "peer %s endpoint=%s local=%v remote=%v version=%d.%d mechanism=%s peer_type=%s queued=%d queued_bytes=%d idle=%v rtt=%v dropped=%d expired=%d throttled=%d\n",
+			peer.ID, peer.Endpoint, peer.LocalAddr, peer.RemoteAddr,
+			peer.Negotiated.Version[0], peer.Negotiated.Version[1], peer.Negotiated.Mechanism,
+			peer.Negotiated.PeerSocketType, peer.Queued, peer.QueuedBytes, peer.Idle, peer.RTT, peer.Dropped, peer.Expired, peer.Throttled)
+	}
+	return b.String()
+}
@@ -0,0 +1,129 @@
+package gomq
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// defaultDedupCount is how many keys WithDedup remembers if
+// its window does not say.
+const defaultDedupCount = 4096
+
+// DedupWindow bounds how far back WithDedup remembers the
+// keys of received messages: the last Count keys, 4096 if
+// Count is zero, and, if Age is positive, only those first
+// seen less than Age ago.
+type DedupWindow struct {
+	Count int
+	Age   time.Duration
+}
+
+// dedupEntry is a key in a dedup ring.
+type dedupEntry struct {
+	key string
+	at  int64
+}
+
+// dedupSeen is where a remembered key is in the ring and when
+// it was first seen, in Unix nanoseconds.
+type dedupSeen struct {
+	slot int
+	at   int64
+}
+
+// dedup remembers the keys of the last messages received in
+// a ring, evicting the oldest as new keys come in, so that
+// it takes a bounded amount of memory however many messages
+// go through. It is shared by the readers of every
+// connection of the socket, so that messages resent over a
+// new connection after a reconnect are caught too.
+type dedup struct {
+	key   func(msg []byte) (string, bool)
+	age   time.Duration
+	clock zmtp.Clock
+
+	mu   sync.Mutex
+	ring []dedupEntry
+	next int
+	seen map[string]dedupSeen
+}
+
+func newDedup(key func(msg []byte) (string, bool), window DedupWindow) *dedup {
+	count := window.Count
+	if count <= 0 {
+		count = defaultDedupCount
+	}
+	return &dedup{
+		key:   key,
+		age:   window.Age,
+		clock: zmtp.RealClock{},
+		ring:  make([]dedupEntry, 0, count),
+		seen:  make(map[string]dedupSeen, count),
+	}
+}
+
+// duplicate reports whether msg has a key that was seen
+// within the window, remembering the key if not. Messages
+// the key function gives no key for are never duplicates.
+func (d *dedup) duplicate(msg []byte) bool {
+	key, ok := d.key(msg)
+	if !ok {
+		return false
+	}
+
+	var now int64
+	if d.age > 0 {
+		now = d.clock.Now().UnixNano()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if seen, ok := d.seen[key]; ok && (d.age <= 0 || now-seen.at < int64(d.age)) {
+		return true
+	}
+
+	entry := dedupEntry{key: key, at: now}
+	slot := d.next
+	if len(d.ring) < cap(d.ring) {
+		d.ring = append(d.ring, entry)
+	} else {
+		// The key in the slot is forgotten, unless it has
+		// been seen again since and lives in a newer slot.
+		if old := d.ring[slot]; d.seen[old.key].slot == slot {
+			delete(d.seen, old.key)
+		}
+		d.ring[slot] = entry
+	}
+	d.seen[key] = dedupSeen{slot: slot, at: now}
+	d.next = (slot + 1) % cap(d.ring)
+	return false
+}
+
+// dedupWindow returns the window of the socket's dedup
+// filter, the zero DedupWindow if it has none.
+func (s *Socket) dedupWindow() DedupWindow {
+	if s.dedup == nil {
+		return DedupWindow{}
+	}
+	return DedupWindow{Count: cap(s.dedup.ring), Age: s.dedup.age}
+}
+
+// deduplicated reports whether msg is a duplicate the socket
+// is to drop, counting it if so.
+func (s *Socket) deduplicated(msg []byte) bool {
+	if s.dedup == nil || !s.dedup.duplicate(msg) {
+		return false
+	}
+	atomic.AddUint64(&s.duplicates, 1)
+	return true
+}
+
+// Duplicates returns the number of received messages the
+// socket dropped as duplicates; see WithDedup.
+func (s *Socket) Duplicates() uint64 {
+	return atomic.LoadUint64(&s.duplicates)
+}
@@ -0,0 +1,94 @@
+package gomq
+
+import (
+	"sync"
+	"time"
+)
+
+// Defaults are the settings new sockets start from, before
+// their options are applied, so that a program can set them
+// once for every socket it creates rather than pass the same
+// options to each; see SetDefaults. A zero field keeps gomq's
+// own default, so the zero Defaults are gomq's defaults.
+type Defaults struct {
+	// RetryInterval is how long dialers wait between
+	// attempts; see RetryInterval. It defaults to 250ms.
+	RetryInterval time.Duration
+
+	// Linger is as set by WithLinger. It defaults to waiting
+	// indefinitely, which zero keeps: the closest Defaults
+	// come to not lingering is a nanosecond.
+	Linger time.Duration
+
+	// SendTimeout is as set by WithSendTimeout. It defaults
+	// to blocking indefinitely, which zero keeps, like Linger.
+	SendTimeout time.Duration
+
+	// SendHWM and RecvHWM are as set by WithSendHWM and
+	// WithRecvHWM. They default to 1000.
+	SendHWM int
+	RecvHWM int
+
+	// HeartbeatInterval and HeartbeatTimeout are as set by
+	// WithHeartbeat, and WriteTimeout and ReadIdleTimeout as
+	// set by WithWriteTimeout and WithReadIdleTimeout. They
+	// default to zero, which turns them off.
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	WriteTimeout      time.Duration
+	ReadIdleTimeout   time.Duration
+}
+
+var (
+	defaultsLock sync.RWMutex
+	defaults     Defaults
+)
+
+// SetDefaults sets the settings sockets created from now on
+// start from, typically once at the start of the program.
+// Sockets that exist already keep the settings they have.
+func SetDefaults(d Defaults) {
+	defaultsLock.Lock()
+	defer defaultsLock.Unlock()
+	defaults = d
+}
+
+// CurrentDefaults returns the settings new sockets start from,
+// with the fields SetDefaults left zero filled in with gomq's
+// own defaults.
+func CurrentDefaults() Defaults {
+	defaultsLock.RLock()
+	d := defaults
+	defaultsLock.RUnlock()
+
+	if d.RetryInterval == 0 {
+		d.RetryInterval = defaultRetry
+	}
+	if d.Linger == 0 {
+		d.Linger = defaultLinger
+	}
+	if d.SendTimeout == 0 {
+		d.SendTimeout = defaultSendTimeout
+	}
+	if d.SendHWM == 0 {
+		d.SendHWM = defaultSendQueueSize
+	}
+	if d.RecvHWM == 0 {
+		d.RecvHWM = defaultRecvQueueSize
+	}
+	return d
+}
+
+// applyDefaults sets the socket's settings to d.
+func (s *Socket) applyDefaults(d Defaults) {
+	s.defaults = d
+	s.retryInterval = d.RetryInterval
+	s.linger = d.Linger
+	s.sendTimeout = d.SendTimeout
+	s.sendHWM = d.SendHWM
+	s.recvHWM = d.RecvHWM
+	s.heartbeatInterval = d.HeartbeatInterval
+	s.heartbeatTimeout = d.HeartbeatTimeout
+	s.writeTimeout = d.WriteTimeout
+	s.readIdleTimeout = d.ReadIdleTimeout
+}
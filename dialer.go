@@ -0,0 +1,439 @@
+package gomq
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// reconnectHookTimeout is how long a dialer waits for the
+// reconnect hook before going ahead with the endpoint it has.
+var reconnectHookTimeout = time.Second
+
+// dialer keeps trying to establish a connection to a
+// connect-side endpoint in the background. A dialer for a
+// list of endpoints holds one connection at a time, trying
+// the endpoints in turn starting with the one after the
+// endpoint it last connected to.
+type dialer struct {
+	endpoints []Endpoint
+	next      int
+
+	// preferV4 tells which address family dialHost tries
+	// first, for familyReprobe after preferSince.
+	preferV4    bool
+	preferSince time.Time
+
+	// clock is the socket's, for the fallback delay and for
+	// preferSince.
+	clock zmtp.Clock
+
+	// epoch counts the connections the dialer has made.
+	epoch uint64
+
+	// redialed is set once the dialer's connection failed
+	// and lastErr holds what it failed with.
+	redialed bool
+	lastErr  error
+
+	first     chan error
+	firstOnce sync.Once
+	done      chan struct{}
+	stopOnce  sync.Once
+
+	// ctx is done once the dialer is stopped, for abandoning
+	// the connection it is dialing or handshaking.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// report delivers the outcome of the first connection
+// attempt to whoever is waiting in Connect.
+func (d *dialer) report(err error) {
+	d.firstOnce.Do(func() {
+		d.first <- err
+	})
+}
+
+// stop makes the dialer give up.
+func (d *dialer) stop() {
+	d.stopOnce.Do(func() {
+		close(d.done)
+		d.cancel()
+	})
+}
+
+// stopped reports whether d has been stopped.
+func (d *dialer) stopped() bool {
+	select {
+	case <-d.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// ConnectAsync accepts a zeromq endpoint, validates and records it,
+// and returns immediately. Dialing and the ZMTP handshake happen in
+// the background, retrying every RetryInterval until the endpoint is
+// reachable. Progress is reported through the monitor events (see
+// WithMonitor) and can be awaited with WaitForPeers. A failed
+// handshake is reported as EventHandshakeFailed. It ends the
+// attempts if the first one fails it; when redialing after the
+// connection failed, it is retried like an unreachable endpoint.
+func (s *Socket) ConnectAsync(endpoint string) error {
+	_, err := s.connectAsync(endpoint)
+	return err
+}
+
+// ConnectAny connects to one of endpoints, trying them in
+// order, and waits for the outcome like Connect. When the
+// connection fails the socket fails over to the next
+// endpoint in the list, going round the list every
+// RetryInterval until one is reachable and handshakes, so
+// there is only ever one connection at a time. To hold
+// connections to all of the endpoints at once, Connect to
+// each of them.
+func (s *Socket) ConnectAny(endpoints []string) error {
+	return s.connect(context.Background(), endpoints...)
+}
+
+// ConnectContext is like Connect, but gives up when ctx is done
+// before the connection is established, returning ctx.Err().
+// The attempt is abandoned, closing the connection if it is
+// still dialing or in its handshake, and no further attempts
+// are made. Once the connection is established ctx no longer
+// matters.
+func (s *Socket) ConnectContext(ctx context.Context, endpoint string) error {
+	return s.connect(ctx, endpoint)
+}
+
+// connectAsync starts a dialer for endpoints, or as many as
+// the socket has parallel connections (see
+// WithParallelConnections).
+func (s *Socket) connectAsync(endpoints ...string) ([]*dialer, error) {
+	if len(endpoints) == 0 {
+		return nil, &EndpointError{Reason: "empty endpoint list"}
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	var eps []Endpoint
+	for _, endpoint := range endpoints {
+		ep, err := ParseEndpoint(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if ep.Network() == "fd" {
+			return nil, &EndpointError{Endpoint: endpoint, Reason: "fd endpoints can only be bound"}
+		}
+		eps = append(eps, ep)
+	}
+
+	ds := make([]*dialer, max(s.parallelConns, 1))
+	for i := range ds {
+		ctx, cancel := context.WithCancel(context.Background())
+		ds[i] = &dialer{
+			endpoints: eps,
+			first:     make(chan error, 1),
+			done:      make(chan struct{}),
+			ctx:       ctx,
+			cancel:    cancel,
+			clock:     s.clock,
+		}
+	}
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil, ErrSocketClosed
+	}
+	s.dialers = append(s.dialers, ds...)
+	s.lock.Unlock()
+
+	for _, d := range ds {
+		d := d
+		s.spawn(resDialer, func() { s.dial(d) })
+	}
+	return ds, nil
+}
+
+// connect connects to endpoints and waits for the outcome of
+// the first attempt of each of its dialers, or for ctx to be
+// done. Handshake errors and ctx's error are returned and stop
+// any further attempts, taking down the connections the other
+// dialers made.
+func (s *Socket) connect(ctx context.Context, endpoints ...string) error {
+	ds, err := s.connectAsync(endpoints...)
+	if err != nil {
+		return err
+	}
+
+wait:
+	for _, d := range ds {
+		select {
+		case first := <-d.first:
+			if first != nil && err == nil {
+				err = first
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+			break wait
+		}
+	}
+	if err != nil {
+		for _, d := range ds {
+			s.removeDialer(d)
+			s.removeDialed(d)
+		}
+	}
+	return err
+}
+
+// removeDialed tears down the connection d made, if it has
+// one.
+func (s *Socket) removeDialed(d *dialer) {
+	s.lock.RLock()
+	var conns []*Connection
+	for _, conn := range s.conns {
+		if conn.dialer == d {
+			conns = append(conns, conn)
+		}
+	}
+	s.lock.RUnlock()
+
+	for _, conn := range conns {
+		if s.removeConnection(conn) {
+			conn.close(0)
+			s.releaseValues(conn)
+		}
+	}
+}
+
+// dial dials the dialer's endpoints in turn, going round
+// them every retry interval, until a connection has been
+// handshaked. The dialer stays with the socket so that it
+// can be started again when the connection fails.
+func (s *Socket) dial(d *dialer) {
+	lastErr := d.lastErr
+	for attempts := 1; ; attempts++ {
+		// Every attempt is a reconnect but the first one
+		// Connect makes.
+		reconnect := attempts - 1
+		if d.redialed {
+			reconnect = attempts
+		}
+		if reconnect > 0 && !s.beforeReconnect(d, reconnect, lastErr) {
+			return
+		}
+
+		ep := d.endpoints[d.next]
+		endpoint := ep.String()
+		began := s.clock.Now()
+
+		netConn, err := s.dialEndpoint(d, ep)
+		if err != nil {
+			lastErr = err
+			s.record(endpoint, began, AttemptDial, err)
+			s.emit(Event{Type: EventConnectRetried, Endpoint: endpoint, Err: err})
+			if !s.retry(d, attempts) {
+				return
+			}
+			continue
+		}
+
+		// Stopping the dialer closes the connection, so that
+		// a handshake with a peer that stalls is abandoned
+		// rather than left blocked.
+		stop := context.AfterFunc(d.ctx, func() {
+			netConn.Close()
+		})
+		zmtpConn := s.newZMTPConn(netConn)
+		_, err = zmtpConn.Prepare(s.SecurityMechanism(), s.sockType, false, nil)
+		if !stop() {
+			d.report(ErrSocketClosed)
+			return
+		}
+		if err != nil {
+			netConn.Close()
+			s.record(endpoint, began, handshakeStage(err), err)
+			s.emit(Event{Type: EventHandshakeFailed, Endpoint: endpoint, Addr: netConn.RemoteAddr(), Err: err})
+			// Connect to a single endpoint fails with the
+			// handshake error; with more, or once the
+			// dialer has been connected, it is retried like
+			// a failed dial.
+			if attempts == 1 && len(d.endpoints) == 1 && !d.redialed {
+				s.removeDialer(d)
+				d.report(err)
+				return
+			}
+			lastErr = err
+			if !s.retry(d, attempts) {
+				return
+			}
+			continue
+		}
+
+		s.record(endpoint, began, AttemptConnected, nil)
+		conn := NewConnection(netConn, zmtpConn)
+		conn.endpoint = endpoint
+		conn.dialer = d
+		d.epoch++
+		conn.epoch = d.epoch
+		if !s.addConnection(conn) {
+			d.report(ErrSocketClosed)
+			return
+		}
+		s.emit(Event{Type: EventConnected, Endpoint: endpoint, Addr: netConn.RemoteAddr()})
+		d.report(nil)
+		return
+	}
+}
+
+// retry moves d on to its next endpoint after a failed
+// attempt, waiting the retry interval once the attempts have
+// gone round all of them. It reports whether to go on, false
+// if d was stopped while waiting.
+func (s *Socket) retry(d *dialer, attempts int) bool {
+	d.next = (d.next + 1) % len(d.endpoints)
+	if attempts%len(d.endpoints) != 0 {
+		return true
+	}
+
+	timer := s.clock.NewTimer(s.retryInterval)
+	select {
+	case <-timer.C():
+		return true
+	case <-d.done:
+		timer.Stop()
+		d.report(ErrSocketClosed)
+		return false
+	}
+}
+
+// redial starts d again after its connection failed with
+// err, from the next of its endpoints, unless the dialer or
+// the socket has been stopped.
+func (s *Socket) redial(d *dialer, err error) {
+	select {
+	case <-d.done:
+		return
+	default:
+	}
+
+	d.redialed = true
+	d.lastErr = err
+	d.next = (d.next + 1) % len(d.endpoints)
+	s.spawn(resDialer, func() { s.dial(d) })
+}
+
+// SetReconnectHook sets a function to be called before each
+// reconnect attempt of the socket's dialers: after a
+// connection failed, and before each retry of a Connect whose
+// first attempt failed. It is passed the endpoint about to be
+// dialed, the number of the attempt since the connection was
+// lost or Connect was called, and the error the connection or
+// the previous attempt failed with. It returns the endpoint
+// to dial instead, for instance a fresh address from service
+// discovery, or "" to keep the endpoint, and whether to go on
+// at all: if not, the dialer is stopped for good, and a
+// Connect still waiting returns ErrReconnectAborted. An
+// endpoint that does not parse is ignored. The hook runs on
+// the dialer's goroutine; if it has not returned within a
+// second the dialer goes ahead with the endpoint it has. A
+// nil hook removes the hook.
+func (s *Socket) SetReconnectHook(hook func(endpoint string, attempt int, lastErr error) (newEndpoint string, proceed bool)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.reconnectHook = hook
+}
+
+// beforeReconnect runs the reconnect hook, if there is one,
+// for the next attempt of d, replacing the endpoint d is to
+// dial if the hook says so. It reports whether to go on with
+// the attempt.
+func (s *Socket) beforeReconnect(d *dialer, attempt int, lastErr error) bool {
+	s.lock.RLock()
+	hook := s.reconnectHook
+	s.lock.RUnlock()
+	if hook == nil {
+		return true
+	}
+
+	type verdict struct {
+		endpoint string
+		proceed  bool
+	}
+	endpoint := d.endpoints[d.next].String()
+	done := make(chan verdict, 1)
+	go func() {
+		newEndpoint, proceed := hook(endpoint, attempt, lastErr)
+		done <- verdict{newEndpoint, proceed}
+	}()
+
+	timer := s.clock.NewTimer(reconnectHookTimeout)
+	defer timer.Stop()
+	select {
+	case v := <-done:
+		if !v.proceed {
+			s.removeDialer(d)
+			d.report(ErrReconnectAborted)
+			return false
+		}
+		if v.endpoint != "" && v.endpoint != endpoint {
+			s.replaceEndpoint(d, v.endpoint)
+		}
+		return true
+	case <-timer.C():
+		return true
+	case <-d.done:
+		d.report(ErrSocketClosed)
+		return false
+	}
+}
+
+// replaceEndpoint makes d dial endpoint in place of the
+// endpoint it was about to dial, unless endpoint does not
+// parse or cannot be dialed. The endpoints of parallel
+// dialers are shared, so they are copied first.
+func (s *Socket) replaceEndpoint(d *dialer, endpoint string) {
+	ep, err := ParseEndpoint(endpoint)
+	if err != nil || ep.Network() == "fd" {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	endpoints := append([]Endpoint(nil), d.endpoints...)
+	endpoints[d.next] = ep
+	d.endpoints = endpoints
+}
+
+// removeDialer stops d and stops tracking it.
+func (s *Socket) removeDialer(d *dialer) {
+	d.stop()
+
+	s.lock.Lock()
+	for k, v := range s.dialers {
+		if v == d {
+			s.dialers = append(s.dialers[:k], s.dialers[k+1:]...)
+			break
+		}
+	}
+	s.lock.Unlock()
+}
+
+// stopDialers stops every dialer of the socket.
+func (s *Socket) stopDialers() {
+	s.lock.Lock()
+	dialers := s.dialers
+	s.dialers = nil
+	s.lock.Unlock()
+
+	for _, d := range dialers {
+		d.stop()
+	}
+}
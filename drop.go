@@ -0,0 +1,150 @@
+package gomq
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// dropQueueSize is how many dropped messages wait for the drop
+// handler before further ones are not handed to it.
+var dropQueueSize = 1000
+
+// errDropped is returned by Connection.send when the HWMDrop
+// policy discarded the message.
+var errDropped = errors.New("gomq: message dropped")
+
+// dropped is a message discarded by the HWM policy, or for
+// outliving the send TTL, on its way to the drop handler.
+type dropped struct {
+	conn *Connection
+	msg  []byte
+}
+
+// drop records that b, meant for conn, was discarded. The
+// first drop after messages went through again is reported
+// as an EventDropped; the message is handed to the drop
+// handler, if there is one, without waiting for it.
+func (s *Socket) drop(conn *Connection, b []byte) {
+	atomic.AddUint64(&conn.dropped, 1)
+	atomic.AddUint64(&s.dropped, 1)
+
+	if atomic.CompareAndSwapInt32(&s.dropping, 0, 1) {
+		s.emit(Event{Type: EventDropped, Endpoint: conn.endpoint, Addr: conn.net.RemoteAddr()})
+	}
+	s.handOff(conn, b)
+}
+
+// handOff passes b, a message for conn that was discarded, to
+// the drop handler, if there is one, without waiting for it.
+func (s *Socket) handOff(conn *Connection, b []byte) {
+	s.lock.RLock()
+	queue := s.dropQueue
+	s.lock.RUnlock()
+
+	if queue != nil {
+		select {
+		case queue <- dropped{conn: conn, msg: b}:
+		default:
+		}
+	}
+}
+
+// delivered records that a message was queued, ending a run
+// of drops.
+func (s *Socket) delivered() {
+	if atomic.LoadInt32(&s.dropping) != 0 {
+		atomic.StoreInt32(&s.dropping, 0)
+	}
+}
+
+// SetDropHandler sets a function to be called with every
+// message the HWMDrop policy discards, or that expired in a
+// send queue (see WithSendTTL), and the peer it was meant
+// for, e.g. to spill it to disk. The handler runs on a
+// goroutine of its own, so a slow handler does not hold up
+// Send; messages dropped while too many are waiting for it
+// are not passed to it. A nil handler removes the handler.
+func (s *Socket) SetDropHandler(handler func(peer PeerInfo, msg []byte)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.dropHandler = handler
+	if handler != nil && s.dropQueue == nil {
+		s.dropQueue = make(chan dropped, dropQueueSize)
+		queue := s.dropQueue
+		s.spawn(resHandler, func() { s.handleDrops(queue) })
+	}
+}
+
+// handleDrops passes dropped messages to the drop handler
+// until the socket is closed.
+func (s *Socket) handleDrops(queue <-chan dropped) {
+	for {
+		select {
+		case d := <-queue:
+			s.lock.RLock()
+			handler := s.dropHandler
+			s.lock.RUnlock()
+
+			if handler != nil {
+				handler(d.conn.PeerInfo(), d.msg)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Dropped returns the number of messages the socket has
+// discarded under the HWMDrop policy. PeerInfo.Dropped gives
+// the count for a single connection.
+func (s *Socket) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// outbound wraps b for the send queue, noting when it
+// expires if it has a TTL: ttl, or the connection's send TTL
+// if ttl is zero.
+func (c *Connection) outbound(b []byte, ttl time.Duration) outbound {
+	m := outbound{msg: b}
+	if ttl <= 0 {
+		ttl = c.sendTTL
+	}
+	if ttl > 0 {
+		m.expires = c.clock.Now().Add(ttl).UnixNano()
+	}
+	return m
+}
+
+// unexpired appends the messages of batch that have not
+// outlived their TTL to frames and returns it. The others are
+// counted as expired and handed to the drop handler.
+func (c *Connection) unexpired(batch []outbound, frames [][]byte) [][]byte {
+	var now int64
+	for _, m := range batch {
+		if m.expires == 0 {
+			frames = append(frames, m.msg)
+			continue
+		}
+		if now == 0 {
+			now = c.clock.Now().UnixNano()
+		}
+		if m.expires < now {
+			atomic.AddUint64(&c.expired, 1)
+			atomic.AddUint64(&c.socket.expired, 1)
+			c.socket.handOff(c, m.msg)
+			continue
+		}
+		frames = append(frames, m.msg)
+	}
+	return frames
+}
+
+// Expired returns the number of messages the socket has
+// discarded for waiting in a send queue longer than the send
+// TTL (see WithSendTTL). PeerInfo.Expired gives the count for
+// a single connection.
+func (s *Socket) Expired() uint64 {
+	return atomic.LoadUint64(&s.expired)
+}
@@ -0,0 +1,292 @@
+package gomq
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidEndpoint is wrapped by the *EndpointError
+// returned for a malformed endpoint, so callers can test
+// for it with errors.Is.
+var ErrInvalidEndpoint = errors.New("gomq: invalid endpoint")
+
+// EndpointError describes why an endpoint could not be
+// parsed.
+type EndpointError struct {
+	Endpoint string
+	Reason   string
+}
+
+func (e *EndpointError) Error() string {
+	return fmt.Sprintf("gomq: invalid endpoint %q: %s", e.Endpoint, e.Reason)
+}
+
+// Unwrap returns ErrInvalidEndpoint.
+func (e *EndpointError) Unwrap() error {
+	return ErrInvalidEndpoint
+}
+
+// Endpoint is a parsed zeromq endpoint of the form
+// "<transport>://<address>". TCP endpoints have a Host and
+// Port, ipc endpoints a Path. The in-process mem transport
+// keeps the endpoint's name in Path and the fd transport,
+// which can only be bound, the number of an inherited
+// listening descriptor.
+type Endpoint struct {
+	Transport string
+	Host      string
+	Port      string
+	Path      string
+}
+
+// transport describes a supported endpoint transport.
+type transport struct {
+	// network is the network name passed to net.Dial
+	// and net.Listen, or "mem" or "fd" for the
+	// transports gomq implements itself.
+	network string
+
+	// parse fills in endpoint from the address part of
+	// an endpoint string, returning the reason it is
+	// malformed if it is.
+	parse func(endpoint *Endpoint, address string) string
+}
+
+// transports holds the supported endpoint transports by
+// their endpoint scheme.
+var transports = map[string]transport{
+	"tcp": {network: "tcp", parse: parseTCP},
+	"ipc": {network: "unix", parse: parseIPC},
+	"mem": {network: "mem", parse: parseMem},
+	"fd":  {network: "fd", parse: parseFD},
+}
+
+// ParseEndpoint parses a zeromq endpoint such as
+// "tcp://127.0.0.1:5555". Binding "fd://3" listens on the
+// already listening socket a process inherited as descriptor
+// 3, e.g. under systemd socket activation; see WithKeepFDs.
+// When binding a TCP endpoint the host may also be "*" for
+// every address (see WithIPFamily), "0.0.0.0" for every IPv4
+// address only, "[::]" for every IPv6 address only, or the
+// name of a network interface, such as "eth0", to listen on
+// each of its addresses. It returns an *EndpointError if the
+// endpoint is malformed or its transport is not supported.
+func ParseEndpoint(s string) (Endpoint, error) {
+	invalid := func(reason string) (Endpoint, error) {
+		return Endpoint{}, &EndpointError{Endpoint: s, Reason: reason}
+	}
+
+	scheme, address, ok := strings.Cut(s, "://")
+	if !ok {
+		return invalid(`missing "://"`)
+	}
+	if scheme == "" {
+		return invalid("missing transport")
+	}
+
+	t, ok := transports[scheme]
+	if !ok {
+		return invalid(fmt.Sprintf("unsupported transport %q", scheme))
+	}
+
+	e := Endpoint{Transport: scheme}
+	if reason := t.parse(&e, address); reason != "" {
+		return invalid(reason)
+	}
+	return e, nil
+}
+
+// parseTCP parses a "host:port" TCP address.
+func parseTCP(e *Endpoint, address string) string {
+	if address == "" {
+		return "missing address"
+	}
+	if strings.Contains(address, "/") {
+		return "unexpected path"
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		if addrErr, ok := err.(*net.AddrError); ok {
+			return addrErr.Err
+		}
+		return err.Error()
+	}
+	if host == "" {
+		return "missing host"
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Sprintf("invalid port %q", port)
+	}
+
+	e.Host, e.Port = host, port
+	return ""
+}
+
+// parseIPC parses a unix socket path. A path starting with
+// "@" names a socket in the Linux abstract namespace, which
+// has no file to clean up.
+func parseIPC(e *Endpoint, address string) string {
+	if address == "" {
+		return "missing path"
+	}
+	if strings.HasPrefix(address, "@") {
+		if !abstractUnixSockets {
+			return "abstract unix sockets are not supported on this platform"
+		}
+		if address == "@" {
+			return "missing abstract socket name"
+		}
+	}
+
+	e.Path = address
+	return ""
+}
+
+// parseMem parses the name of an in-process mem endpoint.
+func parseMem(e *Endpoint, address string) string {
+	if address == "" {
+		return "missing name"
+	}
+
+	e.Path = address
+	return ""
+}
+
+// parseFD parses the number of an inherited file descriptor.
+func parseFD(e *Endpoint, address string) string {
+	if address == "" {
+		return "missing file descriptor"
+	}
+	if _, err := strconv.ParseUint(address, 10, 31); err != nil {
+		return fmt.Sprintf("invalid file descriptor %q", address)
+	}
+
+	e.Path = address
+	return ""
+}
+
+// Network returns the network name of the endpoint's
+// transport, as used by the net package.
+func (e Endpoint) Network() string {
+	return transports[e.Transport].network
+}
+
+// Address returns the endpoint's address in the form
+// the net package expects.
+func (e Endpoint) Address() string {
+	if e.Path != "" {
+		return e.Path
+	}
+	return net.JoinHostPort(e.Host, e.Port)
+}
+
+// String formats the endpoint so that it parses back to
+// the same Endpoint.
+func (e Endpoint) String() string {
+	return e.Transport + "://" + e.Address()
+}
+
+// bindAddress is a network and address a bound endpoint
+// listens on.
+type bindAddress struct {
+	network, address string
+}
+
+// bindAddresses returns what to listen on to bind ep. The
+// host of a TCP endpoint may be a wildcard, which is bound
+// for the address families family says, or the name of a
+// network interface, in which case there is a bindAddress for
+// each of the interface's addresses.
+func bindAddresses(ep Endpoint, family IPFamily) ([]bindAddress, error) {
+	if ep.Transport != "tcp" {
+		return []bindAddress{{ep.Network(), ep.Address()}}, nil
+	}
+
+	if ep.Host == "*" {
+		v4 := bindAddress{"tcp4", net.JoinHostPort("0.0.0.0", ep.Port)}
+		v6 := bindAddress{"tcp6", net.JoinHostPort("::", ep.Port)}
+		switch family {
+		case IPSystemStack:
+			return []bindAddress{{"tcp", net.JoinHostPort("", ep.Port)}}, nil
+		case IPv4Only:
+			return []bindAddress{v4}, nil
+		case IPv6Only:
+			return []bindAddress{v6}, nil
+		}
+		return []bindAddress{v4, v6}, nil
+	}
+
+	if ip := net.ParseIP(ep.Host); ip != nil {
+		network := "tcp"
+		if ip.IsUnspecified() {
+			network = "tcp6"
+			if ip.To4() != nil {
+				network = "tcp4"
+			}
+		}
+		return []bindAddress{{network, ep.Address()}}, nil
+	}
+
+	iface, err := net.InterfaceByName(ep.Host)
+	if err != nil {
+		// Not an interface, so a host name for net.Listen.
+		return []bindAddress{{"tcp", ep.Address()}}, nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var bound []bindAddress
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		host := ipNet.IP.String()
+		if ipNet.IP.IsLinkLocalUnicast() && ipNet.IP.To4() == nil {
+			host += "%" + iface.Name
+		}
+		bound = append(bound, bindAddress{"tcp", net.JoinHostPort(host, ep.Port)})
+	}
+	if len(bound) == 0 {
+		return nil, fmt.Errorf("gomq: interface %q has no addresses", iface.Name)
+	}
+	return bound, nil
+}
+
+// listenEndpoint listens on a parsed endpoint's network and
+// address.
+func (s *Socket) listenEndpoint(network, address string) (net.Listener, error) {
+	switch network {
+	case "mem":
+		return s.ctx.mem.listen(address)
+	case "fd":
+		return listenFD(address, s.keepFDs)
+	}
+
+	ln, err := s.listen(network, address)
+	if err != nil || s.backlog <= 0 {
+		return ln, err
+	}
+	if err := setBacklog(ln, s.backlog); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// dialEndpoint dials a parsed endpoint for d.
+func (s *Socket) dialEndpoint(d *dialer, ep Endpoint) (net.Conn, error) {
+	switch ep.Network() {
+	case "mem":
+		return s.ctx.mem.dial(ep.Address())
+	case "tcp":
+		return d.dialHost(ep.Host, ep.Port)
+	}
+	return net.Dial(ep.Network(), ep.Address())
+}
@@ -0,0 +1,6 @@
+package gomq
+
+// abstractUnixSockets reports whether ipc endpoints may name
+// sockets in the abstract namespace. The net package maps a
+// leading "@" to the NUL byte such addresses start with.
+const abstractUnixSockets = true
@@ -0,0 +1,21 @@
+package gomq
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseAbstractEndpoint(t *testing.T) {
+	ep, err := ParseEndpoint("ipc://@gomq")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "@gomq", ep.Address(); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if _, err := ParseEndpoint("ipc://@"); !errors.Is(err, ErrInvalidEndpoint) {
+		t.Errorf("want ErrInvalidEndpoint, got %v", err)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package gomq
+
+// abstractUnixSockets reports whether ipc endpoints may name
+// sockets in the abstract namespace, which only Linux has.
+const abstractUnixSockets = false
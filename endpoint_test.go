@@ -0,0 +1,274 @@
+package gomq
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	for _, endpoint := range []string{
+		"tcp://127.0.0.1:5555",
+		"tcp://localhost:0",
+		"tcp://[::1]:5555",
+		"ipc:///tmp/gomq.sock",
+		"ipc://gomq.sock",
+		"mem://gomq",
+		"fd://3",
+	} {
+		ep, err := ParseEndpoint(endpoint)
+		if err != nil {
+			t.Errorf("%q: %v", endpoint, err)
+			continue
+		}
+
+		if want, got := endpoint, ep.String(); want != got {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+}
+
+func TestParseEndpointInvalid(t *testing.T) {
+	for endpoint, reason := range map[string]string{
+		"":                      `missing "://"`,
+		"127.0.0.1:5555":        `missing "://"`,
+		"://:5555":              "missing transport",
+		"udp://127.0.0.1:5555":  `unsupported transport "udp"`,
+		"tcp://":                "missing address",
+		"tcp://127.0.0.1":       "missing port in address",
+		"tcp://:5555":           "missing host",
+		"tcp://127.0.0.1:port":  `invalid port "port"`,
+		"tcp://127.0.0.1:99999": `invalid port "99999"`,
+		"tcp://host:5555/extra": "unexpected path",
+		"tcp://tcp://host:5555": "unexpected path",
+		"mem://":                "missing name",
+		"fd://":                 "missing file descriptor",
+		"fd://stdin":            `invalid file descriptor "stdin"`,
+	} {
+		_, err := ParseEndpoint(endpoint)
+		if !errors.Is(err, ErrInvalidEndpoint) {
+			t.Errorf("%q: want ErrInvalidEndpoint, got %v", endpoint, err)
+			continue
+		}
+
+		var epErr *EndpointError
+		if !errors.As(err, &epErr) {
+			t.Fatalf("%q: want *EndpointError, got %T", endpoint, err)
+		}
+
+		if want, got := reason, epErr.Reason; want != got {
+			t.Errorf("%q: want %q, got %q", endpoint, want, got)
+		}
+	}
+}
+
+func TestInvalidEndpointFailsFast(t *testing.T) {
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+
+	if err := client.Connect("tcp://127.0.0.1"); !errors.Is(err, ErrInvalidEndpoint) {
+		t.Errorf("want ErrInvalidEndpoint, got %v", err)
+	}
+
+	server := NewServer(zmtp.NewSecurityNull())
+	defer server.Close()
+
+	if _, err := server.Bind("tcp://127.0.0.1:0/extra"); !errors.Is(err, ErrInvalidEndpoint) {
+		t.Errorf("want ErrInvalidEndpoint, got %v", err)
+	}
+}
+
+func TestBindAddresses(t *testing.T) {
+	for endpoint, want := range map[string]bindAddress{
+		"tcp://*:5555":         {"tcp", ":5555"},
+		"tcp://0.0.0.0:5555":   {"tcp4", "0.0.0.0:5555"},
+		"tcp://[::]:5555":      {"tcp6", "[::]:5555"},
+		"tcp://127.0.0.1:5555": {"tcp", "127.0.0.1:5555"},
+		"ipc:///tmp/gomq.sock": {"unix", "/tmp/gomq.sock"},
+	} {
+		ep, err := ParseEndpoint(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := bindAddresses(ep, IPSystemStack)
+		if err != nil {
+			t.Errorf("%q: %v", endpoint, err)
+			continue
+		}
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("%q: want %v, got %v", endpoint, want, got)
+		}
+	}
+}
+
+func TestBindAddressesFamily(t *testing.T) {
+	ep, err := ParseEndpoint("tcp://*:5555")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v4 := bindAddress{"tcp4", "0.0.0.0:5555"}
+	v6 := bindAddress{"tcp6", "[::]:5555"}
+	for family, want := range map[IPFamily][]bindAddress{
+		IPDualStack:   {v4, v6},
+		IPSystemStack: {{"tcp", ":5555"}},
+		IPv4Only:      {v4},
+		IPv6Only:      {v6},
+	} {
+		got, err := bindAddresses(ep, family)
+		if err != nil {
+			t.Errorf("%v: %v", family, err)
+			continue
+		}
+		if fmt.Sprint(want) != fmt.Sprint(got) {
+			t.Errorf("%v: want %v, got %v", family, want, got)
+		}
+	}
+}
+
+func TestBindWildcard(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull())
+	defer server.Close()
+
+	addr, err := server.Bind("tcp://*:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", portOf(t, addr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestBindInterface(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	// A loopback interface with an IPv4 address, so that every
+	// machine running the tests is likely to have one.
+	var name string
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+		if len(ips) > 0 {
+			name = iface.Name
+			break
+		}
+	}
+	if name == "" {
+		t.Skip("no loopback interface with an IPv4 address")
+	}
+
+	server := NewServer(zmtp.NewSecurityNull())
+	defer server.Close()
+
+	addr, err := server.Bind("tcp://" + name + ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ip := range ips {
+		conn, err := net.Dial("tcp", net.JoinHostPort(ip.String(), portOf(t, addr)))
+		if err != nil {
+			t.Errorf("%v: %v", ip, err)
+			continue
+		}
+		conn.Close()
+	}
+}
+
+func TestBindDualStack(t *testing.T) {
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("no IPv6:", err)
+	} else {
+		ln.Close()
+	}
+
+	server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer server.Close()
+
+	addr, err := server.Bind("tcp://*:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := portOf(t, addr)
+
+	want := []string{"tcp://0.0.0.0:" + port, "tcp://[::]:" + port}
+	if got := server.LastEndpoints(); fmt.Sprint(want) != fmt.Sprint(got) {
+		t.Errorf("want endpoints %v, got %v", want, got)
+	}
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			t.Errorf("%v: %v", host, err)
+			continue
+		}
+		conn.Close()
+	}
+}
+
+func TestBindDegraded(t *testing.T) {
+	noIPv6 := func(network, address string) (net.Listener, error) {
+		if network == "tcp6" {
+			return nil, &net.OpError{Op: "listen", Net: network, Err: syscall.EAFNOSUPPORT}
+		}
+		return net.Listen(network, address)
+	}
+
+	events := make(chan Event, 10)
+	server := NewServer(zmtp.NewSecurityNull(), WithMonitor(events)).(*ServerSocket)
+	defer server.Close()
+	server.base().listen = noIPv6
+
+	addr, err := server.Bind("tcp://*:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := <-events
+	if want, got := EventBindDegraded, ev.Type; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if !errors.Is(ev.Err, syscall.EAFNOSUPPORT) {
+		t.Errorf("want EAFNOSUPPORT, got %v", ev.Err)
+	}
+	if want, got := []string{"tcp://0.0.0.0:" + portOf(t, addr)}, server.LastEndpoints(); fmt.Sprint(want) != fmt.Sprint(got) {
+		t.Errorf("want endpoints %v, got %v", want, got)
+	}
+
+	// A family asked for explicitly has to be there.
+	v6 := NewServer(zmtp.NewSecurityNull(), WithIPFamily(IPv6Only)).(*ServerSocket)
+	defer v6.Close()
+	v6.base().listen = noIPv6
+
+	if _, err := v6.Bind("tcp://*:0"); !errors.Is(err, syscall.EAFNOSUPPORT) {
+		t.Errorf("want EAFNOSUPPORT, got %v", err)
+	}
+}
+
+func portOf(t *testing.T, addr net.Addr) string {
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
@@ -0,0 +1,151 @@
+package gomq
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+var (
+	// ErrNotConnected is returned when a message is sent
+	// on a socket that has no connections.
+	ErrNotConnected = errors.New("gomq: socket is not connected")
+
+	// ErrSocketClosed is returned when an operation is
+	// attempted on, or interrupted by closing, a socket.
+	ErrSocketClosed = errors.New("gomq: socket is closed")
+
+	// ErrTimeout is returned when an operation does not
+	// complete within the socket's configured timeout.
+	ErrTimeout = errors.New("gomq: operation timed out")
+
+	// ErrHostUnreachable is returned by SendToPeer when the
+	// socket has no connection with the given ConnID.
+	ErrHostUnreachable = errors.New("gomq: host unreachable")
+
+	// ErrTooManyHandshakes is the error a handshake fails
+	// with when its connection was closed to make room for a
+	// newer one; see WithMaxHandshakes.
+	ErrTooManyHandshakes = errors.New("gomq: too many handshakes in progress")
+
+	// ErrWouldBlock is returned by SendDontWait, and by
+	// SendOpts with DontWait set, when none of the
+	// socket's connections can take a message without
+	// waiting.
+	ErrWouldBlock = errors.New("gomq: operation would block")
+
+	// ErrAutoRead is returned by Connection.ReadMessage on
+	// a socket that reads its connections itself; see
+	// WithManualRead.
+	ErrAutoRead = errors.New("gomq: connection is read by its socket")
+
+	// ErrHeartbeatTimeout is the error a connection is torn
+	// down with when its peer stopped answering heartbeats.
+	ErrHeartbeatTimeout = errors.New("gomq: heartbeat timed out")
+
+	// ErrReadIdle is wrapped by the error a connection is
+	// torn down with when nothing was read from it within
+	// the read idle timeout; see WithReadIdleTimeout.
+	ErrReadIdle = errors.New("gomq: nothing read within the idle timeout")
+
+	// ErrWriteTimeout is wrapped by the error a connection
+	// is torn down with when a write to it did not complete
+	// within the write timeout; see WithWriteTimeout.
+	ErrWriteTimeout = errors.New("gomq: write timed out")
+
+	// ErrUnexpectedMessage is the error a connection of a
+	// send-only socket is torn down with when its peer sent
+	// it a message; see WithStrictSendOnly.
+	ErrUnexpectedMessage = errors.New("gomq: message sent to a send-only socket")
+
+	// ErrInterceptorPanic is wrapped by the error a
+	// connection is torn down with when the receive
+	// interceptor panicked on one of its messages; see
+	// SetRecvInterceptor.
+	ErrInterceptorPanic = errors.New("gomq: receive interceptor panicked")
+
+	// ErrMultipart is returned by SendOpts when asked to
+	// send part of a multipart message, which CLIENT and
+	// SERVER sockets do not support.
+	ErrMultipart = errors.New("gomq: multipart messages are not supported")
+
+	// ErrReconnectAborted is returned by Connect when the
+	// reconnect hook stopped it from retrying; see
+	// SetReconnectHook.
+	ErrReconnectAborted = errors.New("gomq: reconnect aborted by hook")
+
+	// ErrBufferTooSmall is wrapped by the *BufferTooSmallError
+	// RecvInto returns for a message larger than its buffer.
+	ErrBufferTooSmall = errors.New("gomq: buffer too small")
+
+	// ErrUnknownSocketType is wrapped by the error New
+	// returns for a socket type gomq does not support.
+	ErrUnknownSocketType = errors.New("gomq: unknown socket type")
+
+	// ErrNotSupported is wrapped by the *UnsupportedError
+	// returned for sending on a socket whose type does not
+	// send, or receiving on one whose type does not receive.
+	ErrNotSupported = errors.New("gomq: operation not supported by the socket type")
+
+	// ErrInvalidOptions is wrapped by the *OptionsError
+	// Validate, Connect and Bind return for a socket whose
+	// options conflict or do not apply to its type.
+	ErrInvalidOptions = errors.New("gomq: invalid socket options")
+)
+
+// CloseError is returned by CloseWithTimeout when it had
+// to close connections that were still writing out queued
+// messages.
+type CloseError struct {
+	// Endpoints holds the endpoint of each connection that
+	// was closed before it finished.
+	Endpoints []string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("gomq: closed %d connections before they finished sending: %s", len(e.Endpoints), strings.Join(e.Endpoints, ", "))
+}
+
+// Unwrap returns ErrTimeout.
+func (e *CloseError) Unwrap() error {
+	return ErrTimeout
+}
+
+// UnsupportedError is returned by the send methods of a
+// socket whose type never sends, such as PULL, and by the
+// receive methods of one whose type never receives, such as
+// PUSH.
+type UnsupportedError struct {
+	// SocketType is the type of the socket.
+	SocketType zmtp.SocketType
+
+	// Op is "send" or "receive".
+	Op string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("gomq: %s sockets do not %s", e.SocketType, e.Op)
+}
+
+// Unwrap returns ErrNotSupported.
+func (e *UnsupportedError) Unwrap() error {
+	return ErrNotSupported
+}
+
+// BufferTooSmallError is returned by RecvInto when the next
+// message does not fit the buffer it was given.
+type BufferTooSmallError struct {
+	// Size is the length of the message.
+	Size int
+}
+
+func (e *BufferTooSmallError) Error() string {
+	return fmt.Sprintf("gomq: buffer too small for a %d byte message", e.Size)
+}
+
+// Unwrap returns ErrBufferTooSmall.
+func (e *BufferTooSmallError) Unwrap() error {
+	return ErrBufferTooSmall
+}
@@ -0,0 +1,144 @@
+package gomq
+
+import "net"
+
+// EventType identifies what happened on a socket.
+type EventType int
+
+const (
+	// EventConnected is emitted when a connection to an
+	// endpoint has completed its handshake.
+	EventConnected EventType = iota
+
+	// EventConnectRetried is emitted when dialing an endpoint
+	// failed and will be retried after the retry interval.
+	EventConnectRetried
+
+	// EventAccepted is emitted when a connection accepted
+	// on a bound endpoint has completed its handshake.
+	EventAccepted
+
+	// EventAcceptRetried is emitted when accepting on a bound
+	// endpoint failed temporarily, for example because the
+	// process ran out of file descriptors. Accepting resumes
+	// after a backoff.
+	EventAcceptRetried
+
+	// EventListenerFailed is emitted when the listener of a
+	// bound endpoint failed and the socket is trying to
+	// listen on the endpoint again.
+	EventListenerFailed
+
+	// EventListening is emitted when the socket is listening
+	// on a bound endpoint again after its listener failed.
+	EventListening
+
+	// EventDisconnected is emitted when a connection failed
+	// and was removed from the socket. Connections to dialed
+	// endpoints are re-established in the background.
+	EventDisconnected
+
+	// EventHandshakeFailed is emitted when the ZMTP handshake
+	// with a peer failed.
+	EventHandshakeFailed
+
+	// EventHeartbeatTimeout is emitted when a connection is
+	// torn down because nothing was received on it within the
+	// heartbeat timeout (see WithHeartbeat). It is followed by
+	// EventDisconnected.
+	EventHeartbeatTimeout
+
+	// EventAcceptRejected is emitted when a bound socket at
+	// its connection limit closed a connection it accepted
+	// (see WithMaxConnections).
+	EventAcceptRejected
+
+	// EventDropped is emitted when the HWMDrop policy
+	// discards a message after messages were going through,
+	// so a run of drops is reported once. Endpoint and Addr
+	// describe the connection the first message was meant
+	// for; see Socket.Dropped for the count.
+	EventDropped
+
+	// EventAcceptPaused and EventAcceptResumed are emitted
+	// when a bound endpoint stops and starts accepting again
+	// because of the socket's inbound backlog (see
+	// WithAcceptBackpressure).
+	EventAcceptPaused
+	EventAcceptResumed
+
+	// EventPeerDeparted is emitted when a connection whose
+	// peer announced it was closing (see
+	// WithDisconnectCommand) is removed from the socket, so
+	// a clean close can be told from a crash. It is followed
+	// by EventDisconnected.
+	EventPeerDeparted
+
+	// EventThrottled is emitted when a connection stops being
+	// read for a while because its peer sent faster than its
+	// rate limit (see WithInboundRateLimit). A run of
+	// throttled messages is reported once.
+	EventThrottled
+
+	// EventBindDegraded is emitted when a TCP endpoint bound
+	// to "*" listens on only one address family because the
+	// other could not be listened on (see IPDualStack). Err
+	// is why.
+	EventBindDegraded
+)
+
+var eventTypeNames = map[EventType]string{
+	EventConnected:        "connected",
+	EventConnectRetried:   "connect retried",
+	EventAccepted:         "accepted",
+	EventAcceptRetried:    "accept retried",
+	EventListenerFailed:   "listener failed",
+	EventListening:        "listening",
+	EventDisconnected:     "disconnected",
+	EventHandshakeFailed:  "handshake failed",
+	EventHeartbeatTimeout: "heartbeat timeout",
+	EventAcceptRejected:   "accept rejected",
+	EventDropped:          "dropped",
+	EventAcceptPaused:     "accept paused",
+	EventAcceptResumed:    "accept resumed",
+	EventPeerDeparted:     "peer departed",
+	EventThrottled:        "throttled",
+	EventBindDegraded:     "bind degraded",
+}
+
+// String returns a human readable name for the event type.
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Event describes something that happened on a socket.
+// Events are delivered to the channel configured with
+// WithMonitor.
+type Event struct {
+	Type EventType
+
+	// Endpoint is the endpoint the event relates to.
+	Endpoint string
+
+	// Addr is the remote address of the peer, if known.
+	Addr net.Addr
+
+	// Err is the error that caused the event, if any.
+	Err error
+}
+
+// emit delivers ev to the socket's monitor channel without
+// blocking. Events are dropped if the channel is full.
+func (s *Socket) emit(ev Event) {
+	if s.monitor == nil {
+		return
+	}
+
+	select {
+	case s.monitor <- ev:
+	default:
+	}
+}
@@ -0,0 +1,46 @@
+package gomq
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// keptFDs holds the files of the inherited descriptors bound
+// WithKeepFDs, by descriptor. Holding on to them stops the
+// garbage collector from closing the descriptors behind the
+// program's back.
+var keptFDs = struct {
+	sync.Mutex
+	m map[uintptr]*os.File
+}{m: make(map[uintptr]*os.File)}
+
+// listenFD returns a listener for the inherited listening
+// socket with the given descriptor, as handed over by systemd
+// socket activation. net.FileListener works on a duplicate of
+// the descriptor; unless keep is set the original is closed,
+// so that closing the listener releases the socket.
+func listenFD(address string, keep bool) (net.Listener, error) {
+	n, err := strconv.ParseUint(address, 10, 0)
+	if err != nil {
+		return nil, err
+	}
+	fd := uintptr(n)
+
+	if !keep {
+		f := os.NewFile(fd, "fd://"+address)
+		defer f.Close()
+		return net.FileListener(f)
+	}
+
+	keptFDs.Lock()
+	defer keptFDs.Unlock()
+
+	f, ok := keptFDs.m[fd]
+	if !ok {
+		f = os.NewFile(fd, "fd://"+address)
+		keptFDs.m[fd] = f
+	}
+	return net.FileListener(f)
+}
@@ -0,0 +1,110 @@
+//go:build unix
+
+package gomq
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// inheritFD returns a listening descriptor of the given network
+// the way a process started by systemd would inherit it, and
+// the address it listens on.
+func inheritFD(t *testing.T, network, address string) (int, string) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+
+	f, err := ln.(interface{ File() (*os.File, error) }).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	f.Close()
+	ln.Close()
+
+	return fd, addr
+}
+
+func TestBindFD(t *testing.T) {
+	for _, tc := range []struct {
+		network, address, transport string
+		keep                        bool
+	}{
+		{"tcp", "127.0.0.1:0", "tcp", false},
+		{"unix", t.TempDir() + "/gomq.sock", "ipc", true},
+	} {
+		fd, addr := inheritFD(t, tc.network, tc.address)
+
+		var opts []SocketOption
+		if tc.keep {
+			opts = append(opts, WithKeepFDs())
+		}
+		server := NewServer(zmtp.NewSecurityNull(), opts...)
+
+		bound, err := server.Bind(fmt.Sprintf("fd://%d", fd))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := addr, bound.String(); want != got {
+			t.Errorf("want %q, got %q", want, got)
+		}
+
+		client := NewClient(zmtp.NewSecurityNull())
+		if err := client.Connect(tc.transport + "://" + addr); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.Send([]byte("HELLO")); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := server.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := "HELLO", string(msg); want != got {
+			t.Errorf("want %q, got %q", want, got)
+		}
+
+		client.Close()
+		server.Close()
+
+		var st syscall.Stat_t
+		err = syscall.Fstat(fd, &st)
+		if tc.keep {
+			if err != nil {
+				t.Errorf("want the kept descriptor open, got %v", err)
+			}
+
+			keptFDs.Lock()
+			keptFDs.m[uintptr(fd)].Close()
+			delete(keptFDs.m, uintptr(fd))
+			keptFDs.Unlock()
+		} else if err != syscall.EBADF {
+			t.Errorf("want the descriptor closed, got %v", err)
+		}
+	}
+}
+
+func TestConnectFD(t *testing.T) {
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+
+	if err := client.Connect("fd://3"); err == nil {
+		t.Errorf("want an error connecting to an fd endpoint")
+	}
+}
@@ -1,35 +1,432 @@
 package gomq
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zeromq/gomq/zmtp"
 )
 
 var (
-	defaultRetry = 250 * time.Millisecond
+	defaultRetry         = 250 * time.Millisecond
+	defaultLinger        = time.Duration(-1)
+	defaultSendTimeout   = time.Duration(-1)
+	defaultSendQueueSize = 1000
+	defaultRecvQueueSize = 1000
+
+	// maxWriteBatch is the most queued messages a connection's
+	// writer hands to a single write.
+	maxWriteBatch = 64
 )
 
+// disconnectCommand is the command a socket created
+// WithDisconnectCommand sends before it closes a connection.
+const disconnectCommand = "DISCONNECT"
+
+// errStopped is returned by Connection.send when the
+// connection is closing or its writer has failed, so that
+// the message has to go to another connection.
+var errStopped = errors.New("gomq: connection stopped")
+
+// outbound is a message on a connection's send queue.
+// expires is when it is to be discarded unless written by
+// then, in Unix nanoseconds, if it has a send TTL (see
+// WithSendTTL and SendOptions.TTL).
+type outbound struct {
+	msg     []byte
+	expires int64
+}
+
 // Connection is a gomq connection. It holds
 // both the net.Conn transport as well as the
 // zmtp connection information.
 type Connection struct {
 	net  net.Conn
 	zmtp *zmtp.Connection
+
+	id       string
+	endpoint string
+	dialer   *dialer
+	socket   *Socket
+	clock    zmtp.Clock
+
+	// accepted is set on connections accepted on a bound
+	// endpoint, which count towards the connection limit.
+	accepted bool
+
+	sendQueue  chan outbound
+	senders    sync.RWMutex
+	full       int32
+	sendRoom   chan struct{}
+	closing    chan struct{}
+	closeOnce  sync.Once
+	writerDone chan struct{}
+	writeErr   error
+
+	// lastRecv is the time, in Unix nanoseconds, anything was
+	// last received on the connection and rtt the round trip
+	// time measured by the last heartbeat. Both are accessed
+	// atomically.
+	lastRecv int64
+	rtt      int64
+	pinging  int32
+
+	// queuedBytes is what the messages on sendQueue count
+	// for towards sendLimit, the socket's
+	// WithSendBufferBytes. It is accessed atomically.
+	queuedBytes int64
+	sendLimit   int64
+
+	// dropped counts the messages for this connection the
+	// HWMDrop policy discarded and expired those the writer
+	// discarded for outliving sendTTL. Both are accessed
+	// atomically.
+	dropped uint64
+	expired uint64
+	sendTTL time.Duration
+
+	// announce is set if the connection is to send
+	// disconnectCommand when it is closed gracefully, and
+	// announced once it has. departed is set once the peer
+	// sent it. Both announced and departed are accessed
+	// atomically.
+	announce  bool
+	announced int32
+	departed  int32
+
+	// limiter enforces the connection's inbound rate limit,
+	// if it has one, and throttled counts how many times it
+	// held off reading. throttled is accessed atomically.
+	limiter   *rateLimiter
+	throttled uint64
+
+	values connValues
+
+	// epoch is the number of the connection among those its
+	// dialer made, and recvSeq the sequence number of the
+	// last message read from it. recvSeq is accessed
+	// atomically.
+	epoch   uint64
+	recvSeq uint64
+
+	// claimed is set while a Receiver has the connection, and
+	// parked counts its messages put aside, waiting to be
+	// received ahead of those still queued. nextOrder is the
+	// order of the next message from the connection to be
+	// received; all three are guarded by the socket's lock.
+	// queuedOrder is that of the next message to be queued,
+	// and only used by the connection's reader.
+	claimed     bool
+	parked      int
+	nextOrder   uint64
+	queuedOrder uint64
 }
 
 // NewConnection accepts a net.Conn, a *zmtp.Connection
 // and returns a *gomq.Connection.
 func NewConnection(netConn net.Conn, zmtpConn *zmtp.Connection) *Connection {
 	conn := &Connection{
-		net:  netConn,
-		zmtp: zmtpConn,
+		net:        netConn,
+		zmtp:       zmtpConn,
+		sendQueue:  make(chan outbound, defaultSendQueueSize),
+		sendRoom:   make(chan struct{}, 1),
+		closing:    make(chan struct{}),
+		writerDone: make(chan struct{}),
+		lastRecv:   time.Now().UnixNano(),
+		clock:      zmtp.RealClock{},
 	}
 	return conn
 }
 
+// send queues a message for the connection's writer. It
+// returns ErrTimeout if the queue is still full, by count or
+// by bytes, when timeout fires; a nil timeout waits
+// indefinitely. With the HWMDrop policy a full queue
+// discards the message instead and send returns errDropped.
+// A connection that is closing or has failed takes no more
+// messages and returns errStopped. A ttl of zero gives the
+// message the connection's send TTL.
+func (c *Connection) send(b []byte, ttl time.Duration, policy HWMPolicy, timeout <-chan time.Time) error {
+	for !c.reserve(b) {
+		if policy == HWMDrop {
+			return errDropped
+		}
+		select {
+		case <-c.sendRoom:
+		case <-c.closing:
+			return errStopped
+		case <-c.writerDone:
+			return errStopped
+		case <-timeout:
+			return ErrTimeout
+		}
+	}
+
+	c.senders.RLock()
+	defer c.senders.RUnlock()
+	if c.isStopping() {
+		c.unreserve(b)
+		return errStopped
+	}
+
+	if policy == HWMDrop {
+		select {
+		case c.sendQueue <- c.outbound(b, ttl):
+			return nil
+		default:
+			c.unreserve(b)
+			return errDropped
+		}
+	}
+
+	select {
+	case c.sendQueue <- c.outbound(b, ttl):
+		return nil
+	case <-c.closing:
+		c.unreserve(b)
+		return errStopped
+	case <-c.writerDone:
+		c.unreserve(b)
+		return errStopped
+	case <-timeout:
+		c.unreserve(b)
+		return ErrTimeout
+	}
+}
+
+// trySend queues a message for the connection's writer if
+// there is room in the queue, without waiting.
+func (c *Connection) trySend(b []byte, ttl time.Duration) bool {
+	c.senders.RLock()
+	defer c.senders.RUnlock()
+	if c.isStopping() {
+		return false
+	}
+
+	if !c.reserve(b) {
+		return false
+	}
+	select {
+	case c.sendQueue <- c.outbound(b, ttl):
+		return true
+	default:
+		c.unreserve(b)
+		return false
+	}
+}
+
+// isStopping reports whether the connection is closing or its
+// writer has stopped, so that it must take no more messages.
+func (c *Connection) isStopping() bool {
+	select {
+	case <-c.closing:
+		return true
+	case <-c.writerDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// tryQueue is trySend for the send scheduler. A connection
+// whose queue was found full is passed over until the queue
+// drains below half the high water mark, so that a slow
+// peer does not take turns again as soon as one message
+// leaves its queue. full is accessed atomically.
+func (c *Connection) tryQueue(b []byte, ttl time.Duration) bool {
+	if atomic.LoadInt32(&c.full) != 0 {
+		if c.aboveLowWater() {
+			return false
+		}
+		atomic.StoreInt32(&c.full, 0)
+	}
+
+	if c.trySend(b, ttl) {
+		return true
+	}
+	atomic.StoreInt32(&c.full, 1)
+	return false
+}
+
+// writer writes queued messages to the wire until the
+// connection is closed and the queue has been drained,
+// or until a write fails, in which case it returns the
+// write error. A panic while writing is recovered and
+// returned as an error.
+func (c *Connection) writer() (err error) {
+	defer close(c.writerDone)
+	defer func() {
+		if r := recover(); r != nil {
+			c.writeErr = fmt.Errorf("gomq: connection writer panicked: %v", r)
+		}
+		err = c.writeErr
+	}()
+
+	batch := make([]outbound, 0, maxWriteBatch)
+	frames := make([][]byte, 0, maxWriteBatch)
+	for {
+		select {
+		case m := <-c.sendQueue:
+			if c.writeErr = c.writeBatch(append(batch, m), frames); c.writeErr != nil {
+				return c.writeErr
+			}
+		case <-c.closing:
+			// Senders that got hold of the connection before
+			// it started closing finish queueing their
+			// messages, or give up, before the queue is
+			// drained, so that none is left behind in it.
+			c.senders.Lock()
+			c.senders.Unlock()
+			for {
+				select {
+				case m := <-c.sendQueue:
+					if c.writeErr = c.writeBatch(append(batch, m), frames); c.writeErr != nil {
+						return c.writeErr
+					}
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// writeBatch tops batch up with whatever else is queued, up to
+// its capacity, and writes the messages that have not expired
+// to the wire in one go, using frames, which must be empty, to
+// hold them.
+func (c *Connection) writeBatch(batch []outbound, frames [][]byte) error {
+	// The writer is the queue's only reader, so this never blocks.
+	for len(batch) < cap(batch) && len(c.sendQueue) > 0 {
+		batch = append(batch, <-c.sendQueue)
+	}
+	c.dequeued(batch)
+
+	frames = c.unexpired(batch, frames)
+	clear(batch)
+	if len(frames) == 0 {
+		return nil
+	}
+
+	err := c.zmtp.SendFrames(frames...)
+	if err == nil {
+		c.socket.sent(frames)
+	}
+	clear(frames)
+	return err
+}
+
+// close stops accepting new messages, waits up to linger for
+// the writer to drain the send queue and closes the transport.
+// A negative linger waits until the queue is drained. Calling
+// close again with a shorter linger cuts a pending wait short.
+// It reports whether the writer had finished by the time the
+// transport was closed.
+func (c *Connection) close(linger time.Duration) bool {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+	})
+	deadline := c.clock.Now().Add(linger)
+
+	switch {
+	case linger < 0:
+		<-c.writerDone
+	case linger > 0:
+		timer := c.clock.NewTimer(linger)
+		select {
+		case <-c.writerDone:
+		case <-timer.C():
+		}
+		timer.Stop()
+	}
+
+	var finished bool
+	select {
+	case <-c.writerDone:
+		finished = true
+	default:
+	}
+
+	if finished && c.announce && linger != 0 && atomic.CompareAndSwapInt32(&c.announced, 0, 1) {
+		if linger < 0 {
+			c.zmtp.SendCommand(disconnectCommand, nil)
+		} else {
+			c.announceWithin(deadline.Sub(c.clock.Now()))
+		}
+	}
+
+	c.net.Close()
+	return finished
+}
+
+// announceWithin sends disconnectCommand, giving up after
+// timeout. The write it may leave behind fails once the
+// transport is closed.
+func (c *Connection) announceWithin(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		c.zmtp.SendCommand(disconnectCommand, nil)
+		close(sent)
+	}()
+
+	timer := c.clock.NewTimer(timeout)
+	select {
+	case <-sent:
+	case <-timer.C():
+	}
+	timer.Stop()
+}
+
+// idle reports whether the connection has no queued
+// outbound messages.
+func (c *Connection) idle() bool {
+	return len(c.sendQueue) == 0
+}
+
+// Negotiated returns the ZMTP version, security mechanism and peer
+// socket type agreed on during the connection's handshake.
+func (c *Connection) Negotiated() (zmtp.Negotiated, bool) {
+	return c.zmtp.Negotiated()
+}
+
+// ReadMessage reads the connection's next message on a socket
+// created WithManualRead, blocking until one arrives. Heartbeat
+// commands are answered and absorbed on the way. A read error
+// tears the connection down, as it would on a socket reading
+// its connections itself, and is returned; nothing more can be
+// read after that. ReadMessage returns ErrAutoRead if the
+// socket reads the connection itself.
+func (c *Connection) ReadMessage() (*zmtp.Message, error) {
+	if c.socket == nil || c.socket.manualRead == nil {
+		return nil, ErrAutoRead
+	}
+	return c.socket.readNext(c)
+}
+
+// NetConn returns the connection's transport, for instance to
+// watch it for readiness. Reading from or writing to it directly
+// corrupts the ZMTP stream.
+func (c *Connection) NetConn() net.Conn {
+	return c.net
+}
+
+// Buffered returns the number of bytes already read from the
+// transport but not yet consumed by ReadMessage. An event loop
+// waiting for the transport to become readable should drain
+// these first.
+func (c *Connection) Buffered() int {
+	return c.zmtp.Buffered()
+}
+
 // ZeroMQSocket is the base gomq interface.
 type ZeroMQSocket interface {
 	Recv() ([]byte, error)
@@ -43,41 +440,47 @@ type ZeroMQSocket interface {
 	Close()
 }
 
+// baser is implemented by the sockets of this package, which
+// are all built on a Socket.
+type baser interface {
+	base() *Socket
+}
+
+// socketOf returns the Socket s is built on, or an error
+// wrapping ErrNotSupported if s is not one of this package's
+// sockets.
+func socketOf(s ZeroMQSocket) (*Socket, error) {
+	b, ok := s.(baser)
+	if !ok {
+		return nil, fmt.Errorf("gomq: %T is not a gomq socket: %w", s, ErrNotSupported)
+	}
+	return b.base(), nil
+}
+
 // Client is a gomq interface used for client sockets.
 // It implements the Socket interface along with a
 // Connect method for connecting to endpoints.
 type Client interface {
 	ZeroMQSocket
 	Connect(endpoint string) error
+	ConnectContext(ctx context.Context, endpoint string) error
+	ConnectAsync(endpoint string) error
+	ConnectAny(endpoints []string) error
 }
 
 // ConnectClient accepts a Client interface and an endpoint
 // in the format <proto>://<address>:<port>. It then attempts
-// to connect to the endpoint and perform a ZMTP handshake.
+// to connect to the endpoint and perform a ZMTP handshake,
+// retrying the dial until the endpoint is reachable. It is
+// ConnectAsync followed by waiting for the first attempt.
+// c must be one of this package's sockets: for others it
+// returns an error wrapping ErrNotSupported.
 func ConnectClient(c Client, endpoint string) error {
-	parts := strings.Split(endpoint, "://")
-
-Connect:
-	netConn, err := net.Dial(parts[0], parts[1])
-	if err != nil {
-		time.Sleep(c.RetryInterval())
-		goto Connect
-	}
-
-	zmtpConn := zmtp.NewConnection(netConn)
-	_, err = zmtpConn.Prepare(c.SecurityMechanism(), c.SocketType(), false, nil)
+	s, err := socketOf(c)
 	if err != nil {
 		return err
 	}
-
-	conn := &Connection{
-		net:  netConn,
-		zmtp: zmtpConn,
-	}
-
-	c.AddConnection(conn)
-	zmtpConn.Recv(c.RecvChannel())
-	return nil
+	return s.connect(context.Background(), endpoint)
 }
 
 // Server is a gomq interface used for server sockets.
@@ -86,39 +489,20 @@ Connect:
 type Server interface {
 	ZeroMQSocket
 	Bind(endpoint string) (net.Addr, error)
+	BindContext(ctx context.Context, endpoint string) (net.Addr, error)
+	Shutdown(ctx context.Context) error
 }
 
 // BindServer accepts a Server interface and an endpoint
-// in the format <proto>://<address>:<port>. It then attempts
-// to bind to the endpoint. TODO: change this to starting
-// a listener on the endpoint that performs handshakes
-// with any client that connects
+// in the format <proto>://<address>:<port>. It then starts
+// listening on the endpoint and returns the address it is
+// bound to. Clients that connect are handshaked and added
+// to the socket in the background until the socket is closed.
+// Like ConnectClient, it only takes this package's sockets.
 func BindServer(s Server, endpoint string) (net.Addr, error) {
-	var addr net.Addr
-	parts := strings.Split(endpoint, "://")
-
-	ln, err := net.Listen(parts[0], parts[1])
-	if err != nil {
-		return addr, err
-	}
-
-	netConn, err := ln.Accept()
-	if err != nil {
-		return addr, err
-	}
-
-	zmtpConn := zmtp.NewConnection(netConn)
-	_, err = zmtpConn.Prepare(s.SecurityMechanism(), s.SocketType(), true, nil)
+	socket, err := socketOf(s)
 	if err != nil {
-		return netConn.LocalAddr(), err
-	}
-
-	conn := &Connection{
-		net:  netConn,
-		zmtp: zmtpConn,
+		return nil, err
 	}
-
-	s.AddConnection(conn)
-	zmtpConn.Recv(s.RecvChannel())
-	return netConn.LocalAddr(), nil
+	return socket.bind(context.Background(), endpoint)
 }
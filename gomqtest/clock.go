@@ -0,0 +1,163 @@
+package gomqtest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// FakeClock is a zmtp.Clock whose time stands still until
+// Advance moves it on, for testing backoff, heartbeats and
+// timeouts without waiting for them. Give it to sockets with
+// gomq.WithClock. It is safe for use by several goroutines.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+
+	// changed is closed, and replaced, whenever a timer is
+	// set or stopped, for BlockUntil.
+	changed chan struct{}
+}
+
+// NewFakeClock returns a FakeClock that reads start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start, changed: make(chan struct{})}
+}
+
+// Now returns the clock's time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer returns a timer that fires once the clock has been
+// advanced by d.
+func (c *FakeClock) NewTimer(d time.Duration) zmtp.Timer {
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// After returns the channel of a new timer for d.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// Advance moves the clock on by d, firing the timers that
+// come due on the way in the order they do, each with the
+// time it was due at. Like a time.Timer, a timer whose
+// channel is still full when it fires again loses the tick.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		c.now = next.when
+		c.removeLocked(next)
+		select {
+		case next.c <- c.now:
+		default:
+		}
+	}
+	c.now = end
+}
+
+// Timers returns how many timers are waiting to fire.
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil waits for at least n timers to be waiting to
+// fire, so that a test can tell that the code it drives is
+// waiting on the clock before advancing it. It returns
+// ctx.Err() if ctx is done first.
+func (c *FakeClock) BlockUntil(ctx context.Context, n int) error {
+	for {
+		c.mu.Lock()
+		waiting, changed := len(c.timers), c.changed
+		c.mu.Unlock()
+		if waiting >= n {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// removeLocked stops t, reporting whether it was waiting to
+// fire. The caller holds c.mu.
+func (c *FakeClock) removeLocked(t *fakeTimer) bool {
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			c.changedLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// changedLocked wakes BlockUntil. The caller holds c.mu.
+func (c *FakeClock) changedLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// fakeTimer is a timer of a FakeClock. when is guarded by
+// the clock's lock.
+type fakeTimer struct {
+	clock *FakeClock
+	c     chan time.Time
+	when  time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.removeLocked(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	active := c.removeLocked(t)
+	t.when = c.now.Add(d)
+	if d <= 0 {
+		// As with a time.Timer, the time is already up.
+		select {
+		case t.c <- c.now:
+		default:
+		}
+		return active
+	}
+	c.timers = append(c.timers, t)
+	c.changedLocked()
+	return active
+}
@@ -0,0 +1,299 @@
+package gomqtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// conformanceTimeout bounds each step of RunConformance, so
+// that a transport that loses data fails rather than hangs.
+var conformanceTimeout = 5 * time.Second
+
+// conformanceSizes are the frame lengths RunConformance sends:
+// empty, short, either side of the long frame threshold, and
+// larger than the buffers transports usually have.
+var conformanceSizes = []int{0, 1, 255, 256, 64 << 10, 1 << 20}
+
+// RunConformance checks that a transport carries ZMTP between
+// the two ends of a connection. pair is called for a fresh
+// pair of connected ends for each of a number of subtests,
+// which go through the greeting and NULL handshake, a
+// mechanism mismatch, frames of various lengths, batches of
+// frames, PING and PONG, writes split into single bytes and
+// closing. The ends are closed when each subtest is done.
+//
+// Both ends of a ZMTP connection write before they read, so
+// the transport must buffer writes as network connections do;
+// net.Pipe, for one, does not.
+func RunConformance(t *testing.T, pair func() (net.Conn, net.Conn)) {
+	t.Run("Handshake", func(t *testing.T) {
+		a, b := pair()
+		defer a.Close()
+		defer b.Close()
+
+		metadata := map[string]string{"conformance": "yes"}
+		client, server := prepare(t, a, b, zmtp.NewSecurityNull(), metadata)
+
+		negotiated, ok := server.Negotiated()
+		if !ok {
+			t.Fatal("want the server end to be negotiated")
+		}
+		if want, got := zmtp.ClientSocketType, negotiated.PeerSocketType; want != got {
+			t.Errorf("want peer socket type %v, got %v", want, got)
+		}
+		if want, got := "yes", negotiated.PeerMetadata["conformance"]; want != got {
+			t.Errorf("want metadata %q, got %q", want, got)
+		}
+		if _, ok := client.Negotiated(); !ok {
+			t.Error("want the client end to be negotiated")
+		}
+	})
+
+	t.Run("MechanismMismatch", func(t *testing.T) {
+		a, b := pair()
+		defer a.Close()
+		defer b.Close()
+
+		serverErr := make(chan error, 1)
+		go func() {
+			_, err := zmtp.NewConnection(b).Prepare(&plainOnly{}, zmtp.ServerSocketType, true, nil)
+			serverErr <- err
+		}()
+
+		var clientErr error
+		within(t, "the client handshake", func() {
+			_, clientErr = zmtp.NewConnection(a).Prepare(zmtp.NewSecurityNull(), zmtp.ClientSocketType, false, nil)
+		})
+
+		var mismatch *zmtp.MechanismMismatchError
+		if !errors.As(clientErr, &mismatch) {
+			t.Errorf("want a *zmtp.MechanismMismatchError, got %v", clientErr)
+		}
+		a.Close()
+		within(t, "the server handshake", func() { <-serverErr })
+	})
+
+	t.Run("Frames", func(t *testing.T) {
+		a, b := pair()
+		defer a.Close()
+		defer b.Close()
+
+		client, server := prepare(t, a, b, zmtp.NewSecurityNull(), nil)
+		for _, size := range conformanceSizes {
+			body := pattern(size)
+			sent := make(chan error, 1)
+			go func() { sent <- client.SendFrame(body) }()
+
+			expectFrame(t, server, body)
+			within(t, "the send", func() {
+				if err := <-sent; err != nil {
+					t.Errorf("%d byte frame: %v", size, err)
+				}
+			})
+		}
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		a, b := pair()
+		defer a.Close()
+		defer b.Close()
+
+		client, server := prepare(t, a, b, zmtp.NewSecurityNull(), nil)
+		var bodies [][]byte
+		for _, size := range conformanceSizes {
+			bodies = append(bodies, pattern(size))
+		}
+		sent := make(chan error, 1)
+		go func() { sent <- client.SendFrames(bodies...) }()
+
+		for _, body := range bodies {
+			expectFrame(t, server, body)
+		}
+		within(t, "the send", func() {
+			if err := <-sent; err != nil {
+				t.Error(err)
+			}
+		})
+	})
+
+	t.Run("PingPong", func(t *testing.T) {
+		a, b := pair()
+		defer a.Close()
+		defer b.Close()
+
+		client, server := prepare(t, a, b, zmtp.NewSecurityNull(), nil)
+		context := []byte("conform")
+		go client.SendPing(time.Second, context)
+
+		// The server end answers the PING as it reads it.
+		pinged := make(chan *zmtp.Message, 1)
+		go func() {
+			msg, _ := server.ReadMessage()
+			pinged <- msg
+		}()
+
+		var pong *zmtp.Message
+		var err error
+		within(t, "the PONG", func() {
+			pong, err = client.ReadMessage()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pong.MessageType != zmtp.CommandMessage || pong.Name != "PONG" {
+			t.Fatalf("want a PONG command, got %+v", pong)
+		}
+		if !bytes.Equal(context, pong.Body) {
+			t.Errorf("want PONG context %q, got %q", context, pong.Body)
+		}
+
+		within(t, "the PING", func() {
+			if ping := <-pinged; ping == nil || ping.Name != "PING" {
+				t.Errorf("want a PING command, got %+v", ping)
+			}
+		})
+	})
+
+	t.Run("SplitWrites", func(t *testing.T) {
+		a, b := pair()
+		defer a.Close()
+		defer b.Close()
+
+		// Every write arrives a byte at a time.
+		a = &FaultyConn{Conn: a, WriteChunk: 1}
+		b = &FaultyConn{Conn: b, WriteChunk: 1}
+
+		client, server := prepare(t, a, b, zmtp.NewSecurityNull(), nil)
+		body := pattern(300)
+		go client.SendFrame(body)
+		expectFrame(t, server, body)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		a, b := pair()
+		defer b.Close()
+
+		_, server := prepare(t, a, b, zmtp.NewSecurityNull(), nil)
+		a.Close()
+
+		within(t, "the read to fail", func() {
+			if msg, err := server.ReadMessage(); err == nil {
+				t.Errorf("want an error reading from a closed connection, got %+v", msg)
+			}
+		})
+	})
+}
+
+// plainOnly announces PLAIN in its greeting without
+// implementing it.
+type plainOnly struct {
+	zmtp.SecurityNull
+}
+
+func (plainOnly) Type() zmtp.SecurityMechanismType {
+	return zmtp.PlainSecurityMechanismType
+}
+
+// prepare runs the handshake on both ends at once, a as a
+// CLIENT and b as a SERVER, announcing metadata from a.
+func prepare(t *testing.T, a, b net.Conn, mechanism zmtp.SecurityMechanism, metadata map[string]string) (client, server *zmtp.Connection) {
+	t.Helper()
+
+	server = zmtp.NewConnection(b)
+	serverErr := make(chan error, 1)
+	go func() {
+		_, err := server.Prepare(mechanism, zmtp.ServerSocketType, true, nil)
+		serverErr <- err
+	}()
+
+	client = zmtp.NewConnection(a)
+	var clientErr error
+	within(t, "the handshake", func() {
+		_, clientErr = client.Prepare(mechanism, zmtp.ClientSocketType, false, metadata)
+		if err := <-serverErr; err != nil && clientErr == nil {
+			clientErr = fmt.Errorf("server end: %w", err)
+		}
+	})
+	if clientErr != nil {
+		t.Fatalf("handshake: %v", clientErr)
+	}
+	return client, server
+}
+
+// expectFrame reads a message from conn and fails unless it
+// is a data frame holding want.
+func expectFrame(t *testing.T, conn *zmtp.Connection, want []byte) {
+	t.Helper()
+
+	var msg *zmtp.Message
+	var err error
+	within(t, fmt.Sprintf("a %d byte frame", len(want)), func() {
+		msg, err = conn.ReadMessage()
+	})
+	if err != nil {
+		t.Fatalf("reading a %d byte frame: %v", len(want), err)
+	}
+	if msg.MessageType != zmtp.UserMessage {
+		t.Fatalf("want a data frame, got %+v", msg)
+	}
+	if diff := diffBytes(want, msg.Body); diff != "" {
+		t.Error(diff)
+	}
+}
+
+// diffBytes describes how got differs from want, or returns
+// "" if they are equal.
+func diffBytes(want, got []byte) string {
+	if bytes.Equal(want, got) {
+		return ""
+	}
+
+	i := 0
+	for i < len(want) && i < len(got) && want[i] == got[i] {
+		i++
+	}
+	return fmt.Sprintf("want a %d byte frame, got %d bytes, first differing at offset %d: want %q, got %q",
+		len(want), len(got), i, excerpt(want, i), excerpt(got, i))
+}
+
+// excerpt returns up to 16 bytes of b from offset i.
+func excerpt(b []byte, i int) []byte {
+	if i >= len(b) {
+		return nil
+	}
+	return b[i:min(i+16, len(b))]
+}
+
+// pattern returns n bytes that do not repeat with a short
+// period, so that lost or reordered chunks show up.
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i ^ i>>8 ^ i>>16)
+	}
+	return b
+}
+
+// within runs f and fails the test if it does not return
+// within conformanceTimeout.
+func within(t *testing.T, what string, f func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(conformanceTimeout):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
@@ -0,0 +1,218 @@
+// Package gomqtest provides helpers for testing code built on
+// gomq without real network ports.
+package gomqtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zeromq/gomq"
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// handshakeTimeout bounds how long the helpers wait for a
+// pair of sockets to handshake.
+var handshakeTimeout = 5 * time.Second
+
+// pairs numbers the mem endpoints bound by NewConnectedPair.
+var pairs int64
+
+// NewConnectedPair returns a client and a server socket of the
+// given types, connected over a fresh mem:// endpoint and done
+// with their handshake. The server socket binds and the client
+// connects, so serverType must be a type that can bind. Both
+// sockets are closed when the test ends.
+func NewConnectedPair(t testing.TB, clientType, serverType zmtp.SocketType, opts ...gomq.SocketOption) (client, server gomq.ZeroMQSocket) {
+	t.Helper()
+
+	client = newSocket(t, clientType, opts)
+	server = newSocket(t, serverType, opts)
+
+	b, ok := server.(interface {
+		Bind(endpoint string) (net.Addr, error)
+	})
+	if !ok {
+		t.Fatalf("gomqtest: a %s socket cannot bind", serverType)
+	}
+	c, ok := client.(interface {
+		Connect(endpoint string) error
+	})
+	if !ok {
+		t.Fatalf("gomqtest: a %s socket cannot connect", clientType)
+	}
+
+	endpoint := fmt.Sprintf("mem://gomqtest-%d", atomic.AddInt64(&pairs, 1))
+	if _, err := b.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForPeer(t, client, server)
+	return client, server
+}
+
+// NewFaultyPair is like NewConnectedPair, but connects the
+// sockets over a gomq.MemPipe whose client end is passed
+// through wrap first, typically to wrap it in a FaultyConn.
+// Faults on the client end affect both directions, since the
+// client's reads are the server's writes. The handshake runs
+// over the wrapped connection too.
+func NewFaultyPair(t testing.TB, clientType, serverType zmtp.SocketType, wrap func(net.Conn) net.Conn, opts ...gomq.SocketOption) (client, server gomq.ZeroMQSocket) {
+	t.Helper()
+
+	client = newSocket(t, clientType, opts)
+	server = newSocket(t, serverType, opts)
+
+	clientEnd, serverEnd := gomq.MemPipe()
+	if wrap != nil {
+		clientEnd = wrap(clientEnd)
+	}
+
+	errs := make(chan error, 2)
+	for _, end := range []struct {
+		socket   gomq.ZeroMQSocket
+		netConn  net.Conn
+		asServer bool
+	}{
+		{client, clientEnd, false},
+		{server, serverEnd, true},
+	} {
+		end := end
+		go func() {
+			zmtpConn := zmtp.NewConnection(end.netConn)
+			_, err := zmtpConn.Prepare(zmtp.NewSecurityNull(), end.socket.SocketType(), end.asServer, nil)
+			if err == nil {
+				end.socket.AddConnection(gomq.NewConnection(end.netConn, zmtpConn))
+			}
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			clientEnd.Close()
+			t.Fatalf("gomqtest: handshake: %v", err)
+		}
+	}
+
+	waitForPeer(t, client, server)
+	return client, server
+}
+
+// newSocket returns a socket of the given type using the NULL
+// security mechanism, to be closed when the test ends.
+func newSocket(t testing.TB, sockType zmtp.SocketType, opts []gomq.SocketOption) gomq.ZeroMQSocket {
+	t.Helper()
+
+	s, err := gomq.New(sockType, zmtp.NewSecurityNull(), opts...)
+	if err != nil {
+		t.Fatalf("gomqtest: %v", err)
+	}
+
+	t.Cleanup(s.Close)
+	return s
+}
+
+// waitForPeer waits for both sockets to see each other.
+func waitForPeer(t testing.TB, sockets ...gomq.ZeroMQSocket) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+
+	for _, s := range sockets {
+		waiter, ok := s.(interface {
+			WaitForPeers(ctx context.Context, n int) error
+		})
+		if !ok {
+			t.Fatalf("gomqtest: %T cannot wait for peers", s)
+		}
+		if err := waiter.WaitForPeers(ctx, 1); err != nil {
+			t.Fatalf("gomqtest: waiting for %s peer: %v", s.SocketType(), err)
+		}
+	}
+}
+
+// FaultyConn wraps a net.Conn and injects faults into it, for
+// exercising error paths. The zero value of each field injects
+// no fault. The fields must not be changed once the connection
+// is in use.
+type FaultyConn struct {
+	net.Conn
+
+	// ReadDelay and WriteDelay are slept before every Read
+	// and Write.
+	ReadDelay  time.Duration
+	WriteDelay time.Duration
+
+	// WriteChunk, if positive, splits every Write into
+	// writes of at most that many bytes to the underlying
+	// connection.
+	WriteChunk int
+
+	// CloseAfter, if positive, closes the connection once
+	// that many bytes have been written through it. The
+	// Write that crosses the limit is cut short and returns
+	// io.ErrClosedPipe.
+	CloseAfter int
+
+	mu      sync.Mutex
+	written int
+}
+
+// Read sleeps for ReadDelay and reads from the underlying
+// connection.
+func (c *FaultyConn) Read(p []byte) (int, error) {
+	if c.ReadDelay > 0 {
+		time.Sleep(c.ReadDelay)
+	}
+	return c.Conn.Read(p)
+}
+
+// Write sleeps for WriteDelay and writes p to the underlying
+// connection, applying WriteChunk and CloseAfter.
+func (c *FaultyConn) Write(p []byte) (int, error) {
+	if c.WriteDelay > 0 {
+		time.Sleep(c.WriteDelay)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		chunk := p[n:]
+		if c.WriteChunk > 0 && len(chunk) > c.WriteChunk {
+			chunk = chunk[:c.WriteChunk]
+		}
+		if c.CloseAfter > 0 {
+			if c.written >= c.CloseAfter {
+				c.Conn.Close()
+				return n, io.ErrClosedPipe
+			}
+			if left := c.CloseAfter - c.written; len(chunk) > left {
+				chunk = chunk[:left]
+			}
+		}
+
+		m, err := c.Conn.Write(chunk)
+		n += m
+		c.written += m
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if c.CloseAfter > 0 && c.written >= c.CloseAfter {
+		c.Conn.Close()
+	}
+	return n, nil
+}
@@ -0,0 +1,301 @@
+package gomqtest
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zeromq/gomq"
+	"github.com/zeromq/gomq/zmtp"
+)
+
+func TestNewConnectedPair(t *testing.T) {
+	client, server := NewConnectedPair(t, zmtp.ClientSocketType, zmtp.ServerSocketType)
+
+	if err := client.Send([]byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := server.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "HELLO", string(msg); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if err := server.Send([]byte("WORLD")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err = client.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "WORLD", string(msg); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestNewConnectedPairPushPull(t *testing.T) {
+	push, pull := NewConnectedPair(t, zmtp.PushSocketType, zmtp.PullSocketType)
+
+	if err := push.Send([]byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := pull.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "HELLO", string(msg); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestFaultyConnPartialWrites(t *testing.T) {
+	client, server := NewFaultyPair(t, zmtp.ClientSocketType, zmtp.ServerSocketType, func(conn net.Conn) net.Conn {
+		return &FaultyConn{Conn: conn, ReadDelay: time.Millisecond, WriteChunk: 3}
+	})
+
+	body := bytes.Repeat([]byte("0123456789"), 100)
+	if err := client.Send(body); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := server.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(body, msg) {
+		t.Errorf("want %d bytes, got %d bytes %q", len(body), len(msg), msg)
+	}
+}
+
+func TestFaultyConnCloseAfter(t *testing.T) {
+	client, server := NewFaultyPair(t, zmtp.ClientSocketType, zmtp.ServerSocketType, func(conn net.Conn) net.Conn {
+		return &FaultyConn{Conn: conn, CloseAfter: 4096}
+	})
+
+	if err := client.Send(make([]byte, 1<<16)); err != nil {
+		t.Fatal(err)
+	}
+
+	c, s := client.(*gomq.ClientSocket), server.(*gomq.ServerSocket)
+	deadline := time.Now().Add(5 * time.Second)
+	for c.PeerCount() != 0 || s.PeerCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want no peers after the close, got %d and %d", c.PeerCount(), s.PeerCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	listenerPair := func(t *testing.T, network, address string) func() (net.Conn, net.Conn) {
+		return func() (net.Conn, net.Conn) {
+			ln, err := net.Listen(network, address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				conn, _ := ln.Accept()
+				accepted <- conn
+			}()
+
+			conn, err := net.Dial(network, ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return conn, <-accepted
+		}
+	}
+
+	t.Run("tcp", func(t *testing.T) {
+		RunConformance(t, listenerPair(t, "tcp", "127.0.0.1:0"))
+	})
+	t.Run("unix", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "conformance.sock")
+		pair := listenerPair(t, "unix", path)
+		RunConformance(t, func() (net.Conn, net.Conn) {
+			os.Remove(path)
+			return pair()
+		})
+	})
+	t.Run("mem", func(t *testing.T) {
+		RunConformance(t, gomq.MemPipe)
+	})
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	late := clock.NewTimer(2 * time.Minute)
+	early := clock.NewTimer(time.Minute)
+	stopped := clock.NewTimer(30 * time.Second)
+	if !stopped.Stop() {
+		t.Error("want Stop to stop a pending timer")
+	}
+	if want, got := 2, clock.Timers(); want != got {
+		t.Fatalf("want %d timers, got %d", want, got)
+	}
+
+	clock.Advance(59 * time.Second)
+	select {
+	case <-early.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	// Each timer fires with the time it was due at.
+	clock.Advance(5 * time.Minute)
+	if want, got := start.Add(time.Minute), <-early.C(); !want.Equal(got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if want, got := start.Add(2*time.Minute), <-late.C(); !want.Equal(got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if want, got := start.Add(5*time.Minute+59*time.Second), clock.Now(); !want.Equal(got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	select {
+	case <-stopped.C():
+		t.Error("stopped timer fired")
+	default:
+	}
+
+	expired := clock.After(0)
+	select {
+	case <-expired:
+	default:
+		t.Error("want a timer for no time to fire at once")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := clock.BlockUntil(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("want %v with no timers, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestFakeClockHeartbeatTimeout(t *testing.T) {
+	const interval, timeout = 30 * time.Second, 5 * time.Minute
+
+	// The peer completes the handshake and then ignores
+	// everything, including PINGs.
+	peer := zmtp.NewScriptedPeer(zmtp.Handshake(zmtp.ServerSocketType, true), zmtp.ExpectClose())
+	defer peer.Close()
+	addr, err := peer.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	events := make(chan gomq.Event, 100)
+	client := gomq.NewClient(zmtp.NewSecurityNull(), gomq.WithClock(clock), gomq.WithHeartbeat(interval, timeout), gomq.WithMonitor(events))
+	defer client.Close()
+	if err := client.Connect("tcp://" + addr.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Up to the timeout the connection has only been idle.
+	for elapsed := time.Duration(0); elapsed < timeout; elapsed += interval {
+		if err := clock.BlockUntil(ctx, 1); err != nil {
+			t.Fatalf("waiting for the heartbeat at %v: %v", elapsed, err)
+		}
+		clock.Advance(interval)
+	}
+	if err := clock.BlockUntil(ctx, 1); err != nil {
+		t.Fatalf("waiting for the heartbeat at %v: %v", timeout, err)
+	}
+	for len(events) > 0 {
+		if ev := <-events; ev.Type == gomq.EventHeartbeatTimeout {
+			t.Fatalf("timed out after %v, before %v", clock.Now().Sub(start), timeout)
+		}
+	}
+
+	clock.Advance(interval)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == gomq.EventHeartbeatTimeout {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatal("connection did not time out")
+		}
+	}
+}
+
+func TestFakeClockReconnectBackoff(t *testing.T) {
+	const endpoint = "mem://gomqtest-backoff"
+
+	clock := NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	events := make(chan gomq.Event, 100)
+	client := gomq.NewClient(zmtp.NewSecurityNull(), gomq.WithClock(clock), gomq.WithMonitor(events))
+	defer client.Close()
+	retry := client.RetryInterval()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	expect := func(want gomq.EventType) {
+		t.Helper()
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == want {
+					return
+				}
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for %v", want)
+			}
+		}
+	}
+
+	if err := client.ConnectAsync(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	// A minute of retries, each made only once the retry
+	// interval is up.
+	for elapsed := time.Duration(0); elapsed < time.Minute; elapsed += retry {
+		expect(gomq.EventConnectRetried)
+		if err := clock.BlockUntil(ctx, 1); err != nil {
+			t.Fatalf("waiting for the backoff at %v: %v", elapsed, err)
+		}
+		clock.Advance(retry - time.Nanosecond)
+		if want, got := 1, clock.Timers(); want != got {
+			t.Fatalf("want the backoff pending until the interval is up, got %d timers", got)
+		}
+		clock.Advance(time.Nanosecond)
+	}
+
+	expect(gomq.EventConnectRetried)
+	server := gomq.NewServer(zmtp.NewSecurityNull())
+	defer server.Close()
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	if err := clock.BlockUntil(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(retry)
+	expect(gomq.EventConnected)
+}
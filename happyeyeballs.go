@@ -0,0 +1,155 @@
+package gomq
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// fallbackDelay is how long a connect waits on a dial to one
+// of a hostname's addresses before also dialing the next.
+var fallbackDelay = 300 * time.Millisecond
+
+// familyReprobe is how long a dialer keeps trying the address
+// family it last connected over first, before going back to
+// the resolver's order.
+var familyReprobe = 5 * time.Minute
+
+// lookupIPAddr resolves hostnames for dialHost.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// dialHost dials a TCP endpoint. When its host resolves to
+// several addresses they are dialed in turn, each one
+// fallbackDelay after the one before unless it already
+// failed, and the first connection established wins, as in
+// RFC 6555. The addresses alternate between IPv6 and IPv4,
+// starting with the family the dialer last connected over,
+// so that when one path is broken reconnects do not wait on
+// it first every time. Stopping the dialer abandons the dial.
+func (d *dialer) dialHost(host, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-d.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var dialer net.Dialer
+	if _, err := netip.ParseAddr(host); err == nil {
+		return dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	}
+
+	addrs, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs = d.orderAddrs(addrs)
+
+	type result struct {
+		conn net.Conn
+		err  error
+		ip   net.IP
+	}
+	results := make(chan result, len(addrs))
+	next := 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", joinAddrPort(addr, port))
+			results <- result{conn, err, addr.IP}
+		}()
+	}
+
+	start()
+	pending := 1
+	fallback := d.clock.NewTimer(fallbackDelay)
+	defer func() { fallback.Stop() }()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				d.remember(r.ip)
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+				pending++
+				fallback.Stop()
+				fallback = d.clock.NewTimer(fallbackDelay)
+			}
+		case <-fallback.C():
+			if next < len(addrs) {
+				start()
+				pending++
+				fallback = d.clock.NewTimer(fallbackDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// joinAddrPort joins addr and port into a TCP address,
+// keeping the zone of a link-local IPv6 address, which
+// cannot be dialed without it.
+func joinAddrPort(addr net.IPAddr, port string) string {
+	return net.JoinHostPort(addr.String(), port)
+}
+
+// remember makes the dialer try ip's family first for the
+// next familyReprobe.
+func (d *dialer) remember(ip net.IP) {
+	d.preferV4 = ip.To4() != nil
+	d.preferSince = d.clock.Now()
+}
+
+// orderAddrs interleaves addrs by family, keeping the
+// resolver's order within each family. The first address
+// is of the family the dialer remembers, if it remembers
+// one, and the first resolved address's family otherwise.
+func (d *dialer) orderAddrs(addrs []net.IPAddr) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+
+	first, second := v6, v4
+	preferV4 := len(addrs) > 0 && addrs[0].IP.To4() != nil
+	if !d.preferSince.IsZero() && d.clock.Now().Sub(d.preferSince) < familyReprobe {
+		preferV4 = d.preferV4
+	}
+	if preferV4 {
+		first, second = v4, v6
+	}
+
+	ordered := make([]net.IPAddr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
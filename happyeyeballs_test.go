@@ -0,0 +1,99 @@
+package gomq
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// stoppedClock is a clock whose time only moves when now is
+// set; its timers are real.
+type stoppedClock struct {
+	zmtp.RealClock
+	now time.Time
+}
+
+func (c *stoppedClock) Now() time.Time {
+	return c.now
+}
+
+func TestDialHostFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	defer func(lookup func(context.Context, string) ([]net.IPAddr, error)) {
+		lookupIPAddr = lookup
+	}(lookupIPAddr)
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		// Nothing listens on ::1, standing in for the broken
+		// IPv6 path.
+		return []net.IPAddr{{IP: net.ParseIP("::1")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+
+	clock := &stoppedClock{now: time.Unix(0, 0)}
+	d := &dialer{done: make(chan struct{}), clock: clock}
+	conn, err := d.dialHost("broker.example", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if want, got := l.Addr().String(), conn.RemoteAddr().String(); want != got {
+		t.Errorf("want %s, got %s", want, got)
+	}
+
+	addrs := d.orderAddrs([]net.IPAddr{{IP: net.ParseIP("::1")}, {IP: net.ParseIP("127.0.0.1")}})
+	if want, got := "127.0.0.1", addrs[0].IP.String(); want != got {
+		t.Errorf("want %s first after connecting over IPv4, got %s", want, got)
+	}
+
+	clock.now = clock.now.Add(familyReprobe)
+	addrs = d.orderAddrs([]net.IPAddr{{IP: net.ParseIP("::1")}, {IP: net.ParseIP("127.0.0.1")}})
+	if want, got := "::1", addrs[0].IP.String(); want != got {
+		t.Errorf("want %s first once the preference expired, got %s", want, got)
+	}
+}
+
+func TestOrderAddrs(t *testing.T) {
+	var addrs []net.IPAddr
+	for _, ip := range []string{"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+
+	var got []string
+	for _, addr := range (&dialer{}).orderAddrs(addrs) {
+		got = append(got, addr.IP.String())
+	}
+
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}
+	if len(want) != len(got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	}
+}
+
+func TestJoinAddrPort(t *testing.T) {
+	for _, c := range []struct {
+		addr net.IPAddr
+		want string
+	}{
+		{net.IPAddr{IP: net.ParseIP("192.0.2.1")}, "192.0.2.1:5555"},
+		{net.IPAddr{IP: net.ParseIP("2001:db8::1")}, "[2001:db8::1]:5555"},
+		{net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}, "[fe80::1%eth0]:5555"},
+	} {
+		if got := joinAddrPort(c.addr, "5555"); c.want != got {
+			t.Errorf("want %s, got %s", c.want, got)
+		}
+	}
+}
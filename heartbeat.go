@@ -0,0 +1,66 @@
+package gomq
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeat pings conn every heartbeat interval until it is
+// closed, and tears it down if nothing has been received on
+// it within the heartbeat timeout. Each PING carries the time
+// it was sent, which the peer echoes back in its PONG.
+func (s *Socket) heartbeat(conn *Connection) {
+	timer := s.clock.NewTimer(s.heartbeatInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C():
+		case <-conn.closing:
+			return
+		}
+
+		if s.heartbeatTimeout > 0 && conn.idleFor() > s.heartbeatTimeout {
+			s.emit(Event{Type: EventHeartbeatTimeout, Endpoint: conn.endpoint, Addr: conn.net.RemoteAddr(), Err: ErrHeartbeatTimeout})
+			s.teardown(conn, ErrHeartbeatTimeout)
+			return
+		}
+
+		// A PING stuck behind a full TCP buffer must not hold up
+		// the timeout check, so send it on the side, one at a time.
+		if atomic.CompareAndSwapInt32(&conn.pinging, 0, 1) {
+			go func() {
+				defer atomic.StoreInt32(&conn.pinging, 0)
+
+				var context [8]byte
+				binary.BigEndian.PutUint64(context[:], uint64(conn.clock.Now().UnixNano()))
+				conn.zmtp.SendPing(s.heartbeatTimeout, context[:])
+			}()
+		}
+		timer.Reset(s.heartbeatInterval)
+	}
+}
+
+// received records that something arrived on the connection.
+func (c *Connection) received() {
+	atomic.StoreInt64(&c.lastRecv, c.clock.Now().UnixNano())
+}
+
+// idleFor returns how long ago something last arrived on the
+// connection.
+func (c *Connection) idleFor() time.Duration {
+	return c.clock.Now().Sub(time.Unix(0, atomic.LoadInt64(&c.lastRecv)))
+}
+
+// pong records the round trip time of the PING whose context
+// a PONG echoed. PONGs answering someone else's PINGs carry
+// contexts of other lengths and are ignored.
+func (c *Connection) pong(context []byte) {
+	if len(context) != 8 {
+		return
+	}
+
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(context)))
+	atomic.StoreInt64(&c.rtt, int64(c.clock.Now().Sub(sent)))
+}
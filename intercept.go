@@ -0,0 +1,57 @@
+package gomq
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// SetRecvInterceptor sets a function to be called with every
+// message the socket receives, and the peer that sent it,
+// before the message is queued for Recv. It returns whether
+// to deliver the message: messages it does not deliver are
+// counted by Filtered. It may change msg, e.g. replace its
+// Body with a decompressed one, and what it leaves is what
+// Recv returns.
+//
+// The interceptor runs on the goroutine reading the peer's
+// connection, so it holds up further messages from that peer,
+// and heartbeat replies with them, for as long as it runs; it
+// must not receive from the socket itself, and calls for
+// different peers may run at the same time. A panic in the
+// interceptor tears down the connection of the message it was
+// called with, with an error wrapping ErrInterceptorPanic, as
+// if the connection had failed. Messages queued before it
+// was set are not passed to it, nor are the messages of
+// connections read WithManualRead. A nil interceptor removes
+// the interceptor.
+func (s *Socket) SetRecvInterceptor(interceptor func(peer PeerInfo, msg *zmtp.Message) (deliver bool)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.recvInterceptor = interceptor
+}
+
+// intercept passes msg to interceptor, reporting whether to
+// deliver it, or the error to tear conn down with if
+// interceptor panicked.
+func (s *Socket) intercept(interceptor func(PeerInfo, *zmtp.Message) bool, conn *Connection, msg *zmtp.Message) (deliver bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			deliver, err = false, fmt.Errorf("%w: %v", ErrInterceptorPanic, r)
+		}
+	}()
+
+	if !interceptor(conn.PeerInfo(), msg) {
+		atomic.AddUint64(&s.filtered, 1)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Filtered returns the number of received messages the
+// receive interceptor did not deliver; see
+// SetRecvInterceptor.
+func (s *Socket) Filtered() uint64 {
+	return atomic.LoadUint64(&s.filtered)
+}
@@ -0,0 +1,636 @@
+package gomq
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+var (
+	// shutdownPollInterval is how often Shutdown checks
+	// whether in-flight traffic has drained.
+	shutdownPollInterval = 10 * time.Millisecond
+
+	// backpressurePoll is how often an endpoint paused by
+	// WithAcceptBackpressure checks whether to resume.
+	backpressurePoll = 10 * time.Millisecond
+
+	// minAcceptDelay and maxAcceptDelay bound the backoff
+	// applied after a temporary Accept error.
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// listener is an endpoint the socket is bound to. Its
+// net.Listener is replaced if it has to be re-listened.
+type listener struct {
+	endpoint         string
+	network, address string
+
+	mu     sync.Mutex
+	ln     net.Listener
+	closed bool
+}
+
+// current returns the listener's net.Listener.
+func (l *listener) current() net.Listener {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ln
+}
+
+// replace makes ln the listener's net.Listener. If the
+// listener has been closed in the meantime ln is closed
+// and replace returns false.
+func (l *listener) replace(ln net.Listener) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		ln.Close()
+		return false
+	}
+	l.ln = ln
+	return true
+}
+
+// close closes the listener for good.
+func (l *listener) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.ln.Close()
+}
+
+// isClosed reports whether close has been called.
+func (l *listener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// BindContext is like Bind, but stops listening on the endpoint
+// when ctx is done, abandoning any handshakes still in progress.
+// Connections that were already established stay open.
+func (s *Socket) BindContext(ctx context.Context, endpoint string) (net.Addr, error) {
+	return s.bind(ctx, endpoint)
+}
+
+// bind listens on each of the endpoint's addresses and accepts
+// connections in the background until ctx is done or the socket is closed.
+func (s *Socket) bind(ctx context.Context, endpoint string) (net.Addr, error) {
+	ep, err := ParseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	addrs, err := bindAddresses(ep, s.ipFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	// An endpoint with several addresses gets a listener for
+	// each. If the port is to be picked, the first listener
+	// picks it for the rest. A dual-stack wildcard listens on
+	// as many of its two families as it can.
+	dualStack := ep.Transport == "tcp" && ep.Host == "*" && s.ipFamily == IPDualStack
+	var (
+		ls      []*listener
+		skipped []error
+	)
+	closeBound := func() {
+		for _, l := range ls {
+			l.ln.Close()
+		}
+	}
+	for _, addr := range addrs {
+		if len(ls) > 0 && ep.Port == "0" {
+			if tcpAddr, ok := ls[0].ln.Addr().(*net.TCPAddr); ok {
+				host, _, _ := net.SplitHostPort(addr.address)
+				addr.address = net.JoinHostPort(host, strconv.Itoa(tcpAddr.Port))
+			}
+		}
+
+		ln, err := s.listenEndpoint(addr.network, addr.address)
+		if err != nil && dualStack {
+			skipped = append(skipped, err)
+			continue
+		}
+		if err != nil {
+			closeBound()
+			return nil, err
+		}
+		ls = append(ls, &listener{
+			endpoint: ep.String(),
+			network:  addr.network,
+			address:  addr.address,
+			ln:       ln,
+		})
+	}
+
+	if len(ls) == 0 {
+		return nil, skipped[0]
+	}
+
+	var endpoints []string
+	for _, l := range ls {
+		endpoints = append(endpoints, boundEndpoint(ep, l.ln.Addr()))
+	}
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		closeBound()
+		return nil, ErrSocketClosed
+	}
+	s.listeners = append(s.listeners, ls...)
+	s.lastEndpoints = endpoints
+	s.lock.Unlock()
+
+	for _, err := range skipped {
+		s.emit(Event{Type: EventBindDegraded, Endpoint: ep.String(), Err: err})
+	}
+
+	addr := ls[0].ln.Addr()
+	for _, l := range ls {
+		l := l
+		s.spawn(resAcceptor, func() { s.accept(ctx, l) })
+	}
+	return addr, nil
+}
+
+// boundEndpoint returns the endpoint a listener bound for ep
+// listens on at addr, with its wildcard host and port filled
+// in if it is a TCP endpoint.
+func boundEndpoint(ep Endpoint, addr net.Addr) string {
+	if ep.Transport != "tcp" {
+		return ep.String()
+	}
+	return "tcp://" + addr.String()
+}
+
+// LastEndpoints returns the endpoints the socket listens on
+// for the endpoint it was last bound to, one for each
+// listener: a TCP endpoint bound to "*" is listened on at
+// "tcp://0.0.0.0:port" and "tcp://[::]:port", for instance,
+// and a port of 0 is replaced by the port picked. It returns
+// nil if the socket was never bound.
+func (s *Socket) LastEndpoints() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]string(nil), s.lastEndpoints...)
+}
+
+// accept accepts connections on l until it is closed or ctx
+// is done, performing the ZMTP handshake for each in its own
+// goroutine. Temporary Accept errors are retried with backoff;
+// if the listener fails for any other reason while the socket
+// is still open, accept listens on the endpoint again.
+// Handshakes still in progress when accept returns are
+// abandoned.
+func (s *Socket) accept(ctx context.Context, l *listener) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stop := context.AfterFunc(ctx, func() {
+		s.removeListener(l)
+	})
+	defer stop()
+
+	pause := s.connLimitPolicy == ConnLimitPause
+
+	var delay time.Duration
+	for {
+		if !s.waitBackpressure(ctx, l) {
+			return
+		}
+
+		// With ConnLimitPause a slot is taken before
+		// accepting, so that at the limit new connections
+		// wait in the listener's backlog.
+		if pause && !s.reserveAccepted(ctx, true) {
+			return
+		}
+
+		ln := l.current()
+		netConn, err := ln.Accept()
+		if err == nil {
+			delay = 0
+			if !pause && !s.reserveAccepted(ctx, false) {
+				netConn.Close()
+				s.emit(Event{Type: EventAcceptRejected, Endpoint: l.endpoint, Addr: netConn.RemoteAddr()})
+				continue
+			}
+			netConn := netConn
+			s.spawn(resHandshake, func() { s.handshake(ctx, l.endpoint, netConn) })
+			continue
+		}
+		if pause {
+			s.releaseAccepted()
+		}
+
+		if l.isClosed() || ctx.Err() != nil {
+			return
+		}
+
+		if isTemporary(err) {
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else {
+				delay *= 2
+			}
+			if delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+
+			s.emit(Event{Type: EventAcceptRetried, Endpoint: l.endpoint, Err: err})
+			if !sleep(ctx, s.clock, delay) {
+				return
+			}
+			continue
+		}
+
+		s.emit(Event{Type: EventListenerFailed, Endpoint: l.endpoint, Err: err})
+		ln.Close()
+		if !s.relisten(ctx, l) {
+			return
+		}
+		delay = 0
+	}
+}
+
+// waitBackpressure holds off accepting on l while the socket
+// is above its WithAcceptBackpressure threshold, returning
+// false if ctx is done first. Recv does not signal when it
+// takes a message, so a paused endpoint checks again every
+// backpressurePoll.
+func (s *Socket) waitBackpressure(ctx context.Context, l *listener) bool {
+	if s.acceptHigh <= 0 || atomic.LoadInt64(&s.inbound) < s.acceptHigh {
+		return true
+	}
+
+	s.emit(Event{Type: EventAcceptPaused, Endpoint: l.endpoint})
+	for atomic.LoadInt64(&s.inbound) > s.acceptLow {
+		// The poll is not a timeout, so it runs on the real
+		// clock whatever the socket's is.
+		if !sleep(ctx, zmtp.RealClock{}, backpressurePoll) {
+			return false
+		}
+	}
+	s.emit(Event{Type: EventAcceptResumed, Endpoint: l.endpoint})
+	return true
+}
+
+// reserveAccepted takes one of the socket's connection slots
+// for an accepted connection (see WithMaxConnections). If the
+// socket is at its limit it waits for a slot to be released
+// when wait is set, returning false if ctx is done first, and
+// returns false straight away otherwise.
+func (s *Socket) reserveAccepted(ctx context.Context, wait bool) bool {
+	for {
+		s.lock.Lock()
+		if s.maxConns <= 0 || s.acceptedConns < s.maxConns {
+			s.acceptedConns++
+			s.lock.Unlock()
+			return true
+		}
+		changed := s.acceptFreed
+		s.lock.Unlock()
+
+		if !wait {
+			return false
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// releaseAccepted gives back a slot taken by reserveAccepted.
+func (s *Socket) releaseAccepted() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.releaseAcceptedLocked(1)
+}
+
+// releaseAcceptedLocked gives back n slots and wakes up the
+// accept loops waiting for one. The caller holds s.lock.
+func (s *Socket) releaseAcceptedLocked(n int) {
+	s.acceptedConns -= n
+	close(s.acceptFreed)
+	s.acceptFreed = make(chan struct{})
+}
+
+// AcceptedCount returns the number of connections accepted on
+// the socket's bound endpoints that it currently holds,
+// including those still in their handshake. This is the
+// number WithMaxConnections limits.
+func (s *Socket) AcceptedCount() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.acceptedConns
+}
+
+// relisten listens on l's endpoint again, retrying every
+// retry interval. It returns false if l was closed or ctx
+// was done before it succeeded, or if the endpoint cannot
+// be listened on again.
+func (s *Socket) relisten(ctx context.Context, l *listener) bool {
+	// An inherited descriptor that was not kept open is gone
+	// once its listener failed, and its number may since have
+	// been reused.
+	if l.network == "fd" && !s.keepFDs {
+		return false
+	}
+
+	for {
+		ln, err := s.listenEndpoint(l.network, l.address)
+		if err == nil {
+			if !l.replace(ln) {
+				return false
+			}
+			s.emit(Event{Type: EventListening, Endpoint: l.endpoint})
+			return true
+		}
+
+		s.emit(Event{Type: EventListenerFailed, Endpoint: l.endpoint, Err: err})
+		if !sleep(ctx, s.clock, s.retryInterval) || l.isClosed() {
+			return false
+		}
+	}
+}
+
+// isTemporary reports whether an Accept error is expected
+// to go away by itself, such as running out of file
+// descriptors or a connection aborted before it was
+// accepted.
+func isTemporary(err error) bool {
+	switch {
+	case errors.Is(err, syscall.EMFILE),
+		errors.Is(err, syscall.ENFILE),
+		errors.Is(err, syscall.ENOBUFS),
+		errors.Is(err, syscall.ENOMEM),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.ECONNRESET):
+		return true
+	}
+
+	if te, ok := err.(interface{ Temporary() bool }); ok {
+		return te.Temporary()
+	}
+	return false
+}
+
+// sleep waits for d on clock, returning false if ctx is done
+// first.
+func sleep(ctx context.Context, clock zmtp.Clock, d time.Duration) bool {
+	timer := clock.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// handshake performs the server side of the ZMTP handshake on
+// an accepted connection and adds it to the socket. The
+// connection is closed if ctx is done before it completes.
+func (s *Socket) handshake(ctx context.Context, endpoint string, netConn net.Conn) {
+	stop := context.AfterFunc(ctx, func() {
+		netConn.Close()
+	})
+
+	p := s.startHandshake(netConn)
+	if !s.handshakeTurn(ctx) {
+		stop()
+		netConn.Close()
+		s.endHandshake(p)
+		s.releaseAccepted()
+		return
+	}
+
+	zmtpConn := s.newZMTPConn(netConn)
+	_, err := zmtpConn.Prepare(s.SecurityMechanism(), s.sockType, true, nil)
+	s.handshakeDone()
+	if s.endHandshake(p) {
+		err = ErrTooManyHandshakes
+	}
+	if !stop() {
+		s.releaseAccepted()
+		return
+	}
+
+	if err != nil {
+		netConn.Close()
+		s.releaseAccepted()
+		s.emit(Event{Type: EventHandshakeFailed, Endpoint: endpoint, Addr: netConn.RemoteAddr(), Err: err})
+		return
+	}
+
+	conn := NewConnection(netConn, zmtpConn)
+	conn.endpoint = endpoint
+	conn.accepted = true
+	s.AddConnection(conn)
+	s.emit(Event{Type: EventAccepted, Endpoint: endpoint, Addr: netConn.RemoteAddr()})
+}
+
+// pendingHandshake is an accepted connection in its
+// handshake, tracked for WithMaxHandshakes.
+type pendingHandshake struct {
+	netConn net.Conn
+
+	// evicted is set, under the socket's lock, when the
+	// connection was closed to make room for a newer one.
+	evicted bool
+}
+
+// startHandshake tracks an accepted connection starting its
+// handshake. If that makes more handshakes than the socket
+// allows, the oldest one is closed.
+func (s *Socket) startHandshake(netConn net.Conn) *pendingHandshake {
+	if s.maxHandshakes <= 0 {
+		return nil
+	}
+
+	p := &pendingHandshake{netConn: netConn}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.handshakes = append(s.handshakes, p)
+	if len(s.handshakes) > s.maxHandshakes {
+		oldest := s.handshakes[0]
+		s.handshakes = s.handshakes[1:]
+		oldest.evicted = true
+		oldest.netConn.Close()
+		atomic.AddUint64(&s.evictedHandshakes, 1)
+	}
+	return p
+}
+
+// endHandshake stops tracking p and reports whether it was
+// evicted.
+func (s *Socket) endHandshake(p *pendingHandshake) bool {
+	if p == nil {
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for k, v := range s.handshakes {
+		if v == p {
+			s.handshakes = append(s.handshakes[:k], s.handshakes[k+1:]...)
+			break
+		}
+	}
+	return p.evicted
+}
+
+// handshakeTurn waits until the socket runs fewer handshakes
+// than WithHandshakeConcurrency allows and counts one more. It
+// returns false if ctx is done first.
+func (s *Socket) handshakeTurn(ctx context.Context) bool {
+	if s.handshakeSlots != nil {
+		select {
+		case s.handshakeSlots <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	atomic.AddInt64(&s.inFlight, 1)
+	return true
+}
+
+// handshakeDone counts a handshake started by handshakeTurn
+// as finished, passing the turn on.
+func (s *Socket) handshakeDone() {
+	atomic.AddInt64(&s.inFlight, -1)
+	if s.handshakeSlots != nil {
+		<-s.handshakeSlots
+	}
+}
+
+// HandshakesInFlight returns how many accepted connections
+// are running their ZMTP handshake, leaving out those waiting
+// their turn under WithHandshakeConcurrency.
+func (s *Socket) HandshakesInFlight() int {
+	return int(atomic.LoadInt64(&s.inFlight))
+}
+
+// EvictedHandshakes returns how many accepted connections the
+// socket closed in their handshake to stay within
+// WithMaxHandshakes.
+func (s *Socket) EvictedHandshakes() uint64 {
+	return atomic.LoadUint64(&s.evictedHandshakes)
+}
+
+// removeListener closes l and stops tracking it.
+func (s *Socket) removeListener(l *listener) {
+	s.lock.Lock()
+	for k, v := range s.listeners {
+		if v == l {
+			s.listeners = append(s.listeners[:k], s.listeners[k+1:]...)
+			break
+		}
+	}
+	s.lock.Unlock()
+
+	l.close()
+}
+
+// closeListeners closes every listener of the socket
+// so that no new connections are accepted.
+func (s *Socket) closeListeners() {
+	s.lock.Lock()
+	listeners := s.listeners
+	s.listeners = nil
+	s.lock.Unlock()
+
+	for _, l := range listeners {
+		l.close()
+	}
+}
+
+// drained reports whether no received message is waiting
+// to be returned by Recv and no connection has messages
+// queued for sending.
+func (s *Socket) drained() bool {
+	if atomic.LoadInt64(&s.inbound) != 0 {
+		return false
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, conn := range s.conns {
+		if !conn.idle() {
+			return false
+		}
+	}
+	return true
+}
+
+// Shutdown gracefully shuts down a bound socket. It closes
+// all listeners immediately so that no new peers can connect,
+// then waits until every message already received has been
+// returned by Recv and every queued outbound message has been
+// sent before closing the connections. Recv and Send keep
+// working while Shutdown waits; once it returns, Recv
+// returns ErrSocketClosed.
+//
+// If ctx expires first, the remaining connections are closed
+// immediately and the context's error is returned.
+func (s *Socket) Shutdown(ctx context.Context) error {
+	s.markClosed()
+	defer s.stopRecv()
+	defer s.ctx.remove(s)
+
+	s.stopDialers()
+	s.closeListeners()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for !s.drained() {
+		select {
+		case <-ctx.Done():
+			s.closeConnections(0)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	conns := s.removeConnections()
+	done := make(chan struct{})
+	go func() {
+		closeAll(conns, s.linger)
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		closeAll(conns, 0)
+		err = ctx.Err()
+	}
+	for _, conn := range conns {
+		s.releaseValues(conn)
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+package gomq
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// memPipeSize is how many bytes a mem connection buffers in
+// each direction before writes block.
+const memPipeSize = 64 * 1024
+
+// memRegistry holds the bound mem endpoints of a Context by
+// name.
+type memRegistry struct {
+	sync.Mutex
+	m map[string]*memListener
+}
+
+func newMemRegistry() *memRegistry {
+	return &memRegistry{m: make(map[string]*memListener)}
+}
+
+// MemPipe returns the two ends of an in-memory connection
+// like the ones the mem transport uses. Unlike net.Pipe, each
+// direction buffers writes, so both ends can send their ZMTP
+// greeting before reading the other's.
+func MemPipe() (net.Conn, net.Conn) {
+	return newMemPipe(memAddr("pipe"), memAddr("pipe"))
+}
+
+func newMemPipe(a, b memAddr) (*memConn, *memConn) {
+	ab, ba := newMemBuffer(), newMemBuffer()
+	return &memConn{r: ba, w: ab, local: a, remote: b},
+		&memConn{r: ab, w: ba, local: b, remote: a}
+}
+
+// memAddr is the address of a mem endpoint.
+type memAddr string
+
+func (memAddr) Network() string  { return "mem" }
+func (a memAddr) String() string { return string(a) }
+
+// memBuffer is one direction of a mem connection.
+type memBuffer struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	buf    []byte
+	closed bool
+}
+
+func newMemBuffer() *memBuffer {
+	b := &memBuffer{}
+	b.cond.L = &b.mu
+	return b
+}
+
+// read blocks until there is something to read or the buffer
+// is closed, in which case it returns io.EOF once drained.
+func (b *memBuffer) read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.buf) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if len(b.buf) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	b.cond.Broadcast()
+	return n, nil
+}
+
+// write blocks while the buffer is full.
+func (b *memBuffer) write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	written := 0
+	for written < len(p) {
+		for len(b.buf) >= memPipeSize && !b.closed {
+			b.cond.Wait()
+		}
+		if b.closed {
+			return written, io.ErrClosedPipe
+		}
+
+		n := min(len(p)-written, memPipeSize-len(b.buf))
+		b.buf = append(b.buf, p[written:written+n]...)
+		written += n
+		b.cond.Broadcast()
+	}
+	return written, nil
+}
+
+func (b *memBuffer) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// memConn is one end of a mem connection. Closing either end
+// closes both directions; what was already written can still
+// be read.
+type memConn struct {
+	r, w          *memBuffer
+	local, remote memAddr
+}
+
+func (c *memConn) Read(p []byte) (int, error)  { return c.r.read(p) }
+func (c *memConn) Write(p []byte) (int, error) { return c.w.write(p) }
+
+func (c *memConn) Close() error {
+	c.r.close()
+	c.w.close()
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+// Deadlines are not supported by mem connections.
+func (c *memConn) SetDeadline(t time.Time) error      { return os.ErrNoDeadline }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return os.ErrNoDeadline }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return os.ErrNoDeadline }
+
+// memListener accepts the connections dialed to a bound mem
+// endpoint.
+type memListener struct {
+	registry  *memRegistry
+	name      string
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (r *memRegistry) listen(name string) (net.Listener, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.m[name]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "mem", Addr: memAddr(name), Err: syscall.EADDRINUSE}
+	}
+
+	l := &memListener{
+		registry: r,
+		name:     name,
+		conns:    make(chan net.Conn, 16),
+		done:     make(chan struct{}),
+	}
+	r.m[name] = l
+	return l, nil
+}
+
+func (r *memRegistry) dial(name string) (net.Conn, error) {
+	r.Lock()
+	l, ok := r.m[name]
+	r.Unlock()
+
+	refused := &net.OpError{Op: "dial", Net: "mem", Addr: memAddr(name), Err: syscall.ECONNREFUSED}
+	if !ok {
+		return nil, refused
+	}
+
+	client, server := newMemPipe(memAddr(name+"#client"), memAddr(name))
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, refused
+	}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.registry.Lock()
+		delete(l.registry.m, l.name)
+		l.registry.Unlock()
+		close(l.done)
+
+		for {
+			select {
+			case conn := <-l.conns:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr(l.name)
+}
@@ -0,0 +1,599 @@
+package gomq
+
+import (
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// SocketOption configures optional behaviour of a Socket.
+// Options are passed to the socket constructors,
+// e.g. NewClient(mechanism, WithLinger(0)).
+type SocketOption func(*Socket)
+
+// ConnLimitPolicy decides what a bound socket does with new
+// connections while it is at its connection limit (see
+// WithMaxConnections).
+type ConnLimitPolicy int
+
+const (
+	// ConnLimitPause stops accepting until a connection goes
+	// away, leaving new connections in the listener's backlog.
+	// It is the default.
+	ConnLimitPause ConnLimitPolicy = iota
+
+	// ConnLimitReject accepts new connections and closes them
+	// straight away, emitting EventAcceptRejected.
+	ConnLimitReject
+)
+
+var connLimitPolicyNames = map[ConnLimitPolicy]string{
+	ConnLimitPause:  "pause",
+	ConnLimitReject: "reject",
+}
+
+func (p ConnLimitPolicy) String() string {
+	if name, ok := connLimitPolicyNames[p]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// WithMaxConnections limits the number of connections a bound
+// socket holds at once across all its endpoints, counting
+// those still in their handshake. What happens to connections
+// beyond the limit depends on the ConnLimitPolicy; accepting
+// picks up again as soon as the socket drops below the limit.
+// Zero, the default, means no limit.
+func WithMaxConnections(n int) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithMaxConnections")
+		s.maxConns = n
+	}
+}
+
+// WithConnLimitPolicy sets what a bound socket does with new
+// connections while it is at its connection limit.
+func WithConnLimitPolicy(p ConnLimitPolicy) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithConnLimitPolicy")
+		s.connLimitPolicy = p
+	}
+}
+
+// WithAcceptBackpressure makes a bound socket stop accepting
+// connections while it holds at least high received messages
+// that Recv has not returned yet, until no more than low are
+// left, emitting EventAcceptPaused and EventAcceptResumed.
+// Meanwhile new connections wait in the listener's backlog
+// (see WithListenBacklog). An Accept already waiting when the
+// threshold is crossed still returns its connection. A high
+// of zero, the default, never pauses.
+func WithAcceptBackpressure(high, low int) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithAcceptBackpressure")
+		s.acceptHigh = int64(high)
+		s.acceptLow = int64(low)
+	}
+}
+
+// WithListenBacklog sets how many connections bound tcp and
+// ipc endpoints queue in the kernel waiting to be accepted.
+// The system default, used when n is zero, is typically
+// net.core.somaxconn on Linux. It has no effect on Windows.
+func WithListenBacklog(n int) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithListenBacklog")
+		s.backlog = n
+	}
+}
+
+// WithMaxHandshakes limits how many connections accepted on a
+// bound socket may be in their ZMTP handshake at once. A
+// connection accepted beyond the limit makes the socket close
+// the one that has been in its handshake the longest, which
+// fails with ErrTooManyHandshakes, so that peers that never
+// finish their greeting cannot lock others out; see
+// EvictedHandshakes. Zero, the default, means no limit.
+func WithMaxHandshakes(n int) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithMaxHandshakes")
+		s.maxHandshakes = n
+	}
+}
+
+// WithHandshakeConcurrency limits how many connections
+// accepted on a bound socket run their ZMTP handshake at
+// once, so that a storm of reconnecting peers does not starve
+// the established connections of CPU. Connections accepted
+// beyond the limit wait their turn before reading the peer's
+// greeting; WithMaxHandshakes still applies to them. See
+// HandshakesInFlight. Zero, the default, means no limit.
+func WithHandshakeConcurrency(n int) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithHandshakeConcurrency")
+		s.handshakeSlots = nil
+		if n > 0 {
+			s.handshakeSlots = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithSendBufferBytes limits how many bytes of messages each
+// of a socket's connections queues for sending, on top of
+// the message count limit set by WithSendHWM: a queue is full
+// when either limit is reached. Each message counts for its
+// length plus a fixed 32 bytes, and a queue that is empty
+// takes a message however large. Zero, the default, means no
+// byte limit.
+func WithSendBufferBytes(n int) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithSendBufferBytes")
+		s.sendBufferBytes = int64(n)
+	}
+}
+
+// WithSendTTL makes a socket's connections discard messages
+// that waited in their send queue longer than ttl instead of
+// sending them late, e.g. in a burst once a stalled peer
+// recovers. Discarded messages are counted by Expired and
+// passed to the drop handler, if one is set. Zero, the
+// default, sends messages however long they waited.
+// SendOptions.TTL sets the TTL of a single message.
+func WithSendTTL(ttl time.Duration) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithSendTTL")
+		s.sendTTL = ttl
+	}
+}
+
+// WithDisconnectCommand makes a socket send its peers a
+// DISCONNECT command when it closes a connection gracefully,
+// after the connection's queued messages have been written,
+// so that a gomq peer reports EventPeerDeparted rather than
+// only an error. Other peers ignore the command as an unknown
+// one. The command is sent within the socket's linger, so a
+// socket with a zero linger never sends it.
+func WithDisconnectCommand() SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithDisconnectCommand")
+		s.announceClose = true
+	}
+}
+
+// WithMessageStats makes a socket keep histograms of the
+// sizes of the messages it sends and receives and of how long
+// received messages wait for Recv; see MessageStats. Without
+// it a socket takes no timestamps for them.
+func WithMessageStats() SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithMessageStats")
+		s.stats = newMessageStats()
+	}
+}
+
+// WithParallelConnections makes Connect, ConnectAsync and
+// ConnectAny open n connections instead of one, for links
+// that need more throughput than a single connection gives.
+// Each is dialed, handshaked and redialed on its own, Connect
+// waits for all of them to be handshaked, and Send takes turns
+// between them like between any other connections. The peer
+// sees n independent peers. Messages sent on different
+// connections may overtake each other, so the order in which
+// the peer receives them is not guaranteed. It defaults to 1.
+func WithParallelConnections(n int) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithParallelConnections")
+		s.parallelConns = n
+	}
+}
+
+// WithInboundRateLimit limits how fast each peer of a socket
+// may send to it, so that one flooding peer cannot starve the
+// others of the socket's time and memory. A connection whose
+// peer goes over the limit is not read until it is back under
+// it, so TCP flow control holds further messages at the
+// peer, and EventThrottled is emitted. See
+// WithPeerRateLimit to set limits peer by peer. Sockets
+// created WithManualRead are not limited.
+func WithInboundRateLimit(limit RateLimit) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithInboundRateLimit")
+		s.rateLimit = limit
+	}
+}
+
+// WithPeerRateLimit makes a socket call limit for each
+// connection as it is added, once its handshake is done, for
+// the connection's inbound rate limit. The limit it returns
+// takes the place of the one set by WithInboundRateLimit, so
+// the zero RateLimit exempts the peer.
+func WithPeerRateLimit(limit func(peer PeerInfo) RateLimit) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithPeerRateLimit")
+		s.peerRateLimit = limit
+	}
+}
+
+// WithTimestamps makes a socket stamp each message with the
+// time it was read off its connection; see RecvMessage. It
+// applies to the connections the socket dials and accepts.
+func WithTimestamps() SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithTimestamps")
+		s.timestamps = true
+	}
+}
+
+// WithRecvBufferBytes limits how many bytes of received
+// messages a socket queues for Recv, counted like
+// WithSendBufferBytes does. Its connections stop reading
+// while the limit is reached, so TCP flow control holds
+// further messages at the senders. See InboundBytes. Zero,
+// the default, means no byte limit.
+func WithRecvBufferBytes(n int) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithRecvBufferBytes")
+		s.recvBufferBytes = int64(n)
+	}
+}
+
+// WithLinger sets how long Close waits for queued outbound
+// messages to be written before tearing down connections.
+// A negative duration waits indefinitely, which is the
+// default. A zero duration discards pending messages and
+// closes immediately.
+func WithLinger(d time.Duration) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithLinger")
+		s.linger = d
+	}
+}
+
+// WithSendTimeout bounds how long Send may block, after
+// which it returns ErrTimeout. A negative duration, the
+// default, lets Send block indefinitely.
+func WithSendTimeout(d time.Duration) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithSendTimeout")
+		s.sendTimeout = d
+	}
+}
+
+// HWMPolicy decides what Send does when the send queue of
+// the connection it picked is full.
+type HWMPolicy int
+
+const (
+	// HWMBlock makes Send wait for room in the queue,
+	// bounded by the send timeout. It is the default.
+	HWMBlock HWMPolicy = iota
+
+	// HWMDrop makes Send discard the message and return
+	// without error.
+	HWMDrop
+)
+
+var hwmPolicyNames = map[HWMPolicy]string{
+	HWMBlock: "block",
+	HWMDrop:  "drop",
+}
+
+func (p HWMPolicy) String() string {
+	if name, ok := hwmPolicyNames[p]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// WithSendHWM sets the high water mark: the number of
+// outbound messages queued per connection before Send
+// applies the HWMPolicy. It defaults to 1000 and must be
+// positive. A connection's writer may additionally hold up
+// to as many messages it has taken off the queue to write
+// them out in one go.
+func WithSendHWM(n int) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithSendHWM")
+		s.sendHWM = n
+	}
+}
+
+// WithRecvHWM sets how many received messages a socket
+// queues for Recv before its connections stop reading, so
+// that TCP flow control holds further messages at the
+// senders. It defaults to 1000 and must be positive. See
+// WithRecvBufferBytes to bound the bytes they take instead.
+func WithRecvHWM(n int) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithRecvHWM")
+		s.recvHWM = n
+	}
+}
+
+// WithHWMPolicy sets what Send does when a connection's
+// send queue is full.
+func WithHWMPolicy(p HWMPolicy) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithHWMPolicy")
+		s.hwmPolicy = p
+	}
+}
+
+// WithMinPeers makes Send block until the socket has at
+// least n fully handshaked connections, bounded by the send
+// timeout. It avoids the "slow joiner" problem of sending on
+// a freshly bound socket before any peer has connected. It
+// does not apply to receive-only sockets such as PULL.
+func WithMinPeers(n int) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithMinPeers")
+		s.minPeers = n
+	}
+}
+
+// WithMonitor makes the socket report connection events on
+// events. Events are sent without blocking, so a slow reader
+// misses events rather than stalling the socket; give the
+// channel a buffer.
+func WithMonitor(events chan<- Event) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithMonitor")
+		s.monitor = events
+	}
+}
+
+// WithHeartbeat makes the socket send a ZMTP PING on each of
+// its connections every interval and tear down connections
+// on which nothing, not even a PONG, was received within
+// timeout. The round trip time measured from the PINGs and
+// the time since a connection last received anything are
+// reported in its PeerInfo.
+func WithHeartbeat(interval, timeout time.Duration) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithHeartbeat")
+		s.heartbeatInterval = interval
+		s.heartbeatTimeout = timeout
+	}
+}
+
+// WithWriteTimeout bounds how long each write of queued
+// messages to a connection may take once started, so that a
+// peer that stopped taking data is noticed within d rather
+// than whenever the operating system gives up. A connection
+// whose write times out is torn down like any other failed
+// connection, with an error wrapping ErrWriteTimeout, and
+// dialed endpoints are reconnected. It applies to the
+// connections the socket dials and accepts, over transports
+// that support deadlines, which mem does not. Zero, the
+// default, means no bound.
+func WithWriteTimeout(d time.Duration) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithWriteTimeout")
+		s.writeTimeout = d
+	}
+}
+
+// WithReadIdleTimeout tears down connections on which
+// nothing at all was received for d, like WithWriteTimeout
+// does with stuck writes, with an error wrapping ErrReadIdle.
+// Every read that returns data starts the timeout over,
+// including reads of heartbeat commands, so a peer with a
+// heartbeat interval shorter than d stays connected while
+// idle (see WithHeartbeat). Zero, the default, means no
+// bound.
+func WithReadIdleTimeout(d time.Duration) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithReadIdleTimeout")
+		s.readIdleTimeout = d
+	}
+}
+
+// WithMaxCommandSize limits the length of the body of each
+// ZMTP command the socket's peers may send, during the
+// handshake and after it; see zmtp.Connection.SetMaxCommandSize.
+// A peer that sends a longer command is disconnected with a
+// *zmtp.ProtocolError without the command being buffered.
+// Zero keeps the default of zmtp.DefaultMaxCommandSize and a
+// negative n lifts the limit.
+func WithMaxCommandSize(n int) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithMaxCommandSize")
+		s.maxCommandSize = int64(n)
+	}
+}
+
+// WithAllowedMechanisms restricts the security mechanisms
+// peers may announce in their greeting. A peer announcing any
+// other mechanism is sent a ZMTP ERROR command and
+// disconnected before the handshake goes any further, even if
+// the socket itself was misconfigured with that mechanism.
+// This guards a server that must only accept, say, CURVE peers
+// against silently accepting NULL ones.
+func WithAllowedMechanisms(types ...zmtp.SecurityMechanismType) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithAllowedMechanisms")
+		s.mechanisms = types
+	}
+}
+
+// WithStrictMechanism turns strict checking of peers' security
+// mechanisms on or off, on both connect and accept sides: a
+// peer that announces the socket's mechanism but then claims
+// the socket's role in it, or sends another mechanism's
+// handshake commands, fails the handshake with
+// zmtp.ErrMechanismMismatch, as one announcing another
+// mechanism always does (see zmtp.Connection.SetStrictMechanism).
+// It is on by default for mechanisms other than NULL.
+func WithStrictMechanism(on bool) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithStrictMechanism")
+		s.strictMechanism = &on
+	}
+}
+
+// WithCodec sets the codec SendVal and RecvVal use to turn
+// values into messages and back, e.g. WithCodec(JSONCodec{}).
+func WithCodec(c Codec) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithCodec")
+		s.codec = c
+	}
+}
+
+// WithManualRead stops the socket from reading its connections
+// itself, for callers that drive reads from their own event
+// loop. Each connection is instead passed to read once it has
+// been added to the socket, and its messages are read with
+// Connection.ReadMessage; Recv never returns on such a socket.
+// read is called on the goroutine that added the connection
+// and must not block.
+func WithManualRead(read func(conn *Connection)) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithManualRead")
+		s.manualRead = read
+	}
+}
+
+// WithConnFinalizer makes a socket call finalize with the
+// values attached to a connection with SetConnValue when the
+// connection is torn down or the socket is closed, for
+// instance to release session state kept in them. It is not
+// called for connections without values. finalize is called
+// on the goroutine tearing the connection down, after the
+// connection was removed from the socket and closed.
+func WithConnFinalizer(finalize func(peer PeerInfo, values map[interface{}]interface{})) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithConnFinalizer")
+		s.connFinalizer = finalize
+	}
+}
+
+// WithStrictSendOnly makes a send-only socket, such as PUSH,
+// treat a message from a peer as a protocol violation and
+// disconnect the peer with ErrUnexpectedMessage. By default
+// such messages are read, so that commands like heartbeats
+// behind them still get through, and discarded; see
+// Discarded.
+func WithStrictSendOnly() SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithStrictSendOnly")
+		s.strictSendOnly = true
+	}
+}
+
+// WithClock makes a socket, and its connections, tell the time
+// and wait on clock rather than the time package, for tests
+// that fake the passing of time (see gomqtest.FakeClock). It
+// covers backoff, heartbeats, send timeouts, TTLs, linger,
+// rate limits and the times the socket records. The write
+// and read idle timeouts are deadlines the operating system
+// enforces, and keep to the real clock.
+func WithClock(clock zmtp.Clock) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithClock")
+		s.clock = clock
+	}
+}
+
+// WithUnorderedRecv lets concurrent Recv callers, the
+// socket's Receivers and the workers of its WorkerPools take
+// any connection's messages as they come, rather than each
+// connection's one at a time, in order (see Recv and
+// Receiver). Messages from a connection are then handled in
+// parallel, and may be handled out of order.
+func WithUnorderedRecv() SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithUnorderedRecv")
+		s.unorderedRecv = true
+	}
+}
+
+// WithKeepFDs leaves the inherited descriptors of bound fd://
+// endpoints open when the socket stops listening on them, so
+// that they can be handed on, for instance to a restarted
+// process. By default they are closed.
+func WithKeepFDs() SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithKeepFDs")
+		s.keepFDs = true
+	}
+}
+
+// IPFamily decides which address families a socket listens on
+// when it binds a TCP endpoint with the "*" wildcard host.
+type IPFamily int
+
+const (
+	// IPDualStack listens on every IPv4 and every IPv6
+	// address with a listener for each family, whatever the
+	// system's dual-stack defaults, such as the Linux
+	// net.ipv6.bindv6only sysctl. If one of the two cannot be
+	// bound, for instance on a host without IPv6, the socket
+	// listens on the other and emits EventBindDegraded. It is
+	// the default.
+	IPDualStack IPFamily = iota
+
+	// IPSystemStack listens with a single listener for both
+	// families, leaving it to the system whether IPv4
+	// connections reach it.
+	IPSystemStack
+
+	// IPv4Only and IPv6Only listen on every address of one
+	// family only. Failing to bind it fails the bind.
+	IPv4Only
+	IPv6Only
+)
+
+var ipFamilyNames = map[IPFamily]string{
+	IPDualStack:   "dual stack",
+	IPSystemStack: "system stack",
+	IPv4Only:      "ipv4 only",
+	IPv6Only:      "ipv6 only",
+}
+
+func (f IPFamily) String() string {
+	if name, ok := ipFamilyNames[f]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// WithIPFamily sets the address families a TCP endpoint bound
+// with the "*" wildcard listens on. Endpoints with an address
+// or interface name are bound as they are.
+func WithIPFamily(f IPFamily) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithIPFamily")
+		s.ipFamily = f
+	}
+}
+
+// WithDedup makes a receiving socket drop messages it has
+// already received, for upstreams that resend messages after
+// a reconnect. key returns the key that identifies a message,
+// such as an ID in its header, or false for a message to be
+// let through regardless. A message whose key was seen
+// within window is dropped and counted by Duplicates; the
+// socket remembers keys across connections, in memory
+// bounded by the window's count. It does not apply to
+// connections read by the application (see WithManualRead).
+func WithDedup(key func(msg []byte) (key string, ok bool), window DedupWindow) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithDedup")
+		s.dedup = newDedup(key, window)
+	}
+}
+
+// WithAck sets how long a message received with RecvAck may
+// go unacked before it is redelivered, 30 seconds by default,
+// and how many times it is redelivered before it is rejected,
+// five by default. A negative maxRedeliveries redelivers a
+// message for as long as it goes unacked.
+func WithAck(timeout time.Duration, maxRedeliveries int) SocketOption {
+	return func(s *Socket) {
+		s.markSet("WithAck")
+		s.ackTimeout = timeout
+		s.maxRedeliveries = maxRedeliveries
+	}
+}
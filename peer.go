@@ -0,0 +1,122 @@
+package gomq
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// ConnID identifies a connection of a socket. It stays
+// the same for the lifetime of the connection; a peer that
+// reconnects gets a new ConnID.
+type ConnID string
+
+// PeerInfo describes a connection of a socket and the
+// peer on the other end of it.
+type PeerInfo struct {
+	ID ConnID
+
+	// Endpoint is the endpoint the connection was dialed to
+	// or accepted on.
+	Endpoint string
+
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+
+	// Negotiated holds the details agreed on during the
+	// handshake, including the peer's socket type and
+	// application metadata.
+	Negotiated zmtp.Negotiated
+
+	// RTT is the round trip time measured by the last
+	// heartbeat, or zero if heartbeats are off (see
+	// WithHeartbeat) or none has been answered yet.
+	RTT time.Duration
+
+	// Idle is how long ago anything was last received on
+	// the connection.
+	Idle time.Duration
+
+	// Dropped is the number of messages for the connection
+	// the HWMDrop policy discarded, and Expired the number
+	// that outlived WithSendTTL.
+	Dropped uint64
+	Expired uint64
+
+	// Epoch numbers the connections made by the same
+	// Connect, starting at 1 and going up each time the
+	// endpoint is redialed; it is zero for accepted
+	// connections, which are never redialed. RecvSeq is the
+	// sequence number of the last message read from the
+	// connection (see zmtp.Message.Seq), which starts over
+	// with each connection. Together with ID they tell a
+	// gap in the sequence from a reconnect.
+	Epoch   uint64
+	RecvSeq uint64
+
+	// Throttled is the number of times reading the
+	// connection was held off because its peer was over its
+	// rate limit (see WithInboundRateLimit).
+	Throttled uint64
+
+	// Queued is the number of messages queued for sending
+	// on the connection, and QueuedBytes what they count for
+	// towards WithSendBufferBytes.
+	Queued      int
+	QueuedBytes int64
+}
+
+// PeerInfo returns a description of the connection.
+func (c *Connection) PeerInfo() PeerInfo {
+	negotiated, _ := c.zmtp.Negotiated()
+	return PeerInfo{
+		ID:          ConnID(c.id),
+		Endpoint:    c.endpoint,
+		LocalAddr:   c.net.LocalAddr(),
+		RemoteAddr:  c.net.RemoteAddr(),
+		Negotiated:  negotiated,
+		RTT:         time.Duration(atomic.LoadInt64(&c.rtt)),
+		Idle:        c.idleFor(),
+		Dropped:     atomic.LoadUint64(&c.dropped),
+		Expired:     atomic.LoadUint64(&c.expired),
+		Epoch:       c.epoch,
+		RecvSeq:     atomic.LoadUint64(&c.recvSeq),
+		Throttled:   atomic.LoadUint64(&c.throttled),
+		Queued:      len(c.sendQueue),
+		QueuedBytes: atomic.LoadInt64(&c.queuedBytes),
+	}
+}
+
+// Peers describes each of the socket's connections.
+func (s *Socket) Peers() []PeerInfo {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	peers := make([]PeerInfo, 0, len(s.ids))
+	for _, id := range s.ids {
+		peers = append(peers, s.conns[id].PeerInfo())
+	}
+	return peers
+}
+
+// delivery is a message read from a connection on its way
+// to Recv, together with the connection it arrived on.
+type delivery struct {
+	msg  *zmtp.Message
+	conn *Connection
+
+	// queued is when the message was put on the receive
+	// queue, in Unix nanoseconds, if the socket keeps
+	// statistics (see WithMessageStats).
+	queued int64
+
+	// order numbers the message among those queued from its
+	// connection.
+	order uint64
+
+	// redeliveries counts the times the message was given
+	// back after being received with RecvAck.
+	redeliveries int
+}
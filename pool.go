@@ -0,0 +1,177 @@
+package gomq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNoReply is counted as a handler error when a handler
+// returns a reply on a socket that cannot send, such as PULL.
+var ErrNoReply = errors.New("gomq: socket cannot send replies")
+
+// Message is a received message together with the
+// connection it arrived on.
+type Message struct {
+	Body   []byte
+	Source PeerInfo
+}
+
+// Handler processes a message received by a WorkerPool. A
+// non-nil reply is sent back on the connection the message
+// arrived on.
+type Handler func(msg Message) (reply []byte, err error)
+
+// WorkerPool runs a number of goroutines that receive
+// messages from a socket and pass them to a Handler. Each
+// worker receives with its own Receiver, so a connection's
+// messages are handled one at a time, in order, unless the
+// socket was created WithUnorderedRecv.
+type WorkerPool struct {
+	// OnError, if set, is called with every error returned
+	// by the handler, every recovered handler panic and every
+	// failure to send a reply. It may be called from several
+	// workers at once.
+	OnError func(msg Message, err error)
+
+	socket  ZeroMQSocket
+	handler Handler
+	workers []workerStats
+}
+
+// WorkerStats counts the messages a single worker of a
+// WorkerPool has handled.
+type WorkerStats struct {
+	Processed int64
+	Errored   int64
+	InFlight  int64
+}
+
+// PoolStats counts the messages a WorkerPool has handled,
+// in total and per worker.
+type PoolStats struct {
+	WorkerStats
+	Workers []WorkerStats
+}
+
+type workerStats struct {
+	processed, errored, inFlight int64
+}
+
+// NewWorkerPool returns a WorkerPool that handles the
+// messages received by s with workers goroutines, or with
+// one if workers is not positive.
+func NewWorkerPool(s ZeroMQSocket, workers int, handler Handler) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &WorkerPool{
+		socket:  s,
+		handler: handler,
+		workers: make([]workerStats, workers),
+	}
+}
+
+// Serve handles the messages received by s with a pool of
+// workers goroutines until ctx is done or s is closed; see
+// WorkerPool.Run.
+func Serve(ctx context.Context, s ZeroMQSocket, workers int, handler Handler) error {
+	return NewWorkerPool(s, workers, handler).Run(ctx)
+}
+
+// Run starts the pool's workers and blocks until ctx is done
+// or the socket is closed. Workers stop taking new messages
+// but finish the ones they are handling before Run returns
+// ctx.Err() or ErrSocketClosed. Handler errors and panics
+// are counted and passed to OnError without stopping the
+// pool. A socket that is not one of this package's cannot
+// be served: Run returns an error wrapping ErrNotSupported.
+func (p *WorkerPool) Run(ctx context.Context) error {
+	s, err := socketOf(p.socket)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(p.workers))
+
+	var wg sync.WaitGroup
+	for i := range p.workers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = p.work(ctx, s, &p.workers[i])
+		}(i)
+	}
+	wg.Wait()
+
+	return errs[0]
+}
+
+// work runs a single worker on s.
+func (p *WorkerPool) work(ctx context.Context, s *Socket, stats *workerStats) error {
+	r := s.NewReceiver()
+	defer r.Close()
+
+	for {
+		d, err := r.recv(ctx)
+		if err != nil {
+			return err
+		}
+		msg := Message{Body: d.msg.Body, Source: d.conn.PeerInfo()}
+
+		atomic.AddInt64(&stats.inFlight, 1)
+		err = p.handle(s, msg)
+		atomic.AddInt64(&stats.inFlight, -1)
+
+		atomic.AddInt64(&stats.processed, 1)
+		if err != nil {
+			atomic.AddInt64(&stats.errored, 1)
+			if p.OnError != nil {
+				p.OnError(msg, err)
+			}
+		}
+	}
+}
+
+// handle runs the handler on msg and sends its reply, turning
+// a panic into an error.
+func (p *WorkerPool) handle(s *Socket, msg Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("gomq: handler panicked: %v", r)
+		}
+	}()
+
+	reply, err := p.handler(msg)
+	if err != nil || reply == nil {
+		return err
+	}
+
+	if isReceiveOnly(s.sockType) {
+		return ErrNoReply
+	}
+	return s.SendToPeer(msg.Source.ID, reply)
+}
+
+// Stats returns the pool's counters. Processed includes
+// messages whose handling failed, which are also counted
+// in Errored.
+func (p *WorkerPool) Stats() PoolStats {
+	var stats PoolStats
+	for i := range p.workers {
+		w := WorkerStats{
+			Processed: atomic.LoadInt64(&p.workers[i].processed),
+			Errored:   atomic.LoadInt64(&p.workers[i].errored),
+			InFlight:  atomic.LoadInt64(&p.workers[i].inFlight),
+		}
+		stats.Workers = append(stats.Workers, w)
+
+		stats.Processed += w.Processed
+		stats.Errored += w.Errored
+		stats.InFlight += w.InFlight
+	}
+	return stats
+}
@@ -0,0 +1,116 @@
+package gomq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+func TestWorkerPool(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull())
+	defer server.Close()
+
+	addr, err := server.Bind("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+
+	if err := client.Connect("tcp://" + addr.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	failures := make(chan error, 10)
+	pool := NewWorkerPool(server, 4, func(msg Message) ([]byte, error) {
+		if string(msg.Body) == "PANIC" {
+			panic("boom")
+		}
+		return bytes.ToUpper(msg.Body), nil
+	})
+	pool.OnError = func(msg Message, err error) {
+		failures <- err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- pool.Run(ctx)
+	}()
+
+	const count = 20
+	for i := 0; i < count; i++ {
+		if err := client.Send([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		msg, err := client.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := "HELLO", string(msg); want != got {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+
+	if err := client.Send([]byte("PANIC")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-failures:
+		if err == nil {
+			t.Errorf("want the panic as an error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler panic was not reported")
+	}
+
+	cancel()
+	if want, got := context.Canceled, <-done; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	stats := pool.Stats()
+	if want, got := int64(count+1), stats.Processed; want != got {
+		t.Errorf("want %v processed, got %v", want, got)
+	}
+
+	if want, got := int64(1), stats.Errored; want != got {
+		t.Errorf("want %v errored, got %v", want, got)
+	}
+
+	if want, got := 4, len(stats.Workers); want != got {
+		t.Errorf("want %v workers, got %v", want, got)
+	}
+}
+
+func TestServeSocketClosed(t *testing.T) {
+	pull := NewPull(zmtp.NewSecurityNull())
+
+	done := make(chan error)
+	go func() {
+		done <- Serve(context.Background(), pull, 2, func(msg Message) ([]byte, error) {
+			return nil, nil
+		})
+	}()
+
+	pull.Close()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrSocketClosed) {
+			t.Errorf("want %v, got %v", ErrSocketClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+}
@@ -12,26 +12,29 @@ type PullSocket struct {
 	*Socket
 }
 
-// NewPull accepts a zmtp.SecurityMechanism and returns
-// a PullSocket as a gomq.Pull interface.
-func NewPull(mechanism zmtp.SecurityMechanism) *PullSocket {
-	return &PullSocket{
-		Socket: NewSocket(false, zmtp.PullSocketType, mechanism),
-	}
+// NewPull accepts a zmtp.SecurityMechanism and optional
+// SocketOptions and returns a PullSocket as a
+// gomq.Pull interface.
+func NewPull(mechanism zmtp.SecurityMechanism, opts ...SocketOption) *PullSocket {
+	return mustNew(zmtp.PullSocketType, mechanism, opts).(*PullSocket)
 }
 
 // Bind accepts a zeromq endpoint and binds the
-// push socket to it. Currently the only transport
-// supported is TCP. The endpoint string should be
-// in the format "tcp://<address>:<port>".
+// push socket to it. The supported transports are TCP
+// and unix domain sockets, plus the in-process mem
+// transport, with endpoints in the format
+// "tcp://<address>:<port>", "ipc://<path>" or
+// "mem://<name>"; see ParseEndpoint.
 func (s *PullSocket) Bind(endpoint string) (net.Addr, error) {
 	return BindServer(s, endpoint)
 }
 
 // Connect accepts a zeromq endpoint and connects the
-// pull socket to it. Currently the only transport
-// supported is TCP. The endpoint string should be
-// in the format "tcp://<address>:<port>".
+// pull socket to it. The supported transports are TCP
+// and unix domain sockets, plus the in-process mem
+// transport, with endpoints in the format
+// "tcp://<address>:<port>", "ipc://<path>" or
+// "mem://<name>"; see ParseEndpoint.
 func (c *PullSocket) Connect(endpoint string) error {
 	return ConnectClient(c, endpoint)
 }
@@ -12,26 +12,29 @@ type PushSocket struct {
 	*Socket
 }
 
-// NewPush accepts a zmtp.SecurityMechanism and returns
-// a PushSocket as a gomq.Push interface.
-func NewPush(mechanism zmtp.SecurityMechanism) *PushSocket {
-	return &PushSocket{
-		Socket: NewSocket(false, zmtp.PushSocketType, mechanism),
-	}
+// NewPush accepts a zmtp.SecurityMechanism and optional
+// SocketOptions and returns a PushSocket as a
+// gomq.Push interface.
+func NewPush(mechanism zmtp.SecurityMechanism, opts ...SocketOption) *PushSocket {
+	return mustNew(zmtp.PushSocketType, mechanism, opts).(*PushSocket)
 }
 
 // Bind accepts a zeromq endpoint and binds the
-// push socket to it. Currently the only transport
-// supported is TCP. The endpoint string should be
-// in the format "tcp://<address>:<port>".
+// push socket to it. The supported transports are TCP
+// and unix domain sockets, plus the in-process mem
+// transport, with endpoints in the format
+// "tcp://<address>:<port>", "ipc://<path>" or
+// "mem://<name>"; see ParseEndpoint.
 func (s *PushSocket) Bind(endpoint string) (net.Addr, error) {
 	return BindServer(s, endpoint)
 }
 
 // Connect accepts a zeromq endpoint and connects the
-// client socket to it. Currently the only transport
-// supported is TCP. The endpoint string should be
-// in the format "tcp://<address>:<port>".
+// client socket to it. The supported transports are TCP
+// and unix domain sockets, plus the in-process mem
+// transport, with endpoints in the format
+// "tcp://<address>:<port>", "ipc://<path>" or
+// "mem://<name>"; see ParseEndpoint.
 func (s *PushSocket) Connect(endpoint string) error {
 	return ConnectClient(s, endpoint)
 }
@@ -0,0 +1,132 @@
+package gomq
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// RateLimit bounds how fast the peer of a connection may send
+// to a socket: at most Messages messages and Bytes bytes of
+// message bodies per second, either of which may be zero for
+// no bound. A peer that was quiet may send up to a second's
+// worth at once. The zero RateLimit does not limit anything.
+type RateLimit struct {
+	Messages int
+	Bytes    int
+}
+
+// bucket is a token bucket holding up to a second's worth of
+// rate tokens. It starts full.
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int, now time.Time) *bucket {
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// take takes n tokens at now, going into debt if there are
+// not enough, and returns how long it will be until the debt
+// is paid off.
+func (b *bucket) take(n int, now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiter enforces a RateLimit on the messages read from
+// a connection. It is only used by the connection's reader.
+type rateLimiter struct {
+	messages, bytes *bucket
+	clock           zmtp.Clock
+
+	// throttling is set while the reader is held off, so a
+	// run of throttled messages is reported once.
+	throttling bool
+}
+
+// newRateLimiter returns a rateLimiter for l on clock, or nil
+// if l does not limit anything.
+func newRateLimiter(l RateLimit, clock zmtp.Clock) *rateLimiter {
+	if l.Messages <= 0 && l.Bytes <= 0 {
+		return nil
+	}
+
+	now := clock.Now()
+	r := &rateLimiter{clock: clock}
+	if l.Messages > 0 {
+		r.messages = newBucket(l.Messages, now)
+	}
+	if l.Bytes > 0 {
+		r.bytes = newBucket(l.Bytes, now)
+	}
+	return r
+}
+
+// take accounts for a message of size bytes and returns how
+// long to wait before reading the next one.
+func (r *rateLimiter) take(size int) time.Duration {
+	now := r.clock.Now()
+	var wait time.Duration
+	if r.messages != nil {
+		wait = r.messages.take(1, now)
+	}
+	if r.bytes != nil {
+		if d := r.bytes.take(size, now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// limitRate sets up the rate limit of a connection that is
+// being added to the socket, from the socket's peer rate
+// limit callback if it has one and its inbound rate limit
+// otherwise.
+func (s *Socket) limitRate(conn *Connection) {
+	limit := s.rateLimit
+	if s.peerRateLimit != nil {
+		limit = s.peerRateLimit(conn.PeerInfo())
+	}
+	conn.limiter = newRateLimiter(limit, s.clock)
+}
+
+// throttle holds off reading conn any further while its peer
+// is over its rate limit, emitting EventThrottled as it
+// starts doing so. Meanwhile the peer's messages wait in the
+// kernel's buffers and then at the peer.
+func (s *Socket) throttle(conn *Connection, msg *zmtp.Message) {
+	if conn.limiter == nil {
+		return
+	}
+
+	wait := conn.limiter.take(len(msg.Body))
+	if wait <= 0 {
+		conn.limiter.throttling = false
+		return
+	}
+	if !conn.limiter.throttling {
+		conn.limiter.throttling = true
+		atomic.AddUint64(&conn.throttled, 1)
+		s.emit(Event{Type: EventThrottled, Endpoint: conn.endpoint, Addr: conn.net.RemoteAddr()})
+	}
+
+	timer := conn.clock.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+	case <-conn.closing:
+	}
+}
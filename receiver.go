@@ -0,0 +1,169 @@
+package gomq
+
+import (
+	"context"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// Receiver receives a socket's messages for a single
+// goroutine, so that several goroutines can receive from the
+// same socket without a connection's messages overtaking one
+// another. A connection whose message a Receiver returned is
+// the Receiver's until it asks for its next message or is
+// closed: meanwhile the connection's further messages wait,
+// and the socket's other Receivers, and Recv, are handed
+// messages from other connections. Whoever takes the
+// connection next gets its messages in the order they were
+// read, so that with one Receiver per goroutine every
+// connection's messages are handled one after the other, in
+// order, though not always by the same goroutine.
+//
+// A Receiver that keeps its connection for long holds up that
+// connection's messages, and once as many of them are waiting
+// as the receive queue holds, holds up everyone else's too.
+// A Receiver that is no longer used must be closed.
+//
+// On a socket created WithUnorderedRecv, Receivers keep no
+// connection and take any connection's messages as they come.
+//
+// A Receiver is not safe for use by several goroutines at
+// once.
+type Receiver struct {
+	socket *Socket
+
+	// conn is the connection the Receiver has, if any. It is
+	// guarded by the socket's lock.
+	conn *Connection
+}
+
+// NewReceiver returns a Receiver for the socket's messages.
+func (s *Socket) NewReceiver() *Receiver {
+	return &Receiver{socket: s}
+}
+
+// Recv is like the socket's Recv, but keeps the connection
+// the message arrived on until it is next called.
+func (r *Receiver) Recv() ([]byte, error) {
+	d, err := r.recv(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return d.msg.Body, nil
+}
+
+// RecvWithSource is like Recv but also describes the
+// connection the message arrived on.
+func (r *Receiver) RecvWithSource() ([]byte, PeerInfo, error) {
+	d, err := r.recv(context.Background())
+	if err != nil {
+		return nil, PeerInfo{}, err
+	}
+	return d.msg.Body, d.conn.PeerInfo(), nil
+}
+
+// RecvMessage is like the socket's RecvMessage, but keeps the
+// connection the message arrived on until the Receiver is
+// next called.
+func (r *Receiver) RecvMessage() (*zmtp.Message, PeerInfo, error) {
+	d, err := r.recv(context.Background())
+	if err != nil {
+		return nil, PeerInfo{}, err
+	}
+	return d.msg, d.conn.PeerInfo(), nil
+}
+
+// Close hands back the connection the Receiver has, if any.
+// A closed Receiver may be used again.
+func (r *Receiver) Close() {
+	r.socket.handBack(r)
+}
+
+// recv hands back the Receiver's connection and takes the next
+// message, keeping its connection.
+func (r *Receiver) recv(ctx context.Context) (delivery, error) {
+	r.socket.handBack(r)
+	return r.socket.recvFor(ctx, r)
+}
+
+// handBack hands back the connection r has, letting its next
+// message go to whoever asks first.
+func (s *Socket) handBack(r *Receiver) {
+	s.lock.Lock()
+	conn := r.conn
+	r.conn = nil
+	if conn != nil {
+		conn.claimed = false
+	}
+	waiting := conn != nil && conn.parked > 0
+	s.lock.Unlock()
+
+	if waiting {
+		s.wakeHeld()
+	}
+}
+
+// claim takes d, just taken off the receive queue, giving r,
+// if it is not nil, the connection d arrived on. If another
+// Receiver has the connection, or d is not the next of its
+// messages, d is put aside instead and claim returns false.
+// Receivers take messages off the queue in order but may
+// claim them out of it, so that the next message may still be
+// with another receiver or put aside already. Sockets created
+// WithUnorderedRecv claim nothing.
+func (s *Socket) claim(d delivery, r *Receiver) bool {
+	if s.unorderedRecv {
+		return true
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !d.due() || d.conn.parked > 0 {
+		s.held = append(s.held, d)
+		d.conn.parked++
+		return false
+	}
+	s.takeLocked(d, r)
+	return true
+}
+
+// due reports whether d may be received: no Receiver has its
+// connection, and it is the next of the connection's messages
+// or one that was put back after being received. The caller
+// holds the socket's lock.
+func (d delivery) due() bool {
+	return !d.conn.claimed && d.order <= d.conn.nextOrder
+}
+
+// takeLocked accounts for d being received, giving its
+// connection to r if it is not nil. The caller holds the
+// socket's lock.
+func (s *Socket) takeLocked(d delivery, r *Receiver) {
+	if d.order == d.conn.nextOrder {
+		d.conn.nextOrder++
+	}
+	if r != nil {
+		d.conn.claimed = true
+		r.conn = d.conn
+	}
+}
+
+// heldFull reports whether as many messages have been put
+// aside for the connections Receivers have as the receive
+// queue holds, in which case receivers stop taking messages
+// off the queue until a connection is handed back.
+func (s *Socket) heldFull() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.held) >= cap(s.recvQueue)
+}
+
+// wakeHeld wakes a receiver waiting for messages, to look at
+// those put aside.
+func (s *Socket) wakeHeld() {
+	select {
+	case s.heldReady <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,116 @@
+package gomq
+
+import "sync/atomic"
+
+// ResourceCounts counts what a socket, or every socket, has
+// running: open sockets and the long-lived goroutines that
+// work for them. Each goroutine is counted from just before
+// it starts until it returns, so once a socket is closed and
+// its connections have wound down its counts are all zero.
+// Short-lived helpers, such as the goroutines that close
+// connections in parallel, are not counted.
+type ResourceCounts struct {
+	// Sockets is the number of sockets not yet closed.
+	Sockets int
+
+	// Readers, Writers and Heartbeats are the goroutines
+	// that read from, write to and send heartbeats on
+	// connections.
+	Readers    int
+	Writers    int
+	Heartbeats int
+
+	// Acceptors are the goroutines accepting connections on
+	// bound endpoints, and Handshakes those handshaking with
+	// the connections accepted.
+	Acceptors  int
+	Handshakes int
+
+	// Dialers are the goroutines dialing endpoints,
+	// including those waiting to retry.
+	Dialers int
+
+	// Handlers are the goroutines passing messages to a drop
+	// handler (see SetDropHandler).
+	Handlers int
+}
+
+// Total returns the sum of the counts.
+func (c ResourceCounts) Total() int {
+	return c.Sockets + c.Readers + c.Writers + c.Heartbeats +
+		c.Acceptors + c.Handshakes + c.Dialers + c.Handlers
+}
+
+// resource is a kind of resource counted in ResourceCounts.
+type resource int
+
+const (
+	resSocket resource = iota
+	resReader
+	resWriter
+	resHeartbeat
+	resAcceptor
+	resHandshake
+	resDialer
+	resHandler
+	numResources
+)
+
+// resources holds a count per resource kind, accessed
+// atomically.
+type resources [numResources]int64
+
+func (r *resources) counts() ResourceCounts {
+	load := func(k resource) int {
+		return int(atomic.LoadInt64(&r[k]))
+	}
+	return ResourceCounts{
+		Sockets:    load(resSocket),
+		Readers:    load(resReader),
+		Writers:    load(resWriter),
+		Heartbeats: load(resHeartbeat),
+		Acceptors:  load(resAcceptor),
+		Handshakes: load(resHandshake),
+		Dialers:    load(resDialer),
+		Handlers:   load(resHandler),
+	}
+}
+
+// allResources counts the resources of every socket.
+var allResources resources
+
+// acquire counts a resource of kind k for the socket.
+func (s *Socket) acquire(k resource) {
+	atomic.AddInt64(&s.resources[k], 1)
+	atomic.AddInt64(&allResources[k], 1)
+}
+
+// release stops counting a resource acquired before.
+func (s *Socket) release(k resource) {
+	atomic.AddInt64(&s.resources[k], -1)
+	atomic.AddInt64(&allResources[k], -1)
+}
+
+// spawn runs f on a goroutine of its own, counted as a
+// resource of kind k until f returns.
+func (s *Socket) spawn(k resource, f func()) {
+	s.acquire(k)
+	go func() {
+		defer s.release(k)
+		f()
+	}()
+}
+
+// ActiveResources returns what the socket has running. A
+// socket that keeps counting goroutines long after it was
+// closed leaks them.
+func (s *Socket) ActiveResources() ResourceCounts {
+	return s.resources.counts()
+}
+
+// Diagnostics returns what every socket of the process has
+// running, including sockets that were closed but still have
+// goroutines winding down.
+func Diagnostics() ResourceCounts {
+	return allResources.counts()
+}
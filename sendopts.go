@@ -0,0 +1,46 @@
+package gomq
+
+import "time"
+
+// SendOptions adjusts how SendOpts sends a single message.
+// The zero value of each field leaves the socket's own
+// behaviour as it is, so the zero SendOptions sends like
+// Send.
+type SendOptions struct {
+	// DontWait makes the send return ErrWouldBlock rather
+	// than wait when no connection has room for the
+	// message, as SendDontWait does.
+	DontWait bool
+
+	// TTL is how long the message may wait in a send queue
+	// before it is discarded instead of sent, in place of
+	// the socket's send TTL (see WithSendTTL).
+	TTL time.Duration
+
+	// PeerID sends the message to the connection with that
+	// id, as SendToPeer does, rather than taking turns
+	// between connections.
+	PeerID ConnID
+
+	// More marks the message as a frame of a multipart
+	// message with more to follow. CLIENT and SERVER
+	// sockets only carry single-part messages, so SendOpts
+	// returns ErrMultipart if it is set.
+	More bool
+}
+
+// SendOpts sends a message like Send, but with opts applied
+// to this message alone.
+func (s *Socket) SendOpts(b []byte, opts SendOptions) error {
+	switch {
+	case opts.More:
+		return ErrMultipart
+	case opts.PeerID != "":
+		_, err := s.sendToPeer(opts.PeerID, b, opts.TTL, opts.DontWait)
+		return err
+	case opts.DontWait:
+		return s.sendDontWait(b, opts.TTL)
+	default:
+		return s.send(b, opts.TTL)
+	}
+}
@@ -12,18 +12,53 @@ type ServerSocket struct {
 	*Socket
 }
 
-// NewServer accepts a zmtp.SecurityMechanism and returns
-// a ServerSocket as a gomq.Server interface.
-func NewServer(mechanism zmtp.SecurityMechanism) Server {
-	return &ServerSocket{
-		Socket: NewSocket(true, zmtp.ServerSocketType, mechanism),
-	}
+// NewServer accepts a zmtp.SecurityMechanism and optional
+// SocketOptions and returns a ServerSocket as a
+// gomq.Server interface.
+func NewServer(mechanism zmtp.SecurityMechanism, opts ...SocketOption) Server {
+	return mustNew(zmtp.ServerSocketType, mechanism, opts).(*ServerSocket)
 }
 
 // Bind accepts a zeromq endpoint and binds the
-// server socket to it. Currently the only transport
-// supported is TCP. The endpoint string should be
-// in the format "tcp://<address>:<port>".
+// server socket to it. The supported transports are TCP
+// and unix domain sockets, plus the in-process mem
+// transport, with endpoints in the format
+// "tcp://<address>:<port>", "ipc://<path>" or
+// "mem://<name>"; see ParseEndpoint.
 func (s *ServerSocket) Bind(endpoint string) (net.Addr, error) {
 	return BindServer(s, endpoint)
 }
+
+// Broadcast queues b to every peer connected to the server
+// and returns how many it was queued to. It takes the peers
+// connected when it is called, so a peer that connects while
+// it is at it does not get the message, and never waits: a
+// peer whose send queue is full is skipped and the message
+// counted as dropped for it (see Dropped), whatever the HWM
+// policy. Each peer gets the whole message or none of it.
+// Broadcast returns ErrNotConnected if the server has no
+// peers.
+func (s *ServerSocket) Broadcast(b []byte) (int, error) {
+	s.lock.RLock()
+	conns := make([]*Connection, 0, len(s.ids))
+	for _, id := range s.ids {
+		conns = append(conns, s.conns[id])
+	}
+	s.lock.RUnlock()
+
+	if len(conns) == 0 {
+		return 0, ErrNotConnected
+	}
+
+	delivered := 0
+	for _, conn := range conns {
+		switch {
+		case conn.trySend(b, 0):
+			delivered++
+			s.delivered()
+		case !conn.isStopping():
+			s.drop(conn, b)
+		}
+	}
+	return delivered, nil
+}
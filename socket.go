@@ -1,7 +1,13 @@
 package gomq
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zeromq/gomq/zmtp"
@@ -11,59 +17,640 @@ import (
 // not be used directly. Specifically typed sockets such
 // as ClientSocket, ServerSocket, etc embed this type.
 type Socket struct {
-	sockType      zmtp.SocketType
-	asServer      bool
-	conns         map[string]*Connection
-	ids           []string
-	retryInterval time.Duration
-	lock          *sync.RWMutex
-	mechanism     zmtp.SecurityMechanism
-	recvChannel   chan *zmtp.Message
-}
-
-// NewSocket accepts an asServer boolean, zmtp.SocketType and a zmtp.SecurityMechanism
-// and returns a *Socket.
-func NewSocket(asServer bool, sockType zmtp.SocketType, mechanism zmtp.SecurityMechanism) *Socket {
-	return &Socket{
-		lock:          &sync.RWMutex{},
-		asServer:      asServer,
-		sockType:      sockType,
-		retryInterval: defaultRetry,
-		mechanism:     mechanism,
-		conns:         make(map[string]*Connection),
-		ids:           make([]string, 0),
-		recvChannel:   make(chan *zmtp.Message),
-	}
-}
-
-// AddConnection adds a gomq.Connection to the socket.
-// It is goroutine safe.
+	sockType          zmtp.SocketType
+	asServer          bool
+	conns             map[string]*Connection
+	ids               []string
+	listeners         []*listener
+	listen            func(network, address string) (net.Listener, error)
+	ctx               *Context
+	keepFDs           bool
+	ipFamily          IPFamily
+	lastEndpoints     []string
+	dropped           uint64
+	dropping          int32
+	dropHandler       func(peer PeerInfo, msg []byte)
+	dropQueue         chan dropped
+	dialers           []*dialer
+	closed            bool
+	done              chan struct{}
+	doneOnce          sync.Once
+	peersChanged      chan struct{}
+	maxConns          int
+	connLimitPolicy   ConnLimitPolicy
+	acceptedConns     int
+	acceptFreed       chan struct{}
+	maxHandshakes     int
+	handshakes        []*pendingHandshake
+	evictedHandshakes uint64
+	handshakeSlots    chan struct{}
+	inFlight          int64
+	acceptHigh        int64
+	acceptLow         int64
+	backlog           int
+	inbound           int64
+	inboundBytes      int64
+	recvBufferBytes   int64
+	recvFreed         chan struct{}
+	sendBufferBytes   int64
+	sendTTL           time.Duration
+	stats             *messageStats
+	announceClose     bool
+	rateLimit         RateLimit
+	peerRateLimit     func(peer PeerInfo) RateLimit
+	connFinalizer     func(peer PeerInfo, values map[interface{}]interface{})
+	reconnectHook     func(endpoint string, attempt int, lastErr error) (string, bool)
+	recvInterceptor   func(peer PeerInfo, msg *zmtp.Message) bool
+	filtered          uint64
+	expired           uint64
+	discarded         uint64
+	dedup             *dedup
+	duplicates        uint64
+	ackTimeout        time.Duration
+	maxRedeliveries   int
+	rejected          uint64
+	strictSendOnly    bool
+	unorderedRecv     bool
+	optionsSet        map[string]bool
+	retryInterval     time.Duration
+	linger            time.Duration
+	sendTimeout       time.Duration
+	minPeers          int
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	writeTimeout      time.Duration
+	readIdleTimeout   time.Duration
+	maxCommandSize    int64
+	parallelConns     int
+	timestamps        bool
+	sendHWM           int
+	recvHWM           int
+	defaults          Defaults
+	hwmPolicy         HWMPolicy
+	next              int
+	lock              *sync.RWMutex
+	mechanism         zmtp.SecurityMechanism
+	mechanisms        []zmtp.SecurityMechanismType
+	strictMechanism   *bool
+	codec             Codec
+	clock             zmtp.Clock
+	manualRead        func(conn *Connection)
+	recvChannel       chan *zmtp.Message
+	recvQueue         chan delivery
+	held              []delivery
+	history           attempts
+	heldReady         chan struct{}
+	recvGate          chan struct{}
+	monitor           chan<- Event
+	resources         resources
+}
+
+// NewSocket accepts an asServer boolean, zmtp.SocketType, a zmtp.SecurityMechanism
+// and optional SocketOptions and returns a *Socket.
+func NewSocket(asServer bool, sockType zmtp.SocketType, mechanism zmtp.SecurityMechanism, opts ...SocketOption) *Socket {
+	s := &Socket{
+		lock:            &sync.RWMutex{},
+		asServer:        asServer,
+		sockType:        sockType,
+		ackTimeout:      defaultAckTimeout,
+		maxRedeliveries: defaultMaxRedeliveries,
+		mechanism:       mechanism,
+		conns:           make(map[string]*Connection),
+		ids:             make([]string, 0),
+		peersChanged:    make(chan struct{}),
+		acceptFreed:     make(chan struct{}),
+		done:            make(chan struct{}),
+		listen:          net.Listen,
+		ctx:             defaultContext,
+		recvChannel:     make(chan *zmtp.Message),
+		heldReady:       make(chan struct{}, 1),
+		recvFreed:       make(chan struct{}),
+		clock:           zmtp.RealClock{},
+	}
+
+	s.applyDefaults(CurrentDefaults())
+	for _, opt := range opts {
+		opt(s)
+	}
+	// Validate reports a high water mark that is not
+	// positive.
+	s.recvQueue = make(chan delivery, max(s.recvHWM, 0))
+	if s.dedup != nil {
+		// WithClock may come after WithDedup.
+		s.dedup.clock = s.clock
+	}
+
+	s.acquire(resSocket)
+	return s
+}
+
+// socketKind is what gomq has for a socket type: wrap wraps
+// a *Socket in the type returned for it, and connects and
+// binds tell whether that type has Connect and Bind methods.
+type socketKind struct {
+	wrap            func(*Socket) ZeroMQSocket
+	connects, binds bool
+}
+
+// socketKinds holds the socket types gomq supports.
+var socketKinds = map[zmtp.SocketType]socketKind{
+	zmtp.ClientSocketType: {wrap: func(s *Socket) ZeroMQSocket {
+		return &ClientSocket{Socket: s, turn: make(chan struct{}, 1), owed: make(map[*Connection]int)}
+	}, connects: true},
+	zmtp.ServerSocketType: {wrap: func(s *Socket) ZeroMQSocket { return &ServerSocket{Socket: s} }, binds: true},
+	zmtp.PushSocketType:   {wrap: func(s *Socket) ZeroMQSocket { return &PushSocket{Socket: s} }, connects: true, binds: true},
+	zmtp.PullSocketType:   {wrap: func(s *Socket) ZeroMQSocket { return &PullSocket{Socket: s} }, connects: true, binds: true},
+}
+
+// New returns a socket of the given type, such as a
+// *ClientSocket for zmtp.ClientSocketType, which only
+// handshakes with the peer types zmtp.Capabilities lists
+// for it. It returns an error wrapping ErrUnknownSocketType
+// for a type gomq does not support. NewClient, NewServer,
+// NewPush and NewPull are shorthands for it.
+func New(sockType zmtp.SocketType, mechanism zmtp.SecurityMechanism, opts ...SocketOption) (ZeroMQSocket, error) {
+	kind, ok := socketKinds[sockType]
+	if _, known := zmtp.Capabilities(sockType); !ok || !known {
+		return nil, fmt.Errorf("%w %q", ErrUnknownSocketType, sockType)
+	}
+	return kind.wrap(NewSocket(sockType == zmtp.ServerSocketType, sockType, mechanism, opts...)), nil
+}
+
+// mustNew is New for the types gomq has a constructor for.
+func mustNew(sockType zmtp.SocketType, mechanism zmtp.SecurityMechanism, opts []SocketOption) ZeroMQSocket {
+	s, err := New(sockType, mechanism, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// AddConnection adds a gomq.Connection to the socket
+// and starts reading its messages (unless the socket was
+// created WithManualRead) and writing its queued messages,
+// sizing its send queue to the socket's high water mark
+// (see WithSendHWM). If the socket has been closed the
+// connection is closed instead. It is goroutine safe.
 func (s *Socket) AddConnection(conn *Connection) {
+	s.addConnection(conn)
+}
+
+// addConnection is AddConnection, reporting whether the
+// connection was added. A connection whose dialer was stopped
+// is closed like one added to a closed socket: checking under
+// the lock means removeDialed either finds it or it is not
+// added.
+func (s *Socket) addConnection(conn *Connection) bool {
 	s.lock.Lock()
+	if s.closed || (conn.dialer != nil && conn.dialer.stopped()) {
+		if conn.accepted {
+			s.releaseAcceptedLocked(1)
+		}
+		s.lock.Unlock()
+		conn.net.Close()
+		return false
+	}
+
 	uuid, err := newUUID()
 	if err != nil {
 		panic(err)
 	}
 
+	conn.id = uuid
+	conn.socket = s
+	conn.clock = s.clock
+	atomic.StoreInt64(&conn.lastRecv, s.clock.Now().UnixNano())
+	conn.sendLimit = s.sendBufferBytes
+	conn.sendTTL = s.sendTTL
+	conn.announce = s.announceClose
+	if cap(conn.sendQueue) != s.sendHWM {
+		conn.sendQueue = make(chan outbound, s.sendHWM)
+	}
 	s.conns[uuid] = conn
 	s.ids = append(s.ids, uuid)
+	s.notifyPeers()
 	s.lock.Unlock()
+
+	s.limitRate(conn)
+
+	s.spawn(resWriter, func() {
+		if err := conn.writer(); err != nil {
+			s.teardown(conn, err)
+		}
+	})
+
+	if s.heartbeatInterval > 0 {
+		s.spawn(resHeartbeat, func() { s.heartbeat(conn) })
+	}
+
+	if s.manualRead != nil {
+		s.manualRead(conn)
+		return true
+	}
+	s.spawn(resReader, func() { s.forward(conn) })
+	return true
 }
 
-// RemoveConnection accepts the uuid of a connection
-// and removes that gomq.Connection from the socket
-// if it exists. FIXME will bomb if uuid does not
-// exist in map
-func (s *Socket) RemoveConnection(uuid string) {
+// forward reads the messages of a connection and hands them
+// over to the socket's receive queue, keeping count of the
+// messages that are waiting to be received. While receiving
+// is paused it holds on to the frame it has read, which stops
+// reading after that frame. On send-only sockets it discards
+// the messages instead, see unexpected.
+func (s *Socket) forward(conn *Connection) {
+	sendOnly := isSendOnly(s.sockType)
+	for {
+		msg, err := s.readNext(conn)
+		if err != nil {
+			return
+		}
+		if sendOnly {
+			if !s.unexpected(conn) {
+				return
+			}
+			s.throttle(conn, msg)
+			continue
+		}
+		if s.deduplicated(msg.Body) {
+			s.throttle(conn, msg)
+			continue
+		}
+
+		s.lock.RLock()
+		gate := s.recvGate
+		interceptor := s.recvInterceptor
+		s.lock.RUnlock()
+
+		if gate != nil {
+			select {
+			case <-gate:
+			case <-conn.closing:
+			}
+		}
+
+		if interceptor != nil {
+			deliver, err := s.intercept(interceptor, conn, msg)
+			if err != nil {
+				s.teardown(conn, err)
+				return
+			}
+			if !deliver {
+				s.throttle(conn, msg)
+				continue
+			}
+		}
+
+		if !s.reserveRecv(conn, msg.Body) {
+			return
+		}
+		select {
+		case s.recvQueue <- s.enqueued(delivery{msg: msg, conn: conn, order: conn.queuedOrder}):
+		case <-conn.closing:
+			s.unreserveRecv(msg.Body)
+			return
+		case <-s.done:
+			s.unreserveRecv(msg.Body)
+			return
+		}
+		conn.queuedOrder++
+		s.throttle(conn, msg)
+	}
+}
+
+// unexpected deals with a message a peer sent to a
+// send-only socket, where nothing would receive it: it counts
+// it as discarded or, on a socket created WithStrictSendOnly,
+// tears the connection down. It reports whether to go on
+// reading the connection.
+func (s *Socket) unexpected(conn *Connection) bool {
+	atomic.AddUint64(&s.discarded, 1)
+	if s.strictSendOnly {
+		s.teardown(conn, ErrUnexpectedMessage)
+		return false
+	}
+	return true
+}
+
+// Discarded returns the number of messages peers sent to the
+// socket that were discarded because the socket does not
+// receive, such as a PUSH socket's.
+func (s *Socket) Discarded() uint64 {
+	return atomic.LoadUint64(&s.discarded)
+}
+
+// readNext reads the next message of a connection for the
+// application, dealing with heartbeat commands on the way.
+// A read error tears the connection down; the failure
+// belongs to this connection alone, so it is reported as a
+// disconnect rather than to Recv.
+func (s *Socket) readNext(conn *Connection) (*zmtp.Message, error) {
+	for {
+		msg, err := conn.zmtp.ReadMessage()
+		if err != nil {
+			s.teardown(conn, err)
+			return nil, err
+		}
+		conn.received()
+
+		if msg.MessageType == zmtp.CommandMessage {
+			if msg.Name == "PONG" {
+				conn.pong(msg.Body)
+			}
+			continue
+		}
+		if msg.MessageType == zmtp.ErrorMessage {
+			// Anything the peer still sends after announcing
+			// its departure is delivered as usual; the
+			// command only changes how the connection's end
+			// is reported. Other commands gomq does not know
+			// are ignored, as libzmq ignores them.
+			if msg.Name == disconnectCommand {
+				atomic.StoreInt32(&conn.departed, 1)
+			}
+			continue
+		}
+		atomic.StoreUint64(&conn.recvSeq, msg.Seq)
+		return msg, nil
+	}
+}
+
+// markClosed marks the socket as closed, turning away new
+// connections.
+func (s *Socket) markClosed() {
 	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed {
+		s.release(resSocket)
+	}
+	s.closed = true
+}
+
+// stopRecv wakes up everyone waiting on s.done, failing
+// pending and future receives with ErrSocketClosed.
+func (s *Socket) stopRecv() {
+	s.doneOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// recvContext is like recv but also gives up when ctx is
+// done.
+func (s *Socket) recvContext(ctx context.Context) (delivery, error) {
+	return s.recvFor(ctx, nil)
+}
+
+// recvFor is like recvContext, for r if it is not nil. It
+// only returns a message whose connection no Receiver has,
+// and gives it to r. Without r the connection is only kept
+// until recvFor returns, so that concurrent receives hand
+// out each connection's messages one at a time, in order.
+func (s *Socket) recvFor(ctx context.Context, r *Receiver) (delivery, error) {
+	if err := s.canRecv(); err != nil {
+		return delivery{}, err
+	}
+	if r == nil && !s.unorderedRecv {
+		r = s.NewReceiver()
+		defer r.Close()
+	}
+
+	for {
+		if d, ok := s.takeHeld(r); ok {
+			s.took(d)
+			return d, nil
+		}
+
+		queue := s.recvQueue
+		if s.heldFull() {
+			queue = nil
+		}
+		select {
+		case d := <-queue:
+			if !s.claim(d, r) {
+				continue
+			}
+			s.took(d)
+			return d, nil
+		case <-s.heldReady:
+		case <-ctx.Done():
+			return delivery{}, ctx.Err()
+		case <-s.done:
+			// What was received before the socket closed is
+			// still delivered.
+			if d, ok := s.takeHeld(r); ok {
+				s.took(d)
+				return d, nil
+			}
+			select {
+			case d := <-queue:
+				if !s.claim(d, r) {
+					continue
+				}
+				s.took(d)
+				return d, nil
+			default:
+				return delivery{}, ErrSocketClosed
+			}
+		}
+	}
+}
+
+// hold puts a message that was taken off the receive queue
+// back, to be returned by the next receive ahead of anything
+// still queued.
+func (s *Socket) hold(d delivery) {
+	atomic.AddInt64(&s.inbound, 1)
+	if s.recvBufferBytes > 0 {
+		atomic.AddInt64(&s.inboundBytes, queuedSize(d.msg.Body))
+	}
+
+	// Its time in the queue was counted already.
+	d.queued = 0
+
+	s.lock.Lock()
+	s.held = append([]delivery{d}, s.held...)
+	d.conn.parked++
+	s.lock.Unlock()
+
+	s.wakeHeld()
+}
+
+// takeHeld takes the first message put back by hold or put
+// aside by claim that is due, giving its connection to r.
+func (s *Socket) takeHeld(r *Receiver) (delivery, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, d := range s.held {
+		if !s.unorderedRecv && !d.due() {
+			continue
+		}
+		s.held = append(s.held[:i], s.held[i+1:]...)
+		d.conn.parked--
+		if !s.unorderedRecv {
+			s.takeLocked(d, r)
+		}
+
+		// Someone else waiting may be able to take the next
+		// of these, or to go back to the queue now that
+		// there is room.
+		s.wakeHeld()
+		return d, true
+	}
+	return delivery{}, false
+}
+
+// tryRecv takes the next message off the receive queue if
+// there is one, without waiting.
+func (s *Socket) tryRecv() (delivery, bool) {
+	for {
+		if d, ok := s.takeHeld(nil); ok {
+			s.took(d)
+			return d, true
+		}
+		select {
+		case d := <-s.recvQueue:
+			if !s.claim(d, nil) {
+				continue
+			}
+			s.took(d)
+			return d, true
+		default:
+			return delivery{}, false
+		}
+	}
+}
+
+// recv takes the next message off the receive queue, or
+// returns ErrSocketClosed once the socket is closed.
+func (s *Socket) recv() (delivery, error) {
+	return s.recvContext(context.Background())
+}
+
+// removeConnection removes conn from the socket. It
+// returns false if conn was not part of the socket.
+func (s *Socket) removeConnection(conn *Connection) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conns[conn.id] != conn {
+		return false
+	}
+
 	for k, v := range s.ids {
-		if v == uuid {
+		if v == conn.id {
 			s.ids = append(s.ids[:k], s.ids[k+1:]...)
+			break
 		}
 	}
-	s.conns[uuid].net.Close()
-	delete(s.conns, uuid)
-	s.lock.Unlock()
+	delete(s.conns, conn.id)
+	s.notifyPeers()
+	if conn.accepted {
+		s.releaseAcceptedLocked(1)
+	}
+	return true
+}
+
+// teardown is the single place connections that failed are
+// removed from the socket: it closes the connection, which
+// stops its reader and writer, reports the disconnect and,
+// if the connection was dialed, starts reconnecting to its
+// endpoint. Tearing down a connection more than once, or one
+// that has already been removed, does nothing.
+func (s *Socket) teardown(conn *Connection, err error) {
+	if !s.removeConnection(conn) {
+		return
+	}
+
+	conn.close(0)
+	s.releaseValues(conn)
+	if atomic.LoadInt32(&conn.departed) != 0 {
+		s.emit(Event{Type: EventPeerDeparted, Endpoint: conn.endpoint, Addr: conn.net.RemoteAddr()})
+	}
+	s.emit(Event{Type: EventDisconnected, Endpoint: conn.endpoint, Addr: conn.net.RemoteAddr(), Err: err})
+
+	if conn.dialer != nil {
+		s.redial(conn.dialer, err)
+	}
+}
+
+// RemoveConnection accepts the uuid of a connection
+// and removes that gomq.Connection from the socket
+// if it exists.
+func (s *Socket) RemoveConnection(uuid string) {
+	s.lock.RLock()
+	conn, ok := s.conns[uuid]
+	s.lock.RUnlock()
+
+	if ok && s.removeConnection(conn) {
+		conn.close(0)
+		s.releaseValues(conn)
+	}
+}
+
+// notifyPeers wakes up everyone waiting for the set of
+// connections to change. The caller must hold the lock.
+func (s *Socket) notifyPeers() {
+	close(s.peersChanged)
+	s.peersChanged = make(chan struct{})
+}
+
+// PeerCount returns the number of fully handshaked
+// connections of the socket.
+func (s *Socket) PeerCount() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.ids)
+}
+
+// Connected reports whether the socket has at least
+// one fully handshaked connection.
+func (s *Socket) Connected() bool {
+	return s.PeerCount() > 0
+}
+
+// WaitForPeers blocks until the socket has at least n fully
+// handshaked connections, or until ctx is done in which case
+// the context's error is returned.
+func (s *Socket) WaitForPeers(ctx context.Context, n int) error {
+	for {
+		changed, ok := s.peersAtLeast(n)
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// waitForPeers is like WaitForPeers but gives up with
+// ErrTimeout when timeout fires. A nil timeout waits
+// indefinitely.
+func (s *Socket) waitForPeers(n int, timeout <-chan time.Time) error {
+	for {
+		changed, ok := s.peersAtLeast(n)
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return ErrTimeout
+		}
+	}
+}
+
+// peersAtLeast reports whether the socket has at least n
+// connections. If not, it returns a channel that is closed
+// when the set of connections changes.
+func (s *Socket) peersAtLeast(n int) (<-chan struct{}, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.peersChanged, len(s.ids) >= n
 }
 
 // RetryInterval returns the retry interval used
@@ -79,36 +666,549 @@ func (s *Socket) SocketType() zmtp.SocketType {
 
 // SecurityMechanism returns the Socket's zmtp.SecurityMechanism.
 func (s *Socket) SecurityMechanism() zmtp.SecurityMechanism {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	return s.mechanism
 }
 
-// RecvChannel returns the Socket's receive channel used
-// for receiving messages.
+// SetMechanism replaces the security mechanism the socket
+// uses for the connections it establishes from now on,
+// dialed, accepted or redialed, for instance to move peers
+// from PLAIN over to CURVE without losing queued messages.
+// Handshakes already under way finish with the mechanism
+// they started with, and established connections keep
+// theirs until they are torn down; the mechanism of each is
+// in its PeerInfo's Negotiated. It is goroutine safe.
+func (s *Socket) SetMechanism(m zmtp.SecurityMechanism) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.mechanism = m
+}
+
+// RecvChannel returns the Socket's legacy receive channel.
+//
+// Deprecated: received messages are no longer delivered on
+// this channel. Use Recv or RecvWithSource instead.
 func (s *Socket) RecvChannel() chan *zmtp.Message {
 	return s.recvChannel
 }
 
 // Close closes all underlying transport connections
-// for the socket.
+// for the socket. Messages still queued for sending are
+// given the socket's linger duration to be written out
+// (see WithLinger) before the connections are torn down.
 func (s *Socket) Close() {
+	s.close(s.linger)
+}
+
+// CloseWithTimeout is like Close, but takes at most about
+// timeout, however long the socket's linger. Connections that
+// have not written out their queued messages by then, e.g.
+// to a peer that stopped reading, are closed regardless and
+// a *CloseError listing their endpoints is returned. A
+// negative timeout is the same as Close.
+func (s *Socket) CloseWithTimeout(timeout time.Duration) error {
+	if timeout < 0 || (s.linger >= 0 && s.linger <= timeout) {
+		s.close(s.linger)
+		return nil
+	}
+
+	if forced := s.close(timeout); len(forced) > 0 {
+		return &CloseError{Endpoints: forced}
+	}
+	return nil
+}
+
+// close closes the socket, giving its connections linger to
+// write out their queued messages. It returns the endpoints
+// of the connections that did not finish in time.
+func (s *Socket) close(linger time.Duration) []string {
+	s.markClosed()
+	s.stopRecv()
+	s.ctx.remove(s)
+
+	s.stopDialers()
+	s.closeListeners()
+	return s.closeConnections(linger)
+}
+
+// closeConnections removes all connections from the socket
+// and closes them with the given linger. It returns the
+// endpoints of those whose writers had not finished, like
+// closeAll.
+func (s *Socket) closeConnections(linger time.Duration) []string {
+	conns := s.removeConnections()
+	forced := closeAll(conns, linger)
+	for _, conn := range conns {
+		s.releaseValues(conn)
+	}
+	return forced
+}
+
+// removeConnections removes all connections from the
+// socket and returns them.
+func (s *Socket) removeConnections() map[string]*Connection {
 	s.lock.Lock()
-	for k, v := range s.ids {
-		s.conns[v].net.Close()
-		s.ids = append(s.ids[:k], s.ids[k+1:]...)
+	conns := s.conns
+	s.conns = make(map[string]*Connection)
+	s.ids = s.ids[:0]
+	s.notifyPeers()
+
+	accepted := 0
+	for _, conn := range conns {
+		if conn.accepted {
+			accepted++
+		}
+	}
+	if accepted > 0 {
+		s.releaseAcceptedLocked(accepted)
 	}
 	s.lock.Unlock()
+
+	return conns
+}
+
+// closeAll closes conns concurrently with the given linger.
+// It returns the endpoints of those whose writers had not
+// finished by the time they were closed, sorted.
+func closeAll(conns map[string]*Connection, linger time.Duration) []string {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		forced []string
+	)
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *Connection) {
+			defer wg.Done()
+			if !conn.close(linger) {
+				mu.Lock()
+				forced = append(forced, conn.endpoint)
+				mu.Unlock()
+			}
+		}(conn)
+	}
+	wg.Wait()
+
+	sort.Strings(forced)
+	return forced
+}
+
+func (s *Socket) base() *Socket {
+	return s
 }
 
 // Recv receives a message from the Socket's
-// message channel and returns it.
+// message channel and returns it. A zero-length message is
+// returned as an empty, non-nil slice.
+//
+// Recv only fails when the socket itself does: once the
+// socket is closed it returns the messages that had already
+// been received, and then ErrSocketClosed. On a socket whose
+// type never receives, such as PUSH, it returns an
+// *UnsupportedError. A connection
+// that fails is torn down on its own and reported as an
+// EventDisconnected carrying the error (see WithMonitor),
+// while Recv goes on waiting for messages from the other
+// connections, or from new ones if that was the last; the
+// messages received from it before it failed are delivered
+// all the same.
+//
+// Several goroutines may call Recv at once. They are handed
+// each connection's messages one at a time, in the order they
+// were read: a connection's next message is only handed out
+// once the Recv returning the one before has returned, and
+// meanwhile the others get other connections' messages. What
+// the callers do with the messages once they have them is up
+// to them, so goroutines that must also handle each
+// connection's messages in order should receive with a
+// Receiver each instead. On a socket created
+// WithUnorderedRecv each caller takes the next message
+// whatever connection it came from, and the messages of a
+// connection may be handed out in parallel.
 func (s *Socket) Recv() ([]byte, error) {
-	msg := <-s.recvChannel
-	if msg.MessageType == zmtp.CommandMessage {
+	d, err := s.recv()
+	if err != nil {
+		return nil, err
 	}
-	return msg.Body, msg.Err
+	return d.msg.Body, nil
 }
 
-// Send sends a message. FIXME should use a channel.
+// PauseRecv stops reading messages from the socket's
+// connections without dropping them, so TCP flow control
+// holds further messages at the senders. Messages that
+// were already waiting to be received can still be read
+// with Recv. Pausing a paused socket does nothing.
+func (s *Socket) PauseRecv() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.recvGate == nil {
+		s.recvGate = make(chan struct{})
+	}
+}
+
+// ResumeRecv resumes reading messages after PauseRecv.
+// Resuming a socket that is not paused does nothing.
+func (s *Socket) ResumeRecv() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.recvGate != nil {
+		close(s.recvGate)
+		s.recvGate = nil
+	}
+}
+
+// RecvWithSource is like Recv but also describes the
+// connection the message arrived on.
+func (s *Socket) RecvWithSource() ([]byte, PeerInfo, error) {
+	d, err := s.recv()
+	if err != nil {
+		return nil, PeerInfo{}, err
+	}
+	return d.msg.Body, d.conn.PeerInfo(), nil
+}
+
+// RecvMessage is like RecvWithSource but returns the message
+// as it was read, numbered in the order it was read from its
+// connection and, on a socket created WithTimestamps, stamped
+// with when, so that the time it spent waiting to be received
+// is time.Since(msg.ReceivedAt).
+func (s *Socket) RecvMessage() (*zmtp.Message, PeerInfo, error) {
+	d, err := s.recv()
+	if err != nil {
+		return nil, PeerInfo{}, err
+	}
+	return d.msg, d.conn.PeerInfo(), nil
+}
+
+// RecvInto is like Recv but copies the message into buf and
+// returns its length. If the message does not fit it is left
+// to be received next, and a *BufferTooSmallError giving the
+// size needed is returned.
+func (s *Socket) RecvInto(buf []byte) (int, error) {
+	d, err := s.recv()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(d.msg.Body) > len(buf) {
+		s.hold(d)
+		return 0, &BufferTooSmallError{Size: len(d.msg.Body)}
+	}
+	return copy(buf, d.msg.Body), nil
+}
+
+// Send queues a message to be written to the socket's
+// connections, taking turns between them. It returns
+// ErrNotConnected if the socket has no connections, after
+// first waiting for the minimum number of peers if one is
+// configured (see WithMinPeers). Connections whose send
+// queues are full lose their turn, and keep losing it until
+// their queues have drained to half the high water mark.
+// Only when every queue is full does the socket's HWMPolicy
+// come in: HWMBlock waits for any of them to have room and
+// HWMDrop drops the message. A connection that goes away
+// while Send is at it hands its turn on to the others, and
+// if none is left Send returns ErrNotConnected. On a socket
+// whose type never sends, such as PULL, it returns an
+// *UnsupportedError. An empty or nil b is sent as a
+// zero-length message.
 func (s *Socket) Send(b []byte) error {
-	return s.conns[s.ids[0]].zmtp.SendFrame(b)
+	return s.send(b, 0)
+}
+
+// send is Send, giving the message a TTL of ttl, or the
+// socket's send TTL if ttl is zero.
+func (s *Socket) send(b []byte, ttl time.Duration) error {
+	_, err := s.sendVia(b, ttl)
+	return err
+}
+
+// sendVia is send, also returning the connection the message
+// was queued on, or nil if the HWM policy dropped it.
+func (s *Socket) sendVia(b []byte, ttl time.Duration) (*Connection, error) {
+	if err := s.canSend(); err != nil {
+		return nil, err
+	}
+
+	var timeout <-chan time.Time
+	if s.sendTimeout >= 0 {
+		timer := s.clock.NewTimer(s.sendTimeout)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+
+	if s.minPeers > 0 && !isReceiveOnly(s.sockType) {
+		if err := s.waitForPeers(s.minPeers, timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		conns := s.inTurn()
+		if len(conns) == 0 {
+			return nil, ErrNotConnected
+		}
+
+		if conn := queueAny(conns, b, ttl); conn != nil {
+			s.delivered()
+			return conn, nil
+		}
+
+		var (
+			conn *Connection
+			err  error
+		)
+		if s.hwmPolicy == HWMDrop {
+			var queued bool
+			if queued, err = s.sendOn(conns[0], b, ttl, timeout); queued {
+				conn = conns[0]
+			}
+		} else if conn, err = queueWait(conns, b, ttl, timeout); err == nil {
+			s.delivered()
+		}
+		if err != errStopped {
+			return conn, err
+		}
+		// The connections went away while the message was
+		// waiting for one of them; try those that are left
+		// or have come up since.
+	}
+}
+
+// inTurn returns the socket's connections that still take
+// messages, starting with the one whose turn it is, and moves
+// the turn on. Connections that are closing or have failed
+// but are not torn down yet are left out.
+func (s *Socket) inTurn() []*Connection {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := len(s.ids)
+	if n == 0 {
+		return nil
+	}
+	conns := make([]*Connection, 0, n)
+	for i := 0; i < n; i++ {
+		if conn := s.conns[s.ids[(s.next+i)%n]]; !conn.isStopping() {
+			conns = append(conns, conn)
+		}
+	}
+	s.next = (s.next + 1) % n
+	return conns
+}
+
+// queueAny queues b on the first of conns with room in its
+// send queue, preferring those that have not filled up
+// lately (see Connection.tryQueue). It returns the connection
+// b was queued on, or nil if none had room.
+func queueAny(conns []*Connection, b []byte, ttl time.Duration) *Connection {
+	for _, conn := range conns {
+		if conn.tryQueue(b, ttl) {
+			return conn
+		}
+	}
+	for _, conn := range conns {
+		if conn.trySend(b, ttl) {
+			return conn
+		}
+	}
+	return nil
+}
+
+// queueWait waits for any of conns to have room for b and
+// queues it there, returning the connection it was queued on.
+// It returns ErrTimeout if none does before timeout, and
+// errStopped if they all stop taking messages first.
+func queueWait(conns []*Connection, b []byte, ttl time.Duration, timeout <-chan time.Time) (*Connection, error) {
+	cases := make([]reflect.SelectCase, 0, 3*len(conns)+1)
+	for _, conn := range conns {
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(conn.sendRoom),
+		})
+	}
+	for _, conn := range conns {
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(conn.closing),
+		})
+	}
+	for _, conn := range conns {
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(conn.writerDone),
+		})
+	}
+	cases = append(cases, reflect.SelectCase{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(timeout),
+	})
+
+	for live := len(conns); live > 0; {
+		if conn := queueAny(conns, b, ttl); conn != nil {
+			return conn, nil
+		}
+
+		chosen, _, _ := reflect.Select(cases)
+		switch {
+		case chosen < len(conns):
+			// A writer made room; try again.
+		case chosen == len(cases)-1:
+			return nil, ErrTimeout
+		default:
+			// A closing or failed connection takes no more
+			// messages; a zero Chan disables its cases.
+			i := chosen % len(conns)
+			for j := i; j < len(cases)-1; j += len(conns) {
+				cases[j].Chan = reflect.Value{}
+			}
+			live--
+		}
+	}
+	return nil, errStopped
+}
+
+// sendOn queues b on conn, keeping count of the messages the
+// HWM policy drops. It reports whether b was queued rather
+// than dropped.
+func (s *Socket) sendOn(conn *Connection, b []byte, ttl time.Duration, timeout <-chan time.Time) (bool, error) {
+	switch err := conn.send(b, ttl, s.hwmPolicy, timeout); err {
+	case nil:
+		s.delivered()
+		return true, nil
+	case errDropped:
+		s.drop(conn, b)
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// SendToPeer queues a message to be written to the
+// connection with the given id (see Peers), bypassing the
+// turns Send takes between connections but otherwise like
+// Send. It returns ErrHostUnreachable if there is no such
+// connection, for example because it has since been torn
+// down, or if the connection goes away before taking the
+// message.
+func (s *Socket) SendToPeer(id ConnID, b []byte) error {
+	_, err := s.sendToPeer(id, b, 0, false)
+	return err
+}
+
+// sendToPeer is SendToPeer, giving the message a TTL of ttl,
+// or the socket's send TTL if ttl is zero, and reporting
+// whether the message was queued rather than dropped. If
+// dontWait is set it does not wait for room in the
+// connection's send queue, as SendDontWait does not.
+func (s *Socket) sendToPeer(id ConnID, b []byte, ttl time.Duration, dontWait bool) (bool, error) {
+	if err := s.canSend(); err != nil {
+		return false, err
+	}
+
+	s.lock.RLock()
+	conn, ok := s.conns[string(id)]
+	s.lock.RUnlock()
+
+	if !ok {
+		return false, ErrHostUnreachable
+	}
+
+	if dontWait {
+		if conn.trySend(b, ttl) {
+			s.delivered()
+			return true, nil
+		}
+		if conn.isStopping() {
+			return false, ErrHostUnreachable
+		}
+		if s.hwmPolicy == HWMDrop {
+			s.drop(conn, b)
+			return false, nil
+		}
+		return false, ErrWouldBlock
+	}
+
+	var timeout <-chan time.Time
+	if s.sendTimeout >= 0 {
+		timer := s.clock.NewTimer(s.sendTimeout)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+
+	if queued, err := s.sendOn(conn, b, ttl, timeout); err != errStopped {
+		return queued, err
+	}
+	return false, ErrHostUnreachable
+}
+
+// SendDontWait queues a message like Send but never waits.
+// Starting from the connection whose turn it is, it skips
+// connections whose send queues are full and queues the
+// message on the first one with room. If every queue is
+// full it returns ErrWouldBlock, unless the socket uses the
+// HWMDrop policy, in which case the message is dropped as
+// Send would drop it. A socket with no connections returns
+// ErrNotConnected.
+func (s *Socket) SendDontWait(b []byte) error {
+	return s.sendDontWait(b, 0)
+}
+
+// sendDontWait is SendDontWait, giving the message a TTL of
+// ttl, or the socket's send TTL if ttl is zero.
+func (s *Socket) sendDontWait(b []byte, ttl time.Duration) error {
+	if err := s.canSend(); err != nil {
+		return err
+	}
+
+	conns := s.inTurn()
+	if len(conns) == 0 {
+		return ErrNotConnected
+	}
+
+	if queueAny(conns, b, ttl) != nil {
+		s.delivered()
+		return nil
+	}
+
+	if s.hwmPolicy == HWMDrop {
+		s.drop(conns[0], b)
+		return nil
+	}
+	return ErrWouldBlock
+}
+
+// isReceiveOnly reports whether sockets of type t
+// never send messages to their peers.
+func isReceiveOnly(t zmtp.SocketType) bool {
+	caps, _ := zmtp.Capabilities(t)
+	return !caps.CanSend
+}
+
+// canSend and canRecv return an *UnsupportedError if the
+// socket's type never sends, or never receives. A socket made
+// with NewSocket for a type gomq has no capabilities for may
+// do either, as Validate takes it to.
+func (s *Socket) canSend() error {
+	if caps, known := zmtp.Capabilities(s.sockType); known && !caps.CanSend {
+		return &UnsupportedError{SocketType: s.sockType, Op: "send"}
+	}
+	return nil
+}
+
+func (s *Socket) canRecv() error {
+	if caps, known := zmtp.Capabilities(s.sockType); known && !caps.CanRecv {
+		return &UnsupportedError{SocketType: s.sockType, Op: "receive"}
+	}
+	return nil
+}
+
+// isSendOnly reports whether sockets of type t never
+// receive messages from their peers.
+func isSendOnly(t zmtp.SocketType) bool {
+	caps, _ := zmtp.Capabilities(t)
+	return !caps.CanRecv
 }
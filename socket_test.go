@@ -2,25 +2,62 @@ package gomq
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/zeromq/gomq/internal/test"
 	"github.com/zeromq/gomq/zmtp"
 )
 
+// TestMain fails the suite if the tests leave sockets open
+// or goroutines running once they are done.
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if code == 0 {
+		if leaked := waitResources(5 * time.Second); leaked.Total() != 0 {
+			fmt.Fprintf(os.Stderr, "leaked resources: %+v\n", leaked)
+			code = 1
+		}
+	}
+	os.Exit(code)
+}
+
+// waitResources waits up to timeout for the resources of
+// every socket to be released, and returns what is left.
+func waitResources(timeout time.Duration) ResourceCounts {
+	deadline := time.Now().Add(timeout)
+	for {
+		counts := Diagnostics()
+		if counts.Total() == 0 || time.Now().After(deadline) {
+			return counts
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestNewClient(t *testing.T) {
 	var addr net.Addr
 	var err error
 
 	go func() {
 		client := NewClient(zmtp.NewSecurityNull())
-		err = client.Connect("tcp://127.0.0.1:9999")
+		err := client.Connect("tcp://127.0.0.1:9999")
 		if err != nil {
 			t.Error(err)
 		}
 
-		err := client.Send([]byte("HELLO"))
+		err = client.Send([]byte("HELLO"))
 		if err != nil {
 			t.Error(err)
 		}
@@ -108,28 +145,34 @@ func TestPushPull(t *testing.T) {
 	var addr net.Addr
 	var err error
 
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		pull := NewPull(zmtp.NewSecurityNull())
 		defer pull.Close()
-		err = pull.Connect("tcp://127.0.0.1:12345")
+		err := pull.Connect("tcp://127.0.0.1:12345")
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 
 		msg, err := pull.Recv()
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 
 		if want, got := 0, bytes.Compare([]byte("HELLO"), msg); want != got {
-			t.Fatalf("want %v, got %v", want, got)
+			t.Errorf("want %v, got %v", want, got)
+			return
 		}
 
 		t.Logf("pull received: %q", string(msg))
 
-		err = pull.Send([]byte("GOODBYE"))
-		if err != nil {
-			t.Fatal(err)
+		// PULL does not send.
+		var unsupported *UnsupportedError
+		if err := pull.Send([]byte("GOODBYE")); !errors.As(err, &unsupported) || !errors.Is(err, ErrNotSupported) {
+			t.Errorf("want an *UnsupportedError wrapping ErrNotSupported, got %v", err)
 		}
 
 		pull.Close()
@@ -151,18 +194,19 @@ func TestPushPull(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	push.Send([]byte("HELLO"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
 
-	msg, err := push.Recv()
-	if err != nil {
+	if err := push.WaitForPeers(ctx, 1); err != nil {
 		t.Fatal(err)
 	}
 
-	if want, got := 0, bytes.Compare([]byte("GOODBYE"), msg); want != got {
-		t.Fatalf("want %v, got %v (%v)", want, got, msg)
-	}
+	push.Send([]byte("HELLO"))
+	<-done
 
-	t.Logf("push received: %q", string(msg))
+	if want, got := uint64(0), push.Discarded(); want != got {
+		t.Errorf("want nothing sent back to discard, got %d discarded", got)
+	}
 
 	push.Close()
 }
@@ -172,30 +216,29 @@ func TestPullPush(t *testing.T) {
 	var addr net.Addr
 	var err error
 
+	received := make(chan struct{})
+	defer close(received)
 	go func() {
 		push := NewPush(zmtp.NewSecurityNull())
 		defer push.Close()
-		err = push.Connect("tcp://127.0.0.1:" + port)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		msg, err := push.Recv()
+		err := push.Connect("tcp://127.0.0.1:" + port)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 
-		if want, got := 0, bytes.Compare([]byte("HELLO"), msg); want != got {
-			t.Fatalf("want %v, got %v", want, got)
+		// PUSH does not receive.
+		if _, err := push.Recv(); !errors.Is(err, ErrNotSupported) {
+			t.Errorf("want %v, got %v", ErrNotSupported, err)
 		}
 
-		t.Logf("push received: %q", string(msg))
-
 		err = push.Send([]byte("GOODBYE"))
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 
+		<-received
 		push.Close()
 	}()
 
@@ -215,7 +258,16 @@ func TestPullPush(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	pull.Send([]byte("HELLO"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := pull.WaitForPeers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pull.Send([]byte("HELLO")); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("want %v, got %v", ErrNotSupported, err)
+	}
 
 	msg, err := pull.Recv()
 	if err != nil {
@@ -230,3 +282,4508 @@ func TestPullPush(t *testing.T) {
 
 	pull.Close()
 }
+
+func TestUnsupportedOperations(t *testing.T) {
+	pull := NewPull(zmtp.NewSecurityNull())
+	defer pull.Close()
+	for name, send := range map[string]func() error{
+		"Send":         func() error { return pull.Send([]byte("HELLO")) },
+		"SendDontWait": func() error { return pull.SendDontWait([]byte("HELLO")) },
+		"SendOpts":     func() error { return pull.SendOpts([]byte("HELLO"), SendOptions{DontWait: true}) },
+		"SendToPeer":   func() error { return pull.SendToPeer(ConnID("peer"), []byte("HELLO")) },
+	} {
+		var unsupported *UnsupportedError
+		if err := send(); !errors.As(err, &unsupported) || unsupported.Op != "send" {
+			t.Errorf("PULL %s: want an *UnsupportedError for send, got %v", name, err)
+		}
+	}
+
+	push := NewPush(zmtp.NewSecurityNull())
+	defer push.Close()
+	receiver := push.NewReceiver()
+	defer receiver.Close()
+	for name, recv := range map[string]func() error{
+		"Recv":          func() error { _, err := push.Recv(); return err },
+		"RecvMessage":   func() error { _, _, err := push.RecvMessage(); return err },
+		"RecvAck":       func() error { _, _, _, err := push.RecvAck(); return err },
+		"Receiver.Recv": func() error { _, err := receiver.Recv(); return err },
+	} {
+		var unsupported *UnsupportedError
+		if err := recv(); !errors.As(err, &unsupported) || unsupported.Op != "receive" {
+			t.Errorf("PUSH %s: want an *UnsupportedError for receive, got %v", name, err)
+		}
+	}
+}
+
+func TestCloseLinger(t *testing.T) {
+	port := "19002"
+	count := 100
+
+	go func() {
+		client := NewClient(zmtp.NewSecurityNull())
+		err := client.Connect("tcp://127.0.0.1:" + port)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for i := 0; i < count; i++ {
+			if err := client.Send([]byte(fmt.Sprintf("MSG %d", i))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		client.Close()
+	}()
+
+	server := NewServer(zmtp.NewSecurityNull())
+	defer server.Close()
+
+	_, err := server.Bind("tcp://127.0.0.1:" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < count; i++ {
+		msg, err := server.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := fmt.Sprintf("MSG %d", i), string(msg); want != got {
+			t.Fatalf("want %q, got %q", want, got)
+		}
+	}
+}
+
+// waitInbound waits until s has n received messages
+// waiting to be returned by Recv.
+func waitInbound(t *testing.T, s *Socket, n int64) {
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&s.inbound) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d inbound messages", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	endpoint := "tcp://127.0.0.1:19003"
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+
+	go func() {
+		if err := client.Connect(endpoint); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err := client.Send([]byte("HELLO")); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	waitInbound(t, server.base(), 1)
+
+	done := make(chan error)
+	go func() {
+		done <- server.Shutdown(context.Background())
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, err := net.Dial("tcp", "127.0.0.1:19003")
+		if err != nil {
+			break
+		}
+		conn.Close()
+
+		if time.Now().After(deadline) {
+			t.Fatalf("listener still accepting after Shutdown")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	msg, err := server.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "HELLO", string(msg); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if err := server.Send([]byte("WORLD")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err = client.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "WORLD", string(msg); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	endpoint := "tcp://127.0.0.1:19004"
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+
+	go func() {
+		if err := client.Connect(endpoint); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if err := client.Send([]byte("HELLO")); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	waitInbound(t, server.base(), 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if want, got := context.DeadlineExceeded, server.Shutdown(ctx); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	if want, got := 0, len(server.base().conns); want != got {
+		t.Errorf("want %v connections, got %v", want, got)
+	}
+}
+
+func TestWaitForPeers(t *testing.T) {
+	endpoint := "tcp://127.0.0.1:19005"
+	client := NewClient(zmtp.NewSecurityNull()).(*ClientSocket)
+	defer client.Close()
+
+	if want, got := false, client.Connected(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if want, got := context.DeadlineExceeded, client.WaitForPeers(ctx, 1); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer server.Close()
+
+	go func() {
+		if _, err := server.Bind(endpoint); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	go func() {
+		if err := client.Connect(endpoint); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := client.WaitForPeers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := true, client.Connected(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	second := NewClient(zmtp.NewSecurityNull())
+	defer second.Close()
+
+	if err := second.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.WaitForPeers(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := 2, server.PeerCount(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestMinPeers(t *testing.T) {
+	endpoint := "tcp://127.0.0.1:19006"
+
+	client := NewClient(zmtp.NewSecurityNull(), WithMinPeers(1), WithSendTimeout(20*time.Millisecond))
+	if want, got := ErrTimeout, client.Send([]byte("HELLO")); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	client.Close()
+
+	pull := NewPull(zmtp.NewSecurityNull(), WithMinPeers(1))
+	if err := pull.Send([]byte("HELLO")); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("want %v without waiting, got %v", ErrNotSupported, err)
+	}
+	pull.Close()
+
+	client = NewClient(zmtp.NewSecurityNull(), WithMinPeers(1))
+	defer client.Close()
+
+	sent := make(chan error)
+	go func() {
+		sent <- client.Send([]byte("HELLO"))
+	}()
+
+	go func() {
+		if err := client.Connect(endpoint); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	server := NewServer(zmtp.NewSecurityNull())
+	defer server.Close()
+
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := server.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "HELLO", string(msg); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestConnectAsync(t *testing.T) {
+	endpoint := "tcp://127.0.0.1:19007"
+	events := make(chan Event, 10)
+
+	client := NewClient(zmtp.NewSecurityNull(), WithMonitor(events)).(*ClientSocket)
+	defer client.Close()
+
+	if err := client.ConnectAsync("tcp://"); err == nil {
+		t.Errorf("should have error and do not")
+	}
+
+	start := time.Now()
+	if err := client.ConnectAsync(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > client.RetryInterval() {
+		t.Errorf("ConnectAsync blocked for %v", elapsed)
+	}
+
+	ev := <-events
+	if want, got := EventConnectRetried, ev.Type; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	if want, got := endpoint, ev.Endpoint; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	server := NewServer(zmtp.NewSecurityNull())
+	defer server.Close()
+
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := client.WaitForPeers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for ev := range events {
+		if ev.Type == EventConnected {
+			break
+		}
+	}
+}
+
+func TestConnectHandshakeError(t *testing.T) {
+	endpoint := "tcp://127.0.0.1:19008"
+
+	push := NewPush(zmtp.NewSecurityNull())
+	defer push.Close()
+
+	if _, err := push.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull()).(*ClientSocket)
+	defer client.Close()
+
+	err := client.Connect(endpoint)
+	var protoErr *zmtp.ProtocolError
+	if !errors.As(err, &protoErr) {
+		t.Errorf("want a *zmtp.ProtocolError, got %v", err)
+	}
+
+	if want, got := false, client.Connected(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestConnectClosed(t *testing.T) {
+	client := NewClient(zmtp.NewSecurityNull())
+
+	done := make(chan error)
+	go func() {
+		done <- client.Connect("tcp://127.0.0.1:19009")
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	client.Close()
+
+	if want, got := ErrSocketClosed, <-done; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	if want, got := ErrSocketClosed, client.ConnectAsync("tcp://127.0.0.1:19009"); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestBindReturnsImmediately(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull())
+	defer server.Close()
+
+	addr, err := server.Bind("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+
+	if err := client.Connect("tcp://" + addr.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Send([]byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := server.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "HELLO", string(msg); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestBindContext(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr, err := server.BindContext(ctx, "tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+
+	if err := client.Connect("tcp://" + addr.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server may still be finishing its side of the
+	// handshake, which cancel would abandon.
+	if err := server.WaitForPeers(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer that never sends its greeting stays mid-handshake.
+	pending, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pending.Close()
+
+	cancel()
+
+	pending.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.Copy(io.Discard, pending); err != nil {
+		t.Errorf("pending handshake was not abandoned: %v", err)
+	}
+
+	if _, err := net.Dial("tcp", addr.String()); err == nil {
+		t.Errorf("listener still accepting after cancel")
+	}
+
+	if err := client.Send([]byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := server.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "HELLO", string(msg); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+// failingListener returns errs from Accept, one per call,
+// before deferring to the wrapped listener.
+type failingListener struct {
+	net.Listener
+	errs chan error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	select {
+	case err := <-l.errs:
+		return nil, err
+	default:
+		return l.Listener.Accept()
+	}
+}
+
+func TestAcceptTemporaryError(t *testing.T) {
+	events := make(chan Event, 10)
+	server := NewServer(zmtp.NewSecurityNull(), WithMonitor(events)).(*ServerSocket)
+	defer server.Close()
+
+	server.base().listen = func(network, address string) (net.Listener, error) {
+		ln, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		errs := make(chan error, 2)
+		errs <- &net.OpError{Op: "accept", Net: network, Err: syscall.EMFILE}
+		errs <- &net.OpError{Op: "accept", Net: network, Err: syscall.EMFILE}
+		return &failingListener{Listener: ln, errs: errs}, nil
+	}
+
+	addr, err := server.Bind("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+
+	if err := client.Connect("tcp://" + addr.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := server.WaitForPeers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []EventType{EventAcceptRetried, EventAcceptRetried, EventAccepted} {
+		if got := (<-events).Type; want != got {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	}
+}
+
+func TestListenerRestart(t *testing.T) {
+	endpoint := "tcp://127.0.0.1:19010"
+	events := make(chan Event, 10)
+	server := NewServer(zmtp.NewSecurityNull(), WithMonitor(events)).(*ServerSocket)
+	defer server.Close()
+
+	var listens int32
+	server.base().listen = func(network, address string) (net.Listener, error) {
+		ln, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		if atomic.AddInt32(&listens, 1) > 1 {
+			return ln, nil
+		}
+
+		errs := make(chan error, 1)
+		errs <- errors.New("listener died")
+		return &failingListener{Listener: ln, errs: errs}, nil
+	}
+
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+
+	if err := client.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := server.WaitForPeers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []EventType{EventListenerFailed, EventListening, EventAccepted} {
+		if got := (<-events).Type; want != got {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	}
+
+	if want, got := int32(2), atomic.LoadInt32(&listens); want != got {
+		t.Errorf("want %v listens, got %v", want, got)
+	}
+}
+
+func TestDisconnectedPeerIsRemoved(t *testing.T) {
+	first, second := "tcp://127.0.0.1:19011", "tcp://127.0.0.1:19012"
+
+	server1 := NewServer(zmtp.NewSecurityNull())
+	if _, err := server1.Bind(first); err != nil {
+		t.Fatal(err)
+	}
+
+	server2 := NewServer(zmtp.NewSecurityNull())
+	defer server2.Close()
+	if _, err := server2.Bind(second); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan Event, 10)
+	client := NewClient(zmtp.NewSecurityNull(), WithMonitor(events)).(*ClientSocket)
+	defer client.Close()
+
+	if err := client.Connect(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Connect(second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Send([]byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := server1.Recv(); err != nil || string(msg) != "HELLO" {
+		t.Fatalf("want %q, got %q (%v)", "HELLO", msg, err)
+	}
+
+	server1.Close()
+
+	for ev := range events {
+		if ev.Type == EventDisconnected {
+			if want, got := first, ev.Endpoint; want != got {
+				t.Errorf("want %q, got %q", want, got)
+			}
+			break
+		}
+	}
+
+	if want, got := 1, client.PeerCount(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	if err := client.Send([]byte("WORLD")); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := server2.Recv(); err != nil || string(msg) != "WORLD" {
+		t.Fatalf("want %q, got %q (%v)", "WORLD", msg, err)
+	}
+
+	server1 = NewServer(zmtp.NewSecurityNull())
+	defer server1.Close()
+	if _, err := server1.Bind(first); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := client.WaitForPeers(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecvConnectionError(t *testing.T) {
+	endpoint := "mem://gomq-test-recv-error"
+
+	events := make(chan Event, 10)
+	server := NewServer(zmtp.NewSecurityNull(), WithMonitor(events)).(*ServerSocket)
+	defer server.Close()
+
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+
+	if err := client.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer that sends a malformed frame is torn down without
+	// Recv noticing.
+	bad, err := defaultContext.mem.dial("gomq-test-recv-error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+
+	if _, err := zmtp.NewConnection(bad).Prepare(zmtp.NewSecurityNull(), zmtp.ClientSocketType, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bad.Write([]byte{0x01, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+
+	for ev := range events {
+		if ev.Type == EventDisconnected {
+			if ev.Err == nil {
+				t.Errorf("want the connection's error, got nil")
+			}
+			break
+		}
+	}
+
+	if err := client.Send([]byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := server.Recv(); err != nil || string(msg) != "HELLO" {
+		t.Fatalf("want %q, got %q (%v)", "HELLO", msg, err)
+	}
+
+	// Losing the last connection leaves Recv waiting; only
+	// closing the socket ends it.
+	recvd := make(chan error)
+	go func() {
+		_, err := server.Recv()
+		recvd <- err
+	}()
+
+	client.Close()
+	for ev := range events {
+		if ev.Type == EventDisconnected {
+			break
+		}
+	}
+
+	if want, got := 0, server.PeerCount(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	select {
+	case err := <-recvd:
+		t.Fatalf("want Recv to keep waiting, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	server.Close()
+	if want, got := ErrSocketClosed, <-recvd; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	if _, err := server.Recv(); err != ErrSocketClosed {
+		t.Errorf("want %v, got %v", ErrSocketClosed, err)
+	}
+}
+
+func TestRecvWithSource(t *testing.T) {
+	endpoint := "tcp://127.0.0.1:19013"
+	server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer server.Close()
+
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[ConnID]bool)
+	for i := 0; i < 2; i++ {
+		client := NewClient(zmtp.NewSecurityNull()).(*ClientSocket)
+		defer client.Close()
+
+		if err := client.Connect(endpoint); err != nil {
+			t.Fatal(err)
+		}
+
+		want := fmt.Sprintf("CLIENT %d", i)
+		if err := client.Send([]byte(want)); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, src, err := server.RecvWithSource()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := string(msg); want != got {
+			t.Errorf("want %q, got %q", want, got)
+		}
+
+		if want, got := endpoint, src.Endpoint; want != got {
+			t.Errorf("want %q, got %q", want, got)
+		}
+
+		if want, got := zmtp.ClientSocketType, src.Negotiated.PeerSocketType; want != got {
+			t.Errorf("want %v, got %v", want, got)
+		}
+
+		local := client.base().conns[client.base().ids[0]].net.LocalAddr()
+		if want, got := local.String(), src.RemoteAddr.String(); want != got {
+			t.Errorf("want %v, got %v", want, got)
+		}
+
+		if ids[src.ID] {
+			t.Errorf("connection id %q reused", src.ID)
+		}
+		ids[src.ID] = true
+	}
+}
+
+func TestSendRoundRobin(t *testing.T) {
+	endpoint := "tcp://127.0.0.1:19014"
+	push := NewPush(zmtp.NewSecurityNull())
+	defer push.Close()
+
+	if _, err := push.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	var pulls []*PullSocket
+	for i := 0; i < 2; i++ {
+		pull := NewPull(zmtp.NewSecurityNull())
+		defer pull.Close()
+
+		if err := pull.Connect(endpoint); err != nil {
+			t.Fatal(err)
+		}
+		pulls = append(pulls, pull)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := push.WaitForPeers(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := push.Send([]byte("HELLO")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, pull := range pulls {
+		for i := 0; i < 2; i++ {
+			if _, err := pull.Recv(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// stallConn is a net.Conn whose writes block while it is
+// stalled.
+type stallConn struct {
+	net.Conn
+	mu sync.RWMutex
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Conn.Write(b)
+}
+
+func (c *stallConn) stall()   { c.mu.Lock() }
+func (c *stallConn) release() { c.mu.Unlock() }
+
+// newStalledPush returns a PUSH socket with a single
+// stalled connection to pull, and that connection.
+func newStalledPush(t *testing.T, pull *PullSocket, opts ...SocketOption) (*PushSocket, *stallConn) {
+	addr, err := pull.Bind("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	netConn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stalled := &stallConn{Conn: netConn}
+	zmtpConn := zmtp.NewConnection(stalled)
+	if _, err := zmtpConn.Prepare(zmtp.NewSecurityNull(), zmtp.PushSocketType, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	stalled.stall()
+
+	push := NewPush(zmtp.NewSecurityNull(), opts...)
+	push.AddConnection(NewConnection(stalled, zmtpConn))
+	return push, stalled
+}
+
+func TestSendHWMBlock(t *testing.T) {
+	pull := NewPull(zmtp.NewSecurityNull())
+	defer pull.Close()
+
+	push, stalled := newStalledPush(t, pull, WithSendHWM(1), WithSendTimeout(20*time.Millisecond))
+	defer push.Close()
+	defer stalled.release()
+
+	var err error
+	// The writer holds on to up to one queue's worth of
+	// messages besides the one it is writing.
+	for i := 0; i < 5 && err == nil; i++ {
+		err = push.Send([]byte("HELLO"))
+	}
+
+	if want, got := ErrTimeout, err; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestSendHWMDrop(t *testing.T) {
+	pull := NewPull(zmtp.NewSecurityNull())
+	defer pull.Close()
+
+	push, stalled := newStalledPush(t, pull, WithSendHWM(1), WithHWMPolicy(HWMDrop), WithSendTimeout(20*time.Millisecond))
+	defer push.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := push.Send([]byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stalled.release()
+
+	received := make(chan struct{}, 10)
+	go func() {
+		for {
+			if _, err := pull.Recv(); err != nil {
+				return
+			}
+			received <- struct{}{}
+		}
+	}()
+
+	count := 0
+	for done := false; !done; {
+		select {
+		case <-received:
+			count++
+		case <-time.After(100 * time.Millisecond):
+			done = true
+		}
+	}
+
+	// The writer may hold the message it is writing and one
+	// it took off the queue, and the queue one more; the rest
+	// were dropped.
+	if count < 1 || count > 3 {
+		t.Errorf("want 1 to 3 messages, got %d", count)
+	}
+}
+
+func TestDropReporting(t *testing.T) {
+	pull := NewPull(zmtp.NewSecurityNull())
+	defer pull.Close()
+
+	events := make(chan Event, 100)
+	push, stalled := newStalledPush(t, pull, WithSendHWM(1), WithHWMPolicy(HWMDrop), WithMonitor(events))
+	defer push.Close()
+	defer stalled.release()
+
+	handled := make(chan string, 10)
+	push.SetDropHandler(func(peer PeerInfo, msg []byte) {
+		if peer.ID == "" {
+			t.Error("want the peer the message was meant for")
+		}
+		handled <- string(msg)
+	})
+
+	for i := 0; i < 10; i++ {
+		if err := push.Send([]byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// At most three messages fit in the writer and the queue.
+	dropped := push.Dropped()
+	if dropped < 7 {
+		t.Errorf("want at least 7 dropped messages, got %d", dropped)
+	}
+	if want, got := dropped, push.Peers()[0].Dropped; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	for i := uint64(0); i < dropped; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatalf("want %d messages handled, got %d", dropped, i)
+		}
+	}
+
+	reported := 0
+	for done := false; !done; {
+		select {
+		case ev := <-events:
+			if ev.Type == EventDropped {
+				reported++
+			}
+		default:
+			done = true
+		}
+	}
+	if want, got := 1, reported; want != got {
+		t.Errorf("want %v drop event, got %v", want, got)
+	}
+}
+
+func TestWriterPanic(t *testing.T) {
+	events := make(chan Event, 10)
+	push := NewPush(zmtp.NewSecurityNull(), WithMonitor(events))
+	defer push.Close()
+
+	// Without a handshake the zmtp connection has no security
+	// mechanism, so the first write panics.
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(io.Discard, remote)
+	push.AddConnection(NewConnection(local, zmtp.NewConnection(local)))
+
+	if err := push.Send([]byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ev := <-events:
+		if want, got := EventDisconnected, ev.Type; want != got {
+			t.Errorf("want %v, got %v", want, got)
+		}
+		if ev.Err == nil {
+			t.Errorf("want a writer error, got nil")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection was not torn down")
+	}
+
+	if want, got := 0, push.PeerCount(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestSendDontWait(t *testing.T) {
+	push := NewPush(zmtp.NewSecurityNull())
+	defer push.Close()
+
+	if want, got := ErrNotConnected, push.SendDontWait([]byte("HELLO")); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	pull := NewPull(zmtp.NewSecurityNull())
+	defer pull.Close()
+
+	push, stalled := newStalledPush(t, pull, WithSendHWM(1))
+	defer push.Close()
+	defer stalled.release()
+
+	var err error
+	// The writer holds on to up to one queue's worth of
+	// messages besides the one it is writing.
+	for i := 0; i < 5 && err == nil; i++ {
+		err = push.SendDontWait([]byte("HELLO"))
+	}
+
+	if want, got := ErrWouldBlock, err; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestSendDontWaitDrop(t *testing.T) {
+	pull := NewPull(zmtp.NewSecurityNull())
+	defer pull.Close()
+
+	push, stalled := newStalledPush(t, pull, WithSendHWM(1), WithHWMPolicy(HWMDrop))
+	defer push.Close()
+	defer stalled.release()
+
+	for i := 0; i < 3; i++ {
+		if err := push.SendDontWait([]byte("HELLO")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSendDontWaitSkipsFull(t *testing.T) {
+	stalledPull := NewPull(zmtp.NewSecurityNull())
+	defer stalledPull.Close()
+
+	push, stalled := newStalledPush(t, stalledPull, WithSendHWM(1))
+	defer push.Close()
+	defer stalled.release()
+
+	pull := NewPull(zmtp.NewSecurityNull())
+	defer pull.Close()
+
+	addr, err := pull.Bind("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := push.Connect("tcp://" + addr.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 10
+	for i := 0; i < count; i++ {
+		if err := push.SendDontWait([]byte("HELLO")); err != nil {
+			t.Fatal(err)
+		}
+		// Let the writer keep up so only the stalled
+		// connection is ever full.
+		time.Sleep(time.Millisecond)
+	}
+
+	// At most three messages are held by the stalled connection.
+	for i := 0; i < count-3; i++ {
+		if _, err := pull.Recv(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPauseRecv(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer server.Close()
+
+	addr, err := server.Bind("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+
+	if err := client.Connect("tcp://" + addr.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Send([]byte("BEFORE")); err != nil {
+		t.Fatal(err)
+	}
+	waitInbound(t, server.base(), 1)
+
+	server.PauseRecv()
+
+	if err := client.Send([]byte("AFTER")); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := make(chan string)
+	go func() {
+		for {
+			msg, err := server.Recv()
+			if err != nil {
+				return
+			}
+			msgs <- string(msg)
+		}
+	}()
+
+	if want, got := "BEFORE", <-msgs; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	select {
+	case msg := <-msgs:
+		t.Fatalf("received %q while paused", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	server.ResumeRecv()
+
+	select {
+	case msg := <-msgs:
+		if want, got := "AFTER", msg; want != got {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no message after resuming")
+	}
+}
+
+func TestIPC(t *testing.T) {
+	endpoints := []string{"ipc://" + t.TempDir() + "/gomq.sock"}
+	if abstractUnixSockets {
+		endpoints = append(endpoints, fmt.Sprintf("ipc://@gomq-test-%d", os.Getpid()))
+	}
+
+	for _, endpoint := range endpoints {
+		server := NewServer(zmtp.NewSecurityNull())
+		defer server.Close()
+
+		if _, err := server.Bind(endpoint); err != nil {
+			t.Fatal(err)
+		}
+
+		client := NewClient(zmtp.NewSecurityNull())
+		defer client.Close()
+
+		if err := client.Connect(endpoint); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.Send([]byte("HELLO")); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := server.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := "HELLO", string(msg); want != got {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+}
+
+func TestMem(t *testing.T) {
+	endpoint := "mem://gomq-test-mem"
+
+	events := make(chan Event, 100)
+	client := NewClient(zmtp.NewSecurityNull(), WithMonitor(events)).(*ClientSocket)
+	defer client.Close()
+
+	if err := client.ConnectAsync(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	ev := <-events
+	if want, got := EventConnectRetried, ev.Type; want != got {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if !errors.Is(ev.Err, syscall.ECONNREFUSED) {
+		t.Errorf("want ECONNREFUSED before bind, got %v", ev.Err)
+	}
+
+	server := NewServer(zmtp.NewSecurityNull())
+	defer server.Close()
+
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	other := NewServer(zmtp.NewSecurityNull())
+	defer other.Close()
+	if _, err := other.Bind(endpoint); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("want EADDRINUSE, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.WaitForPeers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Send([]byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := server.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "HELLO", string(msg); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if err := server.Send([]byte("WORLD")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err = client.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "WORLD", string(msg); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestEmptyMessages(t *testing.T) {
+	endpoint := "mem://gomq-test-empty"
+
+	server := NewServer(zmtp.NewSecurityNull())
+	defer server.Close()
+
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+
+	if err := client.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range [][]byte{{}, nil, []byte("HELLO"), {}} {
+		if err := client.Send(b); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := server.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg == nil || !bytes.Equal(b, msg) {
+			t.Errorf("want %#v, got %#v", b, msg)
+		}
+	}
+}
+
+func TestManualRead(t *testing.T) {
+	endpoint := "mem://gomq-test-manual-read"
+
+	conns := make(chan *Connection, 1)
+	server := NewServer(zmtp.NewSecurityNull(), WithManualRead(func(conn *Connection) {
+		conns <- conn
+	})).(*ServerSocket)
+	defer server.Close()
+
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull(), WithHeartbeat(5*time.Millisecond, time.Second)).(*ClientSocket)
+	defer client.Close()
+
+	if err := client.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	c := client.base()
+	c.lock.RLock()
+	auto := c.conns[c.ids[0]]
+	c.lock.RUnlock()
+	if _, err := auto.ReadMessage(); err != ErrAutoRead {
+		t.Errorf("want %v, got %v", ErrAutoRead, err)
+	}
+
+	conn := <-conns
+	if conn.NetConn() == nil {
+		t.Errorf("want the connection's transport")
+	}
+
+	// Let a few PINGs arrive before the message; ReadMessage
+	// answers and skips them.
+	time.Sleep(20 * time.Millisecond)
+	if err := client.Send([]byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "HELLO", string(msg.Body); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for client.Peers()[0].RTT == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("want the client's PINGs answered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	client.Close()
+	if _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("want an error once the peer is gone")
+	}
+
+	if want, got := 0, server.PeerCount(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	endpoint := "mem://gomq-test-max-conns"
+
+	server := NewServer(zmtp.NewSecurityNull(), WithMaxConnections(1)).(*ServerSocket)
+	defer server.Close()
+
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	first := NewClient(zmtp.NewSecurityNull())
+	defer first.Close()
+
+	if err := first.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := 1, server.AcceptedCount(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	second := NewClient(zmtp.NewSecurityNull()).(*ClientSocket)
+	defer second.Close()
+
+	if err := second.ConnectAsync(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := second.WaitForPeers(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("want the second connection held back, got %v", err)
+	}
+
+	first.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := second.WaitForPeers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := 1, server.AcceptedCount(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestMaxConnectionsReject(t *testing.T) {
+	endpoint := "mem://gomq-test-max-conns-reject"
+
+	events := make(chan Event, 10)
+	server := NewServer(zmtp.NewSecurityNull(),
+		WithMaxConnections(1),
+		WithConnLimitPolicy(ConnLimitReject),
+		WithMonitor(events)).(*ServerSocket)
+	defer server.Close()
+
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	first := NewClient(zmtp.NewSecurityNull())
+	defer first.Close()
+
+	if err := first.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	second := NewClient(zmtp.NewSecurityNull())
+	defer second.Close()
+
+	if err := second.Connect(endpoint); err == nil {
+		t.Errorf("want the second connection rejected")
+	}
+
+	for ev := range events {
+		if ev.Type == EventAcceptRejected {
+			if want, got := endpoint, ev.Endpoint; want != got {
+				t.Errorf("want %q, got %q", want, got)
+			}
+			break
+		}
+	}
+
+	if want, got := 1, server.AcceptedCount(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	first.Close()
+	for ev := range events {
+		if ev.Type == EventDisconnected {
+			break
+		}
+	}
+
+	third := NewClient(zmtp.NewSecurityNull())
+	defer third.Close()
+
+	if err := third.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecvInto(t *testing.T) {
+	endpoint := "mem://gomq-test-recv-into"
+
+	server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer server.Close()
+
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+
+	if err := client.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{"HELLO", "HELLO WORLD", "BYE"} {
+		if err := client.Send([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, 5)
+	n, err := server.RecvInto(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "HELLO", string(buf[:n]); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	_, err = server.RecvInto(buf)
+	var tooSmall *BufferTooSmallError
+	if !errors.As(err, &tooSmall) || !errors.Is(err, ErrBufferTooSmall) {
+		t.Fatalf("want a *BufferTooSmallError, got %v", err)
+	}
+	if want, got := 11, tooSmall.Size; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	// The message that did not fit is still the next one.
+	buf = make([]byte, tooSmall.Size)
+	n, err = server.RecvInto(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "HELLO WORLD", string(buf[:n]); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	msg, err := server.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "BYE", string(msg); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if want, got := int64(0), atomic.LoadInt64(&server.base().inbound); want != got {
+		t.Errorf("want %v inbound, got %v", want, got)
+	}
+}
+
+func TestConnectAny(t *testing.T) {
+	endpoints := []string{
+		"tcp://127.0.0.1:19015",
+		"tcp://127.0.0.1:19016",
+		"tcp://127.0.0.1:19017",
+	}
+
+	third := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	if _, err := third.Bind(endpoints[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan Event, 100)
+	client := NewClient(zmtp.NewSecurityNull(), WithMonitor(events)).(*ClientSocket)
+	defer client.Close()
+
+	if err := client.ConnectAny(endpoints); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Send([]byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, src, err := third.RecvWithSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := endpoints[2], src.Endpoint; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	first := NewServer(zmtp.NewSecurityNull())
+	defer first.Close()
+	if _, err := first.Bind(endpoints[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	third.Close()
+
+	timeout := time.After(time.Second)
+	for connected := false; !connected; {
+		select {
+		case ev := <-events:
+			if ev.Type == EventConnected && ev.Endpoint != endpoints[2] {
+				if want, got := endpoints[0], ev.Endpoint; want != got {
+					t.Errorf("want %q, got %q", want, got)
+				}
+				connected = true
+			}
+		case <-timeout:
+			t.Fatal("client did not fail over")
+		}
+	}
+
+	if want, got := 1, client.PeerCount(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestConnectAnyHandshakeFailover(t *testing.T) {
+	// The first endpoint takes the connection but refuses its
+	// handshake.
+	refusing := NewServer(zmtp.NewSecurityNull(),
+		WithAllowedMechanisms(zmtp.CurveSecurityMechanismType))
+	defer refusing.Close()
+	first, err := refusing.Bind("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	healthy := NewServer(zmtp.NewSecurityNull())
+	defer healthy.Close()
+	second, err := healthy.Bind("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan Event, 100)
+	client := NewClient(zmtp.NewSecurityNull(), WithMonitor(events))
+	defer client.Close()
+
+	endpoints := []string{"tcp://" + first.String(), "tcp://" + second.String()}
+	if err := client.ConnectAny(endpoints); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Send([]byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := healthy.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	for failed := false; !failed; {
+		ev := <-events
+		failed = ev.Type == EventHandshakeFailed && ev.Endpoint == endpoints[0]
+	}
+}
+
+func TestAllowedMechanisms(t *testing.T) {
+	events := make(chan Event, 10)
+	server := NewServer(zmtp.NewSecurityNull(),
+		WithAllowedMechanisms(zmtp.CurveSecurityMechanismType),
+		WithMonitor(events)).(*ServerSocket)
+	defer server.Close()
+
+	addr, err := server.Bind("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+
+	err = client.Connect("tcp://" + addr.String())
+	var authErr *zmtp.AuthError
+	if !errors.As(err, &authErr) {
+		t.Errorf("want a *zmtp.AuthError, got %v", err)
+	}
+
+	for ev := range events {
+		if ev.Type == EventHandshakeFailed {
+			var mismatch *zmtp.MechanismMismatchError
+			if !errors.As(ev.Err, &mismatch) {
+				t.Errorf("want a *zmtp.MechanismMismatchError, got %v", ev.Err)
+			}
+			if ev.Addr == nil {
+				t.Errorf("want the remote address")
+			}
+			break
+		}
+	}
+
+	if want, got := 0, server.PeerCount(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull())
+	defer server.Close()
+
+	addr, err := server.Bind("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull(), WithHeartbeat(5*time.Millisecond, time.Second)).(*ClientSocket)
+	defer client.Close()
+
+	if err := client.Connect("tcp://" + addr.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for client.Peers()[0].RTT == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no round trip time measured")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if idle := client.Peers()[0].Idle; idle > 100*time.Millisecond {
+		t.Errorf("want recent traffic, got idle for %v", idle)
+	}
+
+	// PINGs and PONGs are not messages.
+	if err := client.Send([]byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := server.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "HELLO", string(msg); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// The peer completes the handshake and then ignores
+	// everything, including PINGs.
+	go func() {
+		netConn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer netConn.Close()
+
+		zmtp.NewConnection(netConn).Prepare(zmtp.NewSecurityNull(), zmtp.ServerSocketType, true, nil)
+		time.Sleep(time.Second)
+	}()
+
+	events := make(chan Event, 10)
+	client := NewClient(zmtp.NewSecurityNull(), WithHeartbeat(5*time.Millisecond, 50*time.Millisecond), WithMonitor(events))
+	defer client.Close()
+
+	if err := client.Connect("tcp://" + ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type != EventHeartbeatTimeout {
+				continue
+			}
+			if want, got := ErrHeartbeatTimeout, ev.Err; want != got {
+				t.Errorf("want %v, got %v", want, got)
+			}
+			return
+		case <-timeout:
+			t.Fatal("connection did not time out")
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	s, err := New(zmtp.PushSocketType, zmtp.NewSecurityNull())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, ok := s.(*PushSocket); !ok {
+		t.Errorf("want a *PushSocket, got %T", s)
+	}
+
+	if _, err := New("DEALER", zmtp.NewSecurityNull()); !errors.Is(err, ErrUnknownSocketType) {
+		t.Errorf("want ErrUnknownSocketType, got %v", err)
+	}
+}
+
+func TestEndpointStatus(t *testing.T) {
+	endpoint := "mem://gomq-test-endpoint-status"
+
+	events := make(chan Event, 100)
+	client := NewClient(zmtp.NewSecurityNull(), WithMonitor(events)).(*ClientSocket)
+	defer client.Close()
+	client.base().retryInterval = 10 * time.Millisecond
+
+	if err := client.ConnectAsync(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < attemptHistory+2; i++ {
+		<-events
+	}
+
+	status := client.EndpointStatus(endpoint)
+	if status.Connected {
+		t.Error("want not connected before bind")
+	}
+	if want, got := attemptHistory, len(status.Attempts); want > got {
+		t.Fatalf("want %d attempts, got %d", want, got)
+	}
+	if want, got := AttemptDial, status.Attempts[0].Stage; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if !errors.Is(status.LastErr, syscall.ECONNREFUSED) {
+		t.Errorf("want ECONNREFUSED, got %v", status.LastErr)
+	}
+
+	server := NewServer(zmtp.NewSecurityNull())
+	defer server.Close()
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.WaitForPeers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	status = client.EndpointStatus(endpoint)
+	if !status.Connected {
+		t.Error("want connected after bind")
+	}
+	if want, got := attemptHistory, len(status.Attempts); want != got {
+		t.Fatalf("want %d attempts, got %d", want, got)
+	}
+	last := status.Attempts[len(status.Attempts)-1]
+	if want, got := AttemptConnected, last.Stage; want != got || last.Err != nil {
+		t.Errorf("want %v, got %v with %v", want, got, last.Err)
+	}
+}
+
+func TestSendSkipsFullPeer(t *testing.T) {
+	stalledPull := NewPull(zmtp.NewSecurityNull())
+	defer stalledPull.Close()
+
+	push, stalled := newStalledPush(t, stalledPull, WithSendHWM(4), WithSendTimeout(time.Second))
+	defer push.Close()
+	defer stalled.release()
+
+	pull := NewPull(zmtp.NewSecurityNull())
+	defer pull.Close()
+	if _, err := pull.Bind("mem://gomq-test-skip-full"); err != nil {
+		t.Fatal(err)
+	}
+	if err := push.Connect("mem://gomq-test-skip-full"); err != nil {
+		t.Fatal(err)
+	}
+
+	const messages = 1000
+	received := make(chan int, 1)
+	go func() {
+		count := 0
+		for {
+			if _, err := pull.Recv(); err != nil {
+				received <- count
+				return
+			}
+			if count++; count == messages-10 {
+				received <- count
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < messages; i++ {
+		if err := push.Send([]byte("HELLO")); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+
+	select {
+	case count := <-received:
+		if want := messages - 10; count < want {
+			t.Errorf("want at least %d messages on the healthy peer, got %d", want, count)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the healthy peer did not get the messages")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("want the stalled peer not to hold up sends, took %v", elapsed)
+	}
+}
+
+func TestSendTTL(t *testing.T) {
+	pull := NewPull(zmtp.NewSecurityNull())
+	defer pull.Close()
+
+	push, stalled := newStalledPush(t, pull, WithSendTTL(20*time.Millisecond))
+	defer push.Close()
+
+	expired := make(chan string, 10)
+	push.SetDropHandler(func(peer PeerInfo, msg []byte) {
+		expired <- string(msg)
+	})
+
+	// The first message is taken by the writer before it
+	// expires; the next two wait behind it until they do.
+	if err := push.Send([]byte("FIRST")); err != nil {
+		t.Fatal(err)
+	}
+	for push.Peers()[0].Queued != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		if err := push.Send([]byte("STALE")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := push.Send([]byte("FRESH")); err != nil {
+		t.Fatal(err)
+	}
+	stalled.release()
+
+	for _, want := range []string{"FIRST", "FRESH"} {
+		msg, err := pull.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != string(msg) {
+			t.Errorf("want %q, got %q", want, msg)
+		}
+	}
+
+	if want, got := uint64(2), push.Expired(); want != got {
+		t.Errorf("want %d expired, got %d", want, got)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-expired:
+			if want := "STALE"; want != msg {
+				t.Errorf("want %q, got %q", want, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("want the expired messages passed to the drop handler")
+		}
+	}
+}
+
+func TestSendOpts(t *testing.T) {
+	pull := NewPull(zmtp.NewSecurityNull())
+	defer pull.Close()
+
+	push, stalled := newStalledPush(t, pull, WithSendHWM(2))
+	defer push.Close()
+
+	if want, got := ErrMultipart, push.SendOpts([]byte("PART"), SendOptions{More: true}); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if want, got := ErrHostUnreachable, push.SendOpts([]byte("LOST"), SendOptions{PeerID: "nobody"}); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	// Only the message sent with a TTL expires while the
+	// writer is stalled on the first.
+	if err := push.SendOpts([]byte("FIRST"), SendOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for push.Peers()[0].Queued != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := push.SendOpts([]byte("STALE"), SendOptions{TTL: 20 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	peer := push.Peers()[0].ID
+	if err := push.SendOpts([]byte("KEPT"), SendOptions{PeerID: peer}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queue is full; DontWait gives up where Send would
+	// block, on its own and for a directed send.
+	if want, got := ErrWouldBlock, push.SendOpts([]byte("URGENT"), SendOptions{DontWait: true}); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if want, got := ErrWouldBlock, push.SendOpts([]byte("URGENT"), SendOptions{DontWait: true, PeerID: peer}); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	stalled.release()
+	for _, want := range []string{"FIRST", "KEPT"} {
+		msg, err := pull.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != string(msg) {
+			t.Errorf("want %q, got %q", want, msg)
+		}
+	}
+	if want, got := uint64(1), push.Expired(); want != got {
+		t.Errorf("want %d expired, got %d", want, got)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-request"); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			msg, peer, err := server.RecvWithSource()
+			if err != nil {
+				return
+			}
+			if string(msg) == "SLOW" {
+				time.Sleep(50 * time.Millisecond)
+			}
+			server.SendToPeer(peer.ID, append(msg, " REPLY"...))
+		}
+	}()
+
+	client := NewClient(zmtp.NewSecurityNull()).(*ClientSocket)
+	defer client.Close()
+	if err := client.Connect("mem://gomq-test-request"); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := client.Request(context.Background(), []byte("HELLO"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "HELLO REPLY", string(reply); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = client.Request(ctx, []byte("SLOW"))
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want ErrTimeout and context.DeadlineExceeded, got %v", err)
+	}
+
+	// The late reply to the abandoned request is discarded.
+	time.Sleep(100 * time.Millisecond)
+	reply, err = client.Request(context.Background(), []byte("FAST"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "FAST REPLY", string(reply); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// So is one that arrives while the next request waits.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := client.Request(ctx, []byte("SLOW")); !errors.Is(err, ErrTimeout) {
+		t.Errorf("want ErrTimeout, got %v", err)
+	}
+	reply, err = client.Request(context.Background(), []byte("NEXT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "NEXT REPLY", string(reply); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestRequestHedged(t *testing.T) {
+	// A is slow to reply; B is too with SLOW requests.
+	client := NewClient(zmtp.NewSecurityNull()).(*ClientSocket)
+	defer client.Close()
+	for _, name := range []string{"A", "B"} {
+		server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+		defer server.Close()
+		endpoint := "mem://gomq-test-request-hedged-" + name
+		if _, err := server.Bind(endpoint); err != nil {
+			t.Fatal(err)
+		}
+		go func(name string) {
+			for {
+				msg, peer, err := server.RecvWithSource()
+				if err != nil {
+					return
+				}
+				delay := time.Duration(0)
+				if name == "A" || string(msg) == "SLOW" {
+					delay = 200 * time.Millisecond
+				}
+				time.Sleep(delay)
+				server.SendToPeer(peer.ID, []byte(name+" "+string(msg)))
+			}
+		}(name)
+		if err := client.Connect(endpoint); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Whichever of the peers is tried first, B answers first.
+	// The two requests go to A first in turn, leaving one
+	// reply of A's to be discarded.
+	for _, msg := range []string{"ONE", "TWO"} {
+		reply, err := client.RequestHedged(context.Background(), []byte(msg), 20*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := "B "+msg, string(reply); want != got {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+
+	// Giving up leaves both peers' replies to be discarded.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.RequestHedged(ctx, []byte("SLOW"), 10*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Errorf("want ErrTimeout, got %v", err)
+	}
+
+	// Requests to either peer then get their own replies.
+	for i := 0; i < 2; i++ {
+		reply, err := client.Request(context.Background(), []byte("THREE"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(reply), " THREE") {
+			t.Errorf("want the reply to THREE, got %q", reply)
+		}
+	}
+}
+
+// A hedged request the HWM policy drops has no reply coming,
+// so none is owed for it.
+func TestRequestHedgedDropped(t *testing.T) {
+	client := NewClient(zmtp.NewSecurityNull(), WithSendHWM(1), WithHWMPolicy(HWMDrop)).(*ClientSocket)
+	defer client.Close()
+
+	// A's connection is stalled, so its send queue fills up.
+	stalledServer := NewServer(zmtp.NewSecurityNull())
+	defer stalledServer.Close()
+	addr, err := stalledServer.Bind("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	netConn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stalled := &stallConn{Conn: netConn}
+	zmtpConn := zmtp.NewConnection(stalled)
+	if _, err := zmtpConn.Prepare(zmtp.NewSecurityNull(), zmtp.ClientSocketType, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	stalled.stall()
+	defer stalled.release()
+	a := NewConnection(stalled, zmtpConn)
+	client.AddConnection(a)
+
+	// Once the writer is stuck writing the first message, the
+	// next fills the queue and the rest are dropped.
+	if err := client.SendToPeer(ConnID(a.id), []byte("FILL")); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(a.sendQueue) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the writer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for client.Dropped() == 0 {
+		if err := client.SendToPeer(ConnID(a.id), []byte("FILL")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// B replies at once.
+	server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-request-hedged-dropped"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			msg, peer, err := server.RecvWithSource()
+			if err != nil {
+				return
+			}
+			server.SendToPeer(peer.ID, msg)
+		}
+	}()
+	if err := client.Connect("mem://gomq-test-request-hedged-dropped"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The requests go to each peer first in turn.
+	for _, msg := range []string{"ONE", "TWO"} {
+		reply, err := client.RequestHedged(context.Background(), []byte(msg), 10*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := msg, string(reply); want != got {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+	if got := client.owed[a]; got != 0 {
+		t.Errorf("want no replies owed by the stalled peer, got %d", got)
+	}
+}
+
+func TestMessageStats(t *testing.T) {
+	pull := NewPull(zmtp.NewSecurityNull(), WithMessageStats())
+	defer pull.Close()
+	if _, err := pull.Bind("mem://gomq-test-message-stats"); err != nil {
+		t.Fatal(err)
+	}
+
+	push := NewPush(zmtp.NewSecurityNull(), WithMessageStats())
+	defer push.Close()
+	if err := push.Connect("mem://gomq-test-message-stats"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{10, 100, 5000} {
+		if err := push.Send(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pull.Recv(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The writer counts a message once it has been written,
+	// which may be after it was received.
+	deadline := time.Now().Add(time.Second)
+	for push.MessageStats().SentSizes.Total() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	want := []uint64{1, 1, 0, 0, 1, 0, 0, 0, 0}
+	for name, h := range map[string]Histogram{
+		"sent":     push.MessageStats().SentSizes,
+		"received": pull.MessageStats().RecvSizes,
+	} {
+		if fmt.Sprint(want) != fmt.Sprint(h.Counts) {
+			t.Errorf("%s: want %v, got %v", name, want, h.Counts)
+		}
+	}
+	if want, got := uint64(3), pull.MessageStats().QueueLatency.Total(); want != got {
+		t.Errorf("want %d latencies, got %d", want, got)
+	}
+
+	plain := NewPull(zmtp.NewSecurityNull())
+	defer plain.Close()
+	if stats := plain.MessageStats(); stats.RecvSizes.Total() != 0 {
+		t.Errorf("want no statistics by default, got %+v", stats)
+	}
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// A peer that completes the handshake and then never
+	// reads, so the socket's writes back up.
+	peer := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		zmtp.NewConnection(conn).Prepare(zmtp.NewSecurityNull(), zmtp.PullSocketType, false, nil)
+		peer <- conn
+	}()
+
+	push := NewPush(zmtp.NewSecurityNull())
+	endpoint := "tcp://" + ln.Addr().String()
+	if err := push.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	defer (<-peer).Close()
+
+	for i := 0; i < 64; i++ {
+		if err := push.Send(make([]byte, 1<<20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	err = push.CloseWithTimeout(50 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("want CloseWithTimeout to give up after the timeout, took %v", elapsed)
+	}
+
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || !errors.Is(err, ErrTimeout) {
+		t.Fatalf("want a *CloseError wrapping ErrTimeout, got %v", err)
+	}
+	if want, got := []string{endpoint}, closeErr.Endpoints; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("want no goroutines left after the close, %d before and %d after", before, after)
+	}
+}
+
+// openFDs returns the number of file descriptors the process
+// has open, or -1 where that cannot be told.
+func openFDs() int {
+	entries, err := os.ReadDir("/dev/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+func TestConnectAbandoned(t *testing.T) {
+	const n = 16
+	before := runtime.NumGoroutine()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	fds := openFDs()
+
+	// A peer that reads the start of each greeting and then
+	// stalls, leaving the connections in their handshake.
+	peers := make(chan net.Conn, n+1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Read(make([]byte, 1))
+			peers <- conn
+		}
+	}()
+	endpoint := "tcp://" + ln.Addr().String()
+
+	push := NewPush(zmtp.NewSecurityNull())
+	defer push.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() { errs <- push.ConnectContext(ctx, endpoint) }()
+	}
+	var stalled []net.Conn
+	for i := 0; i < n; i++ {
+		stalled = append(stalled, <-peers)
+	}
+	cancel()
+	for i := 0; i < n; i++ {
+		if err := <-errs; !errors.Is(err, context.Canceled) {
+			t.Errorf("want %v, got %v", context.Canceled, err)
+		}
+	}
+
+	// Closing the socket abandons a handshake just the same.
+	closed := NewPush(zmtp.NewSecurityNull())
+	go func() { errs <- closed.Connect(endpoint) }()
+	stalled = append(stalled, <-peers)
+	closed.Close()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrSocketClosed) {
+			t.Errorf("want %v, got %v", ErrSocketClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("want Connect to return once the socket is closed")
+	}
+
+	// The sockets closed their side of each connection, so the
+	// peer reads to the end of it rather than timing out.
+	for _, conn := range stalled {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.Copy(io.Discard, conn); err != nil {
+			t.Errorf("want the abandoned connection closed, got %v", err)
+		}
+		conn.Close()
+	}
+	if got := push.PeerCount(); got != 0 {
+		t.Errorf("want no peers, got %d", got)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for openFDs() > fds && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := openFDs(); after > fds {
+		t.Errorf("want no descriptors left open, %d before and %d after", fds, after)
+	}
+
+	ln.Close()
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("want no goroutines left, %d before and %d after", before, after)
+	}
+	if got := push.ActiveResources().Dialers + closed.ActiveResources().Dialers; got != 0 {
+		t.Errorf("want no dialers running, got %d", got)
+	}
+}
+
+// departureEvents binds a server to endpoint that reports
+// its events, and returns a function that waits for the next
+// EventPeerDeparted or EventDisconnected and returns its type.
+func departureEvents(t *testing.T, endpoint string) (Server, func() EventType) {
+	events := make(chan Event, 16)
+	server := NewServer(zmtp.NewSecurityNull(), WithMonitor(events))
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	return server, func() EventType {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == EventPeerDeparted || ev.Type == EventDisconnected {
+					return ev.Type
+				}
+			case <-timeout:
+				t.Fatal("timed out waiting for the disconnect")
+			}
+		}
+	}
+}
+
+func TestDisconnectCommand(t *testing.T) {
+	server, next := departureEvents(t, "mem://gomq-test-disconnect-command")
+	defer server.Close()
+
+	client := NewClient(zmtp.NewSecurityNull(), WithDisconnectCommand())
+	if err := client.Connect("mem://gomq-test-disconnect-command"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send([]byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	if msg, err := server.Recv(); err != nil || string(msg) != "HELLO" {
+		t.Errorf("want %q, got %q, %v", "HELLO", msg, err)
+	}
+	for _, want := range []EventType{EventPeerDeparted, EventDisconnected} {
+		if got := next(); want != got {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	}
+
+	// Without the option a close looks like any other failure.
+	plain := NewClient(zmtp.NewSecurityNull())
+	if err := plain.Connect("mem://gomq-test-disconnect-command"); err != nil {
+		t.Fatal(err)
+	}
+	plain.Close()
+
+	if want, got := EventDisconnected, next(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestDisconnectCommandThenMessage(t *testing.T) {
+	server, next := departureEvents(t, "mem://gomq-test-disconnect-then-message")
+	defer server.Close()
+
+	netConn, err := defaultContext.mem.dial("gomq-test-disconnect-then-message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := zmtp.NewConnection(netConn)
+	if _, err := peer.Prepare(zmtp.NewSecurityNull(), zmtp.ClientSocketType, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer that keeps sending after announcing its close.
+	if err := peer.SendCommand(disconnectCommand, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.SendFrame([]byte("AFTER")); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := server.Recv(); err != nil || string(msg) != "AFTER" {
+		t.Errorf("want %q, got %q, %v", "AFTER", msg, err)
+	}
+	netConn.Close()
+
+	if want, got := EventPeerDeparted, next(); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestSendToPeer(t *testing.T) {
+	client := NewClient(zmtp.NewSecurityNull()).(*ClientSocket)
+	defer client.Close()
+
+	var servers []Server
+	for i := 0; i < 2; i++ {
+		server := NewServer(zmtp.NewSecurityNull())
+		defer server.Close()
+		endpoint := fmt.Sprintf("mem://gomq-test-send-to-peer-%d", i)
+		if _, err := server.Bind(endpoint); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Connect(endpoint); err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, server)
+	}
+
+	var id ConnID
+	for _, peer := range client.Peers() {
+		if peer.Endpoint == "mem://gomq-test-send-to-peer-1" {
+			id = peer.ID
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := client.SendToPeer(id, []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := servers[1].Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := fmt.Sprintf("%d", i), string(msg); want != got {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+
+	if want, got := ErrHostUnreachable, client.SendToPeer("gone", []byte("HELLO")); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestAcceptBackpressure(t *testing.T) {
+	endpoint := "mem://gomq-test-accept-backpressure"
+
+	events := make(chan Event, 100)
+	server := NewServer(zmtp.NewSecurityNull(), WithAcceptBackpressure(3, 0), WithMonitor(events)).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor := func(want EventType) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == want {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for %v", want)
+			}
+		}
+	}
+
+	first := NewClient(zmtp.NewSecurityNull())
+	defer first.Close()
+	if err := first.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := first.Send([]byte("HELLO")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitInbound(t, server.base(), 3)
+
+	// The accept loop was already waiting on Accept, so the
+	// next client still gets in and then it pauses.
+	second := NewClient(zmtp.NewSecurityNull())
+	defer second.Close()
+	if err := second.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(EventAcceptPaused)
+
+	third := NewClient(zmtp.NewSecurityNull()).(*ClientSocket)
+	defer third.Close()
+	if err := third.ConnectAsync(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if want, got := 2, server.AcceptedCount(); want != got {
+		t.Errorf("want %d connections while paused, got %d", want, got)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := server.Recv(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(EventAcceptResumed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := third.WaitForPeers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenBacklog(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull(), WithListenBacklog(1))
+	defer server.Close()
+
+	if _, err := server.Bind("tcp://127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxHandshakes(t *testing.T) {
+	events := make(chan Event, 100)
+	server := NewServer(zmtp.NewSecurityNull(), WithMaxHandshakes(2), WithMonitor(events)).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-max-handshakes"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Peers that never send their greeting.
+	for i := 0; i < 3; i++ {
+		netConn, err := defaultContext.mem.dial("gomq-test-max-handshakes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer netConn.Close()
+	}
+
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case ev := <-events:
+			if ev.Type == EventHandshakeFailed {
+				if !errors.Is(ev.Err, ErrTooManyHandshakes) {
+					t.Errorf("want ErrTooManyHandshakes, got %v", ev.Err)
+				}
+				done = true
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a handshake to be evicted")
+		}
+	}
+
+	if want, got := uint64(1), server.EvictedHandshakes(); want != got {
+		t.Errorf("want %d evicted, got %d", want, got)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+	if err := client.Connect("mem://gomq-test-max-handshakes"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeConcurrency(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull(), WithHandshakeConcurrency(1)).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-handshake-concurrency"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer that never sends its greeting holds the only turn.
+	stuck, err := defaultContext.mem.dial("gomq-test-handshake-concurrency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.HandshakesInFlight() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the handshake to start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+	if err := client.ConnectAsync("mem://gomq-test-handshake-concurrency"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if want, got := 0, server.PeerCount(); want != got {
+		t.Errorf("want %d peers while the turn is taken, got %d", want, got)
+	}
+	if want, got := 1, server.HandshakesInFlight(); want != got {
+		t.Errorf("want %d handshake in flight, got %d", want, got)
+	}
+
+	stuck.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitForPeers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecvAfterClose(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-recv-after-close"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	if err := client.Connect("mem://gomq-test-recv-after-close"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := client.Send([]byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Close()
+	waitInbound(t, server.base(), 100)
+	server.Close()
+
+	for i := 0; i < 100; i++ {
+		msg, err := server.Recv()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if want, got := fmt.Sprintf("%d", i), string(msg); want != got {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+
+	if _, err := server.Recv(); err != ErrSocketClosed {
+		t.Errorf("want %v, got %v", ErrSocketClosed, err)
+	}
+}
+
+func TestSendBufferBytes(t *testing.T) {
+	pull := NewPull(zmtp.NewSecurityNull())
+	defer pull.Close()
+
+	push, stalled := newStalledPush(t, pull, WithSendBufferBytes(200), WithSendTimeout(20*time.Millisecond))
+	defer push.Close()
+	defer stalled.release()
+
+	body := make([]byte, 50)
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = push.Send(body)
+	}
+	if want, got := ErrTimeout, err; want != got {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	// Two messages of 50 bytes plus overhead fit in 200 bytes.
+	if want, got := 2*queuedSize(body), push.Peers()[0].QueuedBytes; want != got {
+		t.Errorf("want %d queued bytes, got %d", want, got)
+	}
+}
+
+func TestRecvBufferBytes(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull(), WithRecvBufferBytes(200)).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-recv-buffer-bytes"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+	if err := client.Connect("mem://gomq-test-recv-buffer-bytes"); err != nil {
+		t.Fatal(err)
+	}
+
+	body := make([]byte, 50)
+	for i := 0; i < 10; i++ {
+		if err := client.Send(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := 2 * queuedSize(body)
+	deadline := time.Now().Add(time.Second)
+	for server.InboundBytes() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %d inbound bytes, got %d", want, server.InboundBytes())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := server.InboundBytes(); want != got {
+		t.Errorf("want %d inbound bytes once full, got %d", want, got)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := server.Recv(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want, got := int64(0), server.InboundBytes(); want != got {
+		t.Errorf("want %d inbound bytes, got %d", want, got)
+	}
+}
+
+func TestDebugString(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull(), WithSendHWM(10)).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-debug"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull()).(*ClientSocket)
+	defer client.Close()
+	if err := client.Connect("mem://gomq-test-debug"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.WaitForPeers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	info := server.DebugInfo()
+	if want, got := 10, info.SendHWM; want != got {
+		t.Errorf("want SendHWM %d, got %d", want, got)
+	}
+	if want, got := []string{"mem://gomq-test-debug"}, info.Bound; len(got) != 1 || want[0] != got[0] {
+		t.Errorf("want bound %v, got %v", want, got)
+	}
+	if want, got := 1, len(info.Peers); want != got {
+		t.Errorf("want %d peer, got %d", want, got)
+	}
+
+	dump := client.DebugString()
+	for _, want := range []string{"socket CLIENT mechanism=NULL", "connect mem://gomq-test-debug connected=true", "peer "} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("want %q in\n%s", want, dump)
+		}
+	}
+}
+
+func TestBucket(t *testing.T) {
+	start := time.Now()
+	b := newBucket(10, start)
+
+	// A full bucket takes a second's worth at once.
+	if wait := b.take(10, start); wait != 0 {
+		t.Errorf("want no wait with a full bucket, got %v", wait)
+	}
+	if want, got := 100*time.Millisecond, b.take(1, start); want != got {
+		t.Errorf("want a wait of %v, got %v", want, got)
+	}
+	// The debt is paid off after the wait.
+	if wait := b.take(0, start.Add(100*time.Millisecond)); wait != 0 {
+		t.Errorf("want no wait once refilled, got %v", wait)
+	}
+	// A quiet peer does not save up more than a second.
+	if want, got := 100*time.Millisecond, b.take(11, start.Add(time.Hour)); want != got {
+		t.Errorf("want a wait of %v, got %v", want, got)
+	}
+}
+
+func TestInboundRateLimit(t *testing.T) {
+	events := make(chan Event, 16)
+	server := NewServer(zmtp.NewSecurityNull(),
+		WithMonitor(events),
+		WithInboundRateLimit(RateLimit{Messages: 50}),
+		WithPeerRateLimit(func(peer PeerInfo) RateLimit {
+			if peer.Negotiated.PeerMetadata["exempt"] != "" {
+				return RateLimit{}
+			}
+			return RateLimit{Messages: 50}
+		}))
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-rate-limit"); err != nil {
+		t.Fatal(err)
+	}
+
+	flood := func(metadata map[string]string) time.Duration {
+		t.Helper()
+		netConn, err := defaultContext.mem.dial("gomq-test-rate-limit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer netConn.Close()
+		peer := zmtp.NewConnection(netConn)
+		if _, err := peer.Prepare(zmtp.NewSecurityNull(), zmtp.ClientSocketType, false, metadata); err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		go func() {
+			for i := 0; i < 75; i++ {
+				if err := peer.SendFrame([]byte("FLOOD")); err != nil {
+					return
+				}
+			}
+		}()
+		for i := 0; i < 75; i++ {
+			if _, err := server.Recv(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return time.Since(start)
+	}
+
+	// The first 50 go through at once, the other 25 at 50 a
+	// second.
+	if took := flood(nil); took < 400*time.Millisecond {
+		t.Errorf("want the flood held to the limit, took %v", took)
+	}
+	timeout := time.After(time.Second)
+	for throttled := false; !throttled; {
+		select {
+		case ev := <-events:
+			throttled = ev.Type == EventThrottled
+		case <-timeout:
+			t.Fatal("want EventThrottled")
+		}
+	}
+
+	if took := flood(map[string]string{"exempt": "yes"}); took > 400*time.Millisecond {
+		t.Errorf("want an exempt peer not limited, took %v", took)
+	}
+}
+
+func TestSendWhilePeersChurn(t *testing.T) {
+	for _, policy := range []HWMPolicy{HWMBlock, HWMDrop} {
+		t.Run(policy.String(), func(t *testing.T) {
+			endpoint := "gomq-test-send-churn-" + policy.String()
+			push := NewPush(zmtp.NewSecurityNull(), WithHWMPolicy(policy), WithSendHWM(4))
+			defer push.Close()
+			if _, err := push.Bind("mem://" + endpoint); err != nil {
+				t.Fatal(err)
+			}
+
+			stop := make(chan struct{})
+			sent := make(chan error, 1)
+			go func() {
+				for {
+					select {
+					case <-stop:
+						sent <- nil
+						return
+					default:
+					}
+					if err := push.Send([]byte("CHURN")); err != nil && err != ErrNotConnected {
+						sent <- err
+						return
+					}
+				}
+			}()
+
+			// Peers that come, read a little, and go.
+			deadline := time.Now().Add(300 * time.Millisecond)
+			for time.Now().Before(deadline) {
+				netConn, err := defaultContext.mem.dial(endpoint)
+				if err != nil {
+					t.Fatal(err)
+				}
+				peer := zmtp.NewConnection(netConn)
+				if _, err := peer.Prepare(zmtp.NewSecurityNull(), zmtp.PullSocketType, false, nil); err == nil {
+					peer.ReadMessage()
+				}
+				netConn.Close()
+			}
+			close(stop)
+
+			select {
+			case err := <-sent:
+				if err != nil {
+					t.Errorf("want Send to succeed or return %v, got %v", ErrNotConnected, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Send hung after the last peer went away")
+			}
+		})
+	}
+}
+
+// waitDisconnect waits for an EventDisconnected on events and
+// returns its error.
+func waitDisconnect(t *testing.T, events <-chan Event) error {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == EventDisconnected {
+				return ev.Err
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for the disconnect")
+		}
+	}
+}
+
+func TestReadIdleTimeout(t *testing.T) {
+	events := make(chan Event, 16)
+	server := NewServer(zmtp.NewSecurityNull(), WithMonitor(events), WithReadIdleTimeout(100*time.Millisecond)).(*ServerSocket)
+	defer server.Close()
+	addr, err := server.Bind("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A heartbeating peer stays connected while idle.
+	client := NewClient(zmtp.NewSecurityNull(), WithHeartbeat(20*time.Millisecond, time.Second))
+	defer client.Close()
+	if err := client.Connect("tcp://" + addr.String()); err != nil {
+		t.Fatal(err)
+	}
+	quiet := time.After(300 * time.Millisecond)
+	for waiting := true; waiting; {
+		select {
+		case ev := <-events:
+			if ev.Type == EventDisconnected {
+				t.Fatalf("want a heartbeating peer kept, got %v", ev.Err)
+			}
+		case <-quiet:
+			waiting = false
+		}
+	}
+
+	// A silent one is dropped.
+	netConn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netConn.Close()
+	if _, err := zmtp.NewConnection(netConn).Prepare(zmtp.NewSecurityNull(), zmtp.ClientSocketType, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitDisconnect(t, events); !errors.Is(err, ErrReadIdle) {
+		t.Errorf("want an error wrapping %v, got %v", ErrReadIdle, err)
+	}
+	if want, got := 1, server.PeerCount(); want != got {
+		t.Errorf("want %d peer, got %d", want, got)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	events := make(chan Event, 16)
+	push := NewPush(zmtp.NewSecurityNull(), WithMonitor(events), WithWriteTimeout(100*time.Millisecond))
+	defer push.Close()
+	addr, err := push.Bind("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A peer that never reads.
+	netConn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netConn.Close()
+	if _, err := zmtp.NewConnection(netConn).Prepare(zmtp.NewSecurityNull(), zmtp.PullSocketType, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := push.WaitForPeers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		msg := make([]byte, 1<<20)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if push.Send(msg) == ErrNotConnected {
+				return
+			}
+		}
+	}()
+
+	if err := waitDisconnect(t, events); !errors.Is(err, ErrWriteTimeout) {
+		t.Errorf("want an error wrapping %v, got %v", ErrWriteTimeout, err)
+	}
+}
+
+// plainNull is NULL announced as PLAIN, which is enough for a
+// socket to tell two mechanisms apart.
+type plainNull struct {
+	zmtp.SecurityNull
+}
+
+func (plainNull) Type() zmtp.SecurityMechanismType {
+	return zmtp.PlainSecurityMechanismType
+}
+
+func TestSetMechanism(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer server.Close()
+	for _, endpoint := range []string{"mem://gomq-test-set-mechanism-1", "mem://gomq-test-set-mechanism-2"} {
+		if _, err := server.Bind(endpoint); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := NewClient(zmtp.NewSecurityNull()).(*ClientSocket)
+	defer client.Close()
+	if err := client.Connect("mem://gomq-test-set-mechanism-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.SetMechanism(&plainNull{})
+	client.SetMechanism(&plainNull{})
+	if want, got := zmtp.PlainSecurityMechanismType, client.DebugInfo().Mechanism; want != got {
+		t.Errorf("want mechanism %v, got %v", want, got)
+	}
+	if err := client.Connect("mem://gomq-test-set-mechanism-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first connection keeps the mechanism it was
+	// established with.
+	mechanisms := map[string]zmtp.SecurityMechanismType{}
+	for _, peer := range client.Peers() {
+		mechanisms[peer.Endpoint] = peer.Negotiated.Mechanism
+	}
+	want := map[string]zmtp.SecurityMechanismType{
+		"mem://gomq-test-set-mechanism-1": zmtp.NullSecurityMechanismType,
+		"mem://gomq-test-set-mechanism-2": zmtp.PlainSecurityMechanismType,
+	}
+	if len(want) != len(mechanisms) {
+		t.Fatalf("want mechanisms %v, got %v", want, mechanisms)
+	}
+	for endpoint, mechanism := range want {
+		if got := mechanisms[endpoint]; mechanism != got {
+			t.Errorf("want %v on %s, got %v", mechanism, endpoint, got)
+		}
+	}
+}
+
+func TestMaxCommandSize(t *testing.T) {
+	events := make(chan Event, 16)
+	server := NewServer(zmtp.NewSecurityNull(), WithMonitor(events), WithMaxCommandSize(64))
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-max-command-size"); err != nil {
+		t.Fatal(err)
+	}
+
+	netConn, err := defaultContext.mem.dial("gomq-test-max-command-size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netConn.Close()
+	peer := zmtp.NewConnection(netConn)
+	if _, err := peer.Prepare(zmtp.NewSecurityNull(), zmtp.ClientSocketType, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.SendCommand("SUBSCRIBE", make([]byte, 65)); err != nil {
+		t.Fatal(err)
+	}
+
+	var protocolErr *zmtp.ProtocolError
+	if err := waitDisconnect(t, events); !errors.As(err, &protocolErr) {
+		t.Errorf("want a *zmtp.ProtocolError, got %v", err)
+	}
+}
+
+func TestConnValues(t *testing.T) {
+	finalized := make(chan map[interface{}]interface{}, 2)
+	server := NewServer(zmtp.NewSecurityNull(), WithConnFinalizer(func(peer PeerInfo, values map[interface{}]interface{}) {
+		finalized <- values
+	})).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-conn-values"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	if err := client.Connect("mem://gomq-test-conn-values"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.WaitForPeers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	id := server.Peers()[0].ID
+
+	if err := server.SetConnValue(id, "session", 42); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 42, server.ConnValue(id, "session"); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if got := server.ConnValue(id, "other"); got != nil {
+		t.Errorf("want no value, got %v", got)
+	}
+
+	client.Close()
+	select {
+	case values := <-finalized:
+		if want, got := 42, values["session"]; want != got {
+			t.Errorf("want %v finalized, got %v", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("want the values finalized")
+	}
+
+	if want, got := ErrHostUnreachable, server.SetConnValue(id, "session", 43); want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if got := server.ConnValue(id, "session"); got != nil {
+		t.Errorf("want the values released, got %v", got)
+	}
+
+	// A graceful Shutdown finalizes the values of the
+	// connections it closes too.
+	client = NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+	if err := client.Connect("mem://gomq-test-conn-values"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.WaitForPeers(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetConnValue(server.Peers()[0].ID, "session", 43); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case values := <-finalized:
+		if want, got := 43, values["session"]; want != got {
+			t.Errorf("want %v finalized on Shutdown, got %v", want, got)
+		}
+	default:
+		t.Error("want the values finalized by Shutdown")
+	}
+}
+
+func TestSendOnlyDiscards(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%t", strict), func(t *testing.T) {
+			endpoint := fmt.Sprintf("gomq-test-send-only-%t", strict)
+			events := make(chan Event, 16)
+			opts := []SocketOption{WithMonitor(events)}
+			if strict {
+				opts = append(opts, WithStrictSendOnly())
+			}
+			push := NewPush(zmtp.NewSecurityNull(), opts...)
+			defer push.Close()
+			if _, err := push.Bind("mem://" + endpoint); err != nil {
+				t.Fatal(err)
+			}
+
+			// A PULL peer that sends messages anyway.
+			netConn, err := defaultContext.mem.dial(endpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer netConn.Close()
+			peer := zmtp.NewConnection(netConn)
+			if _, err := peer.Prepare(zmtp.NewSecurityNull(), zmtp.PullSocketType, false, nil); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if err := peer.SendFrame([]byte("CONFUSED")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if strict {
+				if want, got := ErrUnexpectedMessage, waitDisconnect(t, events); want != got {
+					t.Errorf("want %v, got %v", want, got)
+				}
+				return
+			}
+
+			// The connection stays up and keeps answering
+			// commands.
+			if err := peer.SendPing(time.Second, []byte("ALIVE")); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := peer.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := "PONG", msg.Name; want != got {
+				t.Errorf("want %q, got %q", want, got)
+			}
+			if want, got := uint64(3), push.Discarded(); want != got {
+				t.Errorf("want %d discarded, got %d", want, got)
+			}
+			if want, got := 1, push.PeerCount(); want != got {
+				t.Errorf("want %d peer, got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestParallelConnections(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-parallel"); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan Event, 16)
+	client := NewClient(zmtp.NewSecurityNull(), WithParallelConnections(4), WithMonitor(events)).(*ClientSocket)
+	defer client.Close()
+	if err := client.Connect("mem://gomq-test-parallel"); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 4, client.PeerCount(); want != got {
+		t.Fatalf("want %d connections, got %d", want, got)
+	}
+	if want, got := 1, len(client.DebugInfo().Connected); want != got {
+		t.Errorf("want %d connected endpoint, got %d", want, got)
+	}
+
+	// Sends are spread over the connections.
+	for i := 0; i < 8; i++ {
+		if err := client.Send([]byte("STRIPE")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	senders := make(map[ConnID]int)
+	for i := 0; i < 8; i++ {
+		_, peer, err := server.RecvWithSource()
+		if err != nil {
+			t.Fatal(err)
+		}
+		senders[peer.ID]++
+	}
+	if want, got := 4, len(senders); want != got {
+		t.Errorf("want messages from %d connections, got %d", want, got)
+	}
+
+	// Each connection is redialed on its own.
+	server.RemoveConnection(string(server.Peers()[0].ID))
+	timeout := time.After(5 * time.Second)
+	for _, want := range []EventType{EventDisconnected, EventConnected} {
+		for found := false; !found; {
+			select {
+			case ev := <-events:
+				found = ev.Type == want
+			case <-timeout:
+				t.Fatalf("timed out waiting for %v", want)
+			}
+		}
+	}
+	if want, got := 4, client.PeerCount(); want != got {
+		t.Errorf("want %d connections, got %d", want, got)
+	}
+}
+
+func TestReconnectHook(t *testing.T) {
+	old := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer old.Close()
+	if _, err := old.Bind("mem://gomq-test-hook-old"); err != nil {
+		t.Fatal(err)
+	}
+	moved := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer moved.Close()
+	if _, err := moved.Bind("mem://gomq-test-hook-new"); err != nil {
+		t.Fatal(err)
+	}
+
+	type call struct {
+		endpoint string
+		attempt  int
+		lastErr  error
+	}
+	calls := make(chan call, 16)
+	client := NewClient(zmtp.NewSecurityNull()).(*ClientSocket)
+	defer client.Close()
+	client.base().retryInterval = 10 * time.Millisecond
+	client.SetReconnectHook(func(endpoint string, attempt int, lastErr error) (string, bool) {
+		calls <- call{endpoint, attempt, lastErr}
+		if endpoint == "mem://gomq-test-hook-old" {
+			return "mem://gomq-test-hook-new", true
+		}
+		return "", false
+	})
+	if err := client.Connect("mem://gomq-test-hook-old"); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); old.PeerCount() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the server to add the connection")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The lost connection is redialed where the hook says.
+	old.RemoveConnection(string(old.Peers()[0].ID))
+	select {
+	case c := <-calls:
+		if c.endpoint != "mem://gomq-test-hook-old" || c.attempt != 1 || c.lastErr == nil {
+			t.Errorf("want attempt 1 at the old endpoint after an error, got %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the hook")
+	}
+	for deadline := time.Now().Add(5 * time.Second); moved.PeerCount() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the connection to the new endpoint")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A vetoed reconnect stops the dialer.
+	moved.RemoveConnection(string(moved.Peers()[0].ID))
+	select {
+	case c := <-calls:
+		if c.endpoint != "mem://gomq-test-hook-new" {
+			t.Errorf("want the new endpoint, got %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the hook")
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case c := <-calls:
+		t.Errorf("want no attempt after the veto, got %+v", c)
+	default:
+	}
+	if got := client.PeerCount(); got != 0 {
+		t.Errorf("want no connections, got %d", got)
+	}
+	if got := len(client.DebugInfo().Connected); got != 0 {
+		t.Errorf("want no dialers left, got %d", got)
+	}
+}
+
+// A handshake failing while redialing is retried rather than
+// stopping the dialer.
+func TestRedialHandshakeFailure(t *testing.T) {
+	endpoint := "mem://gomq-test-redial-handshake"
+	first := NewServer(zmtp.NewSecurityNull())
+	if _, err := first.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan Event, 100)
+	client := NewClient(zmtp.NewSecurityNull(), WithMonitor(events)).(*ClientSocket)
+	defer client.Close()
+	client.base().retryInterval = 10 * time.Millisecond
+	if err := client.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+
+	refusing := NewServer(zmtp.NewSecurityNull(),
+		WithAllowedMechanisms(zmtp.CurveSecurityMechanismType))
+	if _, err := refusing.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for failed := false; !failed; {
+		select {
+		case ev := <-events:
+			failed = ev.Type == EventHandshakeFailed
+		case <-timeout:
+			t.Fatal("timed out waiting for the handshake to fail")
+		}
+	}
+	refusing.Close()
+
+	healthy := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer healthy.Close()
+	if _, err := healthy.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); healthy.PeerCount() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the client to reconnect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// A Connect whose retries are vetoed returns ErrReconnectAborted.
+func TestReconnectHookAbortsConnect(t *testing.T) {
+	client := NewClient(zmtp.NewSecurityNull()).(*ClientSocket)
+	defer client.Close()
+	client.base().retryInterval = 10 * time.Millisecond
+	client.SetReconnectHook(func(string, int, error) (string, bool) {
+		return "", false
+	})
+
+	if err := client.Connect("mem://gomq-test-hook-nowhere"); !errors.Is(err, ErrReconnectAborted) {
+		t.Errorf("want ErrReconnectAborted, got %v", err)
+	}
+}
+
+func TestRecvMessage(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull(), WithTimestamps()).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-recv-message"); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan Event, 16)
+	client := NewClient(zmtp.NewSecurityNull(), WithMonitor(events)).(*ClientSocket)
+	defer client.Close()
+	if err := client.Connect("mem://gomq-test-recv-message"); err != nil {
+		t.Fatal(err)
+	}
+
+	sendAndCheck := func(epoch uint64) {
+		t.Helper()
+		if want, got := epoch, client.Peers()[0].Epoch; want != got {
+			t.Errorf("want epoch %d, got %d", want, got)
+		}
+		for i := 0; i < 2; i++ {
+			if err := client.Send([]byte("SEQ")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for want := uint64(1); want <= 2; want++ {
+			msg, peer, err := server.RecvMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := msg.Seq; want != got {
+				t.Errorf("want sequence number %d, got %d", want, got)
+			}
+			if msg.ReceivedAt.IsZero() {
+				t.Error("want the message stamped")
+			}
+			if peer.RecvSeq < msg.Seq {
+				t.Errorf("want the peer's sequence number at least %d, got %d", msg.Seq, peer.RecvSeq)
+			}
+		}
+	}
+	sendAndCheck(1)
+
+	// Numbering starts over on the redialed connection, which
+	// is the dialer's second.
+	server.RemoveConnection(string(server.Peers()[0].ID))
+	timeout := time.After(5 * time.Second)
+	for _, want := range []EventType{EventDisconnected, EventConnected} {
+		for found := false; !found; {
+			select {
+			case ev := <-events:
+				found = ev.Type == want
+			case <-timeout:
+				t.Fatalf("timed out waiting for %v", want)
+			}
+		}
+	}
+	sendAndCheck(2)
+}
+
+func TestActiveResources(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull(), WithHeartbeat(time.Second, 5*time.Second)).(*ServerSocket)
+	if _, err := server.Bind("mem://gomq-test-resources"); err != nil {
+		t.Fatal(err)
+	}
+	server.SetDropHandler(func(PeerInfo, []byte) {})
+
+	client := NewClient(zmtp.NewSecurityNull()).(*ClientSocket)
+	if err := client.Connect("mem://gomq-test-resources"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send([]byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The goroutine that handshaked the connection may still
+	// be on its way out.
+	waitCounts := func(s *Socket, want ResourceCounts) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for s.ActiveResources() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("want resources %+v, got %+v", want, s.ActiveResources())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitCounts(server.base(), ResourceCounts{Sockets: 1, Readers: 1, Writers: 1, Heartbeats: 1, Acceptors: 1, Handlers: 1})
+	waitCounts(client.base(), ResourceCounts{Sockets: 1, Readers: 1, Writers: 1})
+
+	client.Close()
+	server.Close()
+	waitCounts(client.base(), ResourceCounts{})
+	waitCounts(server.base(), ResourceCounts{})
+}
+
+func TestCloseFullRecvQueue(t *testing.T) {
+	const endpoint = "mem://gomq-test-close-full-recv-queue"
+	pull := NewPull(zmtp.NewSecurityNull(), WithRecvHWM(1))
+	if _, err := pull.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	push := NewPush(zmtp.NewSecurityNull())
+	defer push.Close()
+	if err := push.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := push.Send([]byte("HELLO")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One message fills the queue and the reader waits to
+	// queue the next.
+	deadline := time.Now().Add(5 * time.Second)
+	for pull.DebugInfo().Inbound != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want the reader blocked on the full queue, got %d inbound", pull.DebugInfo().Inbound)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	pull.Close()
+	for pull.ActiveResources() != (ResourceCounts{}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("want no resources after the close, got %+v", pull.ActiveResources())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if want, got := int64(1), pull.DebugInfo().Inbound; want != got {
+		t.Errorf("want the abandoned message uncounted, leaving %d inbound, got %d", want, got)
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	byBody := func(msg []byte) (string, bool) { return string(msg), len(msg) > 0 }
+
+	d := newDedup(byBody, DedupWindow{Count: 2})
+	for i, c := range []struct {
+		msg  string
+		want bool
+	}{
+		{"a", false},
+		{"a", true},
+		{"b", false},
+		{"", false},
+		{"", false},
+		// a is evicted by c, the window holding two keys.
+		{"c", false},
+		{"a", false},
+		{"c", true},
+		{"b", false},
+	} {
+		if got := d.duplicate([]byte(c.msg)); c.want != got {
+			t.Errorf("%d: %q: want duplicate %t, got %t", i, c.msg, c.want, got)
+		}
+	}
+	if got := len(d.seen); got > 2 {
+		t.Errorf("want at most 2 keys remembered, got %d", got)
+	}
+
+	d = newDedup(byBody, DedupWindow{Age: 20 * time.Millisecond})
+	d.duplicate([]byte("a"))
+	if !d.duplicate([]byte("a")) {
+		t.Error("want a duplicate within the window")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if d.duplicate([]byte("a")) {
+		t.Error("want no duplicate once the window has passed")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull(), WithDedup(func(msg []byte) (string, bool) {
+		id, _, ok := bytes.Cut(msg, []byte(" "))
+		return string(id), ok
+	}, DedupWindow{})).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-dedup"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+	if err := client.Connect("mem://gomq-test-dedup"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The resends of 1 and 2 are dropped; a message without
+	// a key goes through however often it is sent.
+	for _, msg := range []string{"1 one", "2 two", "1 one", "2 two", "keyless", "keyless", "3 three"} {
+		if err := client.Send([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"1 one", "2 two", "keyless", "keyless", "3 three"} {
+		msg, err := server.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != string(msg) {
+			t.Errorf("want %q, got %q", want, msg)
+		}
+	}
+	if want, got := uint64(2), server.Duplicates(); want != got {
+		t.Errorf("want %d duplicates, got %d", want, got)
+	}
+}
+
+func TestRecvInterceptor(t *testing.T) {
+	const endpoint = "mem://gomq-test-recv-interceptor"
+	events := make(chan Event, 16)
+	server := NewServer(zmtp.NewSecurityNull(), WithMonitor(events)).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	server.SetRecvInterceptor(func(peer PeerInfo, msg *zmtp.Message) bool {
+		switch string(msg.Body) {
+		case "PANIC":
+			panic("bad message")
+		case "DROP":
+			return false
+		}
+		if peer.Endpoint != endpoint {
+			t.Errorf("want the message from %q, got %q", endpoint, peer.Endpoint)
+		}
+		msg.Body = bytes.ToLower(msg.Body)
+		return true
+	})
+
+	client := NewClient(zmtp.NewSecurityNull()).(*ClientSocket)
+	defer client.Close()
+	if err := client.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{"DROP", "HELLO"} {
+		if err := client.Send([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msg, err := server.Recv(); err != nil || string(msg) != "hello" {
+		t.Errorf("want %q, got %q, %v", "hello", msg, err)
+	}
+	if want, got := uint64(1), server.Filtered(); want != got {
+		t.Errorf("want %d filtered, got %d", want, got)
+	}
+
+	// A panic only takes down the connection, which the
+	// client then dials again.
+	if err := client.Send([]byte("PANIC")); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for disconnected := false; !disconnected; {
+		select {
+		case ev := <-events:
+			if ev.Type == EventDisconnected {
+				if !errors.Is(ev.Err, ErrInterceptorPanic) {
+					t.Errorf("want the connection torn down with %v, got %v", ErrInterceptorPanic, ev.Err)
+				}
+				disconnected = true
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for the disconnect")
+		}
+	}
+
+	server.SetRecvInterceptor(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, socket := range []*Socket{server.base(), client.base()} {
+		if err := socket.WaitForPeers(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Send([]byte("PANIC")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := server.Recv(); err != nil || string(msg) != "PANIC" {
+		t.Errorf("want %q once the interceptor is removed, got %q, %v", "PANIC", msg, err)
+	}
+}
+
+func TestMisbehavingPeer(t *testing.T) {
+	// dialTo runs steps as a peer connecting to a bound
+	// SERVER and returns the server's first event.
+	dialTo := func(t *testing.T, steps ...zmtp.Step) (*zmtp.ScriptedPeer, Event) {
+		t.Helper()
+		events := make(chan Event, 10)
+		server := NewServer(zmtp.NewSecurityNull(), WithMonitor(events))
+		t.Cleanup(server.Close)
+		addr, err := server.Bind("tcp://127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		peer := zmtp.NewScriptedPeer(steps...)
+		t.Cleanup(func() { peer.Close() })
+		if err := peer.Dial("tcp", addr.String()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case ev := <-events:
+			return peer, ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+			return nil, Event{}
+		}
+	}
+
+	t.Run("TruncatedGreeting", func(t *testing.T) {
+		greeting := zmtp.Greeting(3, 0, zmtp.NullSecurityMechanismType, false)
+		peer, ev := dialTo(t, zmtp.Write(greeting[:20]))
+		if want, got := EventHandshakeFailed, ev.Type; want != got {
+			t.Errorf("want %v, got %v", want, got)
+		}
+		if err := peer.Wait(5 * time.Second); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("BadSignature", func(t *testing.T) {
+		greeting := zmtp.Greeting(3, 0, zmtp.NullSecurityMechanismType, false)
+		greeting[0] = 0
+		_, ev := dialTo(t, zmtp.Write(greeting), zmtp.ExpectClose())
+		var protocolErr *zmtp.ProtocolError
+		if ev.Type != EventHandshakeFailed || !errors.As(ev.Err, &protocolErr) {
+			t.Errorf("want %v with a protocol error, got %v: %v", EventHandshakeFailed, ev.Type, ev.Err)
+		}
+	})
+
+	t.Run("WrongSocketType", func(t *testing.T) {
+		_, ev := dialTo(t,
+			zmtp.Greet(zmtp.NullSecurityMechanismType, false),
+			zmtp.ReadGreeting(),
+			zmtp.ExpectCommand("READY"),
+			zmtp.Write(zmtp.ReadyCommand(zmtp.PushSocketType, nil)),
+			zmtp.ExpectClose(),
+		)
+		if want, got := EventHandshakeFailed, ev.Type; want != got {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	})
+
+	// connectTo runs steps as a SERVER a CLIENT connects to.
+	connectTo := func(t *testing.T, steps ...zmtp.Step) (*ClientSocket, *zmtp.ScriptedPeer, chan Event) {
+		t.Helper()
+		peer := zmtp.NewScriptedPeer(steps...)
+		t.Cleanup(func() { peer.Close() })
+		addr, err := peer.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events := make(chan Event, 10)
+		client := NewClient(zmtp.NewSecurityNull(), WithMonitor(events))
+		t.Cleanup(client.Close)
+		if err := client.Connect("tcp://" + addr.String()); err != nil {
+			t.Fatal(err)
+		}
+		return client.(*ClientSocket), peer, events
+	}
+
+	t.Run("UnknownCommand", func(t *testing.T) {
+		client, peer, _ := connectTo(t,
+			zmtp.Handshake(zmtp.ServerSocketType, true),
+			zmtp.Write(zmtp.CommandFrame("BOGUS", []byte("not a message"))),
+			zmtp.Write(zmtp.Frame(0, []byte("AFTER"))),
+			zmtp.ExpectFrame([]byte("HELLO")),
+		)
+		msg, err := client.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := "AFTER", string(msg); want != got {
+			t.Errorf("want %q, got %q", want, got)
+		}
+		if err := client.Send([]byte("HELLO")); err != nil {
+			t.Fatal(err)
+		}
+		if err := peer.Wait(5 * time.Second); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("ReservedFlags", func(t *testing.T) {
+		// Like libzmq, gomq does not look at the reserved bits.
+		client, _, _ := connectTo(t,
+			zmtp.Handshake(zmtp.ServerSocketType, true),
+			zmtp.Write(zmtp.Frame(0xF0, []byte("RESERVED"))),
+			zmtp.ExpectClose(),
+		)
+		msg, err := client.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := "RESERVED", string(msg); want != got {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	})
+
+	t.Run("GarbageAfterHandshake", func(t *testing.T) {
+		_, peer, events := connectTo(t,
+			zmtp.Handshake(zmtp.ServerSocketType, true),
+			zmtp.Write(zmtp.Frame(zmtp.FlagMore, []byte("garbage"))),
+			zmtp.ExpectClose(),
+		)
+		if err := waitDisconnect(t, events); err == nil {
+			t.Error("want the connection torn down with an error")
+		}
+		if err := peer.Wait(5 * time.Second); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestReceiverOrder(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-receiver-order"); err != nil {
+		t.Fatal(err)
+	}
+
+	const clients, count, receivers = 4, 300, 8
+	for i := 0; i < clients; i++ {
+		client := NewClient(zmtp.NewSecurityNull())
+		defer client.Close()
+		if err := client.Connect("mem://gomq-test-receiver-order"); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for n := 0; n < count; n++ {
+				if err := client.Send([]byte(fmt.Sprint(n))); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// Each receiver checks, once it has a message, that it is
+	// the one after the last handled from its connection.
+	var (
+		mu      sync.Mutex
+		last    = make(map[ConnID]int)
+		handled int
+		done    = make(chan struct{})
+	)
+	var wg sync.WaitGroup
+	for i := 0; i < receivers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := server.NewReceiver()
+			defer r.Close()
+			for {
+				msg, peer, err := r.RecvWithSource()
+				if err != nil {
+					return
+				}
+				var n int
+				fmt.Sscan(string(msg), &n)
+
+				mu.Lock()
+				prev, ok := last[peer.ID]
+				if !ok {
+					prev = -1
+				}
+				if n != prev+1 {
+					t.Errorf("connection %v: want message %d, got %d", peer.ID, prev+1, n)
+				}
+				last[peer.ID] = n
+				handled++
+				if handled == clients*count {
+					close(done)
+				}
+				mu.Unlock()
+
+				// Let the others at the queue before handing
+				// the connection back.
+				runtime.Gosched()
+			}
+		}()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the messages")
+	}
+	server.Close()
+	wg.Wait()
+}
+
+func TestConcurrentRecv(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull()).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-concurrent-recv"); err != nil {
+		t.Fatal(err)
+	}
+
+	const clients, count, receivers = 4, 300, 8
+	for i := 0; i < clients; i++ {
+		client := NewClient(zmtp.NewSecurityNull())
+		defer client.Close()
+		if err := client.Connect("mem://gomq-test-concurrent-recv"); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for n := 0; n < count; n++ {
+				if err := client.Send([]byte(fmt.Sprint(n))); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// Each connection's messages are handed out in order, so
+	// every receiver gets them in order, and each exactly once.
+	var (
+		mu      sync.Mutex
+		seen    = make(map[ConnID]map[int]bool)
+		handled int
+		done    = make(chan struct{})
+	)
+	var wg sync.WaitGroup
+	for i := 0; i < receivers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := make(map[ConnID]int)
+			for {
+				msg, peer, err := server.RecvWithSource()
+				if err != nil {
+					return
+				}
+				var n int
+				fmt.Sscan(string(msg), &n)
+				if prev, ok := last[peer.ID]; ok && n <= prev {
+					t.Errorf("connection %v: got message %d after %d", peer.ID, n, prev)
+				}
+				last[peer.ID] = n
+
+				mu.Lock()
+				if seen[peer.ID] == nil {
+					seen[peer.ID] = make(map[int]bool)
+				}
+				if seen[peer.ID][n] {
+					t.Errorf("connection %v: got message %d twice", peer.ID, n)
+				}
+				seen[peer.ID][n] = true
+				handled++
+				if handled == clients*count {
+					close(done)
+				}
+				mu.Unlock()
+				runtime.Gosched()
+			}
+		}()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the messages")
+	}
+	server.Close()
+	wg.Wait()
+}
+
+func TestReceiverHandsBack(t *testing.T) {
+	recvAsync := func(r *Receiver) <-chan string {
+		got := make(chan string, 1)
+		go func() {
+			msg, _ := r.Recv()
+			got <- string(msg)
+		}()
+		return got
+	}
+
+	for _, tc := range []struct {
+		name      string
+		opts      []SocketOption
+		unordered bool
+	}{
+		{name: "Ordered"},
+		{name: "Unordered", opts: []SocketOption{WithUnorderedRecv()}, unordered: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			endpoint := "mem://gomq-test-receiver-" + strings.ToLower(tc.name)
+			server := NewServer(zmtp.NewSecurityNull(), tc.opts...).(*ServerSocket)
+			defer server.Close()
+			if _, err := server.Bind(endpoint); err != nil {
+				t.Fatal(err)
+			}
+			client := NewClient(zmtp.NewSecurityNull())
+			defer client.Close()
+			if err := client.Connect(endpoint); err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range []string{"one", "two"} {
+				if err := client.Send([]byte(msg)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			a, b := server.NewReceiver(), server.NewReceiver()
+			if msg, err := a.Recv(); err != nil || string(msg) != "one" {
+				t.Fatalf("want %q, got %q and %v", "one", msg, err)
+			}
+
+			// While a has the connection, its next message
+			// waits for a to hand it back, unless the socket
+			// receives unordered.
+			got := recvAsync(b)
+			if !tc.unordered {
+				select {
+				case msg := <-got:
+					t.Fatalf("want the message to wait, got %q", msg)
+				case <-time.After(50 * time.Millisecond):
+				}
+				a.Close()
+			}
+			select {
+			case msg := <-got:
+				if want := "two"; want != msg {
+					t.Errorf("want %q, got %q", want, msg)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for the message")
+			}
+		})
+	}
+}
+
+func TestStrictMechanism(t *testing.T) {
+	// The peers' greetings claim NULL, but their handshakes
+	// go on with PLAIN's HELLO.
+	hello := zmtp.Write(zmtp.CommandFrame("HELLO", nil))
+
+	t.Run("Client", func(t *testing.T) {
+		peer := zmtp.NewScriptedPeer(zmtp.Greet(zmtp.NullSecurityMechanismType, true), zmtp.ReadGreeting(), hello, zmtp.ExpectClose())
+		defer peer.Close()
+		addr, err := peer.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client := NewClient(zmtp.NewSecurityNull(), WithStrictMechanism(true)).(*ClientSocket)
+		defer client.Close()
+		endpoint := "tcp://" + addr.String()
+		if err := client.Connect(endpoint); !errors.Is(err, zmtp.ErrMechanismMismatch) {
+			t.Fatalf("want %v, got %v", zmtp.ErrMechanismMismatch, err)
+		}
+		if attempts := client.EndpointStatus(endpoint).Attempts; len(attempts) == 0 || attempts[len(attempts)-1].Stage != AttemptAuth {
+			t.Errorf("want the attempt to fail authenticating, got %+v", attempts)
+		}
+	})
+
+	t.Run("Server", func(t *testing.T) {
+		events := make(chan Event, 10)
+		server := NewServer(zmtp.NewSecurityNull(), WithStrictMechanism(true), WithMonitor(events))
+		defer server.Close()
+		addr, err := server.Bind("tcp://127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		peer := zmtp.NewScriptedPeer(zmtp.Greet(zmtp.NullSecurityMechanismType, false), zmtp.ReadGreeting(), hello, zmtp.ExpectClose())
+		defer peer.Close()
+		if err := peer.Dial("tcp", addr.String()); err != nil {
+			t.Fatal(err)
+		}
+
+		for ev := range events {
+			if ev.Type == EventHandshakeFailed {
+				if !errors.Is(ev.Err, zmtp.ErrMechanismMismatch) {
+					t.Errorf("want %v, got %v", zmtp.ErrMechanismMismatch, ev.Err)
+				}
+				break
+			}
+		}
+	})
+}
+
+func TestBroadcast(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull(), WithSendHWM(1)).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Broadcast([]byte("HELLO")); err != ErrNotConnected {
+		t.Errorf("want %v with no peers, got %v", ErrNotConnected, err)
+	}
+	if _, err := server.Bind("mem://gomq-test-broadcast"); err != nil {
+		t.Fatal(err)
+	}
+
+	var clients []Client
+	for i := 0; i < 2; i++ {
+		client := NewClient(zmtp.NewSecurityNull())
+		defer client.Close()
+		if err := client.Connect("mem://gomq-test-broadcast"); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+	}
+
+	// The third peer stops reading once it is connected, so
+	// that the server's connection to it stalls.
+	peer := zmtp.NewScriptedPeer(zmtp.Handshake(zmtp.ClientSocketType, false), zmtp.Pause(time.Second))
+	defer peer.Close()
+	addr, err := peer.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	netConn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stalled := &stallConn{Conn: netConn}
+	zmtpConn := zmtp.NewConnection(stalled)
+	if _, err := zmtpConn.Prepare(zmtp.NewSecurityNull(), zmtp.ServerSocketType, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	stalled.stall()
+	defer stalled.release()
+	server.AddConnection(NewConnection(stalled, zmtpConn))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.WaitForPeers(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stalled connection's writer holds on to up to one
+	// queue's worth of messages besides the one it is
+	// writing; after that it is skipped. The clients read
+	// each message before the next is broadcast, so that
+	// their queues never fill.
+	const count = 5
+	var delivered int
+	for i := 0; i < count; i++ {
+		delivered, err = server.Broadcast([]byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, client := range clients {
+			msg, err := client.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := fmt.Sprint(i), string(msg); want != got {
+				t.Errorf("want %q, got %q", want, got)
+			}
+		}
+	}
+	if want := 2; want != delivered {
+		t.Errorf("want the last broadcast delivered to %d peers, got %d", want, delivered)
+	}
+	if server.Dropped() == 0 {
+		t.Error("want the stalled peer's skipped messages counted as dropped")
+	}
+}
+
+func TestRecvAck(t *testing.T) {
+	server := NewServer(zmtp.NewSecurityNull(), WithAck(50*time.Millisecond, 1)).(*ServerSocket)
+	defer server.Close()
+	if _, err := server.Bind("mem://gomq-test-recv-ack"); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(zmtp.NewSecurityNull())
+	defer client.Close()
+	if err := client.Connect("mem://gomq-test-recv-ack"); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"1", "2", "3"} {
+		if err := client.Send([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recv := func(want string) (func(), func(bool)) {
+		t.Helper()
+		msg, ack, nack, err := server.RecvAck()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != string(msg.Body) {
+			t.Fatalf("want %q, got %q", want, msg.Body)
+		}
+		return ack, nack
+	}
+
+	ack, _ := recv("1")
+	ack()
+
+	// A message nacked with requeue comes back ahead of the
+	// others, and one nacked without is rejected.
+	_, nack := recv("2")
+	nack(true)
+	_, nack = recv("2")
+	nack(false)
+	if want, got := uint64(1), server.Rejected(); want != got {
+		t.Errorf("want %d rejected, got %d", want, got)
+	}
+
+	// A message left unacked comes back once the ack timeout
+	// is up, until it has been redelivered as often as it
+	// may.
+	lateAck, _ := recv("3")
+	recv("3")
+	lateAck()
+	deadline := time.Now().Add(time.Second)
+	for server.Rejected() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if want, got := uint64(2), server.Rejected(); want != got {
+		t.Errorf("want %d rejected, got %d", want, got)
+	}
+
+	if err := client.Send([]byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	ack, nack = recv("4")
+	ack()
+	nack(true)
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := server.base().tryRecv(); ok {
+		t.Error("want an acked message neither nacked nor redelivered")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	noop := func(*Connection) {}
+	for _, test := range []struct {
+		name     string
+		sockType zmtp.SocketType
+		opts     []SocketOption
+		want     string
+	}{
+		{"HWMNotPositive", zmtp.PushSocketType, []SocketOption{WithSendHWM(0)}, "WithSendHWM: the high water mark must be positive"},
+		{"SendHWMOnPull", zmtp.PullSocketType, []SocketOption{WithSendHWM(10)}, "WithSendHWM: the socket does not send"},
+		// Options set to their defaults are still set.
+		{"DefaultSendHWMOnPull", zmtp.PullSocketType, []SocketOption{WithSendHWM(CurrentDefaults().SendHWM)}, "WithSendHWM: the socket does not send"},
+		{"DefaultRecvHWMOnPush", zmtp.PushSocketType, []SocketOption{WithRecvHWM(CurrentDefaults().RecvHWM)}, "WithRecvHWM: the socket does not receive"},
+		{"HWMPolicyOnPull", zmtp.PullSocketType, []SocketOption{WithHWMPolicy(HWMDrop)}, "WithHWMPolicy: the socket does not send"},
+		{"BlockHWMPolicyOnPull", zmtp.PullSocketType, []SocketOption{WithHWMPolicy(HWMBlock)}, "WithHWMPolicy: the socket does not send"},
+		{"SendTimeoutOnPull", zmtp.PullSocketType, []SocketOption{WithSendTimeout(time.Second)}, "WithSendTimeout: the socket does not send"},
+		{"SendBufferBytesOnPull", zmtp.PullSocketType, []SocketOption{WithSendBufferBytes(1024)}, "WithSendBufferBytes: the socket does not send"},
+		{"SendTTLOnPull", zmtp.PullSocketType, []SocketOption{WithSendTTL(time.Second)}, "WithSendTTL: the socket does not send"},
+		{"MinPeersOnPull", zmtp.PullSocketType, []SocketOption{WithMinPeers(1)}, "WithMinPeers: the socket does not send"},
+		{"StrictSendOnlyOnClient", zmtp.ClientSocketType, []SocketOption{WithStrictSendOnly()}, "WithStrictSendOnly: the socket receives"},
+		{"RecvBufferBytesOnPush", zmtp.PushSocketType, []SocketOption{WithRecvBufferBytes(1024)}, "WithRecvBufferBytes: the socket does not receive"},
+		{"InboundRateLimitOnPush", zmtp.PushSocketType, []SocketOption{WithInboundRateLimit(RateLimit{Messages: 10})}, "WithInboundRateLimit: the socket does not receive"},
+		{"PeerRateLimitOnPush", zmtp.PushSocketType, []SocketOption{WithPeerRateLimit(func(PeerInfo) RateLimit { return RateLimit{} })}, "WithPeerRateLimit: the socket does not receive"},
+		{"DedupOnPush", zmtp.PushSocketType, []SocketOption{WithDedup(func([]byte) (string, bool) { return "", false }, DedupWindow{})}, "WithDedup: the socket does not receive"},
+		{"UnorderedRecvOnPush", zmtp.PushSocketType, []SocketOption{WithUnorderedRecv()}, "WithUnorderedRecv: the socket does not receive"},
+		{"TimestampsOnPush", zmtp.PushSocketType, []SocketOption{WithTimestamps()}, "WithTimestamps: the socket does not receive"},
+		{"AckOnPush", zmtp.PushSocketType, []SocketOption{WithAck(time.Second, 1)}, "WithAck: the socket does not receive"},
+		{"AcceptBackpressureOnPush", zmtp.PushSocketType, []SocketOption{WithAcceptBackpressure(10, 5)}, "WithAcceptBackpressure: the socket does not receive"},
+		{"AckTimeoutNotPositive", zmtp.PullSocketType, []SocketOption{WithAck(0, 1)}, "WithAck: the ack timeout must be positive"},
+		{"RecvBufferBytesManualRead", zmtp.PullSocketType, []SocketOption{WithManualRead(noop), WithRecvBufferBytes(1024)}, "WithRecvBufferBytes: the socket's connections are read by WithManualRead"},
+		{"InboundRateLimitManualRead", zmtp.PullSocketType, []SocketOption{WithManualRead(noop), WithInboundRateLimit(RateLimit{Messages: 10})}, "WithInboundRateLimit: the socket's connections are read by WithManualRead"},
+		{"PeerRateLimitManualRead", zmtp.PullSocketType, []SocketOption{WithManualRead(noop), WithPeerRateLimit(func(PeerInfo) RateLimit { return RateLimit{} })}, "WithPeerRateLimit: the socket's connections are read by WithManualRead"},
+		{"DedupManualRead", zmtp.PullSocketType, []SocketOption{WithManualRead(noop), WithDedup(func([]byte) (string, bool) { return "", false }, DedupWindow{})}, "WithDedup: the socket's connections are read by WithManualRead"},
+		{"UnorderedRecvManualRead", zmtp.PullSocketType, []SocketOption{WithManualRead(noop), WithUnorderedRecv()}, "WithUnorderedRecv: the socket's connections are read by WithManualRead"},
+		{"MaxConnectionsOnClient", zmtp.ClientSocketType, []SocketOption{WithMaxConnections(10)}, "WithMaxConnections: the socket does not bind"},
+		{"ConnLimitPolicyOnClient", zmtp.ClientSocketType, []SocketOption{WithMaxConnections(10), WithConnLimitPolicy(ConnLimitReject)}, "WithConnLimitPolicy: the socket does not bind"},
+		{"AcceptBackpressureOnClient", zmtp.ClientSocketType, []SocketOption{WithAcceptBackpressure(10, 5)}, "WithAcceptBackpressure: the socket does not bind"},
+		{"ListenBacklogOnClient", zmtp.ClientSocketType, []SocketOption{WithListenBacklog(16)}, "WithListenBacklog: the socket does not bind"},
+		{"MaxHandshakesOnClient", zmtp.ClientSocketType, []SocketOption{WithMaxHandshakes(16)}, "WithMaxHandshakes: the socket does not bind"},
+		{"HandshakeConcurrencyOnClient", zmtp.ClientSocketType, []SocketOption{WithHandshakeConcurrency(4)}, "WithHandshakeConcurrency: the socket does not bind"},
+		{"IPFamilyOnClient", zmtp.ClientSocketType, []SocketOption{WithIPFamily(IPv4Only)}, "WithIPFamily: the socket does not bind"},
+		{"KeepFDsOnClient", zmtp.ClientSocketType, []SocketOption{WithKeepFDs()}, "WithKeepFDs: the socket does not bind"},
+		{"ParallelConnectionsOnServer", zmtp.ServerSocketType, []SocketOption{WithParallelConnections(2)}, "WithParallelConnections: the socket does not connect"},
+		{"ConnLimitPolicyWithoutLimit", zmtp.ServerSocketType, []SocketOption{WithConnLimitPolicy(ConnLimitReject)}, "WithConnLimitPolicy: there is no connection limit (see WithMaxConnections)"},
+		{"AcceptBackpressureLowAboveHigh", zmtp.ServerSocketType, []SocketOption{WithAcceptBackpressure(5, 10)}, "WithAcceptBackpressure: low 10 is above high 5"},
+		{"HeartbeatTimeoutWithoutInterval", zmtp.ServerSocketType, []SocketOption{WithHeartbeat(0, time.Second)}, "WithHeartbeat: a timeout needs an interval"},
+		{"HeartbeatTimeoutBelowInterval", zmtp.ServerSocketType, []SocketOption{WithHeartbeat(time.Second, time.Millisecond)}, "WithHeartbeat: timeout 1ms is shorter than interval 1s, so idle peers time out"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := New(test.sockType, zmtp.NewSecurityNull(), test.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			err = s.(baser).base().Validate()
+			var optsErr *OptionsError
+			if !errors.As(err, &optsErr) {
+				t.Fatalf("want an *OptionsError, got %v", err)
+			}
+			if !errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("want %v wrapped, got %v", ErrInvalidOptions, err)
+			}
+			if optsErr.SocketType != test.sockType {
+				t.Errorf("want socket type %s, got %s", test.sockType, optsErr.SocketType)
+			}
+			found := false
+			for _, problem := range optsErr.Problems {
+				found = found || problem == test.want
+			}
+			if !found {
+				t.Errorf("want the problem %q, got %q", test.want, optsErr.Problems)
+			}
+		})
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		for sockType := range socketKinds {
+			s, err := New(sockType, zmtp.NewSecurityNull(), WithHeartbeat(time.Second, 3*time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.(baser).base().Validate(); err != nil {
+				t.Errorf("%s: want no error, got %v", sockType, err)
+			}
+			s.Close()
+		}
+	})
+
+	t.Run("EveryProblem", func(t *testing.T) {
+		push := NewPush(zmtp.NewSecurityNull(), WithDedup(func([]byte) (string, bool) { return "", false }, DedupWindow{}), WithTimestamps())
+		defer push.Close()
+		var optsErr *OptionsError
+		if err := push.Validate(); !errors.As(err, &optsErr) || len(optsErr.Problems) != 2 {
+			t.Errorf("want both problems, got %v", err)
+		}
+	})
+
+	t.Run("ConnectAndBind", func(t *testing.T) {
+		pull := NewPull(zmtp.NewSecurityNull(), WithSendTTL(time.Second))
+		defer pull.Close()
+		if _, err := pull.Bind("mem://gomq-test-validate"); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("want Bind to fail with %v, got %v", ErrInvalidOptions, err)
+		}
+		if err := pull.ConnectAsync("mem://gomq-test-validate"); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("want ConnectAsync to fail with %v, got %v", ErrInvalidOptions, err)
+		}
+	})
+}
+
+func TestDefaults(t *testing.T) {
+	builtIn := CurrentDefaults()
+	if want := (Defaults{RetryInterval: 250 * time.Millisecond, Linger: -1, SendTimeout: -1, SendHWM: 1000, RecvHWM: 1000}); want != builtIn {
+		t.Errorf("want the zero Defaults to be %+v, got %+v", want, builtIn)
+	}
+
+	before := NewPull(zmtp.NewSecurityNull())
+	defer before.Close()
+
+	SetDefaults(Defaults{SendHWM: 10, RecvHWM: 20, Linger: time.Second, HeartbeatInterval: time.Second, HeartbeatTimeout: 3 * time.Second})
+	defer SetDefaults(Defaults{})
+
+	push := NewPush(zmtp.NewSecurityNull(), WithSendHWM(5))
+	defer push.Close()
+	opts := push.Options()
+	if want, got := 5, opts.SendHWM; want != got {
+		t.Errorf("want the option to win over the default, got a send HWM of %d", got)
+	}
+	if want, got := 20, opts.RecvHWM; want != got {
+		t.Errorf("want a receive HWM of %d, got %d", want, got)
+	}
+	if want, got := time.Second, opts.Linger; want != got {
+		t.Errorf("want a linger of %v, got %v", want, got)
+	}
+	if want, got := 3*time.Second, opts.HeartbeatTimeout; want != got {
+		t.Errorf("want a heartbeat timeout of %v, got %v", want, got)
+	}
+	if want, got := builtIn.RetryInterval, opts.RetryInterval; want != got {
+		t.Errorf("want the built-in retry interval %v, got %v", want, got)
+	}
+
+	// A socket that existed already keeps its settings, and
+	// one that does not send is not taken to have been given
+	// the default send HWM as an option.
+	if want, got := 1000, before.Options().SendHWM; want != got {
+		t.Errorf("want the earlier socket's send HWM to stay %d, got %d", want, got)
+	}
+	pull := NewPull(zmtp.NewSecurityNull())
+	defer pull.Close()
+	if err := pull.Validate(); err != nil {
+		t.Errorf("want no error for defaults, got %v", err)
+	}
+}
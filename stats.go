@@ -0,0 +1,140 @@
+package gomq
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// sizeBounds are the upper bounds, in bytes, of the
+	// buckets of the message size histograms.
+	sizeBounds = []int64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+	// latencyBounds are the upper bounds of the buckets of
+	// the inbound queue latency histogram.
+	latencyBounds = []int64{
+		int64(10 * time.Microsecond),
+		int64(100 * time.Microsecond),
+		int64(time.Millisecond),
+		int64(10 * time.Millisecond),
+		int64(100 * time.Millisecond),
+		int64(time.Second),
+	}
+)
+
+// Histogram is a snapshot of bucketed counts. Counts[i] is
+// the number of samples no larger than Bounds[i] and larger
+// than the bound before it; the last count, one more than
+// there are bounds, is for the samples larger than every
+// bound.
+type Histogram struct {
+	Bounds []int64
+	Counts []uint64
+}
+
+// Total returns the number of samples in the histogram.
+func (h Histogram) Total() uint64 {
+	var n uint64
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+// MessageStats is a snapshot of the message statistics a
+// socket created WithMessageStats keeps. SentSizes and
+// RecvSizes bucket messages by length in bytes. QueueLatency
+// buckets received messages by how long they waited between
+// being read off their connection and being received, in
+// nanoseconds: a consumer that falls behind shows up as a
+// shift to the higher buckets.
+type MessageStats struct {
+	SentSizes    Histogram
+	RecvSizes    Histogram
+	QueueLatency Histogram
+}
+
+// histogram counts samples in buckets, atomically.
+type histogram struct {
+	bounds []int64
+	counts []uint64
+}
+
+func newHistogram(bounds []int64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// observe counts v in its bucket.
+func (h *histogram) observe(v int64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+}
+
+func (h *histogram) snapshot() Histogram {
+	counts := make([]uint64, len(h.counts))
+	for i := range h.counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	return Histogram{Bounds: append([]int64(nil), h.bounds...), Counts: counts}
+}
+
+// messageStats holds the histograms of a socket created
+// WithMessageStats. Sockets without it have none, and take
+// no timestamps.
+type messageStats struct {
+	sent, recv, latency *histogram
+}
+
+func newMessageStats() *messageStats {
+	return &messageStats{
+		sent:    newHistogram(sizeBounds),
+		recv:    newHistogram(sizeBounds),
+		latency: newHistogram(latencyBounds),
+	}
+}
+
+// enqueued readies d for the receive queue, counting it and
+// noting when it was queued if the socket keeps statistics.
+func (s *Socket) enqueued(d delivery) delivery {
+	if s.stats != nil {
+		s.stats.recv.observe(int64(len(d.msg.Body)))
+		d.queued = s.clock.Now().UnixNano()
+	}
+	return d
+}
+
+// dequeuedRecv counts how long d waited in the receive
+// queue, if the socket keeps statistics.
+func (s *Socket) dequeuedRecv(d delivery) {
+	if s.stats != nil && d.queued != 0 {
+		s.stats.latency.observe(s.clock.Now().UnixNano() - d.queued)
+	}
+}
+
+// sent counts the messages of frames, just written, if the
+// socket keeps statistics.
+func (s *Socket) sent(frames [][]byte) {
+	if s.stats == nil {
+		return
+	}
+	for _, b := range frames {
+		s.stats.sent.observe(int64(len(b)))
+	}
+}
+
+// MessageStats returns the socket's message statistics. It
+// is the zero MessageStats unless the socket was created
+// WithMessageStats.
+func (s *Socket) MessageStats() MessageStats {
+	if s.stats == nil {
+		return MessageStats{}
+	}
+	return MessageStats{
+		SentSizes:    s.stats.sent.snapshot(),
+		RecvSizes:    s.stats.recv.snapshot(),
+		QueueLatency: s.stats.latency.snapshot(),
+	}
+}
@@ -0,0 +1,166 @@
+package gomq
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// attemptHistory is how many connection attempts are kept
+// for each connect-side endpoint.
+const attemptHistory = 16
+
+// AttemptStage tells how far a connection attempt got.
+type AttemptStage int
+
+const (
+	// AttemptDial is an attempt that failed to dial.
+	AttemptDial AttemptStage = iota
+
+	// AttemptHandshake is an attempt whose ZMTP handshake
+	// failed, other than on security.
+	AttemptHandshake
+
+	// AttemptAuth is an attempt whose handshake failed
+	// because the peer rejected this side's credentials or
+	// the two sides' security mechanisms did not match.
+	AttemptAuth
+
+	// AttemptConnected is an attempt that connected.
+	AttemptConnected
+)
+
+var attemptStageNames = map[AttemptStage]string{
+	AttemptDial:      "dial",
+	AttemptHandshake: "handshake",
+	AttemptAuth:      "auth",
+	AttemptConnected: "connected",
+}
+
+func (s AttemptStage) String() string {
+	return attemptStageNames[s]
+}
+
+// ConnectAttempt is one attempt at connecting to an endpoint.
+type ConnectAttempt struct {
+	Time     time.Time
+	Duration time.Duration
+	Stage    AttemptStage
+
+	// Err is why the attempt failed, nil if it connected.
+	Err error
+}
+
+// EndpointStatus describes a connect-side endpoint.
+type EndpointStatus struct {
+	Endpoint string
+
+	// Connected is set while the socket has a connection
+	// to the endpoint.
+	Connected bool
+
+	// Attempts holds the latest connection attempts, oldest
+	// first.
+	Attempts []ConnectAttempt
+
+	// LastErr is the error of the latest failed attempt.
+	LastErr error
+}
+
+// attemptRing keeps the latest attempts at an endpoint.
+type attemptRing struct {
+	attempts [attemptHistory]ConnectAttempt
+	n        int
+	lastErr  error
+}
+
+func (r *attemptRing) add(a ConnectAttempt) {
+	r.attempts[r.n%attemptHistory] = a
+	r.n++
+	if a.Err != nil {
+		r.lastErr = a.Err
+	}
+}
+
+// list returns the attempts oldest first.
+func (r *attemptRing) list() []ConnectAttempt {
+	start := 0
+	if r.n > attemptHistory {
+		start = r.n - attemptHistory
+	}
+	list := make([]ConnectAttempt, 0, r.n-start)
+	for i := start; i < r.n; i++ {
+		list = append(list, r.attempts[i%attemptHistory])
+	}
+	return list
+}
+
+// attempts is the attempt history of a socket's connect-side
+// endpoints. It outlives the dialers, so that the attempts
+// of one that gave up on a failed handshake can still be
+// looked up.
+type attempts struct {
+	mu    sync.Mutex
+	rings map[string]*attemptRing
+}
+
+// record adds an attempt at endpoint, begun at began.
+func (s *Socket) record(endpoint string, began time.Time, stage AttemptStage, err error) {
+	s.history.mu.Lock()
+	defer s.history.mu.Unlock()
+
+	if s.history.rings == nil {
+		s.history.rings = make(map[string]*attemptRing)
+	}
+	ring, ok := s.history.rings[endpoint]
+	if !ok {
+		ring = &attemptRing{}
+		s.history.rings[endpoint] = ring
+	}
+	ring.add(ConnectAttempt{
+		Time:     began,
+		Duration: s.clock.Now().Sub(began),
+		Stage:    stage,
+		Err:      err,
+	})
+}
+
+// handshakeStage tells whether a handshake error is about
+// security.
+func handshakeStage(err error) AttemptStage {
+	var authErr *zmtp.AuthError
+	var mismatchErr *zmtp.MechanismMismatchError
+	if errors.As(err, &authErr) || errors.As(err, &mismatchErr) {
+		return AttemptAuth
+	}
+	return AttemptHandshake
+}
+
+// EndpointStatus returns the recent connection attempts to an
+// endpoint the socket connects to, and whether it is
+// connected to it now. The status of an endpoint the socket
+// does not connect to has just the Endpoint set.
+func (s *Socket) EndpointStatus(endpoint string) EndpointStatus {
+	status := EndpointStatus{Endpoint: endpoint}
+	if ep, err := ParseEndpoint(endpoint); err == nil {
+		endpoint = ep.String()
+	}
+
+	s.lock.RLock()
+	for _, conn := range s.conns {
+		if conn.dialer != nil && conn.endpoint == endpoint {
+			status.Connected = true
+		}
+	}
+	s.lock.RUnlock()
+
+	s.history.mu.Lock()
+	if ring, ok := s.history.rings[endpoint]; ok {
+		status.Attempts = ring.list()
+		status.LastErr = ring.lastErr
+	}
+	s.history.mu.Unlock()
+	return status
+}
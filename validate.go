@@ -0,0 +1,211 @@
+package gomq
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zeromq/gomq/zmtp"
+)
+
+// OptionsError is returned by Validate, and by Connect and
+// Bind, for a socket whose options conflict with each other
+// or do not apply to its type.
+type OptionsError struct {
+	// SocketType is the type of the socket.
+	SocketType zmtp.SocketType
+
+	// Problems describes each option that is wrong, one per
+	// entry.
+	Problems []string
+}
+
+func (e *OptionsError) Error() string {
+	return fmt.Sprintf("gomq: invalid options for a %s socket: %s", e.SocketType, strings.Join(e.Problems, "; "))
+}
+
+// Unwrap returns ErrInvalidOptions.
+func (e *OptionsError) Unwrap() error {
+	return ErrInvalidOptions
+}
+
+// optionRule is a check of a socket's options: problem reports
+// what is wrong with them, if anything.
+type optionRule struct {
+	option  string
+	problem func(s *Socket, caps zmtp.SocketCapabilities, kind socketKind) string
+}
+
+// markSet records that the option named option was applied
+// to s, for Validate to tell the options that were set from
+// those left at their defaults.
+func (s *Socket) markSet(option string) {
+	if s.optionsSet == nil {
+		s.optionsSet = make(map[string]bool)
+	}
+	s.optionsSet[option] = true
+}
+
+// sendOnly, recvOnly, bindOnly and connectOnly are rules for
+// options that only apply to sockets that send, receive, bind
+// or connect, and were set all the same.
+func sendOnly(option string) optionRule {
+	return optionRule{option, func(s *Socket, caps zmtp.SocketCapabilities, _ socketKind) string {
+		if s.optionsSet[option] && !caps.CanSend {
+			return "the socket does not send"
+		}
+		return ""
+	}}
+}
+
+func recvOnly(option string) optionRule {
+	return optionRule{option, func(s *Socket, caps zmtp.SocketCapabilities, _ socketKind) string {
+		if s.optionsSet[option] && !caps.CanRecv {
+			return "the socket does not receive"
+		}
+		return ""
+	}}
+}
+
+func bindOnly(option string) optionRule {
+	return optionRule{option, func(s *Socket, _ zmtp.SocketCapabilities, kind socketKind) string {
+		if s.optionsSet[option] && !kind.binds {
+			return "the socket does not bind"
+		}
+		return ""
+	}}
+}
+
+func connectOnly(option string) optionRule {
+	return optionRule{option, func(s *Socket, _ zmtp.SocketCapabilities, kind socketKind) string {
+		if s.optionsSet[option] && !kind.connects {
+			return "the socket does not connect"
+		}
+		return ""
+	}}
+}
+
+// readOnly is a rule for options that only apply to sockets
+// that read their connections themselves.
+func readOnly(option string) optionRule {
+	return optionRule{option, func(s *Socket, _ zmtp.SocketCapabilities, _ socketKind) string {
+		if s.optionsSet[option] && s.optionsSet["WithManualRead"] {
+			return "the socket's connections are read by WithManualRead"
+		}
+		return ""
+	}}
+}
+
+// optionRules are the checks Validate makes, each naming the
+// option it is about. Most check that an option applies to
+// the socket's type, going by its zmtp.Capabilities and by
+// whether gomq lets it connect and bind.
+var optionRules = []optionRule{
+	{"WithSendHWM", func(s *Socket, _ zmtp.SocketCapabilities, _ socketKind) string {
+		if s.sendHWM <= 0 {
+			return "the high water mark must be positive"
+		}
+		return ""
+	}},
+	{"WithRecvHWM", func(s *Socket, _ zmtp.SocketCapabilities, _ socketKind) string {
+		if s.recvHWM <= 0 {
+			return "the high water mark must be positive"
+		}
+		return ""
+	}},
+	sendOnly("WithSendHWM"),
+	sendOnly("WithHWMPolicy"),
+	sendOnly("WithSendTimeout"),
+	sendOnly("WithSendBufferBytes"),
+	sendOnly("WithSendTTL"),
+	sendOnly("WithMinPeers"),
+	{"WithStrictSendOnly", func(s *Socket, caps zmtp.SocketCapabilities, _ socketKind) string {
+		if s.optionsSet["WithStrictSendOnly"] && caps.CanRecv {
+			return "the socket receives"
+		}
+		return ""
+	}},
+
+	recvOnly("WithRecvHWM"),
+	recvOnly("WithRecvBufferBytes"),
+	recvOnly("WithInboundRateLimit"),
+	recvOnly("WithPeerRateLimit"),
+	recvOnly("WithDedup"),
+	recvOnly("WithUnorderedRecv"),
+	recvOnly("WithTimestamps"),
+	recvOnly("WithAck"),
+	recvOnly("WithAcceptBackpressure"),
+	{"WithAck", func(s *Socket, _ zmtp.SocketCapabilities, _ socketKind) string {
+		if s.ackTimeout <= 0 {
+			return "the ack timeout must be positive"
+		}
+		return ""
+	}},
+
+	readOnly("WithRecvBufferBytes"),
+	readOnly("WithInboundRateLimit"),
+	readOnly("WithPeerRateLimit"),
+	readOnly("WithDedup"),
+	readOnly("WithUnorderedRecv"),
+
+	bindOnly("WithMaxConnections"),
+	bindOnly("WithConnLimitPolicy"),
+	bindOnly("WithAcceptBackpressure"),
+	bindOnly("WithListenBacklog"),
+	bindOnly("WithMaxHandshakes"),
+	bindOnly("WithHandshakeConcurrency"),
+	bindOnly("WithIPFamily"),
+	bindOnly("WithKeepFDs"),
+	connectOnly("WithParallelConnections"),
+
+	{"WithConnLimitPolicy", func(s *Socket, _ zmtp.SocketCapabilities, _ socketKind) string {
+		if s.optionsSet["WithConnLimitPolicy"] && s.maxConns == 0 {
+			return "there is no connection limit (see WithMaxConnections)"
+		}
+		return ""
+	}},
+	{"WithAcceptBackpressure", func(s *Socket, _ zmtp.SocketCapabilities, _ socketKind) string {
+		if s.acceptHigh > 0 && s.acceptLow > s.acceptHigh {
+			return fmt.Sprintf("low %d is above high %d", s.acceptLow, s.acceptHigh)
+		}
+		return ""
+	}},
+	{"WithHeartbeat", func(s *Socket, _ zmtp.SocketCapabilities, _ socketKind) string {
+		switch {
+		case s.heartbeatTimeout > 0 && s.heartbeatInterval <= 0:
+			return "a timeout needs an interval"
+		case s.heartbeatTimeout > 0 && s.heartbeatTimeout < s.heartbeatInterval:
+			return fmt.Sprintf("timeout %v is shorter than interval %v, so idle peers time out", s.heartbeatTimeout, s.heartbeatInterval)
+		}
+		return ""
+	}},
+}
+
+// Validate checks the socket's options, returning an
+// *OptionsError that lists every option that conflicts with
+// another or does not apply to the socket's type, such as
+// WithSendTTL on a PULL socket, which never sends, or
+// WithMaxConnections on a CLIENT socket, which never binds.
+// Connect and Bind fail with the same error, so a socket
+// that was configured wrong fails early rather than with
+// options silently ignored.
+func (s *Socket) Validate() error {
+	caps, known := zmtp.Capabilities(s.sockType)
+	kind, ok := socketKinds[s.sockType]
+	if !known || !ok {
+		// A socket made with NewSocket for a type gomq has no
+		// constructor for is taken to do everything.
+		caps = zmtp.SocketCapabilities{CanSend: true, CanRecv: true}
+		kind = socketKind{connects: true, binds: true}
+	}
+
+	var problems []string
+	for _, rule := range optionRules {
+		if problem := rule.problem(s, caps, kind); problem != "" {
+			problems = append(problems, rule.option+": "+problem)
+		}
+	}
+	if len(problems) > 0 {
+		return &OptionsError{SocketType: s.sockType, Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package gomq
+
+import "sync"
+
+// connValues holds the values an application attached to a
+// connection with SetConnValue.
+type connValues struct {
+	sync.Mutex
+	m map[interface{}]interface{}
+
+	// released is set once the connection has been removed
+	// from its socket, after which it takes no more values.
+	released bool
+}
+
+// SetConnValue attaches val to the connection with the given
+// id (see Peers) under key, replacing any value already
+// stored under key, for instance to keep per-client session
+// state along with the connection. Keys are compared like map
+// keys. The values are dropped when the connection is torn
+// down, after being passed to the socket's finalizer if it
+// has one (see WithConnFinalizer). It returns
+// ErrHostUnreachable if there is no such connection. It is
+// goroutine safe.
+func (s *Socket) SetConnValue(id ConnID, key, val interface{}) error {
+	s.lock.RLock()
+	conn, ok := s.conns[string(id)]
+	s.lock.RUnlock()
+	if !ok {
+		return ErrHostUnreachable
+	}
+
+	conn.values.Lock()
+	defer conn.values.Unlock()
+	if conn.values.released {
+		return ErrHostUnreachable
+	}
+	if conn.values.m == nil {
+		conn.values.m = make(map[interface{}]interface{})
+	}
+	conn.values.m[key] = val
+	return nil
+}
+
+// ConnValue returns the value attached under key to the
+// connection with the given id, or nil if there is none or no
+// such connection. It is goroutine safe.
+func (s *Socket) ConnValue(id ConnID, key interface{}) interface{} {
+	s.lock.RLock()
+	conn, ok := s.conns[string(id)]
+	s.lock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	conn.values.Lock()
+	defer conn.values.Unlock()
+	return conn.values.m[key]
+}
+
+// releaseValues drops the values attached to conn, which has
+// been removed from the socket, handing them to the socket's
+// finalizer first if there are any.
+func (s *Socket) releaseValues(conn *Connection) {
+	conn.values.Lock()
+	values := conn.values.m
+	conn.values.m = nil
+	conn.values.released = true
+	conn.values.Unlock()
+
+	if s.connFinalizer != nil && len(values) > 0 {
+		s.connFinalizer(conn.PeerInfo(), values)
+	}
+}
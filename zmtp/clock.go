@@ -0,0 +1,61 @@
+package zmtp
+
+import "time"
+
+// Clock tells the time and makes timers. Connections, and the
+// sockets built on them, use the time package's clock unless
+// given another, such as a fake one tests advance by hand.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	After(d time.Duration) <-chan time.Time
+}
+
+// Timer is a timer made by a Clock. It works like a
+// time.Timer, whose channel C returns.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// RealClock is the Clock of the time package.
+type RealClock struct{}
+
+// Now returns time.Now().
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer returns a time.Timer for d.
+func (RealClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+// After returns time.After(d).
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// SetClock sets the clock the connection stamps data frames
+// with (see SetTimestamps). It defaults to RealClock and must
+// be called before the connection is read from.
+func (c *Connection) SetClock(clock Clock) {
+	c.clock = clock
+}
+
+// now returns the time on the connection's clock.
+func (c *Connection) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
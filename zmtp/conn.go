@@ -1,21 +1,58 @@
 package zmtp
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Connection is a ZMTP level connection
 type Connection struct {
 	rw                         io.ReadWriter
+	r                          *bufio.Reader
 	securityMechanism          SecurityMechanism
 	socket                     Socket
 	isPrepared                 bool
 	asServer, otherEndAsServer bool
+	otherEndVersion            [2]uint8
+	otherEndSocketType         SocketType
+	negotiated                 *Negotiated
+	allowedMechanisms          []SecurityMechanismType
+	maxCommandSize             int64
+	recvSeq                    uint64
+	timestamps                 bool
+	clock                      Clock
+	strict, strictSet          bool
+	writeLock                  sync.Mutex
+	header                     [9]byte
+}
+
+// Negotiated holds the details agreed on with the other end
+// of a Connection during a successful ZMTP handshake.
+type Negotiated struct {
+	// Version is the ZMTP version announced by the other end.
+	Version [2]uint8
+
+	// Mechanism is the security mechanism used on the connection.
+	Mechanism SecurityMechanismType
+
+	// AsServer reports whether this end took the as-server role
+	// in the security handshake.
+	AsServer bool
+
+	// PeerSocketType is the Socket-Type announced by the other end.
+	PeerSocketType SocketType
+
+	// PeerMetadata holds the application metadata (the X- properties)
+	// sent by the other end, with the X- prefix stripped.
+	PeerMetadata map[string]string
 }
 
 // SocketType is a ZMTP socket type
@@ -37,10 +74,73 @@ const (
 
 // NewConnection accepts an io.ReadWriter and creates a new ZMTP connection
 func NewConnection(rw io.ReadWriter) *Connection {
-	return &Connection{rw: rw}
+	return &Connection{rw: rw, r: bufio.NewReader(rw)}
+}
+
+// AllowMechanisms restricts the security mechanisms the other end
+// may announce in its greeting. A greeting announcing any other
+// mechanism is answered with an ERROR command and fails Prepare.
+// It must be called before Prepare.
+func (c *Connection) AllowMechanisms(types ...SecurityMechanismType) {
+	c.allowedMechanisms = types
+}
+
+// DefaultMaxCommandSize is the longest command body a
+// Connection reads unless SetMaxCommandSize says otherwise.
+const DefaultMaxCommandSize = 1 << 20
+
+// SetMaxCommandSize limits the length of the body of the
+// commands the other end may send. Commands are read and
+// parsed before the application has a say in them, and some,
+// like SUBSCRIBE, carry data the other end picked, so they get
+// a limit of their own, well below what data frames may take.
+// A longer command fails the read with a *ProtocolError before
+// its body is read. Zero restores DefaultMaxCommandSize and a
+// negative size lifts the limit. It must be called before the
+// connection is read from.
+func (c *Connection) SetMaxCommandSize(size int64) {
+	c.maxCommandSize = size
+}
+
+// SetTimestamps makes ReadMessage stamp the data frames it
+// returns with the time they were read, in Message.ReceivedAt.
+// It is off by default, to save reading the clock for each
+// frame. It must be called before the connection is read from.
+func (c *Connection) SetTimestamps(on bool) {
+	c.timestamps = on
+}
+
+// SetStrictMechanism turns strict checking of the other side's
+// security mechanism on or off. Prepare fails the handshake
+// with a *MechanismMismatchError, which is
+// ErrMechanismMismatch, if the other side's greeting announces
+// a mechanism other than this side's, strict or not: it never
+// falls back to another mechanism. A strict connection also
+// fails it if the other side announces this side's mechanism
+// but then claims the same client or server role, where the
+// mechanism has the two, or sends a command that only other
+// mechanisms' handshakes use. This is what a man in the middle
+// rewriting the greeting to strip the mechanism down looks
+// like. Strict checking is on by default for mechanisms other
+// than NULL. It must be set before Prepare.
+func (c *Connection) SetStrictMechanism(on bool) {
+	c.strict, c.strictSet = on, true
 }
 
-// Prepare performs a ZMTP handshake over a Connection's readWriter
+// isStrict reports whether the connection checks the other
+// side's mechanism strictly.
+func (c *Connection) isStrict() bool {
+	if c.strictSet {
+		return c.strict
+	}
+	return c.securityMechanism.Type() != NullSecurityMechanismType
+}
+
+// Prepare performs a ZMTP handshake over a Connection's readWriter.
+// Failures caused by the other side can be told apart with
+// errors.As: an *AuthError if it rejected the handshake, a
+// *MechanismMismatchError if the security mechanisms do not match
+// and a *ProtocolError if it did not speak ZMTP properly.
 func (c *Connection) Prepare(mechanism SecurityMechanism, socketType SocketType, asServer bool, applicationMetadata map[string]string) (map[string]string, error) {
 	if c.isPrepared {
 		return nil, errors.New("Connection was already prepared")
@@ -48,90 +148,170 @@ func (c *Connection) Prepare(mechanism SecurityMechanism, socketType SocketType,
 
 	c.isPrepared = true
 	c.securityMechanism = mechanism
+	c.asServer = asServer
 
 	var err error
 	if c.socket, err = NewSocket(socketType); err != nil {
-		return nil, fmt.Errorf("gomq/zmtp: Got error while creating socket: %v", err)
+		return nil, fmt.Errorf("gomq/zmtp: Got error while creating socket: %w", err)
 	}
 
-	// Send/recv greeting
-	if err := c.sendGreeting(asServer); err != nil {
-		return nil, fmt.Errorf("gomq/zmtp: Got error while sending greeting: %v", err)
-	}
-	if err := c.recvGreeting(asServer); err != nil {
-		return nil, fmt.Errorf("gomq/zmtp: Got error while receiving greeting: %v", err)
+	// Exchange greetings
+	if err := c.exchangeGreeting(asServer); err != nil {
+		return nil, fmt.Errorf("gomq/zmtp: Got error while exchanging greeting: %w", err)
 	}
 
 	// Do security handshake
 	if err := mechanism.Handshake(); err != nil {
-		return nil, fmt.Errorf("gomq/zmtp: Got error while running the security handshake: %v", err)
+		return nil, fmt.Errorf("gomq/zmtp: Got error while running the security handshake: %w", err)
 	}
 
 	// Send/recv metadata
 	if err := c.sendMetadata(socketType, applicationMetadata); err != nil {
-		return nil, fmt.Errorf("gomq/zmtp: Got error while sending metadata: %v", err)
+		return nil, fmt.Errorf("gomq/zmtp: Got error while sending metadata: %w", err)
 	}
 
 	otherEndApplicationMetaData, err := c.recvMetadata()
 	if err != nil {
-		return nil, fmt.Errorf("gomq/zmtp: Got error while receiving metadata: %v", err)
+		return nil, fmt.Errorf("gomq/zmtp: Got error while receiving metadata: %w", err)
+	}
+
+	c.negotiated = &Negotiated{
+		Version:        c.otherEndVersion,
+		Mechanism:      mechanism.Type(),
+		AsServer:       asServer,
+		PeerSocketType: c.otherEndSocketType,
+		PeerMetadata:   otherEndApplicationMetaData,
 	}
 
 	return otherEndApplicationMetaData, nil
 }
 
-func (c *Connection) sendGreeting(asServer bool) error {
-	greeting := greeting{
-		SignaturePrefix: signaturePrefix,
-		SignatureSuffix: signatureSuffix,
-		Version:         version,
-	}
-	toNullPaddedString(string(c.securityMechanism.Type()), greeting.Mechanism[:])
+// Buffered returns the number of bytes read from the underlying
+// ReadWriter that are waiting to be consumed.
+func (c *Connection) Buffered() int {
+	return c.r.Buffered()
+}
 
-	if err := binary.Write(c.rw, byteOrder, &greeting); err != nil {
-		return err
+// Negotiated returns the details agreed on during the handshake.
+// The boolean is false if Prepare has not completed successfully.
+func (c *Connection) Negotiated() (Negotiated, bool) {
+	if c.negotiated == nil {
+		return Negotiated{}, false
 	}
-
-	return nil
+	return *c.negotiated, true
 }
 
-func (c *Connection) recvGreeting(asServer bool) error {
-	var greeting greeting
-
-	if err := binary.Read(c.rw, byteOrder, &greeting); err != nil {
-		return fmt.Errorf("Error while reading: %v", err)
+// exchangeGreeting sends this side's greeting and reads the
+// other side's in the stages the spec describes: the signature
+// first, then the major version once the other side's signature
+// has arrived, then the rest. Peers such as libzmq 4.0 and 4.1
+// hold back each part until they have seen the previous one.
+func (c *Connection) exchangeGreeting(asServer bool) error {
+	sent, err := EncodeGreeting(GreetingFields{
+		Version:   version,
+		Mechanism: c.securityMechanism.Type(),
+		AsServer:  asServer,
+	})
+	if err != nil {
+		return err
 	}
+	in := make([]byte, len(sent))
 
-	if greeting.SignaturePrefix != signaturePrefix {
-		return fmt.Errorf("Signature prefix received does not correspond with expected signature. Received: %#v. Expected: %#v.", greeting.SignaturePrefix, signaturePrefix)
+	start := 0
+	for _, end := range []int{signatureSize, signatureSize + 1, len(sent)} {
+		if _, err := c.rw.Write(sent[start:end]); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c.r, in[start:end]); err != nil {
+			return fmt.Errorf("Error while reading: %v", err)
+		}
+		if err := checkGreeting(in[:end]); err != nil {
+			return err
+		}
+		start = end
 	}
 
-	if greeting.SignatureSuffix != signatureSuffix {
-		return fmt.Errorf("Signature prefix received does not correspond with expected signature. Received: %#v. Expected: %#v.", greeting.SignatureSuffix, signatureSuffix)
+	theirs, err := ParseGreeting(in)
+	if err != nil {
+		return err
 	}
 
-	if greeting.Version != version {
-		return fmt.Errorf("Version %v.%v received does match expected version %v.%v", int(greeting.Version[0]), int(greeting.Version[1]), int(majorVersion), int(minorVersion))
+	var otherMechanism = string(theirs.Mechanism)
+	if !c.isMechanismAllowed(SecurityMechanismType(otherMechanism)) {
+		c.sendError("security mechanism not allowed")
+		return &MechanismMismatchError{
+			Ours:    string(c.securityMechanism.Type()),
+			Theirs:  otherMechanism,
+			Allowed: c.allowedMechanisms,
+		}
 	}
 
-	var otherMechanism = fromNullPaddedString(greeting.Mechanism[:])
 	var thisMechanism = string(c.securityMechanism.Type())
 	if thisMechanism != otherMechanism {
-		return fmt.Errorf("Encryption mechanism on other side %q does not match this side's %q", otherMechanism, thisMechanism)
+		c.sendError("security mechanism mismatch")
+		return &MechanismMismatchError{Ours: thisMechanism, Theirs: otherMechanism}
 	}
 
-	otherEndAsServer, err := fromByteBool(greeting.ServerFlag)
-	if err != nil {
-		return err
+	c.otherEndAsServer = theirs.AsServer
+	c.otherEndVersion = theirs.Version
+
+	// NULL has no roles; the other mechanisms have a client
+	// and a server.
+	if c.isStrict() && thisMechanism != string(NullSecurityMechanismType) && theirs.AsServer == asServer {
+		c.sendError("security mechanism roles conflict")
+		return &MechanismMismatchError{Ours: thisMechanism, Theirs: otherMechanism, Detail: "claimed this side's role in it"}
+	}
+
+	return nil
+}
+
+// checkGreeting validates as much of the other side's greeting
+// as has been read so far. The padding between the signature
+// bytes is ignored, since older peers fill it with a ZMTP 1.0
+// length rather than zeros. Any version from 3.0 up is accepted;
+// a newer peer falls back to this side's version.
+func checkGreeting(b []byte) error {
+	if len(b) >= signatureSize {
+		if b[0] != signaturePrefix {
+			return protocolErrorf("Signature prefix received does not correspond with expected signature. Received: %#v. Expected: %#v.", b[0], signaturePrefix)
+		}
+		if b[signatureSize-1] != signatureSuffix {
+			return protocolErrorf("Signature suffix received does not correspond with expected signature. Received: %#v. Expected: %#v.", b[signatureSize-1], signatureSuffix)
+		}
+	}
+
+	if len(b) > signatureSize && b[signatureSize] < majorVersion {
+		return protocolErrorf("Version %v received is older than expected version %v.%v", int(b[signatureSize]), int(majorVersion), int(minorVersion))
 	}
-	c.otherEndAsServer = otherEndAsServer
 
 	return nil
 }
 
+func (c *Connection) isMechanismAllowed(mechanism SecurityMechanismType) bool {
+	if c.allowedMechanisms == nil {
+		return true
+	}
+
+	for _, allowed := range c.allowedMechanisms {
+		if allowed == mechanism {
+			return true
+		}
+	}
+	return false
+}
+
+// sendError tells the other end why the handshake failed. The
+// connection is about to be closed, so write errors are ignored.
+func (c *Connection) sendError(reason string) {
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	c.SendCommand("ERROR", append([]byte{byte(len(reason))}, reason...))
+}
+
 func (c *Connection) sendMetadata(socketType SocketType, applicationMetadata map[string]string) error {
 	buffer := new(bytes.Buffer)
-	var usedKeys map[string]struct{}
+	usedKeys := make(map[string]struct{})
 
 	for k, v := range applicationMetadata {
 		if len(k) == 0 {
@@ -166,16 +346,29 @@ func (c *Connection) recvMetadata() (map[string]string, error) {
 	}
 
 	if !isCommand {
-		return nil, errors.New("Got a message frame for metadata, expected a command frame")
+		return nil, &ProtocolError{Detail: "Got a message frame for metadata, expected a command frame"}
 	}
 
-	command, err := c.parseCommand(body)
+	command, err := ParseCommand(body)
 	if err != nil {
 		return nil, err
 	}
 
+	if command.Name == "ERROR" {
+		return nil, &AuthError{Reason: parseErrorReason(command.Body)}
+	}
+
+	if ours := c.securityMechanism.Type(); c.isStrict() && isForeignCommand(ours, command.Name) {
+		c.sendError("security mechanism mismatch")
+		return nil, &MechanismMismatchError{
+			Ours:   string(ours),
+			Theirs: string(ours),
+			Detail: fmt.Sprintf("sent %v, which only other mechanisms' handshakes use", command.Name),
+		}
+	}
+
 	if command.Name != "READY" {
-		return nil, fmt.Errorf("Got a %v command for metadata instead of the expected READY command frame", command.Name)
+		return nil, protocolErrorf("Got a %v command for metadata instead of the expected READY command frame", command.Name)
 	}
 
 	metadata := make(map[string]string)
@@ -185,7 +378,7 @@ func (c *Connection) recvMetadata() (map[string]string, error) {
 		// Key length
 		keyLength := int(command.Body[i])
 		if i+keyLength >= len(command.Body) {
-			return nil, fmt.Errorf("metadata key of length %v overflows body of length %v at position %v", keyLength, len(command.Body), i)
+			return nil, protocolErrorf("metadata key of length %v overflows body of length %v at position %v", keyLength, len(command.Body), i)
 		}
 		i++
 
@@ -194,20 +387,19 @@ func (c *Connection) recvMetadata() (map[string]string, error) {
 		i += keyLength
 
 		// Value length
+		if i+4 > len(command.Body) {
+			return nil, protocolErrorf("metadata value length for key %q overflows body of length %v at position %v", key, len(command.Body), i)
+		}
 		var rawValueLength uint32
 		if err := binary.Read(bytes.NewBuffer(command.Body[i:i+4]), byteOrder, &rawValueLength); err != nil {
 			return nil, err
 		}
+		i += 4
 
-		if uint64(rawValueLength) > uint64(maxInt) {
-			return nil, fmt.Errorf("Length of value %v overflows integer max length %v on this platform", rawValueLength, maxInt)
+		if uint64(rawValueLength) > uint64(len(command.Body)-i) {
+			return nil, protocolErrorf("metadata value of length %v overflows body of length %v at position %v", rawValueLength, len(command.Body), i)
 		}
-
 		valueLength := int(rawValueLength)
-		if i+valueLength >= len(command.Body) {
-			return nil, fmt.Errorf("metadata value of length %v overflows body of length %v at position %v", valueLength, len(command.Body), i)
-		}
-		i += 4
 
 		// Value
 		value := string(command.Body[i : i+valueLength])
@@ -222,25 +414,87 @@ func (c *Connection) recvMetadata() (map[string]string, error) {
 
 	socketType := metadata["socket-type"]
 	if !c.socket.IsSocketTypeCompatible(SocketType(socketType)) {
-		return nil, fmt.Errorf("Socket type %v is not compatible with %v", c.socket.Type(), socketType)
+		return nil, protocolErrorf("Socket type %v is not compatible with %v", c.socket.Type(), socketType)
 	}
+	c.otherEndSocketType = SocketType(socketType)
 
 	return applicationMetadata, nil
 }
 
+// handshakeCommands are the commands each security mechanism's
+// handshake is made of.
+var handshakeCommands = map[SecurityMechanismType][]string{
+	NullSecurityMechanismType:  {"READY", "ERROR"},
+	PlainSecurityMechanismType: {"HELLO", "WELCOME", "INITIATE", "READY", "ERROR"},
+	CurveSecurityMechanismType: {"HELLO", "WELCOME", "INITIATE", "READY", "ERROR"},
+}
+
+// isForeignCommand reports whether the command name is part of
+// another security mechanism's handshake but not of ours's.
+func isForeignCommand(ours SecurityMechanismType, name string) bool {
+	uses := func(mechanism SecurityMechanismType) bool {
+		for _, command := range handshakeCommands[mechanism] {
+			if command == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	if uses(ours) {
+		return false
+	}
+	for mechanism := range handshakeCommands {
+		if mechanism != ours && uses(mechanism) {
+			return true
+		}
+	}
+	return false
+}
+
 // SendCommand sends a ZMTP command over a Connection
 func (c *Connection) SendCommand(commandName string, body []byte) error {
-	if len(commandName) > 255 {
-		return errors.New("Command names may not be longer than 255 characters")
+	command, err := EncodeCommand(commandName, body)
+	if err != nil {
+		return err
 	}
+	return c.send(true, command)
+}
 
-	// Make the buffer of the correct length and reset it
-	buffer := new(bytes.Buffer)
-	buffer.WriteByte(byte(len(commandName)))
-	buffer.Write([]byte(commandName))
-	buffer.Write(body)
+// maxPingContext is the longest context a PING may carry.
+const maxPingContext = 16
+
+// SendPing sends a heartbeat PING command. The other end should
+// close the connection if it sees no traffic for ttl, which is
+// sent in tenths of a second; a zero ttl sets no limit. The other
+// end echoes context, which may be up to 16 bytes, in its PONG.
+func (c *Connection) SendPing(ttl time.Duration, context []byte) error {
+	if len(context) > maxPingContext {
+		return fmt.Errorf("PING context of length %v is longer than %v bytes", len(context), maxPingContext)
+	}
+
+	deciseconds := ttl / (100 * time.Millisecond)
+	if deciseconds > 0xFFFF {
+		deciseconds = 0xFFFF
+	}
+
+	body := make([]byte, 2, 2+len(context))
+	byteOrder.PutUint16(body, uint16(deciseconds))
+	return c.SendCommand("PING", append(body, context...))
+}
+
+// pingContext returns the context carried by the body of a PING
+// command, which follows its two byte TTL.
+func pingContext(body []byte) []byte {
+	if len(body) <= 2 {
+		return nil
+	}
 
-	return c.send(true, buffer.Bytes())
+	context := body[2:]
+	if len(context) > maxPingContext {
+		context = context[:maxPingContext]
+	}
+	return context
 }
 
 // SendFrame sends a ZMTP frame over a Connection
@@ -249,40 +503,35 @@ func (c *Connection) SendFrame(body []byte) error {
 }
 
 func (c *Connection) send(isCommand bool, body []byte) error {
-	// Compute total body length
-	length := len(body)
-
-	var bitFlags byte
-
-	// More flag: Unused, we don't support multiframe messages
-
-	// Long flag
-	isLong := length > 255
-	if isLong {
-		bitFlags ^= isLongBitFlag
-	}
-
-	// Command flag
+	// Frames are written in several parts and commands such as
+	// PONG are sent from the Recv goroutine, so keep writers
+	// from interleaving.
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	// Write out the header and the message itself in one go
+	var flags FrameFlags
 	if isCommand {
-		bitFlags ^= isCommandBitFlag
+		flags = FlagCommand
 	}
+	return writeFrame(c.rw, c.header[:0], flags, c.securityMechanism.Encrypt(body))
+}
 
-	// Write out the message itself
-	if _, err := c.rw.Write([]byte{bitFlags}); err != nil {
-		return err
-	}
+// SendFrames sends each of bodies as a ZMTP frame of its own,
+// in a single write where the ReadWriter supports it.
+func (c *Connection) SendFrames(bodies ...[]byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
 
-	if isLong {
-		if err := binary.Write(c.rw, byteOrder, int64(len(body))); err != nil {
-			return err
-		}
-	} else {
-		if err := binary.Write(c.rw, byteOrder, uint8(len(body))); err != nil {
-			return err
-		}
+	headers := make([]byte, 0, 9*len(bodies))
+	buffers := make(net.Buffers, 0, 2*len(bodies))
+	for _, body := range bodies {
+		start := len(headers)
+		headers = appendHeader(headers, 0, len(body))
+		buffers = append(buffers, headers[start:], c.securityMechanism.Encrypt(body))
 	}
 
-	if _, err := c.rw.Write(c.securityMechanism.Encrypt(body)); err != nil {
+	if _, err := buffers.WriteTo(c.rw); err != nil {
 		return err
 	}
 
@@ -293,129 +542,108 @@ func (c *Connection) send(isCommand bool, body []byte) error {
 func (c *Connection) Recv(messageOut chan<- *Message) {
 	go func() {
 		for {
-			// Actually read out the body and send it over the channel now
-			isCommand, body, err := c.read()
+			msg, err := c.ReadMessage()
 			if err != nil {
 				messageOut <- &Message{Err: err, MessageType: ErrorMessage}
 				return
 			}
-
-			if !isCommand {
-				// Data frame
-				messageOut <- &Message{Body: body, MessageType: UserMessage}
-			} else {
-				command, err := c.parseCommand(body)
-				if err != nil {
-					messageOut <- &Message{Err: err, MessageType: ErrorMessage}
-					return
-				}
-
-				// Check what type of command we got
-				// Certain commands we deal with directly, the rest we send over to the application
-				switch command.Name {
-				case "PING":
-					// When we get a ping, we want to send back a pong, we don't really care about the contents right now
-					if err := c.SendCommand("PONG", nil); err != nil {
-						messageOut <- &Message{Err: err, MessageType: ErrorMessage}
-						return
-					}
-				default:
-					messageOut <- &Message{Name: command.Name, Body: command.Body, MessageType: ErrorMessage}
-				}
-
-			}
+			messageOut <- msg
 		}
 	}()
 }
 
-// read returns the isCommand flag, the body of the message, and optionally an error
-func (c *Connection) read() (bool, []byte, error) {
-	var header [2]byte
-	var longLength [8]byte
-
-	// Read out the header
-	readLength := uint64(0)
-	for readLength != 2 {
-		l, err := c.rw.Read(header[readLength:])
-		if err != nil {
-			return false, nil, err
-		}
-
-		readLength += uint64(l)
+// ReadMessage reads the next frame from the ReadWriter. It is the
+// synchronous counterpart of Recv and must not be used together
+// with it. Data frames are returned as a UserMessage, numbered in
+// the order they were read. PING commands
+// are answered with a PONG before being returned; PING and PONG
+// are returned as a CommandMessage and other commands as an
+// ErrorMessage carrying the command's name and body.
+func (c *Connection) ReadMessage() (*Message, error) {
+	isCommand, body, err := c.read()
+	if err != nil {
+		return nil, err
 	}
 
-	bitFlags := header[0]
-
-	// Read all the flags
-	hasMore := bitFlags&hasMoreBitFlag == hasMoreBitFlag
-	isLong := bitFlags&isLongBitFlag == isLongBitFlag
-	isCommand := bitFlags&isCommandBitFlag == isCommandBitFlag
-
-	// Error out in case get a more flag set to true
-	if hasMore {
-		return false, nil, errors.New("Received a packet with the MORE flag set to true, we don't support more")
+	if !isCommand {
+		// Data frame
+		c.recvSeq++
+		msg := &Message{Body: body, MessageType: UserMessage, Seq: c.recvSeq}
+		if c.timestamps {
+			msg.ReceivedAt = c.now()
+		}
+		return msg, nil
 	}
 
-	// Determine the actual length of the body
-	bodyLength := uint64(0)
-	if isLong {
-		// We read 2 bytes of the header already
-		// In case of a long message, the length is bytes 2-8 of the header
-		// We already have the first byte, so assign it, and then read the rest
-		longLength[0] = header[1]
-
-		readLength := 1
-		for readLength != 8 {
-			l, err := c.rw.Read(longLength[readLength:])
-			if err != nil {
-				return false, nil, err
-			}
-
-			readLength += l
-		}
+	command, err := ParseCommand(body)
+	if err != nil {
+		return nil, err
+	}
 
-		if err := binary.Read(bytes.NewBuffer(longLength[:]), byteOrder, &bodyLength); err != nil {
-			return false, nil, err
+	// Check what type of command we got
+	// Certain commands we deal with directly, the rest we send over to the application
+	switch command.Name {
+	case "PING":
+		// Answer with a PONG echoing the ping's context, then
+		// let the application know there was traffic.
+		if err := c.SendCommand("PONG", pingContext(command.Body)); err != nil {
+			return nil, err
 		}
-	} else {
-		// Short message length is just 1 byte, read it
-		bodyLength = uint64(header[1])
+		return &Message{Name: command.Name, Body: command.Body, MessageType: CommandMessage}, nil
+	case "PONG":
+		return &Message{Name: command.Name, Body: command.Body, MessageType: CommandMessage}, nil
+	default:
+		return &Message{Name: command.Name, Body: command.Body, MessageType: ErrorMessage}, nil
 	}
+}
 
-	if bodyLength > uint64(maxInt64) {
-		return false, nil, fmt.Errorf("Body length %v overflows max int64 value %v", bodyLength, maxInt64)
+// maxPreallocatedBody is the largest frame body read into a buffer
+// allocated up front.
+const maxPreallocatedBody = 1 << 20
+
+// read returns the isCommand flag, the body of the message, and optionally an error
+func (c *Connection) read() (bool, []byte, error) {
+	flags, bodyLength, err := readHeader(c.r)
+	if err != nil {
+		return false, nil, err
 	}
+	isCommand := flags&FlagCommand != 0
 
-	buffer := new(bytes.Buffer)
-	readLength = 0
-	for readLength < bodyLength {
-		l, err := buffer.ReadFrom(io.LimitReader(c.rw, int64(bodyLength)-int64(readLength)))
-		if err != nil {
-			return false, nil, err
-		}
+	// Error out in case get a more flag set to true
+	if flags&FlagMore != 0 {
+		return false, nil, &ProtocolError{Detail: "Received a packet with the MORE flag set to true, we don't support more"}
+	}
 
-		readLength += uint64(l)
+	if limit := c.commandLimit(); isCommand && limit >= 0 && bodyLength > uint64(limit) {
+		return false, nil, protocolErrorf("Command body length %v exceeds the limit of %v", bodyLength, limit)
 	}
 
-	return isCommand, buffer.Bytes(), nil
+	body, err := readBody(c.r, bodyLength)
+	if err != nil {
+		return false, nil, err
+	}
+	return isCommand, body, nil
 }
 
-func (c *Connection) parseCommand(body []byte) (*Command, error) {
-	// Sanity check
-	if len(body) == 0 {
-		return nil, errors.New("Got empty command frame body")
+// commandLimit returns the longest command body the
+// connection reads, or a negative number if there is no limit.
+func (c *Connection) commandLimit() int64 {
+	if c.maxCommandSize == 0 {
+		return DefaultMaxCommandSize
 	}
+	return c.maxCommandSize
+}
 
-	// Read out the command length
-	commandNameLength := int(body[0])
-	if commandNameLength > len(body)-1 {
-		return nil, fmt.Errorf("Got command name length %v, which is too long for a body of length %v", commandNameLength, len(body))
+// parseErrorReason returns the reason carried by the body of an
+// ERROR command.
+func parseErrorReason(body []byte) string {
+	if len(body) == 0 {
+		return ""
 	}
 
-	command := &Command{
-		Name: string(body[1 : commandNameLength+1]),
-		Body: body[1+commandNameLength:],
+	length := int(body[0])
+	if length > len(body)-1 {
+		length = len(body) - 1
 	}
-
-	return command, nil
+	return string(body[1 : 1+length])
 }
@@ -0,0 +1,624 @@
+package zmtp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newConnectedPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, <-accepted
+}
+
+func TestNegotiated(t *testing.T) {
+	clientConn, serverConn := newConnectedPair(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	client := NewConnection(clientConn)
+	server := NewConnection(serverConn)
+
+	if _, ok := client.Negotiated(); ok {
+		t.Errorf("want no negotiated details before Prepare")
+	}
+
+	errs := make(chan error)
+	go func() {
+		_, err := server.Prepare(NewSecurityNull(), ServerSocketType, true, map[string]string{"Name": "server"})
+		errs <- err
+	}()
+
+	if _, err := client.Prepare(NewSecurityNull(), ClientSocketType, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	n, ok := client.Negotiated()
+	if !ok {
+		t.Fatalf("want negotiated details after Prepare")
+	}
+
+	if want, got := version, n.Version; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	if want, got := NullSecurityMechanismType, n.Mechanism; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	if want, got := false, n.AsServer; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	if want, got := ServerSocketType, n.PeerSocketType; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	if want, got := "server", n.PeerMetadata["name"]; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	n, ok = server.Negotiated()
+	if !ok {
+		t.Fatalf("want negotiated details after Prepare")
+	}
+
+	if want, got := true, n.AsServer; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	if want, got := ClientSocketType, n.PeerSocketType; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestAllowMechanisms(t *testing.T) {
+	clientConn, serverConn := newConnectedPair(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	client := NewConnection(clientConn)
+	server := NewConnection(serverConn)
+	server.AllowMechanisms(CurveSecurityMechanismType)
+
+	errs := make(chan error)
+	go func() {
+		_, err := server.Prepare(NewSecurityNull(), ServerSocketType, true, nil)
+		serverConn.Close()
+		errs <- err
+	}()
+
+	_, err := client.Prepare(NewSecurityNull(), ClientSocketType, false, nil)
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("want an *AuthError, got %v", err)
+	}
+	if want, got := "security mechanism not allowed", authErr.Reason; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	err = <-errs
+	var mismatch *MechanismMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("want a *MechanismMismatchError, got %v", err)
+	}
+	if want, got := "NULL", mismatch.Theirs; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if want, got := []SecurityMechanismType{CurveSecurityMechanismType}, mismatch.Allowed; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+// plainMechanism announces PLAIN in its greeting without
+// implementing it.
+type plainMechanism struct {
+	SecurityNull
+}
+
+func (plainMechanism) Type() SecurityMechanismType {
+	return PlainSecurityMechanismType
+}
+
+func TestPrepareMechanismMismatch(t *testing.T) {
+	clientConn, serverConn := newConnectedPair(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go NewConnection(serverConn).Prepare(&plainMechanism{}, ServerSocketType, true, nil)
+
+	_, err := NewConnection(clientConn).Prepare(NewSecurityNull(), ClientSocketType, false, nil)
+	var mismatch *MechanismMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("want a *MechanismMismatchError, got %v", err)
+	}
+
+	if want, got := "NULL", mismatch.Ours; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if want, got := "PLAIN", mismatch.Theirs; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestPrepareProtocolError(t *testing.T) {
+	clientConn, serverConn := newConnectedPair(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go serverConn.Write(make([]byte, 64))
+
+	_, err := NewConnection(clientConn).Prepare(NewSecurityNull(), ClientSocketType, false, nil)
+	var protoErr *ProtocolError
+	if !errors.As(err, &protoErr) {
+		t.Fatalf("want a *ProtocolError, got %v", err)
+	}
+}
+
+// libzmq41Push is what a libzmq 4.1 PUSH socket sends during a
+// NULL handshake, split into the stages it sends them in. The
+// signature padding holds a ZMTP 1.0 length, and the version is
+// 3.1.
+var libzmq41Push = [][]byte{
+	{0xff, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x7f},
+	{0x03},
+	append(append([]byte{0x01, 'N', 'U', 'L', 'L'}, make([]byte, 16+1+31)...),
+		0x04, 0x1a, 0x05, 'R', 'E', 'A', 'D', 'Y',
+		0x0b, 'S', 'o', 'c', 'k', 'e', 't', '-', 'T', 'y', 'p', 'e', 0, 0, 0, 0x04, 'P', 'U', 'S', 'H'),
+}
+
+// replayStagedGreeting plays the libzmq side of a handshake on
+// conn, holding back each stage until the other side's matching
+// stage has arrived. It fails if the other side sends more than
+// its signature before seeing ours.
+func replayStagedGreeting(t *testing.T, conn net.Conn, stages [][]byte) {
+	for i, want := range []int{10, 1, 53} {
+		if _, err := io.ReadFull(conn, make([]byte, want)); err != nil {
+			t.Error(err)
+			return
+		}
+		if i == 0 {
+			conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			if n, _ := conn.Read(make([]byte, 1)); n != 0 {
+				t.Error("want only the signature before the other side's signature")
+			}
+			conn.SetReadDeadline(time.Time{})
+		}
+		if _, err := conn.Write(stages[i]); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestPrepareStagedGreeting(t *testing.T) {
+	clientConn, serverConn := newConnectedPair(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		replayStagedGreeting(t, serverConn, libzmq41Push)
+	}()
+
+	conn := NewConnection(clientConn)
+	if _, err := conn.Prepare(NewSecurityNull(), PullSocketType, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	negotiated, _ := conn.Negotiated()
+	if want, got := [2]uint8{3, 1}, negotiated.Version; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if want, got := PushSocketType, negotiated.PeerSocketType; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestPrepareOldVersion(t *testing.T) {
+	clientConn, serverConn := newConnectedPair(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go serverConn.Write([]byte{0xff, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x7f, 0x02, 0x00})
+
+	_, err := NewConnection(clientConn).Prepare(NewSecurityNull(), ClientSocketType, false, nil)
+	var protoErr *ProtocolError
+	if !errors.As(err, &protoErr) {
+		t.Fatalf("want a *ProtocolError, got %v", err)
+	}
+}
+
+func TestErrorCommand(t *testing.T) {
+	clientConn, serverConn := newConnectedPair(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	server := NewConnection(serverConn)
+	server.securityMechanism = NewSecurityNull()
+	server.sendError("go away")
+
+	client := NewConnection(clientConn)
+	client.securityMechanism = NewSecurityNull()
+	_, err := client.recvMetadata()
+	if err == nil {
+		t.Fatal("want an error")
+	}
+
+	if want, got := "Other side rejected the handshake: go away", err.Error(); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("want an *AuthError, got %T", err)
+	}
+	if want, got := "go away", authErr.Reason; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestRecvMetadataTruncated(t *testing.T) {
+	socketType := append([]byte{11}, "Socket-Type"...)
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"Name", []byte{11, 'S', 'o', 'c'}},
+		{"Length", append(socketType, 0, 0)},
+		{"Value", append(socketType, 0, 0, 0, 6, 'C', 'L')},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			clientConn, serverConn := newConnectedPair(t)
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			body, err := EncodeCommand("READY", c.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go WriteFrame(serverConn, FlagCommand, body)
+
+			client := NewConnection(clientConn)
+			client.securityMechanism = NewSecurityNull()
+			var protoErr *ProtocolError
+			if _, err := client.recvMetadata(); !errors.As(err, &protoErr) {
+				t.Errorf("want a *ProtocolError, got %v", err)
+			}
+		})
+	}
+}
+
+func newPreparedPair(t *testing.T) (*Connection, *Connection, func()) {
+	clientConn, serverConn := newConnectedPair(t)
+
+	client := NewConnection(clientConn)
+	server := NewConnection(serverConn)
+
+	errs := make(chan error)
+	go func() {
+		_, err := server.Prepare(NewSecurityNull(), ServerSocketType, true, nil)
+		errs <- err
+	}()
+
+	if _, err := client.Prepare(NewSecurityNull(), ClientSocketType, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	return client, server, func() {
+		clientConn.Close()
+		serverConn.Close()
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	client, server, done := newPreparedPair(t)
+	defer done()
+
+	serverMessages := make(chan *Message)
+	server.Recv(serverMessages)
+
+	clientMessages := make(chan *Message)
+	client.Recv(clientMessages)
+
+	if err := client.SendPing(time.Second, []byte("context")); err != nil {
+		t.Fatal(err)
+	}
+
+	ping := <-serverMessages
+	if want, got := CommandMessage, ping.MessageType; want != got {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	if want, got := "PING", ping.Name; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if want, got := []byte{0, 10}, ping.Body[:2]; !bytes.Equal(want, got) {
+		t.Errorf("want TTL %v, got %v", want, got)
+	}
+
+	pong := <-clientMessages
+	if want, got := "PONG", pong.Name; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if want, got := "context", string(pong.Body); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if err := client.SendPing(0, make([]byte, 17)); err == nil {
+		t.Errorf("want an error for an oversized context")
+	}
+}
+
+func TestSendFrames(t *testing.T) {
+	client, server, done := newPreparedPair(t)
+	defer done()
+
+	bodies := [][]byte{[]byte("short"), bytes.Repeat([]byte("long"), 100), {}}
+	if err := client.SendFrames(bodies...); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range bodies {
+		msg, err := server.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := UserMessage, msg.MessageType; want != got {
+			t.Errorf("want %v, got %v", want, got)
+		}
+
+		if got := msg.Body; !bytes.Equal(want, got) {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+}
+
+func TestEmptyFrames(t *testing.T) {
+	client, server, done := newPreparedPair(t)
+	defer done()
+
+	// Empty and nil bodies both go out as a short frame of
+	// length zero.
+	if err := client.SendFrame([]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendFrame(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendFrames([]byte("a"), nil, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{0, 0, 0, 0, 0, 1, 'a', 0, 0, 0, 1, 'b'}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(server.r, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	// Both the short and the long encoding of a zero length
+	// read back as an empty, non-nil body.
+	if _, err := client.rw.Write([]byte{0, 0, isLongBitFlag, 0, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		msg, err := server.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := UserMessage, msg.MessageType; want != got {
+			t.Errorf("want %v, got %v", want, got)
+		}
+
+		if msg.Body == nil || len(msg.Body) != 0 {
+			t.Errorf("want an empty, non-nil body, got %#v", msg.Body)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	for _, tt := range []struct {
+		socketType, peer SocketType
+		compatible       bool
+	}{
+		{ClientSocketType, ServerSocketType, true},
+		{ServerSocketType, ClientSocketType, true},
+		{PushSocketType, PullSocketType, true},
+		{PullSocketType, PushSocketType, true},
+		{ClientSocketType, ClientSocketType, false},
+		{PushSocketType, ServerSocketType, false},
+	} {
+		s, err := NewSocket(tt.socketType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := tt.compatible, s.IsSocketTypeCompatible(tt.peer); want != got {
+			t.Errorf("%s with %s: want %v, got %v", tt.socketType, tt.peer, want, got)
+		}
+	}
+
+	if caps, _ := Capabilities(PullSocketType); caps.CanSend || !caps.CanRecv {
+		t.Errorf("want PULL to receive only, got %+v", caps)
+	}
+	if _, err := NewSocket("DEALER"); err == nil {
+		t.Error("want an error for an unsupported socket type")
+	}
+}
+
+func TestMaxCommandSize(t *testing.T) {
+	client, server, done := newPreparedPair(t)
+	defer done()
+	server.SetMaxCommandSize(32)
+
+	if err := client.SendCommand("SUBSCRIBE", []byte("short")); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := server.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "SUBSCRIBE", msg.Name; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if err := client.SendCommand("SUBSCRIBE", bytes.Repeat([]byte("long"), 10)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.ReadMessage()
+	var protocolErr *ProtocolError
+	if !errors.As(err, &protocolErr) {
+		t.Errorf("want a *ProtocolError, got %v", err)
+	}
+}
+
+func TestMessageSeq(t *testing.T) {
+	client, server, done := newPreparedPair(t)
+	defer done()
+	server.SetTimestamps(true)
+
+	if err := client.SendFrames([]byte("one"), []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	for want := uint64(1); want <= 2; want++ {
+		msg, err := server.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := msg.Seq; want != got {
+			t.Errorf("want sequence number %d, got %d", want, got)
+		}
+		if msg.ReceivedAt.IsZero() {
+			t.Error("want the message stamped")
+		}
+	}
+
+	if err := server.SendFrame([]byte("unstamped")); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.ReceivedAt.IsZero() {
+		t.Errorf("want no timestamp by default, got %v", msg.ReceivedAt)
+	}
+}
+
+func TestStrictMechanism(t *testing.T) {
+	// prepare runs steps as the other end of a connection
+	// this end prepares with mechanism.
+	prepare := func(t *testing.T, mechanism SecurityMechanism, asServer bool, strict *bool, steps ...Step) error {
+		t.Helper()
+		a, b := newConnectedPair(t)
+		defer a.Close()
+
+		peer := NewScriptedPeer(steps...)
+		go peer.Run(b)
+		defer peer.Close()
+
+		socketType := ClientSocketType
+		if asServer {
+			socketType = ServerSocketType
+		}
+		conn := NewConnection(a)
+		if strict != nil {
+			conn.SetStrictMechanism(*strict)
+		}
+		_, err := conn.Prepare(mechanism, socketType, asServer, nil)
+		return err
+	}
+	on, off := true, false
+
+	t.Run("AnotherMechanism", func(t *testing.T) {
+		// Announcing another mechanism is a mismatch
+		// whether the connection is strict or not.
+		for _, strict := range []*bool{nil, &on, &off} {
+			err := prepare(t, NewSecurityNull(), false, strict, Greet(PlainSecurityMechanismType, true), ReadGreeting())
+			if !errors.Is(err, ErrMechanismMismatch) {
+				t.Errorf("want %v, got %v", ErrMechanismMismatch, err)
+			}
+		}
+	})
+
+	t.Run("SameRole", func(t *testing.T) {
+		// PLAIN is strict by default. Both a client and a
+		// server check that the other end takes the other
+		// role.
+		for _, asServer := range []bool{false, true} {
+			err := prepare(t, &plainMechanism{}, asServer, nil, Greet(PlainSecurityMechanismType, asServer), ReadGreeting())
+			var mismatch *MechanismMismatchError
+			if !errors.As(err, &mismatch) || !errors.Is(err, ErrMechanismMismatch) {
+				t.Fatalf("as server %v: want a *MechanismMismatchError, got %v", asServer, err)
+			}
+			if mismatch.Detail == "" {
+				t.Errorf("as server %v: want a Detail", asServer)
+			}
+		}
+
+		err := prepare(t, &plainMechanism{}, false, &off,
+			Greet(PlainSecurityMechanismType, false), ReadGreeting(),
+			Write(ReadyCommand(ServerSocketType, nil)), ExpectCommand("READY"))
+		if err != nil {
+			t.Errorf("want the handshake to succeed when not strict, got %v", err)
+		}
+	})
+
+	t.Run("ForeignCommand", func(t *testing.T) {
+		// The greeting claims NULL, but the handshake goes
+		// on with PLAIN's HELLO.
+		steps := []Step{Greet(NullSecurityMechanismType, true), ReadGreeting(), Write(CommandFrame("HELLO", nil))}
+
+		err := prepare(t, NewSecurityNull(), false, &on, steps...)
+		var mismatch *MechanismMismatchError
+		if !errors.As(err, &mismatch) {
+			t.Fatalf("want a *MechanismMismatchError, got %v", err)
+		}
+		if want, got := "NULL", mismatch.Theirs; want != got {
+			t.Errorf("want %q, got %q", want, got)
+		}
+
+		// NULL is not strict by default.
+		err = prepare(t, NewSecurityNull(), false, nil, steps...)
+		var protocolErr *ProtocolError
+		if !errors.As(err, &protocolErr) || errors.Is(err, ErrMechanismMismatch) {
+			t.Errorf("want a *ProtocolError, got %v", err)
+		}
+	})
+}
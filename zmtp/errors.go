@@ -0,0 +1,64 @@
+package zmtp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrMechanismMismatch is what every *MechanismMismatchError
+// is, for errors.Is.
+var ErrMechanismMismatch = errors.New("zmtp: security mechanism mismatch")
+
+// AuthError is returned by Prepare when the other side rejected
+// the handshake with an ERROR command. Reason holds the text of
+// the command as sent.
+type AuthError struct {
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("Other side rejected the handshake: %s", e.Reason)
+}
+
+// MechanismMismatchError is returned by Prepare when the other
+// side's greeting announced a security mechanism this side does
+// not use, or one excluded by AllowMechanisms, in which case
+// Allowed holds the allowed mechanisms. On a strict connection
+// (see SetStrictMechanism) it is also returned when the other
+// side announced this side's mechanism but did not go on to
+// use it as announced, with Detail telling how.
+type MechanismMismatchError struct {
+	Ours, Theirs string
+	Allowed      []SecurityMechanismType
+	Detail       string
+}
+
+func (e *MechanismMismatchError) Error() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("Other side announced encryption mechanism %q but %s", e.Theirs, e.Detail)
+	}
+	if e.Allowed != nil {
+		return fmt.Sprintf("Encryption mechanism on other side %q is not allowed", e.Theirs)
+	}
+	return fmt.Sprintf("Encryption mechanism on other side %q does not match this side's %q", e.Theirs, e.Ours)
+}
+
+// Is reports whether target is ErrMechanismMismatch.
+func (e *MechanismMismatchError) Is(target error) bool {
+	return target == ErrMechanismMismatch
+}
+
+// ProtocolError is returned by Prepare when the other side sent
+// something that is not a valid ZMTP handshake.
+type ProtocolError struct {
+	Detail string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Detail
+}
+
+// protocolErrorf returns a *ProtocolError with a formatted Detail.
+func protocolErrorf(format string, args ...interface{}) error {
+	return &ProtocolError{Detail: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,221 @@
+package zmtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// FrameFlags are the flags byte of a ZMTP frame.
+type FrameFlags byte
+
+// Frame flags. The bits above FlagCommand are reserved and
+// must be zero.
+const (
+	FlagMore    FrameFlags = hasMoreBitFlag
+	FlagLong    FrameFlags = isLongBitFlag
+	FlagCommand FrameFlags = isCommandBitFlag
+)
+
+// reservedFlags are the flag bits ZMTP 3.0 leaves unused.
+const reservedFlags = ^(FlagMore | FlagLong | FlagCommand)
+
+// WriteFrame writes a frame holding body to w, in a single
+// write where w supports it. FlagLong is set or cleared to suit
+// the length of body, whatever flags say; setting a reserved
+// flag is an error. The body is written as it is, so on a
+// connection with a security mechanism that encrypts it, it is
+// up to the caller to encrypt it first.
+func WriteFrame(w io.Writer, flags FrameFlags, body []byte) error {
+	var header [9]byte
+	return writeFrame(w, header[:0], flags, body)
+}
+
+// writeFrame is WriteFrame with the header built in header's
+// space.
+func writeFrame(w io.Writer, header []byte, flags FrameFlags, body []byte) error {
+	if flags&reservedFlags != 0 {
+		return fmt.Errorf("zmtp: frame flags %#x set reserved bits", byte(flags))
+	}
+
+	buffers := net.Buffers{appendHeader(header, flags, len(body)), body}
+	_, err := buffers.WriteTo(w)
+	return err
+}
+
+// appendHeader appends the flags and size of a frame with a
+// body of length bytes to dst, setting FlagLong if the size
+// takes eight bytes.
+func appendHeader(dst []byte, flags FrameFlags, length int) []byte {
+	flags &^= FlagLong
+	if length > 255 {
+		dst = append(dst, byte(flags|FlagLong), 0, 0, 0, 0, 0, 0, 0, 0)
+		byteOrder.PutUint64(dst[len(dst)-8:], uint64(length))
+		return dst
+	}
+	return append(dst, byte(flags), uint8(length))
+}
+
+// ReadFrame reads a frame from r and returns its flags, as
+// they were read, and its body. A frame announcing a body
+// longer than maxSize fails with a *ProtocolError before the
+// body is read; a negative maxSize sets no limit. The body is
+// returned as it is, still encrypted if a security mechanism
+// encrypted it. An empty frame has an empty, non-nil body.
+func ReadFrame(r io.Reader, maxSize int64) (FrameFlags, []byte, error) {
+	flags, size, err := readHeader(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if maxSize >= 0 && size > uint64(maxSize) {
+		return 0, nil, protocolErrorf("Frame body length %v exceeds the limit of %v", size, maxSize)
+	}
+
+	body, err := readBody(r, size)
+	if err != nil {
+		return 0, nil, err
+	}
+	return flags, body, nil
+}
+
+// readHeader reads the flags and body size of a frame.
+func readHeader(r io.Reader) (FrameFlags, uint64, error) {
+	var header [9]byte
+	if _, err := io.ReadFull(r, header[:2]); err != nil {
+		return 0, 0, err
+	}
+
+	flags := FrameFlags(header[0])
+	if flags&FlagLong == 0 {
+		// Short message length is just 1 byte.
+		return flags, uint64(header[1]), nil
+	}
+
+	// A long message's length takes 8 bytes, the first of
+	// which was read with the flags.
+	if _, err := io.ReadFull(r, header[2:]); err != nil {
+		return 0, 0, err
+	}
+	size := byteOrder.Uint64(header[1:])
+	if size > uint64(maxInt64) {
+		return 0, 0, protocolErrorf("Body length %v overflows max int64 value %v", size, maxInt64)
+	}
+	return flags, size, nil
+}
+
+// readBody reads a frame body of size bytes. Only so much of
+// the announced size is trusted: larger bodies grow as they
+// arrive instead of being allocated up front.
+func readBody(r io.Reader, size uint64) ([]byte, error) {
+	if size <= maxPreallocatedBody {
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+		return body, nil
+	}
+
+	buffer := new(bytes.Buffer)
+	if _, err := io.CopyN(buffer, r, int64(size)); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// EncodeCommand returns the body of a command frame for the
+// command name carrying data.
+func EncodeCommand(name string, data []byte) ([]byte, error) {
+	if len(name) > 255 {
+		return nil, errors.New("Command names may not be longer than 255 characters")
+	}
+
+	body := make([]byte, 0, 1+len(name)+len(data))
+	body = append(body, byte(len(name)))
+	body = append(body, name...)
+	return append(body, data...), nil
+}
+
+// ParseCommand parses the body of a command frame. The
+// Command's Body shares body's memory.
+func ParseCommand(body []byte) (*Command, error) {
+	// Sanity check
+	if len(body) == 0 {
+		return nil, &ProtocolError{Detail: "Got empty command frame body"}
+	}
+
+	// Read out the command length
+	commandNameLength := int(body[0])
+	if commandNameLength > len(body)-1 {
+		return nil, protocolErrorf("Got command name length %v, which is too long for a body of length %v", commandNameLength, len(body))
+	}
+
+	command := &Command{
+		Name: string(body[1 : commandNameLength+1]),
+		Body: body[1+commandNameLength:],
+	}
+
+	return command, nil
+}
+
+// GreetingSize is the length of a ZMTP 3.0 greeting.
+const GreetingSize = 64
+
+// GreetingFields are what a ZMTP greeting announces.
+type GreetingFields struct {
+	Version   [2]uint8
+	Mechanism SecurityMechanismType
+	AsServer  bool
+}
+
+// EncodeGreeting returns the greeting announcing g. It fails
+// if the mechanism's name is longer than the 20 bytes a
+// greeting has room for.
+func EncodeGreeting(g GreetingFields) ([]byte, error) {
+	raw := greeting{
+		SignaturePrefix: signaturePrefix,
+		SignatureSuffix: signatureSuffix,
+		Version:         g.Version,
+		ServerFlag:      toByteBool(g.AsServer),
+	}
+	if err := toNullPaddedString(string(g.Mechanism), raw.Mechanism[:]); err != nil {
+		return nil, fmt.Errorf("zmtp: mechanism %q does not fit a greeting", g.Mechanism)
+	}
+
+	var out bytes.Buffer
+	if err := binary.Write(&out, byteOrder, &raw); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// ParseGreeting parses a greeting, which must be GreetingSize
+// bytes long. A greeting that is not valid ZMTP 3.0 or later
+// fails with a *ProtocolError. The padding between its
+// signature bytes is ignored, since older peers fill it with
+// a ZMTP 1.0 length rather than zeros.
+func ParseGreeting(b []byte) (GreetingFields, error) {
+	if len(b) != GreetingSize {
+		return GreetingFields{}, protocolErrorf("Greeting of length %v, expected %v", len(b), GreetingSize)
+	}
+	if err := checkGreeting(b); err != nil {
+		return GreetingFields{}, err
+	}
+
+	var raw greeting
+	if err := binary.Read(bytes.NewReader(b), byteOrder, &raw); err != nil {
+		return GreetingFields{}, err
+	}
+
+	asServer, err := fromByteBool(raw.ServerFlag)
+	if err != nil {
+		return GreetingFields{}, &ProtocolError{Detail: err.Error()}
+	}
+	return GreetingFields{
+		Version:   raw.Version,
+		Mechanism: SecurityMechanismType(fromNullPaddedString(raw.Mechanism[:])),
+		AsServer:  asServer,
+	}, nil
+}
@@ -0,0 +1,196 @@
+package zmtp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// longBody is a body too long for a short frame, and
+// longHeader the header of a frame holding it, as RFC 23
+// gives them: the long flag, then the size in eight bytes in
+// network order.
+var (
+	longBody   = bytes.Repeat([]byte{'x'}, 256)
+	longHeader = []byte{0x02, 0, 0, 0, 0, 0, 0, 0x01, 0x00}
+)
+
+// readyFrame is RFC 23's READY command, for a REQ socket.
+var readyFrame = append([]byte{0x04, 0x19, 0x05, 'R', 'E', 'A', 'D', 'Y', 0x0B}, append([]byte("Socket-Type"), 0, 0, 0, 3, 'R', 'E', 'Q')...)
+
+// nullGreeting is the greeting of a ZMTP 3.0 client using the
+// NULL mechanism.
+var nullGreeting = func() []byte {
+	b := []byte{0xFF, 0, 0, 0, 0, 0, 0, 0, 0, 0x7F, 3, 0}
+	b = append(b, 'N', 'U', 'L', 'L')
+	return append(b, make([]byte, 16+1+31)...)
+}()
+
+func TestWriteFrame(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		flags FrameFlags
+		body  []byte
+		want  []byte
+	}{
+		{"Short", 0, []byte("hello"), []byte{0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}},
+		{"Empty", 0, nil, []byte{0x00, 0x00}},
+		{"More", FlagMore, []byte("a"), []byte{0x01, 0x01, 'a'}},
+		{"Command", FlagCommand, readyFrame[2:], readyFrame},
+		{"Long", 0, longBody, append(longHeader, longBody...)},
+		{"LongCommand", FlagCommand, longBody, append([]byte{0x06}, append(longHeader[1:], longBody...)...)},
+		{"LongFlagCleared", FlagLong, []byte("a"), []byte{0x00, 0x01, 'a'}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := WriteFrame(&out, c.flags, c.body); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(c.want, out.Bytes()) {
+				t.Errorf("want %v, got %v", c.want, out.Bytes())
+			}
+		})
+	}
+
+	if err := WriteFrame(io.Discard, 0x80, nil); err == nil {
+		t.Error("want an error for reserved flags")
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	flags, body, err := ReadFrame(bytes.NewReader(readyFrame), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := FlagCommand, flags; want != got {
+		t.Errorf("want flags %#x, got %#x", want, got)
+	}
+	if want, got := readyFrame[2:], body; !bytes.Equal(want, got) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	flags, body, err = ReadFrame(bytes.NewReader(append(longHeader, longBody...)), 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags != FlagLong || !bytes.Equal(longBody, body) {
+		t.Errorf("want a long frame of %d bytes, got flags %#x and %d bytes", len(longBody), flags, len(body))
+	}
+
+	_, body, err = ReadFrame(bytes.NewReader([]byte{0x00, 0x00}), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body == nil || len(body) != 0 {
+		t.Errorf("want an empty, non-nil body, got %#v", body)
+	}
+
+	var protocolErr *ProtocolError
+	if _, _, err := ReadFrame(bytes.NewReader(append(longHeader, longBody...)), 255); !errors.As(err, &protocolErr) {
+		t.Errorf("want a *ProtocolError for a frame over the limit, got %v", err)
+	}
+	if _, _, err := ReadFrame(bytes.NewReader([]byte{0x00, 0x05, 'h'}), -1); err != io.ErrUnexpectedEOF {
+		t.Errorf("want %v for a truncated frame, got %v", io.ErrUnexpectedEOF, err)
+	}
+	if _, _, err := ReadFrame(bytes.NewReader([]byte{0x02, 0xFF, 0, 0, 0, 0, 0, 0, 0}), -1); !errors.As(err, &protocolErr) {
+		t.Errorf("want a *ProtocolError for a size over max int64, got %v", err)
+	}
+}
+
+func TestEncodeCommand(t *testing.T) {
+	got, err := EncodeCommand("READY", readyFrame[8:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := readyFrame[2:]; !bytes.Equal(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	got, err = EncodeCommand("PING", []byte{0x00, 0x0A})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x04, 'P', 'I', 'N', 'G', 0x00, 0x0A}; !bytes.Equal(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	if _, err := EncodeCommand(string(make([]byte, 256)), nil); err == nil {
+		t.Error("want an error for a command name longer than 255 bytes")
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	command, err := ParseCommand(readyFrame[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "READY", command.Name; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if want, got := readyFrame[8:], command.Body; !bytes.Equal(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	for _, body := range [][]byte{nil, {0x05, 'R', 'E'}} {
+		var protocolErr *ProtocolError
+		if _, err := ParseCommand(body); !errors.As(err, &protocolErr) {
+			t.Errorf("%v: want a *ProtocolError, got %v", body, err)
+		}
+	}
+}
+
+func TestEncodeGreeting(t *testing.T) {
+	got, err := EncodeGreeting(GreetingFields{Version: [2]uint8{3, 0}, Mechanism: NullSecurityMechanismType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(nullGreeting, got) {
+		t.Errorf("want %v, got %v", nullGreeting, got)
+	}
+
+	got, err = EncodeGreeting(GreetingFields{Version: [2]uint8{3, 1}, Mechanism: PlainSecurityMechanismType, AsServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := []byte{3, 1, 'P', 'L', 'A', 'I', 'N'}, got[10:17]; !bytes.Equal(want, got) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if want, got := byte(1), got[32]; want != got {
+		t.Errorf("want the as-server byte %d, got %d", want, got)
+	}
+
+	if _, err := EncodeGreeting(GreetingFields{Mechanism: "A-MECHANISM-TOO-LONG-FOR-IT"}); err == nil {
+		t.Error("want an error for a mechanism name longer than 20 bytes")
+	}
+}
+
+func TestParseGreeting(t *testing.T) {
+	got, err := ParseGreeting(nullGreeting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (GreetingFields{Version: [2]uint8{3, 0}, Mechanism: NullSecurityMechanismType}); want != got {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+
+	// Older peers pad the signature with a ZMTP 1.0 length.
+	padded := append([]byte(nil), nullGreeting...)
+	padded[8] = 0x01
+	if _, err := ParseGreeting(padded); err != nil {
+		t.Errorf("want the padding ignored, got %v", err)
+	}
+
+	for name, change := range map[string]func(b []byte) []byte{
+		"Short":      func(b []byte) []byte { return b[:GreetingSize-1] },
+		"Prefix":     func(b []byte) []byte { b[0] = 0; return b },
+		"Suffix":     func(b []byte) []byte { b[9] = 0; return b },
+		"Version":    func(b []byte) []byte { b[10] = 2; return b },
+		"ServerFlag": func(b []byte) []byte { b[32] = 2; return b },
+	} {
+		var protocolErr *ProtocolError
+		if _, err := ParseGreeting(change(append([]byte(nil), nullGreeting...))); !errors.As(err, &protocolErr) {
+			t.Errorf("%s: want a *ProtocolError, got %v", name, err)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package zmtp
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"time"
+)
 
 const (
 	majorVersion uint8 = 3
@@ -10,6 +13,10 @@ const (
 const (
 	signaturePrefix = 0xFF
 	signatureSuffix = 0x7F
+
+	// signatureSize is the length of the signature that opens a
+	// greeting, padding included.
+	signatureSize = 10
 )
 
 const (
@@ -72,4 +79,15 @@ type Message struct {
 	Body        []byte
 	Err         error
 	MessageType MessageType
+
+	// Seq numbers the data frames read from a connection,
+	// starting at 1. It is zero for commands.
+	Seq uint64
+
+	// ReceivedAt is when a data frame was read off the
+	// connection, if the connection stamps them (see
+	// Connection.SetTimestamps). It carries a monotonic
+	// clock reading, so durations measured from it are not
+	// thrown off by changes to the wall clock.
+	ReceivedAt time.Time
 }
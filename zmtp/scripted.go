@@ -0,0 +1,341 @@
+package zmtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Greeting returns a ZMTP greeting announcing the given
+// version, security mechanism and
+// server flag. A mechanism name too long for a greeting is
+// left out.
+func Greeting(major, minor uint8, mechanism SecurityMechanismType, asServer bool) []byte {
+	g := GreetingFields{Version: [2]uint8{major, minor}, Mechanism: mechanism, AsServer: asServer}
+	b, err := EncodeGreeting(g)
+	if err != nil {
+		g.Mechanism = ""
+		b, _ = EncodeGreeting(g)
+	}
+	return b
+}
+
+// Frame returns a frame with the given flags and body, for
+// sending frames WriteFrame would not. The flags are taken as
+// they are, reserved bits included: the body's length is
+// encoded in eight bytes if FlagLong is set and in one
+// otherwise, truncated if it does not fit.
+func Frame(flags FrameFlags, body []byte) []byte {
+	b := []byte{byte(flags)}
+	if flags&FlagLong != 0 {
+		b = binary.BigEndian.AppendUint64(b, uint64(len(body)))
+	} else {
+		b = append(b, byte(len(body)))
+	}
+	return append(b, body...)
+}
+
+// CommandFrame returns a command frame for the command name,
+// which need not be one ZMTP knows, with body.
+func CommandFrame(name string, body []byte) []byte {
+	command := append([]byte{byte(len(name))}, name...)
+	command = append(command, body...)
+	return append(appendHeader(nil, FlagCommand, len(command)), command...)
+}
+
+// ReadyCommand returns the READY command a peer of the
+// given socket type sends in the NULL handshake, carrying
+// metadata as application metadata.
+func ReadyCommand(socketType SocketType, metadata map[string]string) []byte {
+	var body bytes.Buffer
+	c := &Connection{}
+	for k, v := range metadata {
+		c.writeMetadata(&body, "x-"+k, v)
+	}
+	c.writeMetadata(&body, "socket-type", string(socketType))
+	return CommandFrame("READY", body.Bytes())
+}
+
+// Step is a step of a ScriptedPeer's script.
+type Step struct {
+	name string
+	run  func(r *scriptRun) error
+}
+
+// scriptRun is a script being run on a connection. r reads
+// the connection, keeping what it reads for Received.
+type scriptRun struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Write writes b to the other end as it is.
+func Write(b []byte) Step {
+	return Step{"write", func(r *scriptRun) error {
+		_, err := r.conn.Write(b)
+		return err
+	}}
+}
+
+// Greet writes a ZMTP 3.0 greeting for mechanism.
+func Greet(mechanism SecurityMechanismType, asServer bool) Step {
+	return Write(Greeting(majorVersion, minorVersion, mechanism, asServer))
+}
+
+// Handshake goes through the greeting and NULL handshake as
+// a peer of the given socket type, checking that what the
+// other end sends is valid.
+func Handshake(socketType SocketType, asServer bool) Step {
+	return Step{"handshake", func(r *scriptRun) error {
+		// The connection shares the script's reader, so
+		// that what it reads ahead is left for the next
+		// steps.
+		c := &Connection{rw: r.conn, r: r.r}
+		_, err := c.Prepare(NewSecurityNull(), socketType, asServer, nil)
+		return err
+	}}
+}
+
+// ReadGreeting reads the other end's greeting, checking only
+// its signature and version.
+func ReadGreeting() Step {
+	return Step{"read greeting", func(r *scriptRun) error {
+		b := make([]byte, GreetingSize)
+		if err := r.readFull(b); err != nil {
+			return err
+		}
+		return checkGreeting(b)
+	}}
+}
+
+// ExpectFrame reads a frame and fails unless it is a data
+// frame holding body.
+func ExpectFrame(body []byte) Step {
+	return Step{"expect frame", func(r *scriptRun) error {
+		flags, got, err := r.readFrame()
+		if err != nil {
+			return err
+		}
+		if flags&FlagCommand != 0 || !bytes.Equal(body, got) {
+			return fmt.Errorf("want data frame %q, got flags %#x and body %q", body, flags, got)
+		}
+		return nil
+	}}
+}
+
+// ExpectCommand reads a frame and fails unless it is the
+// command name.
+func ExpectCommand(name string) Step {
+	return Step{"expect command", func(r *scriptRun) error {
+		flags, body, err := r.readFrame()
+		if err != nil {
+			return err
+		}
+		if command, err := ParseCommand(body); flags&FlagCommand == 0 || err != nil || command.Name != name {
+			return fmt.Errorf("want command %q, got flags %#x and body %q", name, flags, body)
+		}
+		return nil
+	}}
+}
+
+// ExpectClose reads until the other end closes the
+// connection, failing if it does not within the peer's
+// timeout. What it reads is kept along with the rest.
+func ExpectClose() Step {
+	return Step{"expect close", func(r *scriptRun) error {
+		_, err := io.Copy(io.Discard, r.r)
+		// A connection closed with data left unread may be
+		// reset rather than closed cleanly.
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return err
+		}
+		return nil
+	}}
+}
+
+// Pause waits for d.
+func Pause(d time.Duration) Step {
+	return Step{"pause", func(r *scriptRun) error {
+		time.Sleep(d)
+		return nil
+	}}
+}
+
+// readFull reads exactly len(b) bytes from the other end.
+func (r *scriptRun) readFull(b []byte) error {
+	_, err := io.ReadFull(r.r, b)
+	return err
+}
+
+// readFrame reads a frame from the other end, which is
+// assumed to use the NULL mechanism.
+func (r *scriptRun) readFrame() (FrameFlags, []byte, error) {
+	return ReadFrame(r.r, maxPreallocatedBody)
+}
+
+// defaultScriptTimeout bounds how long a ScriptedPeer's
+// script may take.
+const defaultScriptTimeout = 5 * time.Second
+
+// ScriptedPeer is a ZMTP peer that follows a script, for
+// testing how the other end of a connection copes with a
+// peer that misbehaves: one that sends a truncated greeting,
+// commands no one knows, frames with reserved flags set, or
+// garbage after a valid handshake. Its steps run in order on
+// a single connection, which is closed once they are done;
+// the first step to fail stops the script. Everything the
+// other end sent is kept for Received.
+//
+// A ScriptedPeer runs once, on the connection it dials with
+// Dial, accepts after Listen or is given to Run.
+type ScriptedPeer struct {
+	steps   []Step
+	timeout time.Duration
+
+	received lockedBuffer
+
+	mu   sync.Mutex
+	ln   net.Listener
+	conn net.Conn
+
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// NewScriptedPeer returns a peer that runs steps.
+func NewScriptedPeer(steps ...Step) *ScriptedPeer {
+	return &ScriptedPeer{steps: steps, timeout: defaultScriptTimeout, done: make(chan struct{})}
+}
+
+// SetTimeout sets how long the script may take before its
+// connection is closed and the step it is at fails. It
+// defaults to five seconds.
+func (p *ScriptedPeer) SetTimeout(d time.Duration) {
+	p.timeout = d
+}
+
+// Listen listens on network and address for the other end to
+// connect, and runs the script on the first connection
+// accepted, in the background. It returns the address
+// listened on.
+func (p *ScriptedPeer) Listen(network, address string) (net.Addr, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.ln = ln
+	p.mu.Unlock()
+
+	go func() {
+		conn, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			p.finish(err)
+			return
+		}
+		p.Run(conn)
+	}()
+	return ln.Addr(), nil
+}
+
+// Dial connects to a bound socket at network and address and
+// runs the script on the connection in the background.
+func (p *ScriptedPeer) Dial(network, address string) error {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return err
+	}
+	go p.Run(conn)
+	return nil
+}
+
+// Run runs the script on conn, closing it when done, and
+// returns the error of the step that failed, if any.
+func (p *ScriptedPeer) Run(conn net.Conn) error {
+	p.mu.Lock()
+	p.conn = conn
+	p.mu.Unlock()
+	defer conn.Close()
+
+	if p.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(p.timeout))
+	}
+
+	r := &scriptRun{conn: conn, r: bufio.NewReader(io.TeeReader(conn, &p.received))}
+	for i, step := range p.steps {
+		if err := step.run(r); err != nil {
+			return p.finish(fmt.Errorf("zmtp: scripted step %d (%s): %w", i, step.name, err))
+		}
+	}
+	return p.finish(nil)
+}
+
+// finish records the outcome of the script.
+func (p *ScriptedPeer) finish(err error) error {
+	p.once.Do(func() {
+		p.err = err
+		close(p.done)
+	})
+	return p.err
+}
+
+// Wait waits for the script to finish and returns the error
+// of the step that failed, if any. It returns an error if the
+// script does not finish within timeout.
+func (p *ScriptedPeer) Wait(timeout time.Duration) error {
+	select {
+	case <-p.done:
+		return p.err
+	case <-time.After(timeout):
+		return errors.New("zmtp: scripted peer did not finish")
+	}
+}
+
+// Received returns what the script read of what the other
+// end sent, including bytes read ahead of the step at hand.
+func (p *ScriptedPeer) Received() []byte {
+	return p.received.bytes()
+}
+
+// Close stops listening and closes the peer's connection,
+// failing the step the script is at.
+func (p *ScriptedPeer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ln != nil {
+		p.ln.Close()
+	}
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	return nil
+}
+
+// lockedBuffer is a buffer a script writes to while
+// Received reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
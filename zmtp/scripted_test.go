@@ -0,0 +1,99 @@
+package zmtp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestScriptedPeer(t *testing.T) {
+	peer := NewScriptedPeer(
+		Handshake(ServerSocketType, true),
+		ExpectFrame([]byte("HELLO")),
+		Write(CommandFrame("BOGUS", []byte("body"))),
+		Write(Frame(0, []byte("WORLD"))),
+	)
+	addr, err := peer.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	netConn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netConn.Close()
+
+	conn := NewConnection(netConn)
+	if _, err := conn.Prepare(NewSecurityNull(), ClientSocketType, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SendFrame([]byte("HELLO")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MessageType != ErrorMessage || msg.Name != "BOGUS" || string(msg.Body) != "body" {
+		t.Errorf("want the BOGUS command, got %+v", msg)
+	}
+	if msg, err = conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "WORLD", string(msg.Body); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if err := peer.Wait(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(peer.Received(), Frame(0, []byte("HELLO"))) {
+		t.Errorf("want the HELLO frame last in what the peer received, got %q", peer.Received())
+	}
+}
+
+func TestScriptedPeerFailedStep(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+
+	peer := NewScriptedPeer(ExpectCommand("READY"))
+	go func() {
+		b.Write(Frame(0, []byte("DATA")))
+		b.Close()
+	}()
+
+	err := peer.Run(a)
+	if err == nil {
+		t.Fatal("want the step to fail")
+	}
+	if !errors.Is(peer.Wait(time.Second), err) {
+		t.Errorf("want Wait to return %v, got %v", err, peer.Wait(time.Second))
+	}
+}
+
+func TestFrame(t *testing.T) {
+	for _, c := range []struct {
+		got, want []byte
+	}{
+		{Frame(0, []byte("ab")), []byte{0, 2, 'a', 'b'}},
+		{Frame(FlagMore|0x80, nil), []byte{0x81, 0}},
+		{Frame(FlagLong, []byte("a")), []byte{2, 0, 0, 0, 0, 0, 0, 0, 1, 'a'}},
+		{CommandFrame("PING", nil), []byte{4, 5, 4, 'P', 'I', 'N', 'G'}},
+	} {
+		if !bytes.Equal(c.want, c.got) {
+			t.Errorf("want %v, got %v", c.want, c.got)
+		}
+	}
+
+	if want, got := 64, len(Greeting(3, 1, NullSecurityMechanismType, true)); want != got {
+		t.Errorf("want a %d byte greeting, got %d", want, got)
+	}
+	if err := checkGreeting(Greeting(3, 1, NullSecurityMechanismType, true)); err != nil {
+		t.Error(err)
+	}
+}
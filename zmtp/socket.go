@@ -1,6 +1,6 @@
 package zmtp
 
-import "errors"
+import "fmt"
 
 // Socket is a ZMTP socket
 type Socket interface {
@@ -9,92 +9,74 @@ type Socket interface {
 	IsCommandTypeValid(name string) bool
 }
 
-// NewSocket returns a new ZMTP socket
-func NewSocket(socketType SocketType) (Socket, error) {
-	switch socketType {
-	case ClientSocketType:
-		return clientSocket{}, nil
-	case ServerSocketType:
-		return serverSocket{}, nil
-	case PullSocketType:
-		return pullSocket{}, nil
-	case PushSocketType:
-		return pushSocket{}, nil
-	default:
-		return nil, errors.New("Invalid socket type")
-	}
-}
+// SocketCapabilities describes the messaging semantics of a
+// socket type.
+type SocketCapabilities struct {
+	// CanSend and CanRecv tell whether sockets of the type
+	// send and receive messages.
+	CanSend, CanRecv bool
 
-type clientSocket struct{}
+	// NeedsSubscriptions is set for types that only receive
+	// the messages they subscribed to.
+	NeedsSubscriptions bool
 
-// Type returns the Socket's type
-func (clientSocket) Type() SocketType {
-	return ClientSocketType
-}
+	// ThreadSafe is set for types whose sockets can be used
+	// from several goroutines at once.
+	ThreadSafe bool
 
-// IsSocketTypeCompatible checks if the socket is compatible with
-// another socket type.
-func (clientSocket) IsSocketTypeCompatible(socketType SocketType) bool {
-	return socketType == ServerSocketType
+	// Peers holds the socket types a socket of the type may
+	// handshake with.
+	Peers []SocketType
 }
 
-// IsCommandTypeValid returns if a command is valid for this socket.
-func (clientSocket) IsCommandTypeValid(name string) bool {
-	return false
+// socketTypes is the compatibility matrix of the supported
+// socket types, as given by RFC 41 and RFC 30.
+var socketTypes = map[SocketType]SocketCapabilities{
+	ClientSocketType: {CanSend: true, CanRecv: true, ThreadSafe: true, Peers: []SocketType{ServerSocketType}},
+	ServerSocketType: {CanSend: true, CanRecv: true, ThreadSafe: true, Peers: []SocketType{ClientSocketType}},
+	PullSocketType:   {CanRecv: true, Peers: []SocketType{PushSocketType}},
+	PushSocketType:   {CanSend: true, Peers: []SocketType{PullSocketType}},
 }
 
-type serverSocket struct{}
-
-// Type returns the Socket's type
-func (serverSocket) Type() SocketType {
-	return ServerSocketType
+// Capabilities returns the capabilities of a socket type and
+// whether the type is supported.
+func Capabilities(socketType SocketType) (SocketCapabilities, bool) {
+	caps, ok := socketTypes[socketType]
+	return caps, ok
 }
 
-// IsSocketTypeCompatible checks if the socket is compatible with
-// another socket type.
-func (serverSocket) IsSocketTypeCompatible(socketType SocketType) bool {
-	return socketType == ClientSocketType
+// NewSocket returns a new ZMTP socket
+func NewSocket(socketType SocketType) (Socket, error) {
+	caps, ok := Capabilities(socketType)
+	if !ok {
+		return nil, fmt.Errorf("Invalid socket type %q", socketType)
+	}
+	return socket{socketType: socketType, caps: caps}, nil
 }
 
-// IsCommandTypeValid returns if a command is valid for this socket.
-func (serverSocket) IsCommandTypeValid(name string) bool {
-	return false
+type socket struct {
+	socketType SocketType
+	caps       SocketCapabilities
 }
 
-type pullSocket struct{}
-
 // Type returns the Socket's type
-func (pullSocket) Type() SocketType {
-	return PullSocketType
+func (s socket) Type() SocketType {
+	return s.socketType
 }
 
 // IsSocketTypeCompatible checks if the socket is compatible with
 // another socket type.
-func (pullSocket) IsSocketTypeCompatible(socketType SocketType) bool {
-	return socketType == PushSocketType
-}
-
-// IsCommandTypeValid returns if a command is valid for this socket.
-func (pullSocket) IsCommandTypeValid(name string) bool {
-	// FIXME(sbinet)
+func (s socket) IsSocketTypeCompatible(socketType SocketType) bool {
+	for _, peer := range s.caps.Peers {
+		if peer == socketType {
+			return true
+		}
+	}
 	return false
 }
 
-type pushSocket struct{}
-
-// Type returns the Socket's type
-func (pushSocket) Type() SocketType {
-	return PushSocketType
-}
-
-// IsSocketTypeCompatible checks if the socket is compatible with
-// another socket type.
-func (pushSocket) IsSocketTypeCompatible(socketType SocketType) bool {
-	return socketType == PullSocketType
-}
-
 // IsCommandTypeValid returns if a command is valid for this socket.
-func (pushSocket) IsCommandTypeValid(name string) bool {
+func (socket) IsCommandTypeValid(name string) bool {
 	// FIXME(sbinet)
 	return false
 }